@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// PullRequestEvent is the subset of a GitHub pull_request event payload that we use
+type PullRequestEvent struct {
+	Number      int `json:"number"`
+	PullRequest struct {
+		Number int    `json:"number"`
+		Title  string `json:"title"`
+		Body   string `json:"body"`
+		Base   struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		} `json:"base"`
+		Head struct {
+			Ref string `json:"ref"`
+			SHA string `json:"sha"`
+		} `json:"head"`
+	} `json:"pull_request"`
+}
+
+// loadPullRequestEvent reads the event payload GitHub Actions provides in GITHUB_EVENT_PATH
+func loadPullRequestEvent() (PullRequestEvent, error) {
+	var event PullRequestEvent
+	eventPath := os.Getenv("GITHUB_EVENT_PATH")
+	if eventPath == "" {
+		return event, fmt.Errorf("GITHUB_EVENT_PATH is not set. Is this running inside GitHub Actions?")
+	}
+
+	Log(DEBUG, "Reading event payload from %s", eventPath)
+	data, err := ioutil.ReadFile(eventPath)
+	if err != nil {
+		return event, fmt.Errorf("failed to read event payload: %v", err)
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		return event, fmt.Errorf("failed to parse event payload: %v", err)
+	}
+	if event.PullRequest.Head.SHA == "" {
+		return event, fmt.Errorf("event payload has no pull_request. Trigger the workflow on pull_request events")
+	}
+	return event, nil
+}
+
+// runActionCommand runs inside a GitHub Actions workflow and publishes the reviewer
+// digest for the triggering pull request as a check run
+func runActionCommand(args []string) error {
+	fs := flag.NewFlagSet("action", flag.ExitOnError)
+	checkName := fs.String("check-name", "GitScribe reviewer digest", "Name of the check run to publish")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	repo := os.Getenv("GITHUB_REPOSITORY")
+	if repo == "" {
+		return fmt.Errorf("GITHUB_REPOSITORY is not set. Is this running inside GitHub Actions?")
+	}
+	event, err := loadPullRequestEvent()
+	if err != nil {
+		return err
+	}
+	base, head := event.PullRequest.Base.SHA, event.PullRequest.Head.SHA
+	Log(INFO, "Processing PR #%d in %s (%s..%s)", event.PullRequest.Number, repo, base, head)
+
+	commits, err := getCommitMessagesInRange(base, head)
+	if err != nil {
+		return err
+	}
+	diff, err := getDiffInRange(base, head)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Generating reviewer digest...")
+	ctx, stop := interruptContext()
+	defer stop()
+	digest, err := GenerateReviewerDigest(ctx, commits, promptDiff(diff, config.LLM), config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate reviewer digest: %w", err)
+	}
+
+	url, err := publishCheckRun(repo, head, *checkName, "Reviewer digest", digest)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Published reviewer digest:", url)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultChatEndpoint is the chat completions API used unless llm.endpoint is set
+const defaultChatEndpoint = "https://api.openai.com/v1/chat/completions"
+
+// offlineMode disables everything that needs the network. It's set from the config when it's
+// loaded, and is always on in airgap builds.
+var offlineMode = airgapBuild
+
+// gitNetworkCommands are the git subcommands that talk to a remote
+var gitNetworkCommands = []string{"push", "fetch", "pull", "clone", "ls-remote", "send-email"}
+
+// requireNetwork returns a capability error for a feature that needs the network when running
+// offline, and nil otherwise
+func requireNetwork(capability string) error {
+	if !offlineMode {
+		return nil
+	}
+	Log(WARN, "%s is disabled in offline mode", capability)
+	return newError(ErrCapabilityDisabled, "%s needs the network and is disabled in offline mode", capability)
+}
+
+// chatEndpoint returns the chat completions URL to send prompts to
+func chatEndpoint(llmConfig LLMConfig) string {
+	if llmConfig.Endpoint == "" && llmConfig.Provider == "ollama" {
+		return ollamaChatURL(llmConfig.Ollama)
+	}
+	if llmConfig.Provider == "mock" {
+		return mockEndpoint
+	}
+	if llmConfig.Endpoint == "" {
+		return defaultChatEndpoint
+	}
+	return llmConfig.Endpoint
+}
+
+// isLocalEndpoint reports whether the URL points at this machine
+func isLocalEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkChatEndpoint refuses to send prompts off the machine when running offline
+func checkChatEndpoint(llmConfig LLMConfig) error {
+	if offlineMode && llmConfig.Provider != "mock" && !isLocalEndpoint(chatEndpoint(llmConfig)) {
+		Log(ERROR, "Refusing to send prompts to %s in offline mode", chatEndpoint(llmConfig))
+		return newError(ErrCapabilityDisabled, "generation with %s is disabled in offline mode. Point llm.endpoint at a local server", chatEndpoint(llmConfig))
+	}
+	return nil
+}
+
+// networkCapability returns the capability a command needs the network for, or "" if it runs
+// locally
+func networkCapability(c *Command) string {
+	switch c.Program {
+	case "gh":
+		return "GitHub access through gh"
+	case "git":
+		for i := 0; i < len(c.Args); i++ {
+			arg := c.Args[i]
+			if arg == "-C" || arg == "-c" {
+				i++
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				continue
+			}
+			for _, subcommand := range gitNetworkCommands {
+				if arg == subcommand {
+					return "git " + arg
+				}
+			}
+			return ""
+		}
+	}
+	return ""
+}
@@ -0,0 +1,6 @@
+//go:build airgap
+
+package main
+
+// airgapBuild makes offline mode permanent, whatever the config says
+const airgapBuild = true
@@ -0,0 +1,7 @@
+//go:build !airgap
+
+package main
+
+// airgapBuild makes offline mode permanent, whatever the config says. Build with -tags airgap
+// to set it.
+const airgapBuild = false
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"go/parser"
+	"go/token"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ArchitectureConfig controls the "Architecture impact" section for Go repos
+type ArchitectureConfig struct {
+	Enabled    bool        `json:"enabled"`
+	LayerRules []LayerRule `json:"layer_rules"`
+}
+
+// LayerRule forbids packages under From from importing packages under any of Deny.
+// Both are paths relative to the module root.
+type LayerRule struct {
+	From string   `json:"from"`
+	Deny []string `json:"deny"`
+}
+
+// importEdge is a new import of one package by another
+type importEdge struct {
+	From string
+	To   string
+}
+
+// goModulePath reads the module path from go.mod at the given revision
+func goModulePath(rev string) string {
+	goMod, ok := gitShowFile(rev, "go.mod")
+	if !ok {
+		return ""
+	}
+	for _, line := range strings.Split(goMod, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "module" {
+			return fields[1]
+		}
+	}
+	return ""
+}
+
+// goModRequirements reads the required modules and versions from go.mod at the given revision
+func goModRequirements(rev string) map[string]string {
+	requirements := make(map[string]string)
+	goMod, ok := gitShowFile(rev, "go.mod")
+	if !ok {
+		return requirements
+	}
+
+	inBlock := false
+	for _, line := range strings.Split(goMod, "\n") {
+		line = strings.TrimSpace(strings.SplitN(line, "//", 2)[0])
+		switch {
+		case line == "require (":
+			inBlock = true
+			continue
+		case inBlock && line == ")":
+			inBlock = false
+			continue
+		case strings.HasPrefix(line, "require "):
+			line = strings.TrimSpace(strings.TrimPrefix(line, "require "))
+		case !inBlock:
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) >= 2 {
+			requirements[fields[0]] = fields[1]
+		}
+	}
+	return requirements
+}
+
+// packageImports returns the set of imports of the non-test Go files in dir at the given revision
+func packageImports(rev string, dir string) (map[string]bool, error) {
+	imports := make(map[string]bool)
+	files, err := gitListFiles(rev, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".go") || strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		src, ok := gitShowFile(rev, file)
+		if !ok {
+			continue
+		}
+		parsed, err := parser.ParseFile(fset, file, src, parser.ImportsOnly)
+		if err != nil {
+			Log(WARN, "Failed to parse imports of %s at %s: %v", file, rev, err)
+			continue
+		}
+		for _, spec := range parsed.Imports {
+			if importPath, err := strconv.Unquote(spec.Path.Value); err == nil {
+				imports[importPath] = true
+			}
+		}
+	}
+	return imports, nil
+}
+
+// newInternalImports finds imports between packages of the module that exist at head but not at base
+func newInternalImports(base string, head string, modulePath string, changedFiles []string) ([]importEdge, error) {
+	dirs := make(map[string]bool)
+	for _, file := range changedFiles {
+		if strings.HasSuffix(file, ".go") && !strings.HasSuffix(file, "_test.go") {
+			dirs[path.Dir(file)] = true
+		}
+	}
+
+	var edges []importEdge
+	for dir := range dirs {
+		before, err := packageImports(base, dir)
+		if err != nil {
+			return nil, err
+		}
+		after, err := packageImports(head, dir)
+		if err != nil {
+			return nil, err
+		}
+		for importPath := range after {
+			if before[importPath] || !strings.HasPrefix(importPath, modulePath+"/") {
+				continue
+			}
+			edges = append(edges, importEdge{From: dir, To: strings.TrimPrefix(importPath, modulePath+"/")})
+		}
+	}
+
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+	return edges, nil
+}
+
+// hasPathPrefix reports whether p is prefix or a path inside it
+func hasPathPrefix(p string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return p == prefix || strings.HasPrefix(p, prefix+"/")
+}
+
+// layerViolations returns a description of each new import that breaks a layering rule
+func layerViolations(edges []importEdge, rules []LayerRule) []string {
+	var violations []string
+	for _, edge := range edges {
+		for _, rule := range rules {
+			if !hasPathPrefix(edge.From, rule.From) {
+				continue
+			}
+			for _, denied := range rule.Deny {
+				if hasPathPrefix(edge.To, denied) {
+					violations = append(violations, fmt.Sprintf("`%s` must not import `%s` (rule: %s -> %s)", edge.From, edge.To, rule.From, denied))
+				}
+			}
+		}
+	}
+	return violations
+}
+
+// buildArchitectureImpact computes the import-graph delta between the merge base and HEAD
+// and renders it as a markdown section. It returns "" if there's nothing to report.
+func buildArchitectureImpact(targetBranch string, archConfig ArchitectureConfig) (string, error) {
+	modulePath := goModulePath(headRev)
+	if modulePath == "" {
+		Log(DEBUG, "No go.mod found, skipping architecture impact")
+		return "", nil
+	}
+
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return "", err
+	}
+	changedFiles, err := getChangedFilesInRange(base, headRev)
+	if err != nil {
+		return "", err
+	}
+
+	edges, err := newInternalImports(base, headRev, modulePath, changedFiles)
+	if err != nil {
+		return "", err
+	}
+
+	before := goModRequirements(base)
+	after := goModRequirements(headRev)
+	var newModules []string
+	for module, version := range after {
+		if _, ok := before[module]; !ok {
+			newModules = append(newModules, fmt.Sprintf("`%s` %s", module, version))
+		}
+	}
+	sort.Strings(newModules)
+
+	violations := layerViolations(edges, archConfig.LayerRules)
+	Log(INFO, "Architecture impact: %d new package dependencies, %d new modules, %d layering violations",
+		len(edges), len(newModules), len(violations))
+	if len(edges) == 0 && len(newModules) == 0 {
+		return "", nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("## Architecture impact\n")
+	if len(edges) > 0 {
+		sb.WriteString("\nNew dependencies between packages:\n")
+		for _, edge := range edges {
+			sb.WriteString(fmt.Sprintf("- `%s` now imports `%s`\n", edge.From, edge.To))
+		}
+	}
+	if len(newModules) > 0 {
+		sb.WriteString("\nNew external modules:\n")
+		for _, module := range newModules {
+			sb.WriteString(fmt.Sprintf("- %s\n", module))
+		}
+	}
+	if len(violations) > 0 {
+		sb.WriteString("\n**Layering violations:**\n")
+		for _, violation := range violations {
+			sb.WriteString(fmt.Sprintf("- :warning: %s\n", violation))
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n"), nil
+}
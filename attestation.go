@@ -0,0 +1,380 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AttestationConfig turns on signed records that a commit message or PR description was
+// generated, for organizations that audit where AI-written text is used
+type AttestationConfig struct {
+	Enabled   bool   `json:"enabled"`
+	KeyFile   string `json:"key_file"`   // Ed25519 private key in PEM, default from GITSCRIBE_ATTESTATION_KEY
+	Dir       string `json:"dir"`        // where attestations are written, default .gitscribe/attestations in the repo
+	GitNotes  bool   `json:"git_notes"`  // also add commit attestations as notes under refs/notes/gitscribe-attestations
+	PRComment bool   `json:"pr_comment"` // also post PR attestations as a comment on the PR
+}
+
+const (
+	intotoStatementType  = "https://in-toto.io/Statement/v1"
+	intotoPayloadType    = "application/vnd.in-toto+json"
+	generationPredicate  = "https://github.com/mattoat/gitscribe/attestation/generation/v1"
+	attestationNotesRef  = "gitscribe-attestations"
+	attestationKeyEnvVar = "GITSCRIBE_ATTESTATION_KEY"
+)
+
+// AttestationSubject is something the attestation is about, identified by its digests
+type AttestationSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// GenerationPredicate records how a message was generated
+type GenerationPredicate struct {
+	Generator       string            `json:"generator"`
+	Kind            string            `json:"kind"` // "commit" or "pr"
+	Provider        string            `json:"provider"`
+	Models          []string          `json:"models"` // the models that answered, which may include fallbacks
+	PromptVersion   string            `json:"promptVersion"`
+	TemplateDigest  map[string]string `json:"templateDigest,omitempty"`
+	PromptDigest    map[string]string `json:"promptDigest,omitempty"` // of the repository's own prompt, if it has one
+	GeneratedAt     string            `json:"generatedAt"`
+	GeneratedDigest map[string]string `json:"generatedDigest"` // of the text as the model wrote it
+	Edited          bool              `json:"edited"`          // whether the author changed it before use
+}
+
+// AttestationStatement is an in-toto statement about generated text
+type AttestationStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []AttestationSubject `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     GenerationPredicate  `json:"predicate"`
+}
+
+// DSSEEnvelope is a signed payload in the Dead Simple Signing Envelope format
+type DSSEEnvelope struct {
+	PayloadType string          `json:"payloadType"`
+	Payload     string          `json:"payload"` // base64
+	Signatures  []DSSESignature `json:"signatures"`
+}
+
+// DSSESignature is one signature of a DSSE envelope
+type DSSESignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"` // base64
+}
+
+// sha256Digest returns an in-toto digest set for text
+func sha256Digest(text string) map[string]string {
+	sum := sha256.Sum256([]byte(text))
+	return map[string]string{"sha256": hex.EncodeToString(sum[:])}
+}
+
+// dssePAE is the pre-authentication encoding DSSE signs, so a payload can't be passed off as
+// another type
+func dssePAE(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// attestationKeyID identifies a public key by the SHA-256 of its PKIX encoding
+func attestationKeyID(public ed25519.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadAttestationKey reads the signing key from attestation.key_file or GITSCRIBE_ATTESTATION_KEY
+func loadAttestationKey(config AttestationConfig) (ed25519.PrivateKey, error) {
+	var data []byte
+	if config.KeyFile != "" {
+		var err error
+		if data, err = ioutil.ReadFile(config.KeyFile); err != nil {
+			return nil, fmt.Errorf("failed to read attestation key: %v", err)
+		}
+	} else if key := envOrFile(attestationKeyEnvVar); key != "" {
+		data = []byte(key)
+	} else {
+		return nil, fmt.Errorf("attestations need a signing key: set attestation.key_file or %s, or create one with gs attest keygen", attestationKeyEnvVar)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("attestation key isn't PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse attestation key: %v", err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("attestation key must be an Ed25519 key")
+	}
+	return key, nil
+}
+
+// signStatement signs a statement into a DSSE envelope
+func signStatement(statement AttestationStatement, key ed25519.PrivateKey) (DSSEEnvelope, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return DSSEEnvelope{}, err
+	}
+	sig := ed25519.Sign(key, dssePAE(intotoPayloadType, payload))
+	return DSSEEnvelope{
+		PayloadType: intotoPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []DSSESignature{{KeyID: attestationKeyID(key.Public().(ed25519.PublicKey)), Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+// verifyEnvelope checks an envelope is signed by the public key and returns its statement
+func verifyEnvelope(envelope DSSEEnvelope, public ed25519.PublicKey) (AttestationStatement, error) {
+	var statement AttestationStatement
+	if envelope.PayloadType != intotoPayloadType {
+		return statement, fmt.Errorf("unexpected payload type %q", envelope.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+	if err != nil {
+		return statement, fmt.Errorf("payload isn't base64: %v", err)
+	}
+	verified := false
+	for _, signature := range envelope.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(signature.Sig)
+		if err == nil && ed25519.Verify(public, dssePAE(envelope.PayloadType, payload), sig) {
+			verified = true
+		}
+	}
+	if !verified {
+		return statement, fmt.Errorf("no signature matches key %s", attestationKeyID(public))
+	}
+	if err := json.Unmarshal(payload, &statement); err != nil {
+		return statement, fmt.Errorf("failed to parse statement: %v", err)
+	}
+	return statement, nil
+}
+
+// attestGenerated writes a signed attestation that final was generated as generated and used for
+// a commit or PR. ref is the commit hash or PR URL, if there is one yet. It returns the file the
+// attestation was written to and the envelope.
+func attestGenerated(kind string, generated string, final string, ref string, templatePath string, config Config) (string, []byte, error) {
+	key, err := loadAttestationKey(config.Attestation)
+	if err != nil {
+		return "", nil, err
+	}
+	name := "commit-message"
+	if kind == "pr" {
+		name = "pr-description"
+	}
+	subjects := []AttestationSubject{{Name: name, Digest: sha256Digest(final)}}
+	if ref != "" && kind == "commit" {
+		subjects = append(subjects, AttestationSubject{Name: "commit", Digest: map[string]string{"gitCommit": ref}})
+	} else if ref != "" {
+		subjects = append(subjects, AttestationSubject{Name: ref, Digest: sha256Digest(final)})
+	}
+	var templateDigest map[string]string
+	if template, err := ioutil.ReadFile(templatePath); err == nil {
+		templateDigest = sha256Digest(string(template))
+	}
+	var promptDigest map[string]string
+	if prompt := config.LLM.Prompts.Commit; kind == "commit" && prompt != "" {
+		promptDigest = sha256Digest(prompt)
+	} else if prompt := config.LLM.Prompts.PR; kind == "pr" && prompt != "" {
+		promptDigest = sha256Digest(prompt)
+	}
+	provider := config.LLM.Provider
+	if provider == "" {
+		provider = "openai"
+	}
+	statement := AttestationStatement{
+		Type:          intotoStatementType,
+		Subject:       subjects,
+		PredicateType: generationPredicate,
+		Predicate: GenerationPredicate{
+			Generator:       "gitscribe",
+			Kind:            kind,
+			Provider:        provider,
+			Models:          usedModels(),
+			PromptVersion:   promptVersion,
+			TemplateDigest:  templateDigest,
+			PromptDigest:    promptDigest,
+			GeneratedAt:     time.Now().UTC().Format(time.RFC3339),
+			GeneratedDigest: sha256Digest(generated),
+			Edited:          strings.TrimSpace(generated) != strings.TrimSpace(final),
+		},
+	}
+	envelope, err := signStatement(statement, key)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to sign attestation: %v", err)
+	}
+	data, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir := config.Attestation.Dir
+	if dir == "" {
+		root, err := repoRoot()
+		if err != nil {
+			return "", nil, err
+		}
+		dir = filepath.Join(root, ".gitscribe", "attestations")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create attestation directory: %v", err)
+	}
+	// Commits are named by their hash and PRs, whose URL has slashes, by their description's
+	file := ref
+	if kind == "pr" || file == "" {
+		file = sha256Digest(final)["sha256"]
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%.12s.dsse.json", kind, file))
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return "", nil, fmt.Errorf("failed to write attestation: %v", err)
+	}
+	Log(INFO, "Wrote attestation to %s", path)
+	return path, data, nil
+}
+
+// attestCommit attests the message of the commit just made, adding it as a git note if configured
+func attestCommit(generated string, final string, config Config) error {
+	commit := ""
+	if currentVCS().Name() == "git" {
+		output, err := newCommand("git", "rev-parse", "HEAD").Output()
+		if err != nil {
+			return fmt.Errorf("failed to read the new commit: %v", err)
+		}
+		commit = strings.TrimSpace(string(output))
+	}
+	path, _, err := attestGenerated("commit", generated, final, commit, config.CommitTemplate, config)
+	if err != nil {
+		return err
+	}
+	if config.Attestation.GitNotes && commit != "" {
+		if err := botGit("notes", "--ref", attestationNotesRef, "add", "-f", "-F", path, commit).Run(); err != nil {
+			return fmt.Errorf("failed to add the attestation as a git note: %v", err)
+		}
+	}
+	fmt.Println("Attestation written to:", path)
+	return nil
+}
+
+// attestPR attests the description of the PR just created, or of the saved description when
+// prURL is empty, and posts it on the PR if configured
+func attestPR(generated string, final string, prURL string, config Config) error {
+	path, envelope, err := attestGenerated("pr", generated, final, prURL, config.PRTemplate, config)
+	if err != nil {
+		return err
+	}
+	if config.Attestation.PRComment && prURL != "" {
+		repo, err := currentRepo()
+		if err != nil {
+			return err
+		}
+		var number int
+		if _, err := fmt.Sscanf(filepath.Base(prURL), "%d", &number); err != nil {
+			return fmt.Errorf("failed to read the PR number from %s", prURL)
+		}
+		body := fmt.Sprintf("<details><summary>GitScribe generation attestation</summary>\n\n```json\n%s\n```\n</details>", envelope)
+		if _, err := postIssueComment(repo, number, body); err != nil {
+			return fmt.Errorf("failed to post the attestation: %w", err)
+		}
+	}
+	fmt.Println("Attestation written to:", path)
+	return nil
+}
+
+// runAttestCommand creates signing keys and verifies attestations
+func runAttestCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gs attest keygen|verify")
+	}
+	fs := flag.NewFlagSet("attest "+args[0], flag.ExitOnError)
+	switch args[0] {
+	case "keygen":
+		out := fs.String("out", "attestation_key", "Write the private key to <out>.pem and the public key to <out>.pub.pem")
+		fs.Parse(args[1:])
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return err
+		}
+		publicDER, err := x509.MarshalPKIXPublicKey(public)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*out+".pem", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*out+".pub.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %s.pem and %s.pub.pem (key ID %s). Keep the private key secret.\n", *out, *out, attestationKeyID(public))
+		return nil
+	case "verify":
+		keyPath := fs.String("key", "", "Public key in PEM to verify with")
+		messagePath := fs.String("message", "", "Also check the attestation is for the message in this file")
+		fs.Parse(args[1:])
+		if *keyPath == "" || fs.NArg() != 1 {
+			return fmt.Errorf("usage: gs attest verify -key <public key> [-message <file>] <attestation>")
+		}
+		keyData, err := ioutil.ReadFile(*keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read public key: %v", err)
+		}
+		block, _ := pem.Decode(keyData)
+		if block == nil {
+			return fmt.Errorf("public key isn't PEM")
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse public key: %v", err)
+		}
+		public, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return fmt.Errorf("public key must be an Ed25519 key")
+		}
+		data, err := ioutil.ReadFile(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("failed to read attestation: %v", err)
+		}
+		var envelope DSSEEnvelope
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return fmt.Errorf("failed to parse attestation: %v", err)
+		}
+		statement, err := verifyEnvelope(envelope, public)
+		if err != nil {
+			return err
+		}
+		if *messagePath != "" {
+			message, err := ioutil.ReadFile(*messagePath)
+			if err != nil {
+				return fmt.Errorf("failed to read message: %v", err)
+			}
+			if len(statement.Subject) == 0 || statement.Subject[0].Digest["sha256"] != sha256Digest(string(message))["sha256"] {
+				return fmt.Errorf("the attestation is for a different message")
+			}
+		}
+		predicate := statement.Predicate
+		fmt.Printf("Verified: %s generated by %s with %s (prompt version %s) at %s, edited: %v\n",
+			predicate.Kind, predicate.Generator, strings.Join(predicate.Models, ", "), predicate.PromptVersion, predicate.GeneratedAt, predicate.Edited)
+		return nil
+	}
+	return fmt.Errorf("unknown attest command %q: use keygen or verify", args[0])
+}
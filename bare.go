@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// headRev is the commit the branch's changes are read from: HEAD of the checkout, or the commit
+// of the ref given with -head, so bots can generate from a bare repository without checking out
+var headRev = "HEAD"
+
+// worktreeless reports whether changes are read from a ref with git plumbing rather than from a
+// working tree
+func worktreeless() bool {
+	return headRev != "HEAD"
+}
+
+// useHeadRef reads the branch's changes from head in gitDir (default the repository in the
+// current directory, which may be bare) instead of from a checkout
+func useHeadRef(gitDir string, head string) error {
+	if gitDir != "" {
+		if _, err := os.Stat(gitDir); err != nil {
+			return newError(ErrGitState, "can't use -git-dir %s: %v", gitDir, err)
+		}
+		// Every git command gs runs, and the programs it runs, then read this repository
+		os.Setenv("GIT_DIR", gitDir)
+		os.Unsetenv("GIT_WORK_TREE")
+	}
+	output, err := newCommand("git", "rev-parse", "--verify", head+"^{commit}").Output()
+	if err != nil {
+		return newError(ErrGitState, "%s isn't a commit in this repository, fetch it first (git fetch origin %s): %v", head, head, err)
+	}
+	headRev = strings.TrimSpace(string(output))
+	Log(INFO, "Reading changes from %s (%s) without a working tree", head, headRev)
+	return nil
+}
+
+// withHeadTree calls fn with a directory holding the files of the head commit: the working tree,
+// or without one a temporary worktree of headRev
+func withHeadTree(fn func(dir string) error) error {
+	if !worktreeless() {
+		return fn(".")
+	}
+	return withWorktree(headRev, fn)
+}
+
+// checkWorktreelessFlags rejects the options that need a working tree
+func checkWorktreelessFlags(dryRun bool, patchIn string, scopeDirs bool) error {
+	switch {
+	case !dryRun:
+		return newError(ErrUsage, "-head needs -dry-run, as there's no working tree to commit in or branch to push")
+	case patchIn != "":
+		return newError(ErrUsage, "-head and -patch can't be used together")
+	case scopeDirs:
+		return newError(ErrUsage, "-head and -scope-dirs can't be used together, as there's nothing staged to unstage")
+	}
+	return nil
+}
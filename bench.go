@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// BenchmarkConfig configures the performance comparison section
+type BenchmarkConfig struct {
+	Packages      []string `json:"packages"`       // Go packages to benchmark, e.g. "./internal/codec/..."
+	Bench         string   `json:"bench"`          // -bench regexp, default "."
+	Count         int      `json:"count"`          // -count, default 5
+	BenchstatFile string   `json:"benchstat_file"` // use this precomputed benchstat output instead of running benchmarks
+}
+
+// runGoBenchmarks runs the configured benchmarks in dir and returns the raw output
+func runGoBenchmarks(benchConfig BenchmarkConfig, dir string) (string, error) {
+	args := []string{"test", "-run", "^$", "-bench", benchConfig.Bench, "-benchmem", "-count", strconv.Itoa(benchConfig.Count)}
+	args = append(args, benchConfig.Packages...)
+	Log(INFO, "Running benchmarks in %s: go %s", dir, strings.Join(args, " "))
+
+	cmd := &Command{Program: "go", Args: args, Dir: dir, ShowStderr: true, Timeout: longCommandTimeout}
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Benchmarks failed: %v", err)
+		return "", fmt.Errorf("benchmarks failed in %s: %v", dir, err)
+	}
+	return string(output), nil
+}
+
+// parseBenchmarkOutput averages the ns/op of each benchmark over all its runs
+func parseBenchmarkOutput(output string) map[string]float64 {
+	sums := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		for i := 2; i+1 < len(fields); i++ {
+			if fields[i+1] != "ns/op" {
+				continue
+			}
+			if value, err := strconv.ParseFloat(fields[i], 64); err == nil {
+				sums[fields[0]] += value
+				counts[fields[0]]++
+			}
+		}
+	}
+
+	averages := make(map[string]float64, len(sums))
+	for name, sum := range sums {
+		averages[name] = sum / float64(counts[name])
+	}
+	return averages
+}
+
+// renderBenchmarkTable renders the averaged base and head timings as a markdown table
+func renderBenchmarkTable(before map[string]float64, after map[string]float64) string {
+	var names []string
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString("| Benchmark | Base ns/op | Head ns/op | Delta |\n")
+	sb.WriteString("|---|---:|---:|---:|\n")
+	for _, name := range names {
+		a := after[name]
+		b, ok := before[name]
+		if !ok || b == 0 {
+			sb.WriteString(fmt.Sprintf("| %s | - | %.1f | new |\n", name, a))
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("| %s | %.1f | %.1f | %+.2f%% |\n", name, b, a, (a-b)*100/b))
+	}
+	return sb.String()
+}
+
+// runBenchstat compares the two outputs with benchstat, if it's installed
+func runBenchstat(before string, after string) (string, bool) {
+	if !programAvailable("benchstat") {
+		Log(DEBUG, "benchstat not found, using built-in comparison")
+		return "", false
+	}
+
+	dir, err := ioutil.TempDir("", "gitscribe_bench_")
+	if err != nil {
+		return "", false
+	}
+	defer os.RemoveAll(dir)
+
+	basePath := filepath.Join(dir, "base.txt")
+	headPath := filepath.Join(dir, "head.txt")
+	if ioutil.WriteFile(basePath, []byte(before), 0600) != nil || ioutil.WriteFile(headPath, []byte(after), 0600) != nil {
+		return "", false
+	}
+
+	output, err := newCommand("benchstat", basePath, headPath).Output()
+	if err != nil {
+		Log(WARN, "benchstat failed, using built-in comparison: %v", err)
+		return "", false
+	}
+	return string(output), true
+}
+
+// buildBenchmarkSection produces the performance comparison section, either from a supplied
+// benchstat file or by benchmarking the merge base and HEAD
+func buildBenchmarkSection(targetBranch string, benchConfig BenchmarkConfig) (string, error) {
+	heading := "## Performance comparison\n\n"
+
+	if benchConfig.BenchstatFile != "" {
+		data, err := ioutil.ReadFile(expandPath(benchConfig.BenchstatFile))
+		if err != nil {
+			return "", fmt.Errorf("failed to read benchstat file: %v", err)
+		}
+		return heading + "```\n" + strings.TrimRight(string(data), "\n") + "\n```", nil
+	}
+
+	if benchConfig.Bench == "" {
+		benchConfig.Bench = "."
+	}
+	if benchConfig.Count <= 0 {
+		benchConfig.Count = 5
+	}
+
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println("Running benchmarks on the base and head of the branch...")
+	var before string
+	err = withWorktree(base, func(dir string) error {
+		before, err = runGoBenchmarks(benchConfig, dir)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	var after string
+	err = withHeadTree(func(dir string) error {
+		after, err = runGoBenchmarks(benchConfig, dir)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if comparison, ok := runBenchstat(before, after); ok {
+		return heading + "```\n" + strings.TrimRight(comparison, "\n") + "\n```", nil
+	}
+
+	afterResults := parseBenchmarkOutput(after)
+	if len(afterResults) == 0 {
+		Log(WARN, "No benchmark results found")
+		return "", nil
+	}
+	return heading + strings.TrimRight(renderBenchmarkTable(parseBenchmarkOutput(before), afterResults), "\n"), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+)
+
+// BotConfig is the identity gs commits as when it writes commits on its own, such as the ones gs
+// sync replays, so history written by automation can be told apart from the user's and audited
+type BotConfig struct {
+	Name          string `json:"name"`
+	Email         string `json:"email"`
+	SigningKey    string `json:"signing_key"`    // GPG key ID, or for ssh a key file; unsigned if empty
+	SigningFormat string `json:"signing_format"` // "openpgp" (default), "ssh" or "x509"
+}
+
+// botSettings is set when the config is loaded
+var botSettings BotConfig
+
+// checkBotConfig rejects a bot identity git can't commit as
+func checkBotConfig(bot BotConfig) error {
+	switch {
+	case (bot.Name == "") != (bot.Email == ""):
+		return fmt.Errorf("bot.name and bot.email in config must be set together")
+	case bot.Name == "" && bot.SigningKey != "":
+		return fmt.Errorf("bot.signing_key in config needs bot.name and bot.email")
+	}
+	switch bot.SigningFormat {
+	case "", "openpgp", "ssh", "x509":
+	default:
+		return fmt.Errorf("unknown bot.signing_format %q in config: use openpgp, ssh or x509", bot.SigningFormat)
+	}
+	return nil
+}
+
+// botGitArgs returns the git options that make commits as the bot, signed with its key rather
+// than the user's, or nothing if no bot is configured
+func botGitArgs() []string {
+	if botSettings.Name == "" {
+		return nil
+	}
+	args := []string{"-c", "user.name=" + botSettings.Name, "-c", "user.email=" + botSettings.Email}
+	if botSettings.SigningKey == "" {
+		// The user's signature would vouch for commits they didn't write
+		return append(args, "-c", "commit.gpgSign=false")
+	}
+	format := botSettings.SigningFormat
+	if format == "" {
+		format = "openpgp"
+	}
+	key := botSettings.SigningKey
+	if format == "ssh" {
+		key = expandPath(key)
+	}
+	return append(args, "-c", "commit.gpgSign=true", "-c", "gpg.format="+format, "-c", "user.signingKey="+key)
+}
+
+// botGit returns a git command that commits as the bot when one is configured
+func botGit(args ...string) *Command {
+	return newCommand("git", append(botGitArgs(), args...)...)
+}
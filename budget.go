@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// MessageBudget limits how long a generated message and its sections may be
+type MessageBudget struct {
+	MaxSubjectLength   int            `json:"max_subject_length"`
+	MaxBodyLength      int            `json:"max_body_length"`
+	SectionWordBudgets map[string]int `json:"section_word_budgets"`
+	Style              string         `json:"style"` // "bullets" or "prose"
+}
+
+// buildBudgetPrompt renders the budget into instructions for the LLM
+func buildBudgetPrompt(budget MessageBudget) string {
+	var sb strings.Builder
+	if budget.MaxSubjectLength > 0 {
+		sb.WriteString(fmt.Sprintf("The first line must be at most %d characters long.\n", budget.MaxSubjectLength))
+	}
+	if budget.MaxBodyLength > 0 {
+		sb.WriteString(fmt.Sprintf("Everything after the first line must be at most %d characters long in total.\n", budget.MaxBodyLength))
+	}
+
+	// Sort section names so the prompt is stable between runs
+	sections := make([]string, 0, len(budget.SectionWordBudgets))
+	for name := range budget.SectionWordBudgets {
+		sections = append(sections, name)
+	}
+	sort.Strings(sections)
+	for _, name := range sections {
+		sb.WriteString(fmt.Sprintf("The %q section must be at most %d words.\n", name, budget.SectionWordBudgets[name]))
+	}
+
+	switch strings.ToLower(budget.Style) {
+	case "bullets":
+		sb.WriteString("Write the body as short bullet points, not paragraphs.\n")
+	case "prose":
+		sb.WriteString("Write the body as short prose paragraphs, not bullet points.\n")
+	}
+	return sb.String()
+}
+
+// applyBudget deterministically trims a message that the model made longer than the budget allows
+func applyBudget(message string, budget MessageBudget) string {
+	lines := strings.SplitN(message, "\n", 2)
+	subject := lines[0]
+	body := ""
+	if len(lines) > 1 {
+		body = lines[1]
+	}
+
+	if length := utf8.RuneCountInString(subject); budget.MaxSubjectLength > 0 && length > budget.MaxSubjectLength {
+		Log(WARN, "Subject is %d characters, trimming to %d", length, budget.MaxSubjectLength)
+		subject = truncateAtWord(subject, budget.MaxSubjectLength)
+	}
+
+	if len(budget.SectionWordBudgets) > 0 {
+		body = trimSections(body, budget.SectionWordBudgets)
+	}
+
+	if length := utf8.RuneCountInString(body); budget.MaxBodyLength > 0 && length > budget.MaxBodyLength {
+		Log(WARN, "Body is %d characters, trimming to %d", length, budget.MaxBodyLength)
+		// Prefer cutting at a line boundary so we don't leave half a sentence behind
+		cut := cutAtChars(body, budget.MaxBodyLength)
+		if idx := strings.LastIndex(cut, "\n"); idx > 0 {
+			body = cut[:idx]
+		} else {
+			body = truncateAtWord(body, budget.MaxBodyLength)
+		}
+	}
+
+	// git takes everything up to the first blank line for the subject
+	body = strings.Trim(body, "\n")
+	if body == "" {
+		return subject
+	}
+	return subject + "\n\n" + body
+}
+
+// truncateAtWord cuts s to at most max characters, backing up to the last space if possible
+func truncateAtWord(s string, max int) string {
+	cut := cutAtChars(s, max)
+	if cut == s {
+		return s
+	}
+	if idx := strings.LastIndex(cut, " "); idx > 0 {
+		cut = cut[:idx]
+	}
+	return strings.TrimRight(cut, " ,;:-")
+}
+
+// cutAtChars cuts s to at most max characters
+func cutAtChars(s string, max int) string {
+	count := 0
+	for i := range s {
+		if count == max {
+			return s[:i]
+		}
+		count++
+	}
+	return s
+}
+
+// cutAtRune cuts s to at most max bytes without splitting a character
+func cutAtRune(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// sectionName returns the name of the section a line starts, or "" if it isn't a section header.
+// Headers are either markdown headings or a line consisting of a label ending in a colon.
+func sectionName(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "#") {
+		return strings.TrimSpace(strings.TrimLeft(trimmed, "#"))
+	}
+	if strings.HasSuffix(trimmed, ":") && !strings.HasPrefix(trimmed, "-") && !strings.HasPrefix(trimmed, "*") &&
+		len(strings.Fields(trimmed)) <= 4 {
+		return strings.TrimSuffix(trimmed, ":")
+	}
+	return ""
+}
+
+// trimSections enforces the per-section word budgets, keeping whole lines where possible
+func trimSections(body string, budgets map[string]int) string {
+	// Match section names case-insensitively
+	normalized := make(map[string]int, len(budgets))
+	for name, words := range budgets {
+		normalized[strings.ToLower(name)] = words
+	}
+
+	var result []string
+	limit, used := 0, 0
+	for _, line := range strings.Split(body, "\n") {
+		if name := sectionName(line); name != "" {
+			limit = normalized[strings.ToLower(name)]
+			used = 0
+			result = append(result, line)
+			continue
+		}
+		if limit == 0 {
+			result = append(result, line)
+			continue
+		}
+
+		words := strings.Fields(line)
+		if used >= limit {
+			if len(words) > 0 {
+				continue
+			}
+			result = append(result, line)
+			continue
+		}
+		if used+len(words) > limit {
+			Log(DEBUG, "Section word budget of %d reached, trimming", limit)
+			// Keep the leading indentation and list marker of the line
+			indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+			line = indent + strings.Join(words[:limit-used], " ")
+		}
+		used += len(words)
+		result = append(result, line)
+	}
+	return strings.Join(result, "\n")
+}
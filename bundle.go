@@ -0,0 +1,524 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigBundle is a team's shared configuration and the templates it references, signed by the
+// team that distributes it
+type ConfigBundle struct {
+	Version   int                    `json:"version"`
+	Created   string                 `json:"created"`
+	Config    map[string]interface{} `json:"config"`
+	Files     map[string]string      `json:"files"` // templates and redaction packs, keyed by their path in the bundle
+	PublicKey string                 `json:"public_key,omitempty"`
+	Signature string                 `json:"signature,omitempty"`
+}
+
+// personalConfigKeys are never exported and are kept from the user's own config on import
+var personalConfigKeys = [][]string{{"consent"}, {"llm", "api_key"}, {"server", "webhook_secret"}, {"phabricator", "token"}, {"sourcehut", "token"}}
+
+// bundleDir returns where imported bundles and their templates are installed
+func bundleDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gitscribe", "bundle"), nil
+}
+
+// nestedValue returns the value at a path of keys in a decoded JSON object
+func nestedValue(raw map[string]interface{}, keys []string) (interface{}, bool) {
+	var current interface{} = raw
+	for _, key := range keys {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// setNestedValue sets the value at a path of keys, creating objects along the way
+func setNestedValue(raw map[string]interface{}, keys []string, value interface{}) {
+	object := raw
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := object[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			object[key] = next
+		}
+		object = next
+	}
+	object[keys[len(keys)-1]] = value
+}
+
+// deleteNestedValue removes the value at a path of keys if it's there
+func deleteNestedValue(raw map[string]interface{}, keys []string) {
+	if parent, ok := nestedValue(raw, keys[:len(keys)-1]); ok {
+		if object, ok := parent.(map[string]interface{}); ok {
+			delete(object, keys[len(keys)-1])
+		}
+	}
+}
+
+// rewriteTemplatePaths replaces every template and system prompt path in a raw config with what
+// rewrite returns
+func rewriteTemplatePaths(raw map[string]interface{}, rewrite func(string) (string, error)) error {
+	for _, key := range []string{"commit_template", "pr_template"} {
+		if p, ok := raw[key].(string); ok && p != "" {
+			rewritten, err := rewrite(p)
+			if err != nil {
+				return err
+			}
+			raw[key] = rewritten
+		}
+	}
+	areas, _ := raw["pr_area_templates"].([]interface{})
+	for _, area := range areas {
+		object, ok := area.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if p, ok := object["template"].(string); ok && p != "" {
+			rewritten, err := rewrite(p)
+			if err != nil {
+				return err
+			}
+			object["template"] = rewritten
+		}
+	}
+	llm, _ := raw["llm"].(map[string]interface{})
+	for _, kind := range []string{"commit", "pr"} {
+		settings, _ := llm[kind].(map[string]interface{})
+		if p, ok := settings["system_prompt_file"].(string); ok && p != "" {
+			rewritten, err := rewrite(p)
+			if err != nil {
+				return err
+			}
+			settings["system_prompt_file"] = rewritten
+		}
+		examples, _ := settings["examples"].([]interface{})
+		for _, example := range examples {
+			object, _ := example.(map[string]interface{})
+			for _, key := range []string{"input_file", "output_file"} {
+				if p, ok := object[key].(string); ok && p != "" {
+					rewritten, err := rewrite(p)
+					if err != nil {
+						return err
+					}
+					object[key] = rewritten
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rewritePolicyPackPaths replaces the path of every redaction pack file in a raw config with what
+// rewrite returns, leaving the built-in packs as they are
+func rewritePolicyPackPaths(raw map[string]interface{}, rewrite func(string) (string, error)) error {
+	redaction, _ := raw["redaction"].(map[string]interface{})
+	packs, _ := redaction["packs"].([]interface{})
+	for i, pack := range packs {
+		p, _ := pack.(string)
+		if _, builtin := builtinRedactionPacks[p]; builtin || p == "" {
+			continue
+		}
+		rewritten, err := rewrite(p)
+		if err != nil {
+			return err
+		}
+		packs[i] = rewritten
+	}
+	return nil
+}
+
+// signedPayload is the part of the bundle the signature covers
+func signedPayload(bundle ConfigBundle) ([]byte, error) {
+	bundle.PublicKey, bundle.Signature = "", ""
+	return json.Marshal(bundle)
+}
+
+// readKeyFile reads a base64 encoded key of the expected size
+func readKeyFile(path string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(expandPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("%s is not a gs config key", path)
+	}
+	return key, nil
+}
+
+// exportBundle collects the config at configPath and the templates and redaction packs it
+// references into a bundle, leaving out credentials and consent
+func exportBundle(configPath string) (ConfigBundle, error) {
+	bundle := ConfigBundle{Version: 1, Created: time.Now().UTC().Format(time.RFC3339), Files: make(map[string]string)}
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return bundle, fmt.Errorf("failed to read config file: %v", err)
+	}
+	if err := json.Unmarshal(data, &bundle.Config); err != nil {
+		return bundle, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+	for _, keys := range personalConfigKeys {
+		deleteNestedValue(bundle.Config, keys)
+	}
+
+	// addFile stores a file under folder in the bundle and returns its name there
+	addFile := func(folder string, p string, content []byte) string {
+		name := folder + "/" + filepath.Base(p)
+		for i := 2; bundle.Files[name] != "" && bundle.Files[name] != string(content); i++ {
+			name = fmt.Sprintf("%s/%d-%s", folder, i, filepath.Base(p))
+		}
+		bundle.Files[name] = string(content)
+		return name
+	}
+	err = rewriteTemplatePaths(bundle.Config, func(p string) (string, error) {
+		content, err := ioutil.ReadFile(expandPath(p))
+		if err != nil {
+			return "", templateError(p, err)
+		}
+		return addFile("templates", p, content), nil
+	})
+	if err != nil {
+		return bundle, err
+	}
+	err = rewritePolicyPackPaths(bundle.Config, func(p string) (string, error) {
+		content, err := ioutil.ReadFile(expandPath(p))
+		if err != nil {
+			return "", fmt.Errorf("failed to read redaction pack %s: %v", p, err)
+		}
+		return addFile("policies", p, content), nil
+	})
+	return bundle, err
+}
+
+// signBundle signs the bundle with an ed25519 private key
+func signBundle(bundle *ConfigBundle, privateKey ed25519.PrivateKey) error {
+	payload, err := signedPayload(*bundle)
+	if err != nil {
+		return err
+	}
+	bundle.PublicKey = base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey))
+	bundle.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, payload))
+	return nil
+}
+
+// verifyBundle checks the bundle was signed with the given public key
+func verifyBundle(bundle ConfigBundle, publicKey ed25519.PublicKey) error {
+	if bundle.Signature == "" {
+		return fmt.Errorf("the bundle isn't signed")
+	}
+	if bundle.PublicKey != base64.StdEncoding.EncodeToString(publicKey) {
+		return fmt.Errorf("the bundle was signed with a different key")
+	}
+	signature, err := base64.StdEncoding.DecodeString(bundle.Signature)
+	if err != nil {
+		return fmt.Errorf("the bundle's signature is malformed")
+	}
+	payload, err := signedPayload(bundle)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, payload, signature) {
+		return fmt.Errorf("the bundle's signature doesn't match its contents")
+	}
+	return nil
+}
+
+// readBundle reads a bundle file
+func readBundle(path string) (ConfigBundle, error) {
+	var bundle ConfigBundle
+	data, err := ioutil.ReadFile(expandPath(path))
+	if err != nil {
+		return bundle, fmt.Errorf("failed to read bundle: %v", err)
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return bundle, fmt.Errorf("failed to parse bundle %s: %v", path, err)
+	}
+	if bundle.Version != 1 {
+		return bundle, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+	return bundle, nil
+}
+
+// flattenConfig turns a raw config into dotted keys and JSON values, for diffing
+func flattenConfig(prefix string, value interface{}, out map[string]string) {
+	if object, ok := value.(map[string]interface{}); ok && len(object) > 0 {
+		for key, child := range object {
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			flattenConfig(name, child, out)
+		}
+		return
+	}
+	encoded, _ := json.Marshal(value)
+	out[prefix] = string(encoded)
+}
+
+// diffBundles describes what importing the new bundle changes compared to the installed one
+func diffBundles(installed ConfigBundle, bundle ConfigBundle) []string {
+	var changes []string
+	before, after := make(map[string]string), make(map[string]string)
+	flattenConfig("", installed.Config, before)
+	flattenConfig("", bundle.Config, after)
+	for _, key := range sortedUnion(before, after) {
+		switch old, new := before[key], after[key]; {
+		case old == "":
+			changes = append(changes, fmt.Sprintf("+ %s = %s", key, new))
+		case new == "":
+			changes = append(changes, fmt.Sprintf("- %s = %s", key, old))
+		case old != new:
+			changes = append(changes, fmt.Sprintf("~ %s: %s -> %s", key, old, new))
+		}
+	}
+
+	for _, name := range sortedUnion(installed.Files, bundle.Files) {
+		old, hadOld := installed.Files[name]
+		new, hasNew := bundle.Files[name]
+		switch {
+		case !hadOld:
+			changes = append(changes, fmt.Sprintf("+ %s (%d lines)", name, len(strings.Split(new, "\n"))))
+		case !hasNew:
+			changes = append(changes, fmt.Sprintf("- %s", name))
+		case old != new:
+			ratio := editRatio(strings.Split(old, "\n"), strings.Split(new, "\n"))
+			changes = append(changes, fmt.Sprintf("~ %s (%.0f%% of lines changed)", name, 100*ratio))
+		}
+	}
+	return changes
+}
+
+// sortedUnion returns the keys of both maps, sorted
+func sortedUnion(a map[string]string, b map[string]string) []string {
+	var keys []string
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// installBundle writes the bundle's templates and redaction packs under dir and the config to configPath, keeping the
+// credentials and consent already in configPath
+func installBundle(bundle ConfigBundle, dir string, configPath string) error {
+	config := make(map[string]interface{})
+	if data, err := json.Marshal(bundle.Config); err == nil {
+		json.Unmarshal(data, &config)
+	}
+	inBundle := func(p string) (string, error) {
+		return filepath.Join(dir, filepath.FromSlash(p)), nil
+	}
+	if err := rewriteTemplatePaths(config, inBundle); err != nil {
+		return err
+	}
+	if err := rewritePolicyPackPaths(config, inBundle); err != nil {
+		return err
+	}
+
+	if data, err := ioutil.ReadFile(configPath); err == nil {
+		var existing map[string]interface{}
+		if err := json.Unmarshal(data, &existing); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", configPath, err)
+		}
+		for _, keys := range personalConfigKeys {
+			if value, ok := nestedValue(existing, keys); ok {
+				setNestedValue(config, keys, value)
+			}
+		}
+	}
+
+	for name, content := range bundle.Files {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(filepath.Separator)) {
+			return fmt.Errorf("bundle file %s is outside the bundle directory", name)
+		}
+		os.MkdirAll(filepath.Dir(target), 0700)
+		if err := ioutil.WriteFile(target, []byte(content), 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %v", target, err)
+		}
+	}
+	installed, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bundle.json"), installed, 0600); err != nil {
+		return fmt.Errorf("failed to record installed bundle: %v", err)
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(configPath), 0700)
+	return ioutil.WriteFile(configPath, append(data, '\n'), 0600)
+}
+
+// runConfigCommand dispatches the config subcommands
+func runConfigCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gs config get|set|unset|list|keygen|export|import")
+	}
+	switch args[0] {
+	case "get":
+		return runConfigGetCommand(args[1:])
+	case "set":
+		return runConfigSetCommand(args[1:])
+	case "unset":
+		return runConfigUnsetCommand(args[1:])
+	case "list":
+		return runConfigListCommand(args[1:])
+	case "keygen":
+		return runConfigKeygenCommand(args[1:])
+	case "export":
+		return runConfigExportCommand(args[1:])
+	case "import":
+		return runConfigImportCommand(args[1:])
+	}
+	return fmt.Errorf("unknown config command %q: use get, set, unset, list, keygen, export or import", args[0])
+}
+
+// runConfigKeygenCommand creates a key pair for signing bundles
+func runConfigKeygenCommand(args []string) error {
+	fs := flag.NewFlagSet("config keygen", flag.ExitOnError)
+	out := fs.String("o", "gitscribe-bundle", "Write the keys to <o>.key and <o>.pub")
+	fs.Parse(args)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	if err := ioutil.WriteFile(*out+".key", []byte(base64.StdEncoding.EncodeToString(privateKey)+"\n"), 0600); err != nil {
+		return fmt.Errorf("failed to write private key: %v", err)
+	}
+	if err := ioutil.WriteFile(*out+".pub", []byte(base64.StdEncoding.EncodeToString(publicKey)+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write public key: %v", err)
+	}
+	fmt.Printf("Wrote %s.key (keep it secret) and %s.pub (give it to your users).\n", *out, *out)
+	return nil
+}
+
+// runConfigExportCommand writes the current config and its templates to a signed bundle
+func runConfigExportCommand(args []string) error {
+	fs := flag.NewFlagSet("config export", flag.ExitOnError)
+	out := fs.String("o", "gitscribe-bundle.json", "File to write the bundle to")
+	keyPath := fs.String("key", "", "Private key to sign the bundle with, from gs config keygen")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *keyPath == "" {
+		return fmt.Errorf("a signing key is required: gs config export -key <file>.key (create one with gs config keygen)")
+	}
+	privateKey, err := readKeyFile(*keyPath, ed25519.PrivateKeySize)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := exportBundle(config.Path)
+	if err != nil {
+		return err
+	}
+	if err := signBundle(&bundle, ed25519.PrivateKey(privateKey)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write bundle: %v", err)
+	}
+	fmt.Printf("Exported %s and %d template and redaction pack files to %s. Credentials and consent were left out.\n", config.Path, len(bundle.Files), *out)
+	return nil
+}
+
+// runConfigImportCommand verifies a bundle, shows how it differs from the installed one and applies it
+func runConfigImportCommand(args []string) error {
+	fs := flag.NewFlagSet("config import", flag.ExitOnError)
+	pubPath := fs.String("pub", "", "Public key the bundle must be signed with")
+	allowUnsigned := fs.Bool("allow-unsigned", false, "Import without checking the signature")
+	dryRun := fs.Bool("dry-run", false, "Only show how the bundle differs from the installed one")
+	target := fs.String("config", "~/.gitscribe/.gitscribe_config.json", "Config file to write")
+	logLevelFlag := fs.String("log-level", "none", "Set logging level (debug, info, warn, error, none)")
+	fs.Parse(args)
+	SetLogLevelFromFlag(*logLevelFlag)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gs config import -pub <file>.pub [-dry-run] <bundle>")
+	}
+	bundle, err := readBundle(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch {
+	case *pubPath != "":
+		publicKey, err := readKeyFile(*pubPath, ed25519.PublicKeySize)
+		if err != nil {
+			return err
+		}
+		if err := verifyBundle(bundle, ed25519.PublicKey(publicKey)); err != nil {
+			return fmt.Errorf("not importing %s: %v", fs.Arg(0), err)
+		}
+	case !*allowUnsigned:
+		return fmt.Errorf("pass the distributing team's public key with -pub to verify the bundle, or -allow-unsigned")
+	}
+
+	dir, err := bundleDir()
+	if err != nil {
+		return fmt.Errorf("failed to find home directory: %v", err)
+	}
+	var installed ConfigBundle
+	if _, err := os.Stat(filepath.Join(dir, "bundle.json")); err == nil {
+		if installed, err = readBundle(filepath.Join(dir, "bundle.json")); err != nil {
+			return err
+		}
+	}
+	changes := diffBundles(installed, bundle)
+	if installed.Created != "" {
+		fmt.Printf("Changes from the installed bundle (%s):\n", installed.Created)
+	} else {
+		fmt.Println("No bundle installed yet. The bundle contains:")
+	}
+	if len(changes) == 0 {
+		fmt.Println("  (no changes)")
+	}
+	for _, change := range changes {
+		fmt.Println("  " + change)
+	}
+	if *dryRun {
+		return nil
+	}
+
+	configPath := expandPath(*target)
+	if err := installBundle(bundle, dir, configPath); err != nil {
+		return err
+	}
+	fmt.Printf("Installed the bundle to %s and %s.\n", configPath, dir)
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CalendarConfig sets how the date and sprint template variables, such as {{.Today}} and
+// {{.Sprint}}, are worked out
+type CalendarConfig struct {
+	TimeZone   string `json:"time_zone"`   // IANA name such as Europe/Berlin, default the local time zone
+	Locale     string `json:"locale"`      // how dates are written, such as en-US or de-DE, default from LC_TIME or LANG
+	SprintFile string `json:"sprint_file"` // JSON list of sprints, see Sprint
+}
+
+// Sprint is one entry of the sprint calendar file
+type Sprint struct {
+	Name    string `json:"name"`
+	Start   string `json:"start"`   // first day, YYYY-MM-DD
+	End     string `json:"end"`     // last day, YYYY-MM-DD
+	Release string `json:"release"` // the release train the sprint ships in
+}
+
+// calendarSettings is the calendar of the loaded config
+var calendarSettings CalendarConfig
+
+// templateVarPattern matches a template variable such as {{.Today}} or {{ .Sprint }}
+var templateVarPattern = regexp.MustCompile(`\{\{\s*\.(\w+)\s*\}\}`)
+
+// localeMonths are month names by language, for the locales whose dates aren't written in English
+var localeMonths = map[string][]string{
+	"de": {"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"},
+	"fr": {"janvier", "février", "mars", "avril", "mai", "juin", "juillet", "août", "septembre", "octobre", "novembre", "décembre"},
+	"es": {"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+	"nl": {"januari", "februari", "maart", "april", "mei", "juni", "juli", "augustus", "september", "oktober", "november", "december"},
+}
+
+// calendarLocale returns the configured locale, or the one from the environment, as in en-US
+func calendarLocale(calendar CalendarConfig) string {
+	locale := calendar.Locale
+	for _, name := range []string{"LC_ALL", "LC_TIME", "LANG"} {
+		if locale == "" {
+			locale = os.Getenv(name)
+		}
+	}
+	// Environment locales look like de_DE.UTF-8
+	locale = strings.SplitN(strings.SplitN(locale, ".", 2)[0], "@", 2)[0]
+	locale = strings.Replace(locale, "_", "-", 1)
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return "en-US"
+	}
+	return locale
+}
+
+// formatDate writes a date the way the locale does
+func formatDate(t time.Time, locale string) string {
+	language := strings.ToLower(strings.SplitN(locale, "-", 2)[0])
+	day, month, year := t.Day(), t.Month(), t.Year()
+	switch {
+	case strings.EqualFold(locale, "iso"):
+		return t.Format("2006-01-02")
+	case language == "de":
+		return fmt.Sprintf("%d. %s %d", day, localeMonths["de"][month-1], year)
+	case language == "es":
+		return fmt.Sprintf("%d de %s de %d", day, localeMonths["es"][month-1], year)
+	case language == "fr" || language == "nl":
+		return fmt.Sprintf("%d %s %d", day, localeMonths[language][month-1], year)
+	case language == "ja" || language == "zh":
+		return fmt.Sprintf("%d年%d月%d日", year, month, day)
+	case language == "en" && !strings.EqualFold(locale, "en-US"):
+		return t.Format("2 January 2006")
+	}
+	return t.Format("January 2, 2006")
+}
+
+// templateVars are the values template variables are replaced with. Sprint values are only
+// looked up when a template uses them, so a missing calendar only fails templates that need it.
+type templateVars struct {
+	calendar CalendarConfig
+	now      time.Time
+}
+
+// newTemplateVars returns the template variables for now in the calendar's time zone
+func newTemplateVars(calendar CalendarConfig) (templateVars, error) {
+	now := time.Now()
+	if calendar.TimeZone != "" {
+		location, err := time.LoadLocation(calendar.TimeZone)
+		if err != nil {
+			return templateVars{}, fmt.Errorf("unknown calendar.time_zone %q: %v", calendar.TimeZone, err)
+		}
+		now = now.In(location)
+	}
+	return templateVars{calendar: calendar, now: now}, nil
+}
+
+// sprint returns the sprint of the calendar file that today falls in
+func (v templateVars) sprint() (Sprint, error) {
+	if v.calendar.SprintFile == "" {
+		return Sprint{}, fmt.Errorf("sprint template variables need calendar.sprint_file")
+	}
+	data, err := ioutil.ReadFile(v.calendar.SprintFile)
+	if err != nil {
+		return Sprint{}, fmt.Errorf("failed to read sprint calendar: %v", err)
+	}
+	var sprints []Sprint
+	if err := json.Unmarshal(data, &sprints); err != nil {
+		return Sprint{}, fmt.Errorf("failed to parse sprint calendar %s: %v", v.calendar.SprintFile, err)
+	}
+	// Dates in YYYY-MM-DD compare as strings
+	today := v.now.Format("2006-01-02")
+	sort.Slice(sprints, func(i, j int) bool { return sprints[i].Start < sprints[j].Start })
+	for _, sprint := range sprints {
+		if sprint.Start <= today && today <= sprint.End {
+			return sprint, nil
+		}
+	}
+	return Sprint{}, fmt.Errorf("no sprint in %s covers %s. Add the coming sprints to it", v.calendar.SprintFile, today)
+}
+
+// value returns the value of the named variable
+func (v templateVars) value(name string) (string, error) {
+	locale := calendarLocale(v.calendar)
+	switch name {
+	case "Today":
+		return formatDate(v.now, locale), nil
+	case "Date":
+		return v.now.Format("2006-01-02"), nil
+	case "Year":
+		return v.now.Format("2006"), nil
+	case "Sprint", "SprintStart", "SprintEnd", "Release":
+		sprint, err := v.sprint()
+		if err != nil {
+			return "", err
+		}
+		switch name {
+		case "SprintStart", "SprintEnd":
+			day := sprint.Start
+			if name == "SprintEnd" {
+				day = sprint.End
+			}
+			t, err := time.Parse("2006-01-02", day)
+			if err != nil {
+				return "", fmt.Errorf("sprint %s has an invalid date %q, use YYYY-MM-DD", sprint.Name, day)
+			}
+			return formatDate(t, locale), nil
+		case "Release":
+			if sprint.Release == "" {
+				return "", fmt.Errorf("sprint %s has no release in %s", sprint.Name, v.calendar.SprintFile)
+			}
+			return sprint.Release, nil
+		}
+		return sprint.Name, nil
+	}
+	return "", fmt.Errorf("unknown template variable {{.%s}}. Use Today, Date, Year, Sprint, SprintStart, SprintEnd or Release", name)
+}
+
+// renderTemplateVars replaces the date and sprint variables in a template. Other {{ }} text, such
+// as GitHub Actions expressions, is left alone.
+func renderTemplateVars(template string) (string, error) {
+	if !templateVarPattern.MatchString(template) {
+		return template, nil
+	}
+	vars, err := newTemplateVars(calendarSettings)
+	if err != nil {
+		return "", err
+	}
+	var renderErr error
+	rendered := templateVarPattern.ReplaceAllStringFunc(template, func(match string) string {
+		value, err := vars.value(templateVarPattern.FindStringSubmatch(match)[1])
+		if err != nil && renderErr == nil {
+			renderErr = err
+		}
+		return value
+	})
+	if renderErr != nil {
+		return "", fmt.Errorf("failed to fill in template: %w", renderErr)
+	}
+	return rendered, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Capability is an integration that features depend on, whether this run can use it, and why
+type Capability struct {
+	Name   string
+	Active bool
+	Reason string
+}
+
+// degradedFeature is a configured feature that is left out or reduced when a capability isn't
+// active, instead of failing the run
+type degradedFeature struct {
+	capability string
+	name       string
+	effect     string
+	configured func(Config) bool
+}
+
+// degradedFeatures are the features that work without their integration, in a reduced form
+var degradedFeatures = []degradedFeature{
+	{"github", "Creating and updating PRs with gs -pr", "the description is saved to a file, as with -skip-create",
+		func(Config) bool { return true }},
+	{"github", "Branch protection in Required approvals", "left out, only the code owners are listed",
+		func(c Config) bool { return c.Owners.Enabled }},
+	{"github", "Review history in Review effort", "left out, only the size of the change is described",
+		func(c Config) bool { return c.ReviewEffort.Enabled }},
+	{"github", "Upstream changes of vendored modules", "the section is left out",
+		func(c Config) bool { return c.Vendor.SummarizeUpstream }},
+}
+
+// githubCapability is worked out once per run, as it runs gh
+var githubCapability struct {
+	sync.Once
+	Capability
+}
+
+// githubAvailable returns whether gh can be used in this run and why
+func githubAvailable() Capability {
+	githubCapability.Do(func() {
+		githubCapability.Capability = checkGitHub()
+		if !githubCapability.Active {
+			Log(INFO, "GitHub isn't available: %s", githubCapability.Reason)
+		}
+	})
+	return githubCapability.Capability
+}
+
+// checkGitHub checks that gh is installed and has a token, without calling the API
+func checkGitHub() Capability {
+	capability := Capability{Name: "github"}
+	switch {
+	case offlineMode:
+		capability.Reason = "offline mode is on"
+	case !isAllowedProgram("gh"):
+		capability.Reason = "gh isn't in exec.allow"
+	case !programAvailable("gh"):
+		capability.Reason = "the GitHub CLI (gh) isn't installed, see https://cli.github.com/"
+	case os.Getenv("GH_TOKEN") != "" || os.Getenv("GITHUB_TOKEN") != "":
+		capability.Active, capability.Reason = true, "gh authenticates with GH_TOKEN or GITHUB_TOKEN"
+	default:
+		// gh auth token reads the stored token without asking GitHub
+		_, err := newCommand("gh", "auth", "token").Output()
+		switch {
+		case err == nil:
+			capability.Active, capability.Reason = true, "gh is logged in"
+		case strings.Contains(err.Error(), "unknown command"):
+			capability.Active, capability.Reason = true, "gh is installed, too old to check its login"
+		default:
+			capability.Reason = "gh isn't logged in, run gh auth login or set GH_TOKEN"
+		}
+	}
+	return capability
+}
+
+// noteOmitted tells the user a part of the output was left out because an integration isn't
+// available, rather than failing the run
+func noteOmitted(what string, capability Capability) {
+	Log(WARN, "Leaving out %s: %s", what, capability.Reason)
+	fmt.Fprintf(os.Stderr, "Note: %s is left out, as %s. Run gs capabilities to see what's available.\n", what, capability.Reason)
+}
+
+// configCapabilities returns every integration and whether this config can use it
+func configCapabilities(config Config) []Capability {
+	llm := Capability{Name: "llm", Active: config.LLM.APIKey != ""}
+	switch {
+	case config.LLM.APIKey == "local":
+		llm.Reason = "no key needed for " + chatEndpoint(config.LLM)
+	case llm.Active:
+		llm.Reason = "API key set for " + chatEndpoint(config.LLM)
+	default:
+		llm.Reason = "no API key, set llm.api_key or OPENAI_KEY, or run gs auth login"
+	}
+	if err := checkChatEndpoint(config.LLM); err != nil {
+		llm.Active, llm.Reason = false, err.Error()
+	}
+
+	phabricator := Capability{Name: "phabricator"}
+	switch {
+	case config.Phabricator.URL == "":
+		phabricator.Reason = "phabricator.url isn't set"
+	case config.Phabricator.Token == "":
+		phabricator.Reason = "no Conduit token, set phabricator.token or PHABRICATOR_TOKEN"
+	default:
+		phabricator.Active, phabricator.Reason = true, "Conduit at "+config.Phabricator.URL
+	}
+
+	sourceHut := Capability{Name: "sourcehut"}
+	switch {
+	case len(config.SourceHut.Remotes) == 0:
+		sourceHut.Reason = "no mailing lists in sourcehut.remotes"
+	case config.SourceHut.Token == "":
+		sourceHut.Reason = "no token, set sourcehut.token or SRHT_TOKEN"
+	default:
+		sourceHut.Active, sourceHut.Reason = true, fmt.Sprintf("%d mailing lists configured", len(config.SourceHut.Remotes))
+	}
+
+	return []Capability{llm, githubAvailable(), phabricator, sourceHut}
+}
+
+// runCapabilitiesCommand shows which integrations are available and which configured features
+// are reduced without them
+func runCapabilitiesCommand(args []string) error {
+	config, err := parseCommandFlags(flag.NewFlagSet("capabilities", flag.ExitOnError), args)
+	if err != nil {
+		return err
+	}
+	inactive := make(map[string]bool)
+	for _, capability := range configCapabilities(config) {
+		status := "active"
+		if !capability.Active {
+			status = "inactive"
+			inactive[capability.Name] = true
+		}
+		fmt.Printf("%-12s %-9s %s\n", capability.Name, status, capability.Reason)
+	}
+
+	var degraded []string
+	for _, feature := range degradedFeatures {
+		if inactive[feature.capability] && feature.configured(config) {
+			degraded = append(degraded, fmt.Sprintf("- %s (needs %s): %s", feature.name, feature.capability, feature.effect))
+		}
+	}
+	if len(degraded) > 0 {
+		fmt.Println("\nReduced in this config:")
+		fmt.Println(strings.Join(degraded, "\n"))
+	}
+	return nil
+}
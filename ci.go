@@ -0,0 +1,176 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// WorkflowRun is a GitHub Actions workflow run
+type WorkflowRun struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Conclusion string `json:"conclusion"`
+	HTMLURL    string `json:"html_url"`
+}
+
+// WorkflowJob is a job within a workflow run
+type WorkflowJob struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	Conclusion string `json:"conclusion"`
+	Steps      []struct {
+		Name       string `json:"name"`
+		Conclusion string `json:"conclusion"`
+	} `json:"steps"`
+}
+
+// ciLogTailLines is how much of the end of each failed job's log is sent to the LLM
+const ciLogTailLines = 150
+
+// failedWorkflowRuns lists the failed workflow runs for a commit
+func failedWorkflowRuns(repo string, headSHA string) ([]WorkflowRun, error) {
+	var response struct {
+		WorkflowRuns []WorkflowRun `json:"workflow_runs"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/actions/runs?head_sha=%s&per_page=100", repo, headSHA), nil, &response); err != nil {
+		return nil, err
+	}
+
+	var failed []WorkflowRun
+	for _, run := range response.WorkflowRuns {
+		if run.Conclusion == "failure" || run.Conclusion == "timed_out" {
+			failed = append(failed, run)
+		}
+	}
+	return failed, nil
+}
+
+// failedJobs lists the failed jobs of a workflow run
+func failedJobs(repo string, runID int64) ([]WorkflowJob, error) {
+	var response struct {
+		Jobs []WorkflowJob `json:"jobs"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/actions/runs/%d/jobs?per_page=100", repo, runID), nil, &response); err != nil {
+		return nil, err
+	}
+
+	var failed []WorkflowJob
+	for _, job := range response.Jobs {
+		if job.Conclusion == "failure" || job.Conclusion == "timed_out" {
+			failed = append(failed, job)
+		}
+	}
+	return failed, nil
+}
+
+// relevantLogLines keeps the lines that usually explain a failure plus the tail of the log
+func relevantLogLines(log string) string {
+	lines := strings.Split(log, "\n")
+	start := len(lines) - ciLogTailLines
+	if start < 0 {
+		start = 0
+	}
+
+	var kept []string
+	for _, line := range lines[:start] {
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "error") || strings.Contains(lower, "fail") || strings.Contains(lower, "panic") {
+			kept = append(kept, line)
+		}
+	}
+	if start > 0 {
+		kept = append(kept, "...")
+	}
+	kept = append(kept, lines[start:]...)
+	return strings.Join(kept, "\n")
+}
+
+// collectCIFailures gathers the failed jobs and their logs for a commit into a single report
+func collectCIFailures(repo string, headSHA string) (string, int, error) {
+	runs, err := failedWorkflowRuns(repo, headSHA)
+	if err != nil {
+		return "", 0, err
+	}
+
+	var sb strings.Builder
+	jobCount := 0
+	for _, run := range runs {
+		jobs, err := failedJobs(repo, run.ID)
+		if err != nil {
+			return "", 0, err
+		}
+		for _, job := range jobs {
+			jobCount++
+			var failedSteps []string
+			for _, step := range job.Steps {
+				if step.Conclusion == "failure" {
+					failedSteps = append(failedSteps, step.Name)
+				}
+			}
+			sb.WriteString(fmt.Sprintf("### %s / %s\nFailed steps: %s\n", run.Name, job.Name, strings.Join(failedSteps, ", ")))
+
+			log, err := ghAPIRaw(fmt.Sprintf("repos/%s/actions/jobs/%d/logs", repo, job.ID), "")
+			if err != nil {
+				Log(WARN, "Could not fetch logs for job %s: %v", job.Name, err)
+				sb.WriteString("(logs unavailable)\n\n")
+				continue
+			}
+			sb.WriteString("```\n" + relevantLogLines(log) + "\n```\n\n")
+		}
+	}
+	return sb.String(), jobCount, nil
+}
+
+// runCICommand summarizes why CI failed on a pull request
+func runCICommand(args []string) error {
+	fs := flag.NewFlagSet("ci", flag.ExitOnError)
+	prNumber := fs.Int("pr", 0, "Number of the pull request (default: the PR for the current branch)")
+	post := fs.Bool("post", false, "Post the digest as a PR comment instead of only printing it")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	if *prNumber <= 0 {
+		if *prNumber, err = currentPullRequestNumber(); err != nil {
+			return err
+		}
+	}
+	pr, err := getPullRequest(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+
+	failures, jobCount, err := collectCIFailures(repo, pr.Head.SHA)
+	if err != nil {
+		return err
+	}
+	if jobCount == 0 {
+		fmt.Printf("No failed CI jobs found for PR #%d at %s.\n", *prNumber, pr.Head.SHA)
+		return nil
+	}
+
+	fmt.Printf("Summarizing %d failed CI jobs...\n", jobCount)
+	ctx, stop := interruptContext()
+	defer stop()
+	digest, err := GenerateCIFailureDigest(ctx, failures, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate CI failure digest: %w", err)
+	}
+	digest = "## CI failure digest\n\n" + digest
+
+	fmt.Println(digest)
+	if *post {
+		url, err := postIssueComment(repo, *prNumber, digest)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Comment posted:", url)
+	}
+	return nil
+}
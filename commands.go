@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+// subcommands maps each subcommand name to its entry point. Each receives the
+// arguments that follow the subcommand name.
+var subcommands = map[string]func(args []string) error{
+	"action":       runActionCommand,
+	"attest":       runAttestCommand,
+	"auth":         runAuthCommand,
+	"cache":        runCacheCommand,
+	"capabilities": runCapabilitiesCommand,
+	"ci":           runCICommand,
+	"comment":      runCommentCommand,
+	"config":       runConfigCommand,
+	"digest":       runDigestCommand,
+	"history":      runHistoryCommand,
+	"issue":        runIssueCommand,
+	"mq-check":     runMergeQueueCheckCommand,
+	"phab":         runPhabCommand,
+	"postprocess":  runPostProcessCommand,
+	"prefetch":     runPrefetchCommand,
+	"rangediff":    runRangeDiffCommand,
+	"redact":       runRedactCommand,
+	"rereview":     runReReviewCommand,
+	"review":       runReviewCommand,
+	"serve":        runServeCommand,
+	"srht":         runSourceHutCommand,
+	"sync":         runSyncCommand,
+	"telemetry":    runTelemetryCommand,
+	"templates":    runTemplatesCommand,
+	"tutorial":     runTutorialCommand,
+	"usage":        runUsageCommand,
+	"workspace":    runWorkspaceCommand,
+}
+
+// parseCommandFlags registers the flags shared by all subcommands, parses args,
+// applies the log level, and loads the config
+func parseCommandFlags(fs *flag.FlagSet, args []string) (Config, error) {
+	configPath := fs.String("config", "", "Path to config file (default: search in standard locations)")
+	logLevelFlag := fs.String("log-level", "none", "Set logging level (debug, info, warn, error, none)")
+	llmTimeout := fs.Int("llm-timeout", 0, "Seconds a request to the LLM may take before it's given up on (default: llm.timeout_seconds)")
+	localContextOnly := fs.Bool("local-context-only", false, "Only send commit messages and file paths to the LLM, not file contents")
+	fs.BoolVar(&showCost, "show-cost", false, "Print the tokens used and their estimated cost when done")
+	fs.BoolVar(&refreshCache, "refresh", false, "Fetch metadata from GitHub again instead of using the cache")
+	fs.Var(&resultFormat, "format", "Report the outcome as text, or as a JSON result envelope on stdout with json")
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	SetLogLevelFromFlag(*logLevelFlag)
+	Log(INFO, "Running %s command", fs.Name())
+	config, err := loadConfigFromPrioritizedLocations(*configPath)
+	if err == nil && *llmTimeout != 0 {
+		config.LLM.TimeoutSeconds = *llmTimeout
+	}
+	if err == nil && *localContextOnly {
+		config.LLM.LocalContextOnly = true
+	}
+	return config, err
+}
+
+// stringListFlag is a flag that can be given multiple times, collecting every value
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
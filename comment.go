@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// runCommentCommand generates a PR comment from a prompt and posts it, optionally as a
+// reply in a review thread
+func runCommentCommand(args []string) error {
+	fs := flag.NewFlagSet("comment", flag.ExitOnError)
+	prNumber := fs.Int("pr", 0, "Number of the pull request to comment on")
+	threadID := fs.Int64("thread", 0, "ID of the review comment whose thread to reply in (default: choose interactively)")
+	topLevel := fs.Bool("top-level", false, "Post a top-level comment instead of replying in a review thread")
+	dryRun := fs.Bool("dry-run", false, "Print the generated comment without posting it")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *prNumber <= 0 {
+		return fmt.Errorf("a pull request number is required: gs comment -pr <number> \"<prompt>\"")
+	}
+	prompt := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if prompt == "" {
+		return fmt.Errorf("a prompt describing the comment is required: gs comment -pr <number> \"<prompt>\"")
+	}
+
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	pr, err := getPullRequest(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+	commits, err := getPullRequestCommits(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+	diff, err := getPullRequestDiff(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+
+	var thread *ReviewThread
+	if !*topLevel {
+		threads, err := listReviewThreads(repo, *prNumber)
+		if err != nil {
+			return err
+		}
+		thread, err = selectReviewThread(threads, *threadID)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Generating comment...")
+	ctx, stop := interruptContext()
+	defer stop()
+	comment, err := GeneratePRComment(ctx, prompt, pr, commits, promptDiff(diff, config.LLM), thread, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate comment: %w", err)
+	}
+
+	if *dryRun {
+		fmt.Println("=== Generated Comment (Dry Run) ===")
+		fmt.Println(comment)
+		fmt.Println("===================================")
+		return nil
+	}
+
+	comment, err = editMessage(comment)
+	if err != nil {
+		return err
+	}
+	if comment == "" {
+		fmt.Println("Comment is empty, not posting.")
+		return nil
+	}
+
+	var url string
+	if thread != nil {
+		url, err = replyToReviewComment(repo, *prNumber, thread.Root.ID, comment)
+	} else {
+		url, err = postIssueComment(repo, *prNumber, comment)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Comment posted:", url)
+	return nil
+}
+
+// selectReviewThread returns the thread with the given root comment ID, or asks the user to
+// pick one when no ID was given. A nil thread means a top-level comment.
+func selectReviewThread(threads []ReviewThread, threadID int64) (*ReviewThread, error) {
+	if threadID != 0 {
+		for i := range threads {
+			if threads[i].Root.ID == threadID {
+				return &threads[i], nil
+			}
+			for _, reply := range threads[i].Replies {
+				if reply.ID == threadID {
+					return &threads[i], nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("no review thread contains comment %d", threadID)
+	}
+
+	if len(threads) == 0 {
+		Log(DEBUG, "PR has no review threads, posting a top-level comment")
+		return nil, nil
+	}
+
+	fmt.Println("\nReview threads:")
+	for i, t := range threads {
+		firstLine := strings.SplitN(t.Root.Body, "\n", 2)[0]
+		fmt.Printf("  %d. %s:%d (%s, %d replies) %s\n", i+1, t.Root.Path, t.Root.Line, t.Root.User.Login, len(t.Replies), firstLine)
+	}
+	fmt.Print("Choose a thread to reply in, or press Enter for a top-level comment: ")
+
+	reader := bufio.NewReader(os.Stdin)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(answer)
+	if err != nil || n < 1 || n > len(threads) {
+		return nil, fmt.Errorf("invalid thread number: %s", answer)
+	}
+	return &threads[n-1], nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// commitTypes are the conventional commit types
+var commitTypes = []string{"feat", "fix", "docs", "style", "refactor", "perf", "test", "build", "ci", "chore", "revert"}
+
+// lockFiles are dependency lock files, which only change along with dependencies
+var lockFiles = []string{"go.sum", "package-lock.json", "yarn.lock", "pnpm-lock.yaml", "Cargo.lock", "poetry.lock", "Gemfile.lock", "composer.lock"}
+
+// isTestPath reports whether the file only holds tests
+func isTestPath(p string) bool {
+	base := path.Base(p)
+	return strings.HasSuffix(base, "_test.go") || strings.HasPrefix(base, "test_") || strings.HasSuffix(strings.TrimSuffix(base, path.Ext(base)), "_test") ||
+		strings.Contains(base, ".test.") || strings.Contains(base, ".spec.") ||
+		strings.HasPrefix(p, "test/") || strings.HasPrefix(p, "tests/") || strings.Contains(p, "/test/") || strings.Contains(p, "/tests/") ||
+		strings.Contains(p, "__tests__/") || strings.Contains(p, "testdata/")
+}
+
+// isDocsPath reports whether the file is documentation
+func isDocsPath(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".md", ".rst", ".adoc", ".txt":
+		return true
+	}
+	base := strings.ToUpper(path.Base(p))
+	return strings.HasPrefix(p, "docs/") || strings.HasPrefix(p, "doc/") || base == "LICENSE" || base == "AUTHORS" || base == "CODEOWNERS"
+}
+
+// isDependencyPath reports whether the file is a dependency manifest or lock file
+func isDependencyPath(p string) bool {
+	base := path.Base(p)
+	for _, name := range append(manifestFiles, lockFiles...) {
+		if base == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isCIPath reports whether the file configures CI
+func isCIPath(p string) bool {
+	return strings.HasPrefix(p, ".github/workflows/") || strings.HasPrefix(p, ".circleci/") || strings.HasPrefix(p, ".buildkite/") ||
+		p == ".gitlab-ci.yml" || p == ".travis.yml" || p == "Jenkinsfile" || p == "azure-pipelines.yml"
+}
+
+// isBuildPath reports whether the file configures the build
+func isBuildPath(p string) bool {
+	base := path.Base(p)
+	return base == "Makefile" || strings.HasSuffix(base, ".mk") || strings.HasPrefix(base, "Dockerfile") || base == ".dockerignore" ||
+		base == "BUILD" || base == "BUILD.bazel" || base == "WORKSPACE" || base == "CMakeLists.txt" || base == ".goreleaser.yml"
+}
+
+// isChorePath reports whether the file is repository housekeeping
+func isChorePath(p string) bool {
+	switch path.Base(p) {
+	case ".gitignore", ".gitattributes", ".editorconfig", ".golangci.yml", ".prettierrc", ".eslintrc", ".eslintrc.json", ".pre-commit-config.yaml":
+		return true
+	}
+	return false
+}
+
+// whitespaceOnly reports whether every removed line comes back as an added line that differs only
+// in whitespace
+func whitespaceOnly(files []FileDiff) bool {
+	counts := make(map[string]int)
+	changed := 0
+	for _, file := range files {
+		for _, line := range strings.Split(file.Content, "\n") {
+			if strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++") || len(line) == 0 {
+				continue
+			}
+			normalized := strings.Join(strings.Fields(line[1:]), "")
+			switch line[0] {
+			case '-':
+				counts[normalized]++
+				changed++
+			case '+':
+				counts[normalized]--
+				changed++
+			}
+		}
+	}
+	if changed == 0 {
+		return false
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// classifyCommitType deterministically picks the conventional commit type of a diff when it's
+// clear from the files changed, e.g. only tests or only docs. It returns "" when the change
+// needs reading to classify, such as most code changes.
+func classifyCommitType(files []FileDiff) string {
+	if len(files) == 0 {
+		return ""
+	}
+	if whitespaceOnly(files) {
+		return "style"
+	}
+
+	// Checked in order, so a file that fits several categories counts as the first
+	categories := []struct {
+		commitType string
+		matches    func(string) bool
+	}{
+		{"test", isTestPath},
+		{"build", isDependencyPath},
+		{"ci", isCIPath},
+		{"build", isBuildPath},
+		{"docs", isDocsPath},
+		{"chore", isChorePath},
+	}
+	found := ""
+	for _, file := range files {
+		fileType := ""
+		for _, category := range categories {
+			if category.matches(file.Path) {
+				fileType = category.commitType
+				break
+			}
+		}
+		if fileType == "" || (found != "" && fileType != found) {
+			return ""
+		}
+		found = fileType
+	}
+	return found
+}
+
+// inferCommitType returns the conventional commit type of a diff, asking the LLM only when the
+// files changed don't settle it. It is used for commit messages and can classify any diff.
+func inferCommitType(ctx context.Context, diff string, llmConfig LLMConfig) (string, error) {
+	if commitType := classifyCommitType(splitDiffByFile(diff)); commitType != "" {
+		Log(DEBUG, "Classified commit type %s from the changed files", commitType)
+		return commitType, nil
+	}
+
+	// The type only needs an outline of a change too big to send whole
+	if usePipeline(diff, llmConfig) {
+		llmConfig.LocalContextOnly = true
+	}
+	response, err := GenerateCommitType(ctx, promptDiff(diff, llmConfig), commitTypes, llmConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to classify commit type: %w", err)
+	}
+	commitType := strings.ToLower(strings.Trim(strings.TrimSpace(response), "`\"'."))
+	for _, known := range commitTypes {
+		if commitType == known {
+			Log(DEBUG, "LLM classified commit type as %s", commitType)
+			return commitType, nil
+		}
+	}
+	Log(WARN, "LLM returned unknown commit type %q, leaving the type to generation", response)
+	return "", nil
+}
+
+// enforceCommitType makes the first line start with the commit type, replacing a different type
+// the model chose and keeping any scope it gave
+func enforceCommitType(message string, commitType string) string {
+	if commitType == "" {
+		return message
+	}
+	lines := strings.SplitN(message, "\n", 2)
+	firstLine := strings.TrimSpace(lines[0])
+	prefix := scopePrefixPattern.FindString(firstLine)
+	if prefix == "" {
+		lines[0] = commitType + ": " + firstLine
+	} else if current := strings.FieldsFunc(prefix, func(r rune) bool { return r == '(' || r == '!' || r == ':' })[0]; current != commitType {
+		Log(WARN, "Generated first line uses type %q instead of %q, rewriting it", current, commitType)
+		lines[0] = commitType + firstLine[len(current):]
+	}
+	return strings.Join(lines, "\n")
+}
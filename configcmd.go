@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// configKeyPath returns the path of keys of a config key, which is dotted like llm.model or one
+// of the short names of the GITSCRIBE_* variables, like model
+func configKeyPath(key string) []string {
+	for _, env := range configEnv {
+		if key == strings.ToLower(strings.TrimPrefix(env.name, "GITSCRIBE_")) {
+			key = env.key
+		}
+	}
+	return strings.Split(key, ".")
+}
+
+// configKeyType returns the Go type of the value at a path of keys in Config, so an unknown key
+// or a value of the wrong type is rejected before it's written
+func configKeyType(keys []string) (reflect.Type, error) {
+	t := reflect.TypeOf(Config{})
+	for i, key := range keys {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+			continue
+		case reflect.Struct:
+		default:
+			return nil, fmt.Errorf("%s is a %s, not an object with keys", strings.Join(keys[:i], "."), configTypeName(t))
+		}
+		found := false
+		for f := 0; f < t.NumField(); f++ {
+			field := t.Field(f)
+			if name := strings.Split(field.Tag.Get("json"), ",")[0]; name == key && name != "-" {
+				t, found = field.Type, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown config key %s", strings.Join(keys[:i+1], "."))
+		}
+	}
+	return t, nil
+}
+
+// configTypeName describes a type of config value to the user
+func configTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return configTypeName(t.Elem())
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		return "number"
+	case reflect.Slice:
+		return "JSON list"
+	}
+	return "JSON object"
+}
+
+// parseConfigValue decodes a value given on the command line for a key of type t. Strings are
+// taken as they are and everything else as JSON.
+func parseConfigValue(t reflect.Type, text string) (interface{}, error) {
+	if t.Kind() == reflect.String {
+		return text, nil
+	}
+	if err := json.Unmarshal([]byte(text), reflect.New(t).Interface()); err != nil {
+		return nil, fmt.Errorf("%s isn't a valid value, use a %s", text, configTypeName(t))
+	}
+	var value interface{}
+	json.Unmarshal([]byte(text), &value)
+	return value, nil
+}
+
+// configTargetFlags registers the flags that choose which config file gs config set and unset
+// write, and returns a function that resolves it after parsing
+func configTargetFlags(fs *flag.FlagSet) func() (string, error) {
+	global := fs.Bool("global", false, "Write the global config, ~/.gitscribe/.gitscribe_config.json")
+	repo := fs.Bool("repo", false, "Write the repository's .gitscribe_config.json")
+	path := fs.String("config", "", "Config file to write (default: the repository's if it has one, else the global one)")
+	logLevelFlag := fs.String("log-level", "none", "Set logging level (debug, info, warn, error, none)")
+	return func() (string, error) {
+		SetLogLevelFromFlag(*logLevelFlag)
+		if *path == "" {
+			*path = os.Getenv("GITSCRIBE_CONFIG")
+		}
+		switch {
+		case *global && *repo:
+			return "", fmt.Errorf("-global and -repo can't be used together")
+		case *path != "":
+			return expandPath(*path), nil
+		case *repo:
+			if existing := repoConfigPath(); existing != "" {
+				return existing, nil
+			}
+			output, err := newCommand("git", "rev-parse", "--show-toplevel").Output()
+			if err != nil {
+				return "", newError(ErrGitState, "not in a git repository: %v", err)
+			}
+			return filepath.Join(strings.TrimSpace(string(output)), repoConfigName), nil
+		case !*global:
+			if existing := repoConfigPath(); existing != "" {
+				return existing, nil
+			}
+		}
+		if existing := globalConfigPath(); existing != "" {
+			return existing, nil
+		}
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to find home directory: %v", err)
+		}
+		return filepath.Join(home, ".gitscribe", ".gitscribe_config.json"), nil
+	}
+}
+
+// repoConfigTarget reports whether a config file to write is the repository's, which may not
+// exist yet
+func repoConfigTarget(path string) bool {
+	if _, err := os.Stat(path); err == nil {
+		return isRepoLayer(path)
+	}
+	output, err := newCommand("git", "rev-parse", "--show-toplevel").Output()
+	return err == nil && filepath.Clean(path) == filepath.Join(strings.TrimSpace(string(output)), repoConfigName)
+}
+
+// editConfigFile changes the JSON object in a config file, creating the file if needed, and
+// keeps the old contents if the config doesn't load afterwards
+func editConfigFile(path string, edit func(raw map[string]interface{}) error) error {
+	old, readErr := ioutil.ReadFile(path)
+	raw := make(map[string]interface{})
+	if readErr == nil {
+		if err := json.Unmarshal(old, &raw); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	}
+	if err := edit(raw); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	// The file is checked with the layers it's merged with, if it's one of them
+	layers := []string{path}
+	for _, layer := range configLayers() {
+		if sameFile(layer, path) {
+			layers = configLayers()
+			break
+		}
+	}
+	if _, err := loadConfig(layers...); err != nil {
+		if readErr == nil {
+			ioutil.WriteFile(path, old, 0600)
+		} else {
+			os.Remove(path)
+		}
+		return fmt.Errorf("not changing %s: %v", path, err)
+	}
+	return nil
+}
+
+// runConfigSetCommand sets a key in a config file
+func runConfigSetCommand(args []string) error {
+	fs := flag.NewFlagSet("config set", flag.ExitOnError)
+	target := configTargetFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: gs config set [-global|-repo] <key> <value>")
+	}
+	path, err := target()
+	if err != nil {
+		return err
+	}
+	keys := configKeyPath(fs.Arg(0))
+	t, err := configKeyType(keys)
+	if err != nil {
+		return err
+	}
+	value, err := parseConfigValue(t, fs.Arg(1))
+	if err != nil {
+		return fmt.Errorf("%s: %v", strings.Join(keys, "."), err)
+	}
+	if repoConfigTarget(path) && !repoConfigAllows(keys) {
+		return newError(ErrUsage, "%s can't be set in the repository's config, which would ignore it: use -global", strings.Join(keys, "."))
+	}
+	err = editConfigFile(path, func(raw map[string]interface{}) error {
+		if parent, ok := nestedValue(raw, keys[:len(keys)-1]); ok {
+			if _, isObject := parent.(map[string]interface{}); !isObject {
+				return fmt.Errorf("%s in %s isn't an object", strings.Join(keys[:len(keys)-1], "."), path)
+			}
+		}
+		setNestedValue(raw, keys, value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Set %s in %s.\n", strings.Join(keys, "."), path)
+	return nil
+}
+
+// runConfigUnsetCommand removes a key from a config file
+func runConfigUnsetCommand(args []string) error {
+	fs := flag.NewFlagSet("config unset", flag.ExitOnError)
+	target := configTargetFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gs config unset [-global|-repo] <key>")
+	}
+	path, err := target()
+	if err != nil {
+		return err
+	}
+	keys := configKeyPath(fs.Arg(0))
+	if _, err := configKeyType(keys); err != nil {
+		return err
+	}
+	err = editConfigFile(path, func(raw map[string]interface{}) error {
+		if _, ok := nestedValue(raw, keys); !ok {
+			return fmt.Errorf("%s isn't set in %s", strings.Join(keys, "."), path)
+		}
+		deleteNestedValue(raw, keys)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Removed %s from %s.\n", strings.Join(keys, "."), path)
+	return nil
+}
+
+// runConfigGetCommand prints the value a key has in the merged config, defaults included
+func runConfigGetCommand(args []string) error {
+	fs := flag.NewFlagSet("config get", flag.ExitOnError)
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gs config get <key>")
+	}
+	keys := configKeyPath(fs.Arg(0))
+	if _, err := configKeyType(keys); err != nil {
+		return err
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(data, &raw)
+	value, ok := nestedValue(raw, keys)
+	if !ok || value == nil {
+		return fmt.Errorf("%s isn't set", strings.Join(keys, "."))
+	}
+	if text, isString := value.(string); isString {
+		fmt.Println(text)
+		return nil
+	}
+	encoded, _ := json.MarshalIndent(value, "", "  ")
+	fmt.Println(string(encoded))
+	return nil
+}
+
+// runConfigListCommand prints every key set in the config files and the environment, and where
+// each value comes from. Credentials are masked.
+func runConfigListCommand(args []string) error {
+	fs := flag.NewFlagSet("config list", flag.ExitOnError)
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	merged, err := mergeConfigLayers(config.Layers)
+	if err != nil {
+		return err
+	}
+	keys, _ := parseJSONKeys(merged)
+	origins := make(map[string]string)
+	unexpanded := make(map[string]string)
+	for _, layer := range config.Layers {
+		data, _ := ioutil.ReadFile(layer)
+		layerKeys, _ := parseJSONKeys(data)
+		for key, value := range layerKeys {
+			origins[key] = layer
+			unexpanded[key] = value
+		}
+	}
+	for _, env := range configEnv {
+		if os.Getenv(env.name) != "" {
+			origins[env.key] = env.name
+			delete(unexpanded, env.key)
+		}
+	}
+	secrets := make(map[string]bool)
+	for _, secret := range personalConfigKeys {
+		secrets[strings.Join(secret, ".")] = true
+	}
+
+	var names []string
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		value := keys[key]
+		// Values taken from the environment are shown as written, as they're often secrets
+		if raw := unexpanded[key]; configVar.MatchString(raw) {
+			value = raw
+		}
+		if secrets[key] {
+			value = "(set)"
+		}
+		fmt.Printf("%s=%s  (%s)\n", key, value, origins[key])
+	}
+	return nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// repoConfigName is the name of the config file a repository can commit to share settings
+const repoConfigName = ".gitscribe_config.json"
+
+// repoConfigKeys are the keys a repository's committed config may set: the conventions a team
+// shares. true allows a key and everything in it, an object only the keys it lists. Endpoints,
+// keys, commands, consent, telemetry, registries, recipients, the judge and the model policy
+// only come from the user's own config, so cloning a repository can't send their key or data
+// elsewhere, run programs or loosen their checks.
+var repoConfigKeys = map[string]interface{}{
+	"commit_template":   true,
+	"pr_template":       true,
+	"pr_area_templates": true,
+	"human_sections":    true,
+	"calendar":          true,
+	"commit_format":     true,
+	"commit_budget":     true,
+	"pr_graph":          true,
+	"architecture":      true,
+	"security":          true,
+	"owners":            true,
+	"license":           true,
+	"review_effort":     true,
+	"vendor":            true,
+	"toolchain":         true,
+	"infra":             map[string]interface{}{"enabled": true},
+	"follow_ups":        true,
+	"redaction":         map[string]interface{}{"packs": true, "rules": true}, // added to the user's, see appendRepoRedaction
+	"post_process":      true,                                                 // without command steps, see dropCommandSteps
+	"merge_queue":       true,
+	"vcs":               true,
+	"model_policy":      map[string]interface{}{"classification": true},
+	"llm": map[string]interface{}{
+		"model": true, "temperature": true, "max_tokens": true, "enable_questions": true,
+		"local_context_only": true, "pipeline": true, "vision": true, "structured_diffs": true,
+		"prose_diffs": true, "model_tiers": true, "context_window": true, "language": true,
+		"commit": true, "pr": true,
+	},
+}
+
+// configEnv are the environment variables that override keys of the config files. Flags
+// override them in turn.
+var configEnv = []struct {
+	name string
+	key  string
+	kind string // "string", "number" or "bool"
+}{
+	{"GITSCRIBE_PROVIDER", "llm.provider", "string"},
+	{"GITSCRIBE_MODEL", "llm.model", "string"},
+	{"GITSCRIBE_ENDPOINT", "llm.endpoint", "string"},
+	{"GITSCRIBE_TEMPERATURE", "llm.temperature", "number"},
+	{"GITSCRIBE_MAX_TOKENS", "llm.max_tokens", "number"},
+	{"GITSCRIBE_OFFLINE", "offline", "bool"},
+}
+
+// globalConfigPath returns the user's own config file: ~/.gitscribe/.gitscribe_config.json, or
+// the one next to the executable. It returns "" if there's neither.
+func globalConfigPath() string {
+	var locations []string
+	if home, err := os.UserHomeDir(); err == nil {
+		locations = append(locations, filepath.Join(home, ".gitscribe", ".gitscribe_config.json"))
+	} else {
+		Log(WARN, "Could not get user home directory: %v", err)
+	}
+	if execPath, err := os.Executable(); err == nil {
+		locations = append(locations, filepath.Join(filepath.Dir(execPath), ".gitscribe_config.json"))
+	} else {
+		Log(WARN, "Could not get executable path: %v", err)
+	}
+	for _, location := range locations {
+		if _, err := os.Stat(location); err == nil {
+			return location
+		}
+		Log(DEBUG, "No global config at %s", location)
+	}
+	return ""
+}
+
+// repoConfigPath returns the nearest .gitscribe_config.json from the working directory up to
+// the repository root, or "" if there's none
+func repoConfigPath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	root := dir
+	if output, err := newCommand("git", "rev-parse", "--show-toplevel").Output(); err == nil {
+		root = filepath.Clean(strings.TrimSpace(string(output)))
+	}
+	for {
+		location := filepath.Join(dir, repoConfigName)
+		if _, err := os.Stat(location); err == nil {
+			return location
+		}
+		parent := filepath.Dir(dir)
+		if dir == root || parent == dir || !strings.HasPrefix(dir, root) {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// configLayers returns the config files to merge, the global one first
+func configLayers() []string {
+	var layers []string
+	if global := globalConfigPath(); global != "" {
+		layers = append(layers, global)
+	}
+	if repo := repoConfigPath(); repo != "" && (len(layers) == 0 || !sameFile(layers[0], repo)) {
+		layers = append(layers, repo)
+	}
+	return layers
+}
+
+// isRepoLayer reports whether a config file is the one committed to the repository, which whoever
+// controls the repository wrote
+func isRepoLayer(path string) bool {
+	repo := repoConfigPath()
+	if repo == "" || !sameFile(path, repo) {
+		return false
+	}
+	global := globalConfigPath()
+	return global == "" || !sameFile(path, global)
+}
+
+// filterRepoLayer removes the keys of a repository's config that only the user's own config may
+// set, as repoConfigKeys lists them
+func filterRepoLayer(layer map[string]interface{}, allowed map[string]interface{}, prefix string, path string) {
+	for key, value := range layer {
+		switch rule := allowed[key].(type) {
+		case bool:
+			continue
+		case map[string]interface{}:
+			if object, ok := value.(map[string]interface{}); ok {
+				filterRepoLayer(object, rule, prefix+key+".", path)
+				continue
+			}
+		}
+		Log(WARN, "Ignoring %s%s in %s: only your own config can set it", prefix, key, path)
+		delete(layer, key)
+	}
+}
+
+// repoConfigAllows reports whether a repository's config may set a key, given as its path
+func repoConfigAllows(keys []string) bool {
+	allowed := repoConfigKeys
+	for _, key := range keys {
+		switch rule := allowed[key].(type) {
+		case bool:
+			return true
+		case map[string]interface{}:
+			allowed = rule
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// dropCommandSteps removes the post-processing steps of a repository's config that run programs
+func dropCommandSteps(layer map[string]interface{}, path string) {
+	postProcess, _ := layer["post_process"].(map[string]interface{})
+	for kind, value := range postProcess {
+		steps, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		var kept []interface{}
+		for _, step := range steps {
+			object, _ := step.(map[string]interface{})
+			if name, _ := object["step"].(string); name == "command" {
+				Log(WARN, "Ignoring the command step of post_process.%s in %s: only your own config can run programs", kind, path)
+				continue
+			}
+			kept = append(kept, step)
+		}
+		postProcess[kind] = kept
+	}
+}
+
+// appendRepoRedaction adds the redaction packs and rules of a repository's config to the user's
+// own instead of replacing them, so a repository can redact more but never less. Pack files have
+// to be in the repository.
+func appendRepoRedaction(merged map[string]interface{}, layer map[string]interface{}, path string) error {
+	redaction, ok := layer["redaction"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	delete(layer, "redaction")
+	existing, ok := merged["redaction"].(map[string]interface{})
+	if !ok {
+		existing = make(map[string]interface{})
+		merged["redaction"] = existing
+	}
+	packs, _ := redaction["packs"].([]interface{})
+	for i, pack := range packs {
+		name, _ := pack.(string)
+		if _, builtin := builtinRedactionPacks[name]; name == "" || builtin {
+			continue
+		}
+		resolved, err := repoFilePath(path, name)
+		if err != nil {
+			return err
+		}
+		packs[i] = resolved
+	}
+	for _, key := range []string{"packs", "rules"} {
+		added, _ := redaction[key].([]interface{})
+		if len(added) == 0 {
+			continue
+		}
+		list, _ := existing[key].([]interface{})
+		existing[key] = append(list, added...)
+	}
+	return nil
+}
+
+// repoFilePath resolves a file a repository's config refers to, relative to the config. Files
+// outside the repository, such as ~/.ssh or /etc, would be sent to the provider, so they're
+// refused.
+func repoFilePath(configPath string, p string) (string, error) {
+	dir := filepath.Dir(configPath)
+	root := dir
+	if output, err := newCommand("git", "-C", dir, "rev-parse", "--show-toplevel").Output(); err == nil {
+		root = filepath.Clean(strings.TrimSpace(string(output)))
+	}
+	resolved := filepath.Join(dir, p)
+	if real, err := filepath.EvalSymlinks(resolved); err == nil {
+		resolved = real
+	}
+	if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+		root = realRoot
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if filepath.IsAbs(p) || strings.HasPrefix(p, "~") || err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s in %s is outside the repository: a repository's config can only refer to its own files", p, configPath)
+	}
+	return filepath.Join(dir, p), nil
+}
+
+// userConfigPath returns the file the user's own state is written to: the last layer that isn't
+// the repository's, or where the global config goes if there's none yet
+func userConfigPath(layers []string) string {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if !isRepoLayer(layers[i]) {
+			return layers[i]
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".gitscribe", ".gitscribe_config.json")
+	}
+	return filepath.Join(".gitscribe", ".gitscribe_config.json")
+}
+
+// sameFile reports whether two paths name the same file
+func sameFile(a string, b string) bool {
+	aInfo, aErr := os.Stat(a)
+	bInfo, bErr := os.Stat(b)
+	return aErr == nil && bErr == nil && os.SameFile(aInfo, bInfo)
+}
+
+// mergeConfigLayers reads the config files in order, each overriding the keys the earlier ones
+// set, applies the environment overrides and returns the result as one JSON config
+func mergeConfigLayers(paths []string) ([]byte, error) {
+	merged := make(map[string]interface{})
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		var layer map[string]interface{}
+		if err := json.Unmarshal(data, &layer); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+		}
+		// Whoever wrote the repository's config mustn't be able to copy the user's environment into
+		// requests, so only the user's own files are expanded
+		if !isRepoLayer(path) {
+			layer = expandConfigVars(layer).(map[string]interface{})
+		} else {
+			filterRepoLayer(layer, repoConfigKeys, "", path)
+			dropCommandSteps(layer, path)
+			moveRepoClassification(layer)
+			// Templates of the repo's config are kept in the repo, next to it
+			if err := rewriteTemplatePaths(layer, func(p string) (string, error) {
+				return repoFilePath(path, p)
+			}); err != nil {
+				return nil, err
+			}
+			if calendar, ok := layer["calendar"].(map[string]interface{}); ok {
+				if p, ok := calendar["sprint_file"].(string); ok && p != "" {
+					if calendar["sprint_file"], err = repoFilePath(path, p); err != nil {
+						return nil, err
+					}
+				}
+			}
+			if err := appendRepoRedaction(merged, layer, path); err != nil {
+				return nil, err
+			}
+		}
+		mergeConfigObjects(merged, layer)
+		Log(DEBUG, "Merged config layer %s", path)
+	}
+	if err := applyConfigEnv(merged); err != nil {
+		return nil, err
+	}
+	return json.Marshal(merged)
+}
+
+// configVar matches ${NAME} and ${NAME:-default} in config values, and $${NAME} for a literal
+// ${NAME}
+var configVar = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_]*)(?::-([^}]*))?\}`)
+
+// expandConfigVars replaces the environment variables referred to in the strings of a config
+// value, so a committed config can take secrets and URLs from each user's environment. Variables
+// are read as envOrFile reads them, so NAME_FILE works too.
+func expandConfigVars(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = expandConfigVars(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = expandConfigVars(item)
+		}
+	case string:
+		return configVar.ReplaceAllStringFunc(v, func(match string) string {
+			parts := configVar.FindStringSubmatch(match)
+			if parts[1] != "" {
+				return match[1:]
+			}
+			if expanded := envOrFile(parts[2]); expanded != "" {
+				return expanded
+			}
+			if !strings.Contains(match, ":-") {
+				Log(WARN, "The config refers to ${%s}, which isn't set", parts[2])
+			}
+			return parts[3]
+		})
+	}
+	return value
+}
+
+// mergeConfigObjects overrides the keys of base with those of layer. Objects are merged key by
+// key and everything else, lists too, is replaced.
+func mergeConfigObjects(base map[string]interface{}, layer map[string]interface{}) {
+	for key, value := range layer {
+		object, isObject := value.(map[string]interface{})
+		existing, hasObject := base[key].(map[string]interface{})
+		if isObject && hasObject {
+			mergeConfigObjects(existing, object)
+			continue
+		}
+		base[key] = value
+	}
+}
+
+// applyConfigEnv sets the config keys given in the environment
+func applyConfigEnv(raw map[string]interface{}) error {
+	for _, env := range configEnv {
+		value := os.Getenv(env.name)
+		if value == "" {
+			continue
+		}
+		var parsed interface{} = value
+		switch env.kind {
+		case "number":
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%s=%s isn't a number", env.name, value)
+			}
+			parsed = number
+		case "bool":
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%s=%s isn't true or false", env.name, value)
+			}
+			parsed = flag
+		}
+		Log(DEBUG, "Setting %s from %s", env.key, env.name)
+		setNestedValue(raw, strings.Split(env.key, "."), parsed)
+	}
+	return nil
+}
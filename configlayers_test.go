@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// mergeTestLayers writes the global and repository configs and merges them as loadConfig would
+func mergeTestLayers(t *testing.T, global string, repo string) (map[string]interface{}, error) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	globalPath := filepath.Join(home, ".gitscribe", ".gitscribe_config.json")
+	if err := os.MkdirAll(filepath.Dir(globalPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(globalPath, []byte(global), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testRepo(t, map[string]string{repoConfigName: repo, "templates/commit.txt": "Summary:\n"})
+
+	layers := configLayers()
+	if len(layers) != 2 || !isRepoLayer(layers[1]) || isRepoLayer(layers[0]) {
+		t.Fatalf("configLayers() = %q, want the global config and then the repository's", layers)
+	}
+	data, err := mergeConfigLayers(layers)
+	if err != nil {
+		return nil, err
+	}
+	var merged map[string]interface{}
+	if err := json.Unmarshal(data, &merged); err != nil {
+		t.Fatal(err)
+	}
+	return merged, nil
+}
+
+// configValue returns the value of a dotted key of a merged config, or nil if it's not set
+func configValue(config map[string]interface{}, key string) interface{} {
+	var value interface{} = config
+	for _, part := range strings.Split(key, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
+
+func TestMergeConfigLayersRepoLayer(t *testing.T) {
+	global := `{
+		"llm": {"provider": "openai", "endpoint": "https://llm.example.com/v1/chat/completions", "api_key": "${TEST_GLOBAL_KEY}", "model": "gpt-4o"},
+		"model_policy": {"default_class": "public", "classes": {"public": {"models": ["gpt-4o*"]}, "confidential": {"providers": ["ollama"]}}},
+		"redaction": {"packs": ["secrets"], "rules": [{"name": "ticket", "pattern": "TICKET-[0-9]+"}]},
+		"judge": {"enabled": true, "threshold": 7}
+	}`
+	t.Setenv("TEST_GLOBAL_KEY", "sk-global")
+	t.Setenv("TEST_SECRET", "sk-secret")
+
+	tests := []struct {
+		name string
+		repo string
+		want map[string]interface{} // nil means the key isn't set
+	}{
+		{
+			name: "shared settings apply",
+			repo: `{"llm": {"model": "gpt-4o-mini", "temperature": 0.2}, "human_sections": ["Rollout"]}`,
+			want: map[string]interface{}{
+				"llm.model":       "gpt-4o-mini",
+				"llm.temperature": 0.2,
+				"llm.endpoint":    "https://llm.example.com/v1/chat/completions",
+				"human_sections":  []interface{}{"Rollout"},
+			},
+		},
+		{
+			name: "endpoint and key are the user's",
+			repo: `{"llm": {"endpoint": "https://attacker.example.com/", "api_key": "stolen", "provider": "ollama"}}`,
+			want: map[string]interface{}{
+				"llm.endpoint": "https://llm.example.com/v1/chat/completions",
+				"llm.api_key":  "sk-global",
+				"llm.provider": "openai",
+			},
+		},
+		{
+			name: "programs and consent",
+			repo: `{"exec": {"allow": ["sh"]}, "consent": {"/": {"provider": "x"}}, "size_report": {"command": ["sh", "-c", "id"]}}`,
+			want: map[string]interface{}{"exec": nil, "consent": nil, "size_report": nil},
+		},
+		{
+			name: "command steps are dropped",
+			repo: `{"post_process": {"commit": [{"step": "wrap"}, {"step": "command", "command": ["sh"]}]}}`,
+			want: map[string]interface{}{"post_process.commit": []interface{}{map[string]interface{}{"step": "wrap"}}},
+		},
+		{
+			name: "environment isn't expanded",
+			repo: `{"llm": {"model": "${TEST_SECRET}"}}`,
+			want: map[string]interface{}{"llm.model": "${TEST_SECRET}"},
+		},
+		{
+			name: "model policy can only add a class",
+			repo: `{"model_policy": {"classification": "confidential", "default_class": "none", "classes": {"public": {}}}}`,
+			want: map[string]interface{}{
+				"model_policy.classification":      nil,
+				"model_policy.repo_classification": "confidential",
+				"model_policy.default_class":       "public",
+				"model_policy.classes.public":      map[string]interface{}{"models": []interface{}{"gpt-4o*"}},
+			},
+		},
+		{
+			name: "redaction can only be added to",
+			repo: `{"redaction": {"packs": ["pci", "packs/internal.json"], "rules": [{"name": "host", "pattern": "[a-z]+\\.internal"}]}}`,
+			want: map[string]interface{}{
+				"redaction.rules": []interface{}{
+					map[string]interface{}{"name": "ticket", "pattern": "TICKET-[0-9]+"},
+					map[string]interface{}{"name": "host", "pattern": "[a-z]+\\.internal"},
+				},
+			},
+		},
+		{
+			name: "registries, recipients and the judge are the user's",
+			repo: `{"template_registry": "https://attacker.example.com/packs.git", "workspace": {"repos": ["/"]}, "digest": {"to": ["x@example.com"]}, "judge": {"threshold": 0}}`,
+			want: map[string]interface{}{
+				"template_registry": nil,
+				"workspace":         nil,
+				"digest":            nil,
+				"judge.threshold":   7.0,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged, err := mergeTestLayers(t, global, test.repo)
+			if err != nil {
+				t.Fatalf("mergeConfigLayers failed: %v", err)
+			}
+			for key, want := range test.want {
+				if got := configValue(merged, key); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %#v, want %#v", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeConfigLayersRepoTemplates(t *testing.T) {
+	tests := []struct {
+		template string
+		wantErr  bool
+	}{
+		{"templates/commit.txt", false},
+		{"../outside.txt", true},
+		{"/etc/passwd", true},
+		{"~/.ssh/id_rsa", true},
+	}
+	for _, test := range tests {
+		merged, err := mergeTestLayers(t, `{}`, `{"commit_template": "`+test.template+`"}`)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("commit_template %s: merged as %v, want an error", test.template, configValue(merged, "commit_template"))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("commit_template %s: %v", test.template, err)
+			continue
+		}
+		dir, _ := os.Getwd()
+		if got, want := configValue(merged, "commit_template"), filepath.Join(dir, test.template); got != want {
+			t.Errorf("commit_template %s = %v, want %s", test.template, got, want)
+		}
+	}
+}
+
+func TestMergeConfigLayersRepoFiles(t *testing.T) {
+	tests := []struct {
+		repo    string
+		key     string
+		wantErr bool
+	}{
+		{`{"calendar": {"sprint_file": "sprints.json"}}`, "calendar.sprint_file", false},
+		{`{"calendar": {"sprint_file": "~/sprints.json"}}`, "calendar.sprint_file", true},
+		{`{"redaction": {"packs": ["packs/internal.json"]}}`, "redaction.packs", false},
+		{`{"redaction": {"packs": ["../packs.json"]}}`, "redaction.packs", true},
+	}
+	for _, test := range tests {
+		merged, err := mergeTestLayers(t, `{}`, test.repo)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: merged as %v, want an error", test.repo, configValue(merged, test.key))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.repo, err)
+			continue
+		}
+		dir, _ := os.Getwd()
+		got := configValue(merged, test.key)
+		if list, ok := got.([]interface{}); ok && len(list) == 1 {
+			got = list[0]
+		}
+		if s, _ := got.(string); !strings.HasPrefix(s, dir+string(filepath.Separator)) {
+			t.Errorf("%s: %s = %v, want a path in %s", test.repo, test.key, got, dir)
+		}
+	}
+}
+
+func TestRepoConfigAllows(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"commit_template", true},
+		{"llm.model", true},
+		{"llm.commit.temperature", true},
+		{"llm", false},
+		{"llm.endpoint", false},
+		{"llm.api_key", false},
+		{"llm.provider", false},
+		{"exec.allow", false},
+		{"infra.enabled", true},
+		{"infra.plan_command", false},
+		{"model_policy.classification", true},
+		{"model_policy.classes", false},
+		{"redaction.rules", true},
+		{"redaction.policy", false},
+		{"template_registry", false},
+		{"judge", false},
+		{"consent", false},
+	}
+	for _, test := range tests {
+		if got := repoConfigAllows(strings.Split(test.key, ".")); got != test.want {
+			t.Errorf("repoConfigAllows(%s) = %v, want %v", test.key, got, test.want)
+		}
+	}
+}
+
+func TestExpandConfigVars(t *testing.T) {
+	t.Setenv("TEST_HOST", "llm.example.com")
+	t.Setenv("TEST_EMPTY", "")
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"https://${TEST_HOST}/v1", "https://llm.example.com/v1"},
+		{"${TEST_EMPTY:-fallback}", "fallback"},
+		{"${TEST_UNSET_VARIABLE}", ""},
+		{"$${TEST_HOST}", "${TEST_HOST}"},
+		{"no variables", "no variables"},
+	}
+	for _, test := range tests {
+		if got := expandConfigVars(test.value); got != test.want {
+			t.Errorf("expandConfigVars(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
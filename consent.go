@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// llmProvider names where prompts are sent, for consent prompts
+func llmProvider(llmConfig LLMConfig) string {
+	endpoint := chatEndpoint(llmConfig)
+	if llmConfig.Provider == "mock" {
+		return "the mock provider"
+	}
+	if endpoint == defaultChatEndpoint {
+		return "OpenAI (api.openai.com)"
+	}
+	u, err := url.Parse(endpoint)
+	if err == nil && u.Host != "" && llmConfig.Provider == "ollama" {
+		return "Ollama (" + u.Host + ")"
+	}
+	if err == nil && u.Host != "" {
+		return u.Host
+	}
+	return endpoint
+}
+
+// ConsentRecord is the consent given for a repository to send data to a provider
+type ConsentRecord struct {
+	Provider   string   `json:"provider"`
+	Categories []string `json:"categories"`
+	GrantedAt  string   `json:"granted_at"`
+}
+
+// consentCategories lists the kinds of data the command will send to the provider
+func consentCategories(generatePR bool, config Config) []string {
+	var categories []string
+	if generatePR {
+		categories = append(categories, "commit messages on the branch", "PR template")
+		if config.Toolchain.Enabled || config.Infra.Enabled || config.LLM.Pipeline.Enabled {
+			categories = append(categories, fileCategory(config.LLM))
+		}
+		if config.Vendor.SummarizeUpstream {
+			categories = append(categories, "upstream release notes of bumped dependencies")
+		}
+	} else {
+		categories = append(categories, fileCategory(config.LLM), "commit template")
+	}
+	if config.LLM.Vision.Enabled && !config.LLM.LocalContextOnly {
+		categories = append(categories, "changed images, such as screenshots")
+	}
+	return categories
+}
+
+// fileCategory describes how much of the changed files is sent
+func fileCategory(llmConfig LLMConfig) string {
+	if llmConfig.LocalContextOnly {
+		return "changed file paths and line counts"
+	}
+	return "diffs of changed files, including their contents"
+}
+
+// repoRoot returns the top-level directory of the current git repository
+func repoRoot() (string, error) {
+	// A bare repository has no top level, so it's known by its git directory
+	args := []string{"rev-parse", "--show-toplevel"}
+	if worktreeless() {
+		args = []string{"rev-parse", "--absolute-git-dir"}
+	}
+	output, err := newCommand("git", args...).Output()
+	if err != nil {
+		return "", newError(ErrGitState, "not in a git repository: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// hasConsent reports whether every category was already consented to for this provider
+func hasConsent(record ConsentRecord, provider string, categories []string) bool {
+	if record.Provider != provider {
+		return false
+	}
+	granted := make(map[string]bool, len(record.Categories))
+	for _, category := range record.Categories {
+		granted[category] = true
+	}
+	for _, category := range categories {
+		if !granted[category] {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	// consentMu keeps requests sent in parallel from asking for consent at once
+	consentMu sync.Mutex
+	// consentedProviders are the providers consent was checked for in this run
+	consentedProviders = map[string]bool{}
+	// consentForPR is whether the run sends a branch's commits rather than a commit's changes,
+	// for the data consent is asked for when a request is sent before ensureConsent was called
+	consentForPR = true
+	// serverConsent is set in server mode, whose operator picked the repositories it handles and
+	// where there's no one to ask
+	serverConsent bool
+)
+
+// ensureConsent checks the user has agreed to send this data from this repo, asking the first
+// time and recording the answer in the config file
+func ensureConsent(generatePR bool, config Config) error {
+	consentMu.Lock()
+	defer consentMu.Unlock()
+	consentForPR = generatePR
+	return askConsent(generatePR, config)
+}
+
+// requireConsent checks consent was given to send data to the provider of a request, which is
+// checked before each one. Commands that didn't call ensureConsent are asked here, and so are
+// fallback models at another provider.
+func requireConsent(llmConfig LLMConfig) error {
+	if serverConsent || llmConfig.Provider == "mock" {
+		return nil
+	}
+	consentMu.Lock()
+	defer consentMu.Unlock()
+	if consentedProviders[llmProvider(llmConfig)] {
+		return nil
+	}
+	if loadedConfig == nil {
+		return fmt.Errorf("no config is loaded, so consent to send data to %s can't be checked", llmProvider(llmConfig))
+	}
+	config := *loadedConfig
+	config.LLM = llmConfig
+	return askConsent(consentForPR, config)
+}
+
+// askConsent asks for consent unless it was given before. consentMu must be held.
+func askConsent(generatePR bool, config Config) error {
+	if config.LLM.Provider == "mock" {
+		// Nothing leaves the machine
+		return nil
+	}
+	// There's no point asking to send data where the model policy won't let it go
+	if err := checkModelPolicy(config.LLM); err != nil {
+		return err
+	}
+	root, err := repoRoot()
+	if err != nil {
+		// Patch files can be described outside a repository; consent is then per directory
+		if root, err = os.Getwd(); err != nil {
+			return err
+		}
+	}
+	provider := llmProvider(config.LLM)
+	categories := consentCategories(generatePR, config)
+	record, ok := config.Consent[root]
+	if ok && hasConsent(record, provider, categories) {
+		consentedProviders[provider] = true
+		return nil
+	}
+	if ok {
+		// Keep what was agreed before so switching between modes doesn't ask again
+		categories = mergeCategories(record.Categories, categories)
+	}
+
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		// A CI job's workflow decides what it sends, and there's no one to ask
+		if os.Getenv("GITSCRIBE_CONSENT") == "yes" {
+			Log(INFO, "Sending data from %s to %s, as GITSCRIBE_CONSENT is yes", root, provider)
+			consentedProviders[provider] = true
+			return nil
+		}
+		return fmt.Errorf("consent is needed to send data from %s to %s. Run gs interactively once in this repository to give it", root, provider)
+	}
+
+	fmt.Printf("\nGitScribe will send the following from %s to %s:\n", root, provider)
+	for _, category := range consentCategories(generatePR, config) {
+		fmt.Printf("  - %s\n", category)
+	}
+	if !config.LLM.LocalContextOnly {
+		fmt.Println("Use -local-context-only to send file paths instead of file contents.")
+	}
+	fmt.Print("Allow this for this repository? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		return fmt.Errorf("consent not given, nothing was sent")
+	}
+
+	record = ConsentRecord{Provider: provider, Categories: categories, GrantedAt: time.Now().UTC().Format(time.RFC3339)}
+	if err := saveConsent(config.Path, root, record); err != nil {
+		Log(WARN, "Failed to record consent: %v", err)
+		fmt.Println("Warning: couldn't save your answer to the config, you'll be asked again next time:", err)
+	}
+	consentedProviders[provider] = true
+	return nil
+}
+
+// mergeCategories returns the categories in either list, without duplicates
+func mergeCategories(a []string, b []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, category := range append(append([]string{}, a...), b...) {
+		if !seen[category] {
+			seen[category] = true
+			merged = append(merged, category)
+		}
+	}
+	return merged
+}
+
+// saveConsent adds a consent record to the config file, leaving the rest of the file's settings as they were
+func saveConsent(configPath string, root string, record ConsentRecord) error {
+	// The user's own config may not exist yet when everything else comes from the repository's
+	raw := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadFile(configPath)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", configPath, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	consent := make(map[string]ConsentRecord)
+	if existing, ok := raw["consent"]; ok {
+		if err := json.Unmarshal(existing, &consent); err != nil {
+			return fmt.Errorf("failed to parse consent in %s: %v", configPath, err)
+		}
+	}
+	consent[root] = record
+	encoded, err := json.Marshal(consent)
+	if err != nil {
+		return err
+	}
+	raw["consent"] = encoded
+
+	data, err = json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(configPath), 0700)
+	return ioutil.WriteFile(configPath, append(data, '\n'), 0600)
+}
+
+// promptDiff returns the diff to put in a prompt: the diff itself, or only the changed paths and
+// line counts when file contents must stay on this machine
+func promptDiff(diff string, llmConfig LLMConfig) string {
+	if !llmConfig.LocalContextOnly {
+		return fitDiff(summarizeStructuredDiffs(summarizeProseDiffs(diff, llmConfig.ProseDiffs), llmConfig.StructuredDiffs), llmConfig)
+	}
+	var sb strings.Builder
+	sb.WriteString("File contents are withheld. Changed files with lines added and removed:\n")
+	for _, file := range splitDiffByFile(diff) {
+		sb.WriteString(fmt.Sprintf("%s (+%d -%d)\n", file.Path, file.Added, file.Removed))
+	}
+	return sb.String()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// filterTriggerPattern matches changed lines that content filters commonly refuse: exploit code,
+// attack payloads and profanity, which turn up in security fixes and test fixtures
+var filterTriggerPattern = regexp.MustCompile(`(?i)(shellcode|exploit|payload|reverse[ _-]?shell|<script|javascript:|onerror\s*=|union\s+select|drop\s+table|/etc/passwd|\\x[0-9a-f]{2}\\x[0-9a-f]{2}|\b(fuck|shit|bitch|cunt|asshole|bastard|dick)\w*)`)
+
+// filterTriggerPaths are path segments of files whose contents are test data rather than code
+var filterTriggerPaths = []string{"fixtures/", "fixture/", "testdata/", "corpus/", "payloads/", "exploits/"}
+
+// likelyFiltered reports whether a file's diff is among the likeliest to trip a content filter
+func likelyFiltered(file FileDiff) bool {
+	for _, segment := range filterTriggerPaths {
+		if strings.Contains("/"+file.Path, "/"+segment) {
+			return true
+		}
+	}
+	for _, line := range strings.Split(file.Content, "\n") {
+		if (strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-")) && filterTriggerPattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// elideFiles returns the diff with the changed lines of the matching files replaced by a note
+// giving the reason, and the paths left out
+func elideFiles(files []FileDiff, elide func(FileDiff) bool, reason string) (string, []string) {
+	var sb strings.Builder
+	var omitted []string
+	for _, file := range files {
+		if !elide(file) {
+			sb.WriteString(file.Content)
+			continue
+		}
+		omitted = append(omitted, file.Path)
+		header := strings.SplitN(file.Content, "\n", 2)[0]
+		sb.WriteString(fmt.Sprintf("%s\n(%d lines added and %d removed, %s)\n", header, file.Added, file.Removed, reason))
+	}
+	return sb.String(), omitted
+}
+
+// omissionNote says which files the generated text doesn't describe
+func omissionNote(omitted []string) string {
+	return fmt.Sprintf("The provider's content filter blocked the diff, so the message doesn't describe the changes to %s. Check it covers them.", strings.Join(omitted, ", "))
+}
+
+// generateAroundContentFilter runs generate on the diff. If the provider's content filter
+// refuses it, it retries first without the files likeliest to have tripped the filter, then
+// with every file's changes left out, and returns the files that were left out.
+func generateAroundContentFilter(diff string, generate func(diff string) (string, error)) (string, []string, error) {
+	message, err := generate(diff)
+	if errorKind(err) != ErrContentFilter {
+		return message, nil, err
+	}
+	files := splitDiffByFile(diff)
+	elisions := []func(FileDiff) bool{likelyFiltered, func(FileDiff) bool { return true }}
+	for _, elide := range elisions {
+		elided, omitted := elideFiles(files, elide, "left out because the provider's content filter blocked them")
+		if len(omitted) == 0 || elided == diff {
+			continue
+		}
+		Log(WARN, "%v. Retrying without the changes to %s", err, strings.Join(omitted, ", "))
+		message, err = generate(elided)
+		if errorKind(err) != ErrContentFilter {
+			return message, omitted, err
+		}
+		diff = elided
+	}
+	return "", nil, err
+}
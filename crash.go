@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// issuesURL is where users should report crashes
+const issuesURL = "https://github.com/mattoat/gitscribe/issues/new"
+
+// loadedConfig is the config of this run, kept for crash reports
+var loadedConfig *Config
+
+// secretPatterns match credentials that may end up in log lines
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`sk-[A-Za-z0-9_-]{8,}`),
+	regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{8,}`),
+	regexp.MustCompile(`github_pat_[A-Za-z0-9_]{8,}`),
+	regexp.MustCompile(`(?i)(bearer|token|secret|password)([=: ]+)\S+`),
+}
+
+// recoverCrash turns a panic into a crash report instead of a bare stack trace. It must be
+// deferred at the top of main and of any goroutine that does real work. Goroutines handling a
+// webhook delivery use recoverDelivery instead.
+func recoverCrash() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+
+	fmt.Fprintf(os.Stderr, "\ngs crashed unexpectedly: %v\n", r)
+	path, err := writeCrashBundle(r, stack)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the crash report (%v). Stack trace:\n%s\n", err, stack)
+	} else {
+		fmt.Fprintf(os.Stderr, "A crash report with the stack trace, recent logs and your config (secrets removed) was written to:\n  %s\n", path)
+		fmt.Fprintf(os.Stderr, "Please check it and attach it to an issue at %s\n", issuesURL)
+	}
+
+	crash := newError(ErrCrash, "panic: %v", r)
+	recordRun(crash)
+	os.Exit(exitCode(crash))
+}
+
+// recoverDelivery turns a panic while handling a webhook delivery into a failure of that delivery,
+// so the server keeps handling the others. fail records the failure.
+func recoverDelivery(delivery string, fail func(err error)) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+
+	path, err := writeCrashBundle(r, stack)
+	if err != nil {
+		Log(ERROR, "Delivery %s crashed: %v. Failed to write the crash report (%v). Stack trace:\n%s", delivery, r, err, stack)
+	} else {
+		Log(ERROR, "Delivery %s crashed: %v. A crash report was written to %s, please attach it to an issue at %s", delivery, r, path, issuesURL)
+	}
+	fail(newError(ErrCrash, "panic: %v", r))
+}
+
+// writeCrashBundle writes the crash report to a temp file and returns its path
+func writeCrashBundle(r interface{}, stack []byte) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("GitScribe crash report\n")
+	sb.WriteString(fmt.Sprintf("Time: %s\n", time.Now().UTC().Format(time.RFC3339)))
+	sb.WriteString(fmt.Sprintf("Command: %s\n", redactSecrets(strings.Join(os.Args, " "))))
+	sb.WriteString(fmt.Sprintf("Go: %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH))
+	sb.WriteString(fmt.Sprintf("Panic: %s\n", redactSecrets(fmt.Sprint(r))))
+
+	sb.WriteString("\n== Stack ==\n")
+	sb.Write(stack)
+
+	sb.WriteString("\n== Config ==\n")
+	if loadedConfig == nil {
+		sb.WriteString("(not loaded)\n")
+	} else {
+		sb.WriteString(redactedConfig(*loadedConfig))
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n== Recent logs ==\n")
+	for _, line := range recentLogLines() {
+		sb.WriteString(redactSecrets(line))
+		sb.WriteString("\n")
+	}
+
+	file, err := ioutil.TempFile("", "gitscribe-crash-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(sb.String()); err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// redactedConfig renders the config as JSON with credentials removed
+func redactedConfig(config Config) string {
+	if config.LLM.APIKey != "" {
+		config.LLM.APIKey = "[redacted]"
+	}
+	if config.Server.WebhookSecret != "" {
+		config.Server.WebhookSecret = "[redacted]"
+	}
+	if config.Phabricator.Token != "" {
+		config.Phabricator.Token = "[redacted]"
+	}
+	if config.SourceHut.Token != "" {
+		config.SourceHut.Token = "[redacted]"
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("(failed to render config: %v)", err)
+	}
+	return string(data)
+}
+
+// redactSecrets removes anything that looks like a credential from s
+func redactSecrets(s string) string {
+	if loadedConfig != nil {
+		secrets := []string{loadedConfig.LLM.APIKey, loadedConfig.Server.WebhookSecret, loadedConfig.Phabricator.Token, loadedConfig.SourceHut.Token}
+		for _, fallback := range loadedConfig.LLM.FallbackModels {
+			secrets = append(secrets, fallback.APIKey)
+		}
+		for _, secret := range secrets {
+			if secret != "" {
+				s = strings.ReplaceAll(s, secret, "[redacted]")
+			}
+		}
+	}
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllStringFunc(s, func(match string) string {
+			if groups := pattern.FindStringSubmatch(match); len(groups) == 3 {
+				return groups[1] + groups[2] + "[redacted]"
+			}
+			return "[redacted]"
+		})
+	}
+	return s
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Delivery statuses
+const (
+	deliveryProcessing = "processing"
+	deliverySucceeded  = "succeeded"
+	deliveryFailed     = "failed"
+)
+
+// deliveryRetention is how long records of successful deliveries are kept. GitHub redelivers within hours.
+const deliveryRetention = 7 * 24 * time.Hour
+
+// deliveryStaleAfter is how long a delivery can be processing without its record changing before
+// the server that claimed it is taken to have stopped. It's well over the longest build.
+const deliveryStaleAfter = 2 * time.Hour
+
+// deliveryIDPattern matches GitHub delivery IDs, which are GUIDs
+var deliveryIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// DeliveryRecord is what we store about a webhook delivery
+type DeliveryRecord struct {
+	ID         string          `json:"id"`
+	Event      string          `json:"event"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	Attempts   int             `json:"attempts"`
+	Host       string          `json:"host,omitempty"` // the host of the server processing it
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// deliveryHost names this server in the deliveries it processes
+var deliveryHost, _ = os.Hostname()
+
+// deliveryStore records webhook deliveries as files in a directory, which can be shared between
+// replicas. Exclusive file creation makes sure only one replica claims a delivery, and failed
+// deliveries keep their payload so they can be replayed.
+type deliveryStore struct {
+	dir string
+}
+
+// newDeliveryStore opens the store in dir, creating it if needed
+func newDeliveryStore(dir string) (*deliveryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create delivery directory %s: %v", dir, err)
+	}
+	return &deliveryStore{dir: dir}, nil
+}
+
+// path returns the file a delivery is recorded in
+func (d *deliveryStore) path(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+// Claim records a new delivery and reports whether this caller is the first to see it.
+// Deliveries without a usable ID are always processed but can't be replayed.
+func (d *deliveryStore) Claim(id string, event string, payload []byte) (bool, error) {
+	if !deliveryIDPattern.MatchString(id) {
+		Log(WARN, "Delivery ID %q can't be deduplicated or replayed", id)
+		return true, nil
+	}
+	record := DeliveryRecord{ID: id, Event: event, ReceivedAt: time.Now().UTC(), Status: deliveryProcessing, Attempts: 1, Host: deliveryHost, Payload: payload}
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return false, err
+	}
+
+	file, err := os.OpenFile(d.path(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return false, err
+	}
+	return true, file.Close()
+}
+
+// Get reads the record of a delivery
+func (d *deliveryStore) Get(id string) (DeliveryRecord, error) {
+	var record DeliveryRecord
+	if !deliveryIDPattern.MatchString(id) {
+		return record, fmt.Errorf("invalid delivery ID %q", id)
+	}
+	data, err := ioutil.ReadFile(d.path(id))
+	if err != nil {
+		return record, fmt.Errorf("failed to read delivery %s: %v", id, err)
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return record, fmt.Errorf("failed to parse delivery %s: %v", id, err)
+	}
+	return record, nil
+}
+
+// save replaces the record of a delivery. The write is atomic so readers never see half a record.
+func (d *deliveryStore) save(record DeliveryRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp := d.path(record.ID) + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, d.path(record.ID))
+}
+
+// Finish records the outcome of processing a delivery
+func (d *deliveryStore) Finish(id string, processErr error) error {
+	if !deliveryIDPattern.MatchString(id) {
+		return nil
+	}
+	record, err := d.Get(id)
+	if err != nil {
+		return err
+	}
+	record.Status, record.Error = deliverySucceeded, ""
+	if processErr != nil {
+		record.Status, record.Error = deliveryFailed, processErr.Error()
+	}
+	return d.save(record)
+}
+
+// Retry marks a delivery as being processed again
+func (d *deliveryStore) Retry(record DeliveryRecord) error {
+	record.Status = deliveryProcessing
+	record.Attempts++
+	record.Host = deliveryHost
+	return d.save(record)
+}
+
+// FailStale marks the deliveries a stopped server was processing as failed, so they can be
+// replayed. Those claimed on this host were left by an earlier run of the server, and those
+// another replica hasn't touched in deliveryStaleAfter were left by a replica that stopped.
+func (d *deliveryStore) FailStale() {
+	records, err := d.List(deliveryProcessing)
+	if err != nil {
+		Log(WARN, "Failed to check for stale deliveries: %v", err)
+		return
+	}
+	for _, record := range records {
+		info, err := os.Stat(d.path(record.ID))
+		if err != nil || record.Host != deliveryHost && time.Since(info.ModTime()) < deliveryStaleAfter {
+			continue
+		}
+		record.Status, record.Error = deliveryFailed, "the server stopped while processing it"
+		if err := d.save(record); err != nil {
+			Log(WARN, "Failed to record stale delivery %s as failed: %v", record.ID, err)
+			continue
+		}
+		Log(WARN, "Delivery %s was still processing when the server stopped, replay it with gs serve replay -delivery %s", record.ID, record.ID)
+	}
+}
+
+// List returns the recorded deliveries with the given status, or all of them if status is
+// empty, oldest first
+func (d *deliveryStore) List(status string) ([]DeliveryRecord, error) {
+	entries, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deliveries: %v", err)
+	}
+	var records []DeliveryRecord
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		record, err := d.Get(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			Log(WARN, "%v", err)
+			continue
+		}
+		if status == "" || record.Status == status {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].ReceivedAt.Before(records[j].ReceivedAt)
+	})
+	return records, nil
+}
+
+// Prune removes records of successful deliveries older than the retention period
+func (d *deliveryStore) Prune() {
+	records, err := d.List(deliverySucceeded)
+	if err != nil {
+		Log(WARN, "Failed to prune deliveries: %v", err)
+		return
+	}
+	for _, record := range records {
+		if time.Since(record.ReceivedAt) > deliveryRetention {
+			os.Remove(d.path(record.ID))
+		}
+	}
+}
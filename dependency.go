@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// dependencyImpactMarker delimits the section we own in dependency PR bodies so it can be
+// replaced instead of duplicated when the bot updates the PR
+const dependencyImpactMarker = "gitscribe:dependency-impact"
+
+// manifestFiles are the dependency manifests whose diff is relevant to an update
+var manifestFiles = []string{"go.mod", "package.json", "requirements.txt", "pyproject.toml", "Cargo.toml", "Gemfile", "pom.xml", "build.gradle"}
+
+// isDependencyBotPR reports whether the PR was opened by one of the dependency update bots
+func isDependencyBotPR(pr PullRequest, bots []string) bool {
+	for _, bot := range bots {
+		if strings.EqualFold(pr.User.Login, bot) {
+			return true
+		}
+	}
+	return false
+}
+
+// manifestDiff keeps only the parts of the diff that touch dependency manifests, skipping lock files
+func manifestDiff(diff string) string {
+	var sb strings.Builder
+	for _, file := range splitDiffByFile(diff) {
+		for _, manifest := range manifestFiles {
+			if file.Path == manifest || strings.HasSuffix(file.Path, "/"+manifest) {
+				sb.WriteString(file.Content)
+				break
+			}
+		}
+	}
+	return sb.String()
+}
+
+// parseGoModDiffUpdates extracts module version changes from the go.mod part of a diff
+func parseGoModDiffUpdates(diff string) []ModuleUpdate {
+	removed := make(map[string]string)
+	added := make(map[string]string)
+	for _, file := range splitDiffByFile(diff) {
+		if file.Path != "go.mod" && !strings.HasSuffix(file.Path, "/go.mod") {
+			continue
+		}
+		for _, line := range strings.Split(file.Content, "\n") {
+			if strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++") || len(line) == 0 {
+				continue
+			}
+			fields := strings.Fields(strings.TrimPrefix(strings.SplitN(line[1:], "//", 2)[0], "require"))
+			if len(fields) != 2 || !strings.HasPrefix(fields[1], "v") {
+				continue
+			}
+			switch line[0] {
+			case '-':
+				removed[fields[0]] = fields[1]
+			case '+':
+				added[fields[0]] = fields[1]
+			}
+		}
+	}
+
+	var updates []ModuleUpdate
+	for module, newVersion := range added {
+		if oldVersion, ok := removed[module]; ok && oldVersion != newVersion {
+			updates = append(updates, ModuleUpdate{Module: module, OldVersion: oldVersion, NewVersion: newVersion})
+		}
+	}
+	return updates
+}
+
+// searchCodeUsage uses GitHub code search to find files in the repo that reference the module
+func searchCodeUsage(repo string, module string) []string {
+	var response struct {
+		Items []struct {
+			Path string `json:"path"`
+		} `json:"items"`
+	}
+	query := url.QueryEscape(fmt.Sprintf("\"%s\" repo:%s", module, repo))
+	if err := ghAPI("GET", "search/code?per_page=20&q="+query, nil, &response); err != nil {
+		Log(WARN, "Code search for %s failed: %v", module, err)
+		return nil
+	}
+
+	var files []string
+	for _, item := range response.Items {
+		if !strings.HasPrefix(item.Path, "vendor/") && !strings.HasSuffix(item.Path, ".sum") {
+			files = append(files, item.Path)
+		}
+	}
+	return files
+}
+
+// replaceMarkedSection replaces the content between the named HTML comment markers in body,
+// appending a new marked section if the markers aren't there yet
+func replaceMarkedSection(body string, marker string, content string) string {
+	start := fmt.Sprintf("<!-- %s -->", marker)
+	end := fmt.Sprintf("<!-- /%s -->", marker)
+	section := start + "\n" + content + "\n" + end
+
+	startIdx := strings.Index(body, start)
+	endIdx := strings.Index(body, end)
+	if startIdx != -1 && endIdx > startIdx {
+		return body[:startIdx] + section + body[endIdx+len(end):]
+	}
+	return appendSections(body, []string{section})
+}
+
+// enrichDependencyPR appends an impact analysis to a bot-created dependency update PR
+func enrichDependencyPR(ctx context.Context, repo string, pr PullRequest, config Config) error {
+	Log(INFO, "Enriching dependency PR %s#%d opened by %s", repo, pr.Number, pr.User.Login)
+	diff, err := getPullRequestDiff(repo, pr.Number)
+	if err != nil {
+		return err
+	}
+	manifests := manifestDiff(diff)
+
+	var sb strings.Builder
+	for _, update := range parseGoModDiffUpdates(manifests) {
+		sb.WriteString(fmt.Sprintf("### %s %s -> %s\n", update.Module, update.OldVersion, update.NewVersion))
+		if usage := searchCodeUsage(repo, update.Module); len(usage) > 0 {
+			sb.WriteString(fmt.Sprintf("Used by: %s\n", strings.Join(usage, ", ")))
+		}
+		sb.WriteString(upstreamNotes(update) + "\n\n")
+	}
+
+	analysis, err := GenerateDependencyImpact(ctx, pr, manifests, sb.String(), config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate dependency impact: %w", err)
+	}
+
+	content := "## Impact analysis\n\n" + analysis + "\n\n" + generatedMarker(pr.Head.SHA)
+	if config.Judge.Enabled {
+		judgement, err := judgeGenerated(ctx, "dependency impact analysis", analysis, manifests+"\n"+sb.String(), config.Judge, config.LLM)
+		if err != nil {
+			return err
+		}
+		if judgement.Score < config.Judge.Threshold {
+			url, err := postSuggestion(repo, pr.Number, dependencyImpactMarker, content, judgement)
+			if err != nil {
+				return err
+			}
+			Log(INFO, "Impact analysis for %s#%d scored below %.2f, posted as a suggestion: %s", repo, pr.Number, config.Judge.Threshold, url)
+			return nil
+		}
+	}
+
+	body := replaceMarkedSection(pr.Body, dependencyImpactMarker, content)
+	if err := updatePullRequestBodyAPI(repo, pr.Number, body); err != nil {
+		return err
+	}
+	Log(INFO, "Added impact analysis to %s#%d", repo, pr.Number)
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FileDiff is the portion of a unified diff that belongs to a single file
+type FileDiff struct {
+	Path    string
+	Content string
+	Added   int
+	Removed int
+}
+
+// DirectoryStat summarizes the changes under one top-level directory
+type DirectoryStat struct {
+	Dir     string
+	Files   int
+	Added   int
+	Removed int
+}
+
+// splitDiffByFile splits a unified git diff into per-file chunks
+func splitDiffByFile(diff string) []FileDiff {
+	var files []FileDiff
+	var current *FileDiff
+	var sb strings.Builder
+
+	flush := func() {
+		if current != nil {
+			current.Content = sb.String()
+			files = append(files, *current)
+		}
+		sb.Reset()
+	}
+
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") {
+			flush()
+			paths := changedPathsFromDiff(strings.TrimRight(line, "\n"))
+			current = &FileDiff{}
+			if len(paths) > 0 {
+				current.Path = paths[0]
+			}
+		}
+		if current == nil {
+			continue
+		}
+		sb.WriteString(line)
+		if strings.HasPrefix(line, "+") && !strings.HasPrefix(line, "+++") {
+			current.Added++
+		} else if strings.HasPrefix(line, "-") && !strings.HasPrefix(line, "---") {
+			current.Removed++
+		}
+	}
+	flush()
+	return files
+}
+
+// topLevelDir returns the first path component, or "." for files at the repo root
+func topLevelDir(path string) string {
+	if idx := strings.Index(path, "/"); idx != -1 {
+		return path[:idx]
+	}
+	return "."
+}
+
+// directoryStats groups per-file changes by top-level directory
+func directoryStats(files []FileDiff) []DirectoryStat {
+	byDir := make(map[string]*DirectoryStat)
+	for _, f := range files {
+		dir := topLevelDir(f.Path)
+		stat, ok := byDir[dir]
+		if !ok {
+			stat = &DirectoryStat{Dir: dir}
+			byDir[dir] = stat
+		}
+		stat.Files++
+		stat.Added += f.Added
+		stat.Removed += f.Removed
+	}
+
+	stats := make([]DirectoryStat, 0, len(byDir))
+	for _, stat := range byDir {
+		stats = append(stats, *stat)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Dir < stats[j].Dir })
+	return stats
+}
+
+// scopeDiffByDirectory lets the user exclude top-level directories from the prompt,
+// and optionally unstage them so they're left out of the commit as well
+func scopeDiffByDirectory(diff string) (string, error) {
+	files := splitDiffByFile(diff)
+	stats := directoryStats(files)
+	if len(stats) <= 1 {
+		Log(DEBUG, "Only %d changed directories, skipping directory scoping", len(stats))
+		return diff, nil
+	}
+
+	fmt.Println("\nChanged directories:")
+	for i, stat := range stats {
+		fmt.Printf("  %d. %s (%d files, +%d -%d)\n", i+1, stat.Dir, stat.Files, stat.Added, stat.Removed)
+	}
+	fmt.Print("Enter the numbers of directories to exclude (comma separated), or press Enter to keep all: ")
+
+	reader := bufio.NewReader(os.Stdin)
+	answer, _ := reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return diff, nil
+	}
+
+	excluded := make(map[string]bool)
+	for _, field := range strings.Split(answer, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 || n > len(stats) {
+			return "", fmt.Errorf("invalid directory number: %s", strings.TrimSpace(field))
+		}
+		excluded[stats[n-1].Dir] = true
+	}
+	if len(excluded) == len(stats) {
+		return "", fmt.Errorf("all directories were excluded, nothing left to describe")
+	}
+
+	var sb strings.Builder
+	var excludedPaths []string
+	for _, f := range files {
+		if excluded[topLevelDir(f.Path)] {
+			excludedPaths = append(excludedPaths, f.Path)
+			continue
+		}
+		sb.WriteString(f.Content)
+	}
+	Log(INFO, "Excluded %d files from the prompt", len(excludedPaths))
+
+	fmt.Print("Also unstage the excluded directories so they are left out of the commit? [y/N]: ")
+	answer, _ = reader.ReadString('\n')
+	if strings.ToLower(strings.TrimSpace(answer)) == "y" {
+		if err := unstagePaths(excludedPaths); err != nil {
+			return "", err
+		}
+		fmt.Printf("Unstaged %d files.\n", len(excludedPaths))
+	}
+
+	return sb.String(), nil
+}
+
+// unstagePaths removes the given paths from the index while keeping the working tree changes
+func unstagePaths(paths []string) error {
+	Log(INFO, "Unstaging %d files", len(paths))
+	args := append([]string{"reset", "-q", "--"}, paths...)
+	if err := newCommand("git", args...).Run(); err != nil {
+		Log(ERROR, "Failed to unstage files: %v", err)
+		return fmt.Errorf("failed to unstage files: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DigestConfig controls gs digest, which summarizes the PRs merged in the last days for people
+// who don't read GitHub
+type DigestConfig struct {
+	Repos  []string `json:"repos"`  // "owner/name" repositories, default the current one
+	Days   int      `json:"days"`   // how far back to look, default 7
+	Format string   `json:"format"` // "email" (default) or "rss"
+	Title  string   `json:"title"`  // the email's subject and the feed's title, default "Weekly changes"
+	Link   string   `json:"link"`   // the feed's link, default the first repository on GitHub
+	To     []string `json:"to"`     // the email's recipients
+}
+
+// ServerDigestConfig controls the digest the server writes on a schedule
+type ServerDigestConfig struct {
+	Schedule string `json:"schedule"` // weekday and local time, default "monday 09:00"
+	Output   string `json:"output"`   // directory the digests are written to; none turns it off
+}
+
+// digestFeedItems is how many items a feed keeps, the newest first
+const digestFeedItems = 50
+
+// digestBodyLimit is how much of each PR's description is sent to the LLM
+const digestBodyLimit = 3000
+
+// htmlCommentPattern finds the hidden comments gs and other tools leave in descriptions
+var htmlCommentPattern = regexp.MustCompile(`(?s)<!--.*?-->`)
+
+// MergedPullRequest is a closed pull request from the GitHub API, with when it was merged
+type MergedPullRequest struct {
+	Number   int    `json:"number"`
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	HTMLURL  string `json:"html_url"`
+	MergedAt string `json:"merged_at"`
+	Updated  string `json:"updated_at"`
+	User     struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// RepoDigest is the summary of what was merged into one repository
+type RepoDigest struct {
+	Repo    string
+	Summary string
+	PRs     []MergedPullRequest
+}
+
+// checkDigestConfig rejects digest settings that can't be used
+func checkDigestConfig(config Config) error {
+	if format := strings.ToLower(config.Digest.Format); format != "" && format != "email" && format != "rss" {
+		return fmt.Errorf("unknown digest.format %q in config: use email or rss", config.Digest.Format)
+	}
+	if _, _, err := parseDigestSchedule(config.Server.Digest.Schedule); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseDigestSchedule returns the weekday and minutes after midnight of a schedule such as
+// "monday 09:00"
+func parseDigestSchedule(schedule string) (time.Weekday, int, error) {
+	fields := strings.Fields(strings.ToLower(schedule))
+	if len(fields) == 0 {
+		fields = []string{"monday", "09:00"}
+	}
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid server.digest.schedule %q in config: use a weekday and a time, e.g. monday 09:00", schedule)
+	}
+	weekday := -1
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.ToLower(day.String()) == fields[0] {
+			weekday = int(day)
+		}
+	}
+	at, err := time.Parse("15:04", fields[1])
+	if weekday == -1 || err != nil {
+		return 0, 0, fmt.Errorf("invalid server.digest.schedule %q in config: use a weekday and a time, e.g. monday 09:00", schedule)
+	}
+	return time.Weekday(weekday), at.Hour()*60 + at.Minute(), nil
+}
+
+// listMergedPullRequests returns the PRs of a repository merged since a time, the most recent
+// first
+func listMergedPullRequests(repo string, since time.Time) ([]MergedPullRequest, error) {
+	var merged []MergedPullRequest
+	// Sorted by the last update, which is never before the merge, so the pages can stop at the
+	// first PR updated before the window
+	for page := 1; page <= 10; page++ {
+		var prs []MergedPullRequest
+		endpoint := fmt.Sprintf("repos/%s/pulls?state=closed&sort=updated&direction=desc&per_page=100&page=%d", repo, page)
+		if err := ghAPI("GET", endpoint, nil, &prs); err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if at, err := time.Parse(time.RFC3339, pr.MergedAt); err == nil && !at.Before(since) {
+				merged = append(merged, pr)
+			}
+		}
+		if len(prs) < 100 {
+			break
+		}
+		if updated, err := time.Parse(time.RFC3339, prs[len(prs)-1].Updated); err == nil && updated.Before(since) {
+			break
+		}
+	}
+	return merged, nil
+}
+
+// digestInput lists the merged PRs for the LLM. Descriptions are left out if they don't all fit
+// in the model's context.
+func digestInput(prs []MergedPullRequest, llmConfig LLMConfig) string {
+	var titles, full strings.Builder
+	for _, pr := range prs {
+		line := fmt.Sprintf("PR #%d: %s (by %s, merged %s)\n", pr.Number, pr.Title, pr.User.Login, pr.MergedAt[:10])
+		titles.WriteString(line)
+		body := strings.TrimSpace(htmlCommentPattern.ReplaceAllString(pr.Body, ""))
+		full.WriteString(line + truncateAtWord(body, digestBodyLimit) + "\n\n")
+	}
+	if overflowsContext(full.String(), llmConfig) {
+		Log(WARN, "The descriptions of %d PRs don't fit in the model's context, summarizing their titles only", len(prs))
+		return titles.String()
+	}
+	return full.String()
+}
+
+// buildDigests summarizes the PRs merged into each repository since a time
+func buildDigests(ctx context.Context, repos []string, since time.Time, config Config) ([]RepoDigest, error) {
+	var digests []RepoDigest
+	for _, repo := range repos {
+		prs, err := listMergedPullRequests(repo, since)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the merged PRs of %s: %v", repo, err)
+		}
+		digest := RepoDigest{Repo: repo, PRs: prs, Summary: "Nothing was merged."}
+		if len(prs) > 0 {
+			Log(INFO, "Summarizing %d PRs merged into %s", len(prs), repo)
+			digest.Summary, err = GenerateDigest(ctx, repo, digestInput(prs, config.LLM), config.LLM)
+			if err != nil {
+				return nil, fmt.Errorf("failed to summarize %s: %v", repo, err)
+			}
+		}
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// digestTitle is the title of the digest of a week
+func digestTitle(config DigestConfig, since time.Time, until time.Time) string {
+	title := config.Title
+	if title == "" {
+		title = "Weekly changes"
+	}
+	return fmt.Sprintf("%s, %s to %s", title, since.Format("Jan 2"), until.Format("Jan 2"))
+}
+
+// renderEmailDigest renders the digests as a plain-text email, with headers a mail client or
+// sendmail -t can send as is
+func renderEmailDigest(digests []RepoDigest, config DigestConfig, since time.Time, until time.Time) string {
+	var sb strings.Builder
+	if len(config.To) > 0 {
+		sb.WriteString("To: " + strings.Join(config.To, ", ") + "\n")
+	}
+	sb.WriteString("Subject: " + digestTitle(config, since, until) + "\n")
+	sb.WriteString("Date: " + until.Format(time.RFC1123Z) + "\n")
+	sb.WriteString("MIME-Version: 1.0\nContent-Type: text/plain; charset=utf-8\nContent-Transfer-Encoding: 8bit\n\n")
+	for _, digest := range digests {
+		sb.WriteString(digest.Repo + "\n" + strings.Repeat("=", len(digest.Repo)) + "\n\n")
+		sb.WriteString(digest.Summary + "\n\n")
+		if len(digest.PRs) > 0 {
+			sb.WriteString(fmt.Sprintf("Merged (%d):\n", len(digest.PRs)))
+			for _, pr := range digest.PRs {
+				sb.WriteString(fmt.Sprintf("- %s (#%d) %s\n", pr.Title, pr.Number, pr.HTMLURL))
+			}
+			sb.WriteString("\n")
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n") + "\n"
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// digestHTML renders a summary and its PRs as the HTML of a feed item. Lines of the summary that
+// start with "- " become a list.
+func digestHTML(digest RepoDigest) string {
+	var sb strings.Builder
+	inList := false
+	for _, line := range strings.Split(digest.Summary, "\n") {
+		line = strings.TrimSpace(line)
+		item := strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ")
+		if inList && !item {
+			sb.WriteString("</ul>")
+			inList = false
+		}
+		switch {
+		case item && !inList:
+			sb.WriteString("<ul>")
+			inList = true
+			fallthrough
+		case item:
+			sb.WriteString("<li>" + html.EscapeString(line[2:]) + "</li>")
+		case line != "":
+			sb.WriteString("<p>" + html.EscapeString(line) + "</p>")
+		}
+	}
+	if inList {
+		sb.WriteString("</ul>")
+	}
+	if len(digest.PRs) > 0 {
+		sb.WriteString(fmt.Sprintf("<p>Merged (%d):</p><ul>", len(digest.PRs)))
+		for _, pr := range digest.PRs {
+			sb.WriteString(fmt.Sprintf(`<li><a href="%s">%s (#%d)</a></li>`, html.EscapeString(pr.HTMLURL), html.EscapeString(pr.Title), pr.Number))
+		}
+		sb.WriteString("</ul>")
+	}
+	return sb.String()
+}
+
+// renderRSSDigest adds an item per repository to a feed, which may hold the items of earlier
+// weeks. An item for the same repository and week replaces the old one.
+func renderRSSDigest(existing []byte, digests []RepoDigest, config DigestConfig, since time.Time, until time.Time) (string, error) {
+	feed := rssFeed{Version: "2.0"}
+	if len(existing) > 0 {
+		if err := xml.Unmarshal(existing, &feed); err != nil {
+			return "", fmt.Errorf("failed to read the existing feed: %v", err)
+		}
+	}
+	feed.Channel.Title = config.Title
+	if feed.Channel.Title == "" {
+		feed.Channel.Title = "Weekly changes"
+	}
+	if config.Link != "" {
+		feed.Channel.Link = config.Link
+	}
+	if feed.Channel.Link == "" && len(digests) > 0 {
+		feed.Channel.Link = "https://github.com/" + digests[0].Repo
+	}
+	feed.Channel.Description = "What was merged each week, summarized by GitScribe"
+
+	var items []rssItem
+	replaced := map[string]bool{}
+	for _, digest := range digests {
+		guid := fmt.Sprintf("gitscribe-digest:%s:%s", digest.Repo, until.Format("2006-01-02"))
+		replaced[guid] = true
+		items = append(items, rssItem{
+			Title:       fmt.Sprintf("%s: %s", digest.Repo, digestTitle(config, since, until)),
+			Link:        fmt.Sprintf("https://github.com/%s/pulls?q=is%%3Apr+is%%3Amerged", digest.Repo),
+			Description: digestHTML(digest),
+			GUID:        rssGUID{IsPermaLink: "false", Value: guid},
+			PubDate:     until.Format(time.RFC1123Z),
+		})
+	}
+	for _, item := range feed.Channel.Items {
+		if !replaced[item.GUID.Value] {
+			items = append(items, item)
+		}
+	}
+	if len(items) > digestFeedItems {
+		items = items[:digestFeedItems]
+	}
+	feed.Channel.Items = items
+
+	data, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to render the feed: %v", err)
+	}
+	return xml.Header + string(data) + "\n", nil
+}
+
+// renderDigest renders the digests in the configured format. A feed written to a file keeps the
+// items already in it.
+func renderDigest(digests []RepoDigest, config DigestConfig, output string, since time.Time, until time.Time) (string, error) {
+	if strings.ToLower(config.Format) != "rss" {
+		return renderEmailDigest(digests, config, since, until), nil
+	}
+	var existing []byte
+	if output != "" {
+		data, err := ioutil.ReadFile(output)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read %s: %v", output, err)
+		}
+		existing = data
+	}
+	return renderRSSDigest(existing, digests, config, since, until)
+}
+
+// runDigestCommand prints or writes the digest of the PRs merged in the last days
+func runDigestCommand(args []string) error {
+	fs := flag.NewFlagSet("digest", flag.ExitOnError)
+	var repos stringListFlag
+	fs.Var(&repos, "repo", "Repository to include, as owner/name; can be repeated (default: digest.repos, or the current repository)")
+	days := fs.Int("days", 0, "Days to look back (default: digest.days, or 7)")
+	rss := fs.Bool("rss", false, "Render an RSS feed instead of an email (default: digest.format)")
+	output := fs.String("o", "", "Write the digest to a file instead of stdout; an existing feed keeps its earlier items")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *days > 0 {
+		config.Digest.Days = *days
+	}
+	if *rss {
+		config.Digest.Format = "rss"
+	}
+	if len(repos) == 0 {
+		repos = config.Digest.Repos
+	}
+	if len(repos) == 0 {
+		repo, err := currentRepo()
+		if err != nil {
+			return err
+		}
+		repos = []string{repo}
+	}
+
+	until := time.Now()
+	since := until.AddDate(0, 0, -config.Digest.Days)
+	digests, err := buildDigests(context.Background(), repos, since, config)
+	if err != nil {
+		return err
+	}
+	text, err := renderDigest(digests, config.Digest, *output, since, until)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		fmt.Print(text)
+		return nil
+	}
+	if err := ioutil.WriteFile(*output, []byte(text), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", *output, err)
+	}
+	fmt.Printf("Wrote the digest to %s\n", *output)
+	return nil
+}
+
+// lastDigestTime returns the most recent time the schedule came round, at or before now
+func lastDigestTime(weekday time.Weekday, minutes int, now time.Time) time.Time {
+	at := time.Date(now.Year(), now.Month(), now.Day(), minutes/60, minutes%60, 0, 0, now.Location())
+	at = at.AddDate(0, 0, -((int(now.Weekday()) - int(weekday) + 7) % 7))
+	if at.After(now) {
+		at = at.AddDate(0, 0, -7)
+	}
+	return at
+}
+
+// writeScheduledDigest writes the digest due at a time to the output directory: an .eml file
+// per week, or the items of the week added to digest.xml
+func (s *webhookServer) writeScheduledDigest(due time.Time) error {
+	config := s.currentConfig()
+	dir := expandPath(config.Server.Digest.Output)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	output := filepath.Join(dir, "digest-"+due.Format("2006-01-02")+".eml")
+	if strings.ToLower(config.Digest.Format) == "rss" {
+		output = filepath.Join(dir, "digest.xml")
+	}
+
+	since := due.AddDate(0, 0, -config.Digest.Days)
+	digests, err := buildDigests(context.Background(), config.Digest.Repos, since, config)
+	if err != nil {
+		return err
+	}
+	text, err := renderDigest(digests, config.Digest, output, since, due)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(output, []byte(text), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", output, err)
+	}
+	Log(INFO, "Wrote the digest due %s to %s", due.Format(time.RFC3339), output)
+	// Remember the run, so a restart doesn't write the same digest again
+	return ioutil.WriteFile(filepath.Join(dir, "last_digest"), []byte(due.Format(time.RFC3339)+"\n"), 0644)
+}
+
+// watchDigest writes the digest each time the schedule comes round. The schedule, repositories
+// and output are read from the current config each time, so reloads apply to the next digest.
+func watchDigest(s *webhookServer) {
+	for {
+		time.Sleep(time.Minute)
+		if atomic.LoadInt32(&s.draining) == 1 {
+			return
+		}
+		config := s.currentConfig()
+		if config.Server.Digest.Output == "" || len(config.Digest.Repos) == 0 {
+			continue
+		}
+		weekday, minutes, err := parseDigestSchedule(config.Server.Digest.Schedule)
+		if err != nil {
+			continue
+		}
+		due := lastDigestTime(weekday, minutes, time.Now())
+		last, _ := ioutil.ReadFile(filepath.Join(expandPath(config.Server.Digest.Output), "last_digest"))
+		if written, err := time.Parse(time.RFC3339, strings.TrimSpace(string(last))); err == nil && !written.Before(due) {
+			continue
+		}
+
+		result := "success"
+		if err := s.writeScheduledDigest(due); err != nil {
+			Log(ERROR, "Failed to write the digest: %v", err)
+			result = "error"
+		}
+		metrics.add("gitscribe_digests_total", 1, "result", result)
+		if result == "error" {
+			// Try again after an hour rather than every minute
+			time.Sleep(time.Hour)
+		}
+	}
+}
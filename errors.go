@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrorKind is the category of a failure that scripts and users can act on
+type ErrorKind string
+
+const (
+	ErrUnknown             ErrorKind = "other"
+	ErrUsage               ErrorKind = "usage"
+	ErrAuth                ErrorKind = "auth"
+	ErrRateLimit           ErrorKind = "rate_limit"
+	ErrContextOverflow     ErrorKind = "context_overflow"
+	ErrTemplateMissing     ErrorKind = "template_missing"
+	ErrGitState            ErrorKind = "git_state"
+	ErrCrash               ErrorKind = "crash"
+	ErrCapabilityDisabled  ErrorKind = "capability_disabled"
+	ErrQuota               ErrorKind = "quota"
+	ErrContentFilter       ErrorKind = "content_filter"
+	ErrInvalidModel        ErrorKind = "invalid_model"
+	ErrProviderUnavailable ErrorKind = "provider_unavailable"
+	ErrCanceled            ErrorKind = "canceled"
+	ErrPolicyBlocked       ErrorKind = "policy_blocked"
+	ErrPreflightFailed     ErrorKind = "preflight_failed"
+	ErrModelNotAllowed     ErrorKind = "model_not_allowed"
+)
+
+// exitCodes are the process exit codes for each kind of error. 2 is also what the flag package
+// exits with for flags it can't parse.
+var exitCodes = map[ErrorKind]int{
+	ErrUnknown:             1,
+	ErrUsage:               2,
+	ErrAuth:                3,
+	ErrRateLimit:           4,
+	ErrContextOverflow:     5,
+	ErrTemplateMissing:     6,
+	ErrGitState:            7,
+	ErrCrash:               8,
+	ErrCapabilityDisabled:  9,
+	ErrQuota:               10,
+	ErrContentFilter:       11,
+	ErrInvalidModel:        12,
+	ErrProviderUnavailable: 13,
+	ErrPolicyBlocked:       14,
+	ErrPreflightFailed:     15,
+	ErrModelNotAllowed:     16,
+	ErrCanceled:            130, // the shell's code for a command stopped with Ctrl-C
+}
+
+// remediations tell the user what to do about each kind of error
+var remediations = map[ErrorKind]string{
+	ErrUsage:               "Check the flags against `gs -h`.",
+	ErrAuth:                "Check that OPENAI_KEY (or llm.api_key) is set and valid, and that gh is logged in with `gh auth status`.",
+	ErrRateLimit:           "The API is rate limiting requests. Wait a minute and try again, or check your plan's usage limits.",
+	ErrContextOverflow:     "The input is too large for the model. Stage fewer changes, use -scope-dirs, set llm.context_window to the model's real context size, or configure a model with a larger context.",
+	ErrTemplateMissing:     "Create the template file or point commit_template/pr_template in your config at an existing file.",
+	ErrGitState:            "Check the state of the repository: you need to be in a git repo with staged changes or commits on your branch, and without unresolved conflicts or a rebase or merge left unfinished.",
+	ErrCapabilityDisabled:  "GitScribe is running offline, so features that need the network are turned off. Use a local model through llm.endpoint, or run without offline mode.",
+	ErrQuota:               "The API account is out of quota or credits. Add credits or raise the spending limit with your provider, or use another llm.api_key.",
+	ErrContentFilter:       "The provider's content filter blocked the request or the reply, even with the files likeliest to trip it left out. Leave the offending files out with -scope-dirs, or write the message yourself.",
+	ErrInvalidModel:        "The model doesn't exist or your key can't use it. Check llm.model and the pipeline, vision and judge models against what your provider offers, or set llm.fallback_models.",
+	ErrProviderUnavailable: "The provider is overloaded or down. Try again later, or set llm.fallback_models to models that are available.",
+	ErrPolicyBlocked:       "A redaction rule set to block matched the prompt, so nothing was sent. Remove the matching content from the change, or check the rule with `gs redact test`.",
+	ErrModelNotAllowed:     "The model policy doesn't allow this provider, model or endpoint for the repository's classification. Use a provider and model it allows, with llm.provider and llm.model or -model, or ask whoever manages model_policy.",
+	ErrPreflightFailed:     "Fix the failed pre-flight checks listed above, or use -skip-create to only write the description.",
+}
+
+// GSError is an error with a kind that decides its remediation text and exit code
+type GSError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *GSError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *GSError) Unwrap() error {
+	return e.Err
+}
+
+// newError creates an error of the given kind
+func newError(kind ErrorKind, format string, args ...interface{}) error {
+	return &GSError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+// errorKind returns the kind of err, looking through wrapped errors
+func errorKind(err error) ErrorKind {
+	var gsErr *GSError
+	if errors.As(err, &gsErr) {
+		return gsErr.Kind
+	}
+	return ErrUnknown
+}
+
+// exitCode returns the process exit code for err
+func exitCode(err error) int {
+	return exitCodes[errorKind(err)]
+}
+
+// printRemediation prints what the user can do about err, if we know
+func printRemediation(err error) {
+	if hint, ok := remediations[errorKind(err)]; ok {
+		fmt.Fprintln(os.Stderr, "Hint:", hint)
+	}
+}
+
+// templateError wraps a failure to read a template, marking a missing file as such
+func templateError(name string, err error) error {
+	if os.IsNotExist(err) {
+		return newError(ErrTemplateMissing, "%s template not found: %v", name, err)
+	}
+	return fmt.Errorf("failed to read %s template: %v", name, err)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExecConfig controls which external programs gs may run and for how long
+type ExecConfig struct {
+	Allow          []string `json:"allow"`           // programs allowed on top of the defaults, e.g. for the size report command
+	TimeoutSeconds int      `json:"timeout_seconds"` // default 120
+}
+
+// defaultAllowedPrograms are the programs gs runs itself
+var defaultAllowedPrograms = []string{"git", "gh", "go", "benchstat", "vim", "sqlite3", "jj", "sl", "hg", "security", "secret-tool", "powershell", "stty"}
+
+// longCommandTimeout is used for builds and benchmarks, which routinely take minutes
+const longCommandTimeout = 30 * time.Minute
+
+// execSettings is set when the config is loaded
+var execSettings = ExecConfig{TimeoutSeconds: 120}
+
+// Command is an external program with its arguments. Programs are run directly, never through
+// a shell, so arguments are passed through exactly as given.
+type Command struct {
+	Program     string
+	Args        []string
+	Dir         string
+	Stdin       io.Reader
+	ShowStderr  bool          // copy stderr to the terminal as well as capturing it
+	Interactive bool          // connect the program to the terminal and don't time it out, e.g. for the editor
+	Timeout     time.Duration // 0 means the configured default
+}
+
+// CommandError is a failed command along with what it printed to stderr
+type CommandError struct {
+	Command string
+	Err     error
+	Stderr  string
+}
+
+func (e *CommandError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("%s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s: %v\n%s", e.Command, e.Err, e.Stderr)
+}
+
+// newCommand creates a command for program with the given arguments
+func newCommand(program string, args ...string) *Command {
+	return &Command{Program: program, Args: args}
+}
+
+// String renders the command for logs and error messages
+func (c *Command) String() string {
+	parts := []string{c.Program}
+	for _, arg := range c.Args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'") {
+			arg = strconv.Quote(arg)
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// isAllowedProgram reports whether program is one of the defaults or allowed in the config. A
+// path is only allowed if it's listed, or is the file an allowed name runs from PATH, so
+// ./git or /tmp/x/git can't pass for git.
+func isAllowedProgram(program string) bool {
+	allowedPrograms := append(append([]string{}, defaultAllowedPrograms...), execSettings.Allow...)
+	for _, allowed := range allowedPrograms {
+		if program == allowed {
+			return true
+		}
+	}
+	if !strings.ContainsRune(program, filepath.Separator) && !strings.Contains(program, "/") {
+		return false
+	}
+	info, err := os.Stat(program)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowedPrograms {
+		resolved, err := exec.LookPath(allowed)
+		if err != nil {
+			continue
+		}
+		if resolvedInfo, err := os.Stat(resolved); err == nil && os.SameFile(info, resolvedInfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// programAvailable reports whether program is allowed and installed
+func programAvailable(program string) bool {
+	if !isAllowedProgram(program) {
+		return false
+	}
+	_, err := exec.LookPath(program)
+	return err == nil
+}
+
+// Output runs the command and returns its stdout. Failures include the captured stderr.
+func (c *Command) Output() ([]byte, error) {
+	if !isAllowedProgram(c.Program) {
+		Log(ERROR, "Refusing to run %s, it is not an allowed program", c.Program)
+		return nil, fmt.Errorf("%s is not an allowed program. Add it to exec.allow in your config to run it", c.Program)
+	}
+	if capability := networkCapability(c); capability != "" {
+		if err := requireNetwork(capability); err != nil {
+			return nil, err
+		}
+	}
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(execSettings.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if !c.Interactive && timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, c.Program, c.Args...)
+	cmd.Dir = c.Dir
+	var stdout, stderr bytes.Buffer
+	if c.Interactive {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else {
+		cmd.Stdin = c.Stdin
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if c.ShowStderr {
+			cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		}
+	}
+
+	Log(DEBUG, "Running %s", c)
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	if err != nil {
+		return stdout.Bytes(), &CommandError{Command: c.String(), Err: err, Stderr: strings.TrimSpace(stderr.String())}
+	}
+	return stdout.Bytes(), nil
+}
+
+// Run runs the command, discarding its output
+func (c *Command) Run() error {
+	_, err := c.Output()
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsAllowedProgram(t *testing.T) {
+	git, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git isn't installed")
+	}
+	fake := filepath.Join(t.TempDir(), "git")
+	if err := ioutil.WriteFile(fake, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tool := filepath.Join(t.TempDir(), "tool")
+	if err := ioutil.WriteFile(tool, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := execSettings
+	execSettings.Allow = []string{"make", tool}
+	defer func() { execSettings = previous }()
+
+	tests := []struct {
+		program string
+		want    bool
+	}{
+		{"git", true},
+		{"make", true},
+		{"rm", false},
+		{git, true},
+		{fake, false},
+		{"./git", false},
+		{"bin/git", false},
+		{tool, true},
+		{"tool", false},
+	}
+	for _, test := range tests {
+		if got := isAllowedProgram(test.program); got != test.want {
+			t.Errorf("isAllowedProgram(%s) = %v, want %v", test.program, got, test.want)
+		}
+	}
+}
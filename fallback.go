@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+)
+
+// modelsUsed are the models that answered requests in this run, recorded for attestations
+var modelsUsed = struct {
+	sync.Mutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// recordModelUsed notes that a model answered a request
+func recordModelUsed(llmConfig LLMConfig) {
+	modelsUsed.Lock()
+	defer modelsUsed.Unlock()
+	modelsUsed.names[llmConfig.Model] = true
+}
+
+// usedModels returns the models that answered requests in this run
+func usedModels() []string {
+	modelsUsed.Lock()
+	defer modelsUsed.Unlock()
+	var names []string
+	for name := range modelsUsed.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FallbackModel is one model of llm.fallback_models. In the config it's either the name of a
+// model from the same provider or an object, for models served elsewhere such as a local one.
+type FallbackModel struct {
+	Model         string `json:"model"`
+	Provider      string `json:"provider"`       // default llm.provider
+	Endpoint      string `json:"endpoint"`       // default llm.endpoint when the provider is the same
+	APIKeyEnv     string `json:"api_key_env"`    // variable holding its key, default llm.api_key when the provider is the same
+	ContextWindow int    `json:"context_window"` // default from the model name
+
+	// APIKey is the key from APIKeyEnv, or the provider's own default when that differs from
+	// llm.provider, resolved by LoadConfig
+	APIKey string `json:"-"`
+}
+
+func (m *FallbackModel) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*m = FallbackModel{Model: name}
+		return nil
+	}
+	type plain FallbackModel
+	return json.Unmarshal(data, (*plain)(m))
+}
+
+// fallbackConfig returns the LLM config for a fallback model
+func fallbackConfig(llmConfig LLMConfig, fallback FallbackModel) LLMConfig {
+	if fallback.Provider != "" && fallback.Provider != llmConfig.Provider {
+		llmConfig.Provider = fallback.Provider
+		llmConfig.Endpoint = ""
+		llmConfig.APIKey = fallback.APIKey
+	}
+	if fallback.APIKeyEnv != "" {
+		llmConfig.APIKey = fallback.APIKey
+	}
+	if fallback.Endpoint != "" {
+		llmConfig.Endpoint = fallback.Endpoint
+	}
+	llmConfig.Model = fallback.Model
+	llmConfig.ContextWindow = fallback.ContextWindow
+	return llmConfig
+}
+
+// modelChain returns the configs to try a request with in order: the model, then its fallbacks.
+// Fallbacks without a key are left out.
+func modelChain(llmConfig LLMConfig) []LLMConfig {
+	chain := []LLMConfig{llmConfig}
+	for _, fallback := range llmConfig.FallbackModels {
+		candidate := fallbackConfig(llmConfig, fallback)
+		if candidate.APIKey == "" {
+			continue
+		}
+		duplicate := false
+		for _, seen := range chain {
+			duplicate = duplicate || seen.Model == candidate.Model && seen.Provider == candidate.Provider && seen.Endpoint == candidate.Endpoint
+		}
+		if !duplicate {
+			chain = append(chain, candidate)
+		}
+	}
+	return chain
+}
+
+// fitsContext reports whether a prompt of about promptTokens tokens and the reply fit in the
+// model's context window
+func fitsContext(llmConfig LLMConfig, promptTokens int) bool {
+	reply := llmConfig.MaxTokens
+	if reply <= 0 {
+		reply = defaultReplyTokens
+	}
+	return promptTokens+reply <= contextWindow(llmConfig)
+}
+
+// fittingModels leaves out the models of the chain whose context the prompt doesn't fit. If it
+// fits none, the whole chain is kept, as the estimate may be off.
+func fittingModels(chain []LLMConfig, promptTokens int) []LLMConfig {
+	var fitting []LLMConfig
+	for _, candidate := range chain {
+		if fitsContext(candidate, promptTokens) {
+			fitting = append(fitting, candidate)
+		} else if len(chain) > 1 {
+			Log(INFO, "Skipping %s, the prompt is about %d tokens and its context is %d", candidate.Model, promptTokens, contextWindow(candidate))
+		}
+	}
+	if len(fitting) == 0 {
+		return chain
+	}
+	return fitting
+}
+
+// largestContextWindow returns the largest context window of the model and its fallbacks, which
+// diffs are sized for since the models too small for them are skipped
+func largestContextWindow(llmConfig LLMConfig) int {
+	largest := 0
+	for _, candidate := range modelChain(llmConfig) {
+		if window := contextWindow(candidate); window > largest {
+			largest = window
+		}
+	}
+	return largest
+}
+
+// fallsBack reports whether a failure of one model is worth trying the next model for
+func fallsBack(kind ErrorKind) bool {
+	switch kind {
+	case ErrInvalidModel, ErrProviderUnavailable, ErrRateLimit, ErrQuota, ErrContextOverflow:
+		return true
+	}
+	return false
+}
+
+// promptTokens estimates the size of a chat request's messages in tokens
+func promptTokens(messages []ChatMessage) int {
+	tokens := 0
+	for _, message := range messages {
+		tokens += estimateTokens(message.Content)
+	}
+	return tokens
+}
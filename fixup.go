@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// maxFixupCandidates caps how many of the branch's most recent commits are checked as fixup targets
+const maxFixupCandidates = 20
+
+// FixupTarget is an earlier commit on the branch that the staged changes look like a fix for
+type FixupTarget struct {
+	SHA     string
+	Subject string
+	Reason  string
+}
+
+// diffFootprint is the set of files and functions a diff touches
+type diffFootprint struct {
+	files     map[string]bool
+	functions map[string]bool
+}
+
+// footprintOf collects the files of a diff and the function names git puts in its hunk headers
+func footprintOf(diff string) diffFootprint {
+	footprint := diffFootprint{files: make(map[string]bool), functions: make(map[string]bool)}
+	for _, file := range splitDiffByFile(diff) {
+		footprint.files[file.Path] = true
+		for _, line := range strings.Split(file.Content, "\n") {
+			if !strings.HasPrefix(line, "@@ ") {
+				continue
+			}
+			parts := strings.SplitN(line, "@@", 3)
+			if len(parts) == 3 {
+				if function := strings.TrimSpace(parts[2]); function != "" {
+					footprint.functions[file.Path+"\x00"+function] = true
+				}
+			}
+		}
+	}
+	return footprint
+}
+
+// covers reports whether the footprint touches every file of other and, if other's hunks have
+// function names, at least one of the same functions
+func (f diffFootprint) covers(other diffFootprint) bool {
+	for file := range other.files {
+		if !f.files[file] {
+			return false
+		}
+	}
+	if len(other.functions) == 0 {
+		return true
+	}
+	for function := range other.functions {
+		if f.functions[function] {
+			return true
+		}
+	}
+	return false
+}
+
+// findFixupTarget returns the commit on the branch that the staged changes clearly belong to:
+// the only one of the recent commits that touched all the staged files and the same functions
+func findFixupTarget(targetBranch string, stagedDiff string) (FixupTarget, bool) {
+	output, err := newCommand("git", "log", fmt.Sprintf("-n%d", maxFixupCandidates), "--no-merges", "--format=%H %s", targetBranch+"..HEAD").Output()
+	if err != nil {
+		Log(DEBUG, "Not looking for a fixup target: %v", err)
+		return FixupTarget{}, false
+	}
+	staged := footprintOf(stagedDiff)
+	if len(staged.files) == 0 {
+		return FixupTarget{}, false
+	}
+
+	var matches []FixupTarget
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[1], "fixup! ") || strings.HasPrefix(parts[1], "squash! ") {
+			continue
+		}
+		diff, err := newCommand("git", "show", "--format=", parts[0]).Output()
+		if err != nil {
+			Log(DEBUG, "Skipping %s as a fixup target: %v", parts[0], err)
+			continue
+		}
+		if footprintOf(string(diff)).covers(staged) {
+			reason := fmt.Sprintf("it changed the same %d files", len(staged.files))
+			if len(staged.functions) > 0 {
+				reason += " and functions"
+			}
+			matches = append(matches, FixupTarget{SHA: parts[0], Subject: parts[1], Reason: reason})
+		}
+	}
+	// With several candidates it isn't clear which one the change belongs to
+	if len(matches) != 1 {
+		Log(DEBUG, "Found %d fixup candidates, not offering a fixup", len(matches))
+		return FixupTarget{}, false
+	}
+	return matches[0], true
+}
+
+// offerFixup asks whether to commit the staged changes as a fixup of the target, when there's a
+// terminal to ask on
+func offerFixup(target FixupTarget) bool {
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	fmt.Printf("The staged changes look like a fix to %s %q (%s).\n", target.SHA[:7], target.Subject, target.Reason)
+	fmt.Print("Create a fixup! commit for it instead of a new commit? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y"
+}
+
+// commitFixup commits the staged changes as a fixup of the target, to be squashed into it by
+// git rebase --autosquash
+func commitFixup(target FixupTarget) error {
+	Log(INFO, "Creating fixup commit for %s", target.SHA)
+	cmd := &Command{Program: "git", Args: []string{"commit", "--fixup=" + target.SHA}, ShowStderr: true}
+	if err := cmd.Run(); err != nil {
+		Log(ERROR, "Failed to create fixup commit: %v", err)
+		return fmt.Errorf("failed to create fixup commit: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FirstLineFormat describes how the first line of a commit message is structured
+type FirstLineFormat struct {
+	Pattern    string      `json:"pattern"`
+	Examples   []string    `json:"examples"`
+	ScopeRules []ScopeRule `json:"scope_rules"`
+	InferScope bool        `json:"infer_scope"`
+	InferType  bool        `json:"infer_type"` // classify the conventional commit type instead of letting the model pick it
+}
+
+// ScopeRule maps changed paths under a prefix to the scope used in the first line
+type ScopeRule struct {
+	Path  string `json:"path"`
+	Scope string `json:"scope"`
+}
+
+// defaultFirstLineFormat returns the first-line convention used when the config doesn't define one
+func defaultFirstLineFormat() FirstLineFormat {
+	return FirstLineFormat{
+		Pattern: "<subdirectory of the repo> <common directory of the file changes>: <brief title of the changes>",
+		Examples: []string{
+			"go ingester_worker: Adds implementation for receiving LLM requests",
+			"client dashboard_settings: add LLM settings to UI",
+			"go gql_api: Defines GraphQL API for auth signin",
+			"database/migrations: Adds new migrations for new tables",
+			"client map: fixes bug with map view",
+		},
+		InferScope: true,
+	}
+}
+
+// buildFirstLinePrompt renders the first-line rules into instructions for the LLM.
+func buildFirstLinePrompt(format FirstLineFormat) string {
+	if format.Pattern == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("The first line of the commit message should be structured as follows:\n")
+	sb.WriteString(format.Pattern + "\n")
+	for _, example := range format.Examples {
+		sb.WriteString(fmt.Sprintf("Example: %s\n", example))
+	}
+
+	if len(format.ScopeRules) > 0 {
+		sb.WriteString("Use these scopes for changes under the following paths:\n")
+		for _, rule := range format.ScopeRules {
+			sb.WriteString(fmt.Sprintf("- %s -> %s\n", rule.Path, rule.Scope))
+		}
+	}
+
+	return sb.String()
+}
+
+// scopePrompt tells the LLM which scope the first line must use. It's sent with the diff rather
+// than in the system prompt so the system prompt stays the same between commits and can be cached.
+func scopePrompt(scope string) string {
+	if scope == "" {
+		return ""
+	}
+	return fmt.Sprintf("The first line MUST start with exactly \"%s: \". Do not invent a different scope.\n\n", scope)
+}
+
+// typePrompt tells the LLM which conventional commit type the first line must use
+func typePrompt(commitType string) string {
+	if commitType == "" {
+		return ""
+	}
+	return fmt.Sprintf("The commit type is \"%s\". Use it as the type in the first line.\n\n", commitType)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// FreshnessConfig controls the server's periodic check for PR descriptions that fell behind
+// their branch
+type FreshnessConfig struct {
+	Repos           []string `json:"repos"`             // "owner/name" repositories to scan; none turns the check off
+	IntervalMinutes int      `json:"interval_minutes"`  // default 60
+	MinCommits      int      `json:"min_commits"`       // commits since generation that make a description stale, default 3
+	MinChangedLines int      `json:"min_changed_lines"` // or lines changed since generation, default 200
+	Action          string   `json:"action"`            // "comment" (default) or "refresh"
+}
+
+// generatedMarkerPattern finds the head a description or section was generated from
+var generatedMarkerPattern = regexp.MustCompile(`<!-- gitscribe:generated-from ([0-9a-f]{7,40}) -->`)
+
+// freshnessNudgeMarker marks the nudge comment for a description generated from a head, so the
+// same description is only nudged once
+const freshnessNudgeMarker = "<!-- gitscribe:freshness %s -->"
+
+// generatedMarker records the head a description was generated from
+func generatedMarker(sha string) string {
+	return fmt.Sprintf("<!-- gitscribe:generated-from %s -->", sha)
+}
+
+// generatedFrom returns the head the PR's description was last generated from
+func generatedFrom(body string) (string, bool) {
+	matches := generatedMarkerPattern.FindAllStringSubmatch(body, -1)
+	if len(matches) == 0 {
+		return "", false
+	}
+	return matches[len(matches)-1][1], true
+}
+
+// markGenerated appends the marker for the current head to a generated description, so the server
+// can tell when the branch has moved on from it
+func markGenerated(messageFile string) error {
+	output, err := newCommand("git", "rev-parse", headRev).Output()
+	if err != nil {
+		return newError(ErrGitState, "failed to get HEAD: %v", err)
+	}
+	file, err := os.OpenFile(messageFile, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open message file: %v", err)
+	}
+	defer file.Close()
+	_, err = file.WriteString("\n\n" + generatedMarker(strings.TrimSpace(string(output))) + "\n")
+	return err
+}
+
+// listOpenPullRequests returns the open PRs of a repository
+func listOpenPullRequests(repo string) ([]PullRequest, error) {
+	var prs []PullRequest
+	err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls?state=open&per_page=100", repo), nil, &prs)
+	return prs, err
+}
+
+// staleness compares the PR's head with the head its description was generated from and returns
+// why the description is stale, or "" if it isn't
+func staleness(repo string, pr PullRequest, generated string, config FreshnessConfig) (string, error) {
+	if strings.HasPrefix(pr.Head.SHA, generated) {
+		return "", nil
+	}
+	commits, diff, err := compareCommits(repo, generated, pr.Head.SHA)
+	if err != nil {
+		return "", err
+	}
+	commitCount := 0
+	if commits != "" {
+		commitCount = len(strings.Split(commits, "\n"))
+	}
+	changed := 0
+	for _, file := range splitDiffByFile(diff) {
+		changed += file.Added + file.Removed
+	}
+
+	if commitCount >= config.MinCommits || changed >= config.MinChangedLines {
+		return fmt.Sprintf("%d commits and %d changed lines", commitCount, changed), nil
+	}
+	return "", nil
+}
+
+// nudgeStalePR asks the author to refresh the description, once per generated description
+func nudgeStalePR(repo string, pr PullRequest, generated string, reason string) error {
+	marker := fmt.Sprintf(freshnessNudgeMarker, generated)
+	comments, err := listIssueComments(repo, pr.Number)
+	if err != nil {
+		return err
+	}
+	for _, comment := range comments {
+		if strings.Contains(comment.Body, marker) {
+			return nil
+		}
+	}
+	comment := fmt.Sprintf("The branch has %s since this description was generated from %s, so it may be out of date. Run `gs -pr` again or update it by hand.\n\n%s",
+		reason, generated[:7], marker)
+	url, err := postIssueComment(repo, pr.Number, comment)
+	if err != nil {
+		return err
+	}
+	Log(INFO, "Nudged stale description on %s#%d: %s", repo, pr.Number, url)
+	return nil
+}
+
+// refreshStalePR regenerates the sections the server owns. Descriptions written or edited by
+// people are never rewritten, so PRs without such sections get a nudge instead.
+func refreshStalePR(ctx context.Context, repo string, pr PullRequest, generated string, reason string, config Config) error {
+	if isDependencyBotPR(pr, config.Server.DependencyBots) && strings.Contains(pr.Body, dependencyImpactMarker) {
+		// A refresh the judge held back is waiting in a suggestion comment until someone accepts it
+		comments, err := listIssueComments(repo, pr.Number)
+		if err != nil {
+			return err
+		}
+		for _, comment := range comments {
+			if content, ok := extractSuggestion(comment.Body, dependencyImpactMarker); ok && strings.Contains(content, generatedMarker(pr.Head.SHA)) {
+				return nil
+			}
+		}
+		Log(INFO, "Refreshing impact analysis on %s#%d after %s", repo, pr.Number, reason)
+		return enrichDependencyPR(ctx, repo, pr, config)
+	}
+	return nudgeStalePR(repo, pr, generated, reason)
+}
+
+// checkFreshness scans the configured repositories once for stale descriptions
+func (s *webhookServer) checkFreshness() {
+	config := s.currentConfig()
+	freshness := config.Server.Freshness
+	for _, repo := range freshness.Repos {
+		prs, err := listOpenPullRequests(repo)
+		if err != nil {
+			Log(ERROR, "Failed to list open PRs of %s: %v", repo, err)
+			continue
+		}
+		for _, pr := range prs {
+			if atomic.LoadInt32(&s.draining) == 1 {
+				return
+			}
+			generated, ok := generatedFrom(pr.Body)
+			if !ok {
+				continue
+			}
+			reason, err := staleness(repo, pr, generated, freshness)
+			if err != nil {
+				Log(WARN, "Failed to compare %s#%d with %s: %v", repo, pr.Number, generated, err)
+				continue
+			}
+			if reason == "" {
+				continue
+			}
+
+			if strings.ToLower(freshness.Action) == "refresh" {
+				err = refreshStalePR(context.Background(), repo, pr, generated, reason, config)
+			} else {
+				err = nudgeStalePR(repo, pr, generated, reason)
+			}
+			result := "success"
+			if err != nil {
+				Log(ERROR, "Failed to handle stale description on %s#%d: %v", repo, pr.Number, err)
+				result = "error"
+			}
+			metrics.add("gitscribe_stale_descriptions_total", 1, "result", result)
+		}
+	}
+}
+
+// watchFreshness runs the freshness check every interval. The interval and repositories are read
+// from the current config each time, so reloads apply to the next scan.
+func watchFreshness(s *webhookServer) {
+	for {
+		freshness := s.currentConfig().Server.Freshness
+		time.Sleep(time.Duration(freshness.IntervalMinutes) * time.Minute)
+		if atomic.LoadInt32(&s.draining) == 1 {
+			return
+		}
+		if len(s.currentConfig().Server.Freshness.Repos) > 0 {
+			s.checkFreshness()
+		}
+	}
+}
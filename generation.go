@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// GenerationSettings overrides llm's model, temperature and max tokens for one kind of message,
+// for example a lower temperature for commit messages than for PR descriptions
+type GenerationSettings struct {
+	Model         string   `json:"model"`          // used instead of llm.model and llm.model_tiers
+	ContextWindow int      `json:"context_window"` // of model, default from the model name
+	Temperature   *float64 `json:"temperature"`    // a pointer, as 0 is a temperature too
+	MaxTokens     int      `json:"max_tokens"`
+
+	SystemPromptFile string           `json:"system_prompt_file"` // replaces the whole built-in system prompt; only the template is added to it
+	Examples         []FewShotExample `json:"examples"`           // shown to the model as earlier requests and their replies
+}
+
+// FewShotExample is the input of an earlier message and the message the team wrote for it. The
+// input is a diff for commit messages and the commit subjects for PR descriptions.
+type FewShotExample struct {
+	Input      string `json:"input"`
+	InputFile  string `json:"input_file"` // instead of input
+	Output     string `json:"output"`
+	OutputFile string `json:"output_file"` // instead of output
+}
+
+// check rejects settings the provider would refuse. name is where they are in the config.
+func (s GenerationSettings) check(name string) error {
+	if s.Temperature != nil && !validTemperature(*s.Temperature) {
+		return fmt.Errorf("%s.temperature %g in config is out of range: use 0 to 2", name, *s.Temperature)
+	}
+	if s.MaxTokens < 0 {
+		return fmt.Errorf("%s.max_tokens in config can't be negative", name)
+	}
+	return nil
+}
+
+// loadSystemPrompts reads the system prompt files of commit messages and PR descriptions
+func loadSystemPrompts(llmConfig *LLMConfig) error {
+	prompts := []struct {
+		name   string
+		file   *string
+		prompt *string
+	}{
+		{"llm.commit", &llmConfig.Commit.SystemPromptFile, &llmConfig.Prompts.CommitSystem},
+		{"llm.pr", &llmConfig.PR.SystemPromptFile, &llmConfig.Prompts.PRSystem},
+	}
+	for _, prompt := range prompts {
+		if *prompt.file == "" {
+			continue
+		}
+		*prompt.file = expandPath(*prompt.file)
+		data, err := ioutil.ReadFile(*prompt.file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s.system_prompt_file: %v", prompt.name, err)
+		}
+		if strings.TrimSpace(string(data)) == "" {
+			return fmt.Errorf("%s.system_prompt_file %s is empty", prompt.name, *prompt.file)
+		}
+		*prompt.prompt = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+// loadExamples reads the files of the few-shot examples of commit messages and PR descriptions
+func loadExamples(llmConfig *LLMConfig) error {
+	kinds := []struct {
+		name     string
+		examples []FewShotExample
+	}{{"llm.commit", llmConfig.Commit.Examples}, {"llm.pr", llmConfig.PR.Examples}}
+	for _, kind := range kinds {
+		for i := range kind.examples {
+			example := &kind.examples[i]
+			fields := []struct {
+				name string
+				file *string
+				text *string
+			}{{"input", &example.InputFile, &example.Input}, {"output", &example.OutputFile, &example.Output}}
+			for _, field := range fields {
+				if *field.file != "" {
+					*field.file = expandPath(*field.file)
+					data, err := ioutil.ReadFile(*field.file)
+					if err != nil {
+						return fmt.Errorf("failed to read %s.examples[%d].%s_file: %v", kind.name, i, field.name, err)
+					}
+					*field.text = string(data)
+				}
+				if strings.TrimSpace(*field.text) == "" {
+					return fmt.Errorf("%s.examples[%d] in config has no %s: set %s or %s_file", kind.name, i, field.name, field.name, field.name)
+				}
+				*field.text = strings.TrimSpace(*field.text)
+			}
+		}
+	}
+	return nil
+}
+
+// fewShotMessages returns the examples as earlier turns of the conversation: each input as the
+// request would send it, and its output as the reply
+func fewShotMessages(examples []FewShotExample, request func(input string) string, reply func(output string) string) []ChatMessage {
+	var messages []ChatMessage
+	for _, example := range examples {
+		messages = append(messages,
+			ChatMessage{Role: "user", Content: request(example.Input)},
+			ChatMessage{Role: "assistant", Content: reply(example.Output)},
+		)
+	}
+	return messages
+}
+
+// exampleTokens estimates the tokens the commit message examples take from the diff's budget
+func exampleTokens(llmConfig LLMConfig) int {
+	tokens := 0
+	for _, example := range llmConfig.Commit.Examples {
+		tokens += estimateTokens(example.Input) + estimateTokens(example.Output)
+	}
+	return tokens
+}
+
+// validTemperature reports whether providers take a sampling temperature
+func validTemperature(temperature float64) bool {
+	return temperature >= 0 && temperature <= 2
+}
+
+// merge returns the settings with the ones set in override replacing them
+func (s GenerationSettings) merge(override GenerationSettings) GenerationSettings {
+	if override.Model != "" {
+		s.Model, s.ContextWindow = override.Model, override.ContextWindow
+	}
+	if override.Temperature != nil {
+		s.Temperature = override.Temperature
+	}
+	if override.MaxTokens != 0 {
+		s.MaxTokens = override.MaxTokens
+	}
+	return s
+}
+
+// withGeneration returns the LLM config with the settings applied
+func (c LLMConfig) withGeneration(s GenerationSettings) LLMConfig {
+	if s.Model != "" {
+		// A model picked for the command is meant, whatever the size of the diff
+		c.Model, c.ContextWindow, c.ModelTiers = s.Model, s.ContextWindow, nil
+	}
+	if s.Temperature != nil {
+		c.Temperature = *s.Temperature
+	}
+	if s.MaxTokens != 0 {
+		c.MaxTokens = s.MaxTokens
+	}
+	Log(DEBUG, "Generating with %s, temperature %g, up to %d tokens", c.Model, c.Temperature, c.MaxTokens)
+	return c
+}
+
+// optionalFloatFlag is a float flag that tells whether it was given, for values where 0 means
+// something
+type optionalFloatFlag struct {
+	value *float64
+}
+
+func (f *optionalFloatFlag) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f.value, 'g', -1, 64)
+}
+
+func (f *optionalFloatFlag) Set(value string) error {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("not a number: %s", value)
+	}
+	f.value = &parsed
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CheckRunOutput is the output block shown on a check run's page
+type CheckRunOutput struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// CheckRunRequest is the request body for creating a check run
+type CheckRunRequest struct {
+	Name       string         `json:"name"`
+	HeadSHA    string         `json:"head_sha"`
+	Status     string         `json:"status"`
+	Conclusion string         `json:"conclusion,omitempty"`
+	Output     CheckRunOutput `json:"output"`
+}
+
+// PullRequest is the subset of a GitHub pull request that we use
+type PullRequest struct {
+	Number int    `json:"number"`
+	Title  string `json:"title"`
+	Body   string `json:"body"`
+	User   struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	Base struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"base"`
+	Head struct {
+		Ref string `json:"ref"`
+		SHA string `json:"sha"`
+	} `json:"head"`
+}
+
+// ReviewComment is an inline comment on a pull request diff
+type ReviewComment struct {
+	ID          int64  `json:"id"`
+	InReplyToID int64  `json:"in_reply_to_id"`
+	Path        string `json:"path"`
+	Line        int    `json:"line"`
+	DiffHunk    string `json:"diff_hunk"`
+	Body        string `json:"body"`
+	User        struct {
+		Login string `json:"login"`
+	} `json:"user"`
+}
+
+// IssueComment is a comment on the conversation of an issue or pull request
+type IssueComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+	User struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	AuthorAssociation string `json:"author_association"`
+}
+
+// Review is a submitted pull request review
+type Review struct {
+	ID   int64 `json:"id"`
+	User struct {
+		Login string `json:"login"`
+	} `json:"user"`
+	State       string `json:"state"`
+	CommitID    string `json:"commit_id"`
+	SubmittedAt string `json:"submitted_at"`
+}
+
+// DraftReviewComment is an inline comment of a review being submitted
+type DraftReviewComment struct {
+	Path      string `json:"path"`
+	Line      int    `json:"line"`
+	Side      string `json:"side"`
+	StartLine int    `json:"start_line,omitempty"`
+	StartSide string `json:"start_side,omitempty"`
+	Body      string `json:"body"`
+}
+
+// ReviewThread is a top-level review comment together with its replies
+type ReviewThread struct {
+	Root    ReviewComment
+	Replies []ReviewComment
+}
+
+// maxCheckRunSummary is GitHub's limit on the size of a check run summary
+const maxCheckRunSummary = 65535
+
+// ghAPI calls the GitHub REST API through the gh CLI, which takes care of authentication.
+// If body is non-nil it's sent as JSON, and if out is non-nil the response is decoded into it.
+func ghAPI(method string, endpoint string, body interface{}, out interface{}) error {
+	Log(DEBUG, "Calling GitHub API: %s %s", method, endpoint)
+	if err := requireNetwork("the GitHub API"); err != nil {
+		return err
+	}
+	if !programAvailable("gh") {
+		Log(ERROR, "GitHub CLI (gh) not found")
+		return fmt.Errorf("GitHub CLI (gh) not found. Please install it from https://cli.github.com/")
+	}
+
+	args := []string{"api", "--method", method, endpoint}
+	var stdin []byte
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %v", err)
+		}
+		stdin = data
+		args = append(args, "--input", "-")
+	}
+
+	cmd := newCommand("gh", args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "GitHub API call %s %s failed: %v", method, endpoint, err)
+		return newError(ghErrorKind(err.Error()), "GitHub API call %s %s failed: %v", method, endpoint, err)
+	}
+
+	if out != nil && len(output) > 0 {
+		if err := json.Unmarshal(output, out); err != nil {
+			return fmt.Errorf("failed to parse GitHub API response: %v", err)
+		}
+	}
+	return nil
+}
+
+// ghAPIDiff fetches an API resource in diff format instead of JSON
+func ghAPIDiff(endpoint string) (string, error) {
+	return ghAPIRaw(endpoint, "application/vnd.github.diff")
+}
+
+// ghAPIRaw fetches an API resource and returns the raw response body. accept may be empty.
+func ghAPIRaw(endpoint string, accept string) (string, error) {
+	Log(DEBUG, "Fetching raw response from GitHub API: %s", endpoint)
+	if err := requireNetwork("the GitHub API"); err != nil {
+		return "", err
+	}
+	args := []string{"api", endpoint}
+	if accept != "" {
+		args = append(args, "-H", "Accept: "+accept)
+	}
+	output, err := newCommand("gh", args...).Output()
+	if err != nil {
+		Log(ERROR, "GitHub API call GET %s failed: %v", endpoint, err)
+		return "", newError(ghErrorKind(err.Error()), "GitHub API call GET %s failed: %v", endpoint, err)
+	}
+	return string(output), nil
+}
+
+// ghErrorKind classifies a failed gh call from its error output
+func ghErrorKind(output string) ErrorKind {
+	switch {
+	case strings.Contains(output, "HTTP 401") || strings.Contains(output, "gh auth login"):
+		return ErrAuth
+	case strings.Contains(output, "rate limit"):
+		return ErrRateLimit
+	default:
+		return ErrUnknown
+	}
+}
+
+// publishCheckRun creates a completed check run on the given commit with a markdown summary
+func publishCheckRun(repo string, headSHA string, name string, title string, summary string) (string, error) {
+	Log(INFO, "Publishing check run %q on %s@%s", name, repo, headSHA)
+	if len(summary) > maxCheckRunSummary {
+		Log(WARN, "Check run summary is %d bytes, truncating to GitHub's limit", len(summary))
+		summary = cutAtRune(summary, maxCheckRunSummary)
+	}
+
+	request := CheckRunRequest{
+		Name:       name,
+		HeadSHA:    headSHA,
+		Status:     "completed",
+		Conclusion: "neutral",
+		Output:     CheckRunOutput{Title: title, Summary: summary},
+	}
+
+	var response struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := ghAPI("POST", fmt.Sprintf("repos/%s/check-runs", repo), request, &response); err != nil {
+		return "", err
+	}
+	return response.HTMLURL, nil
+}
+
+// currentRepo returns the "owner/name" of the GitHub repository we're working in, cached by
+// the checkout's path
+func currentRepo() (string, error) {
+	if repo := os.Getenv("GITHUB_REPOSITORY"); repo != "" {
+		return repo, nil
+	}
+	root, err := repoRoot()
+	if err != nil {
+		return viewCurrentRepo()
+	}
+	var repo string
+	err = cachedFetch("repo", root, &repo, func() (interface{}, error) {
+		return viewCurrentRepo()
+	})
+	return repo, err
+}
+
+// viewCurrentRepo asks gh which GitHub repository the checkout's remotes point at
+func viewCurrentRepo() (string, error) {
+	cmd := newCommand("gh", "repo", "view", "--json", "nameWithOwner", "-q", ".nameWithOwner")
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to determine GitHub repository: %v", err)
+		return "", fmt.Errorf("failed to determine GitHub repository: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// getPullRequest fetches a pull request by number
+func getPullRequest(repo string, number int) (PullRequest, error) {
+	var pr PullRequest
+	err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls/%d", repo, number), nil, &pr)
+	return pr, err
+}
+
+// getPullRequestDiff fetches the full diff of a pull request
+func getPullRequestDiff(repo string, number int) (string, error) {
+	Log(INFO, "Fetching diff for PR #%d", number)
+	cmd := newCommand("gh", "pr", "diff", fmt.Sprintf("%d", number), "--repo", repo)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to fetch PR diff: %v", err)
+		return "", fmt.Errorf("failed to fetch diff for PR #%d: %v", number, err)
+	}
+	return string(output), nil
+}
+
+// getPullRequestCommits returns the subjects of the commits in a pull request, oldest first
+func getPullRequestCommits(repo string, number int) (string, error) {
+	var commits []struct {
+		Commit struct {
+			Message string `json:"message"`
+		} `json:"commit"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls/%d/commits?per_page=100", repo, number), nil, &commits); err != nil {
+		return "", err
+	}
+
+	var subjects []string
+	for _, c := range commits {
+		subjects = append(subjects, strings.SplitN(c.Commit.Message, "\n", 2)[0])
+	}
+	return strings.Join(subjects, "\n"), nil
+}
+
+// listReviewThreads fetches the inline review comments of a pull request grouped into threads
+func listReviewThreads(repo string, number int) ([]ReviewThread, error) {
+	var comments []ReviewComment
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls/%d/comments?per_page=100", repo, number), nil, &comments); err != nil {
+		return nil, err
+	}
+
+	var threads []ReviewThread
+	index := make(map[int64]int)
+	for _, c := range comments {
+		if c.InReplyToID == 0 {
+			index[c.ID] = len(threads)
+			threads = append(threads, ReviewThread{Root: c})
+		}
+	}
+	for _, c := range comments {
+		if i, ok := index[c.InReplyToID]; ok {
+			threads[i].Replies = append(threads[i].Replies, c)
+		}
+	}
+	return threads, nil
+}
+
+// replyToReviewComment posts a reply in the thread started by the given review comment
+func replyToReviewComment(repo string, number int, commentID int64, body string) (string, error) {
+	var response struct {
+		HTMLURL string `json:"html_url"`
+	}
+	endpoint := fmt.Sprintf("repos/%s/pulls/%d/comments/%d/replies", repo, number, commentID)
+	if err := ghAPI("POST", endpoint, map[string]string{"body": body}, &response); err != nil {
+		return "", err
+	}
+	return response.HTMLURL, nil
+}
+
+// postReview submits a review of the given commit of a pull request with inline comments, without
+// approving or requesting changes
+func postReview(repo string, number int, commitID string, body string, comments []DraftReviewComment) (string, error) {
+	request := map[string]interface{}{"commit_id": commitID, "event": "COMMENT", "body": body, "comments": comments}
+	var response struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := ghAPI("POST", fmt.Sprintf("repos/%s/pulls/%d/reviews", repo, number), request, &response); err != nil {
+		return "", err
+	}
+	return response.HTMLURL, nil
+}
+
+// postIssueComment posts a top-level comment on a pull request's conversation
+func postIssueComment(repo string, number int, body string) (string, error) {
+	var response struct {
+		HTMLURL string `json:"html_url"`
+	}
+	endpoint := fmt.Sprintf("repos/%s/issues/%d/comments", repo, number)
+	if err := ghAPI("POST", endpoint, map[string]string{"body": body}, &response); err != nil {
+		return "", err
+	}
+	return response.HTMLURL, nil
+}
+
+// listIssueComments fetches the conversation comments of an issue or pull request, oldest first
+func listIssueComments(repo string, number int) ([]IssueComment, error) {
+	var comments []IssueComment
+	err := ghAPI("GET", fmt.Sprintf("repos/%s/issues/%d/comments?per_page=100", repo, number), nil, &comments)
+	return comments, err
+}
+
+// listReviews fetches the submitted reviews of a pull request, oldest first
+func listReviews(repo string, number int) ([]Review, error) {
+	var reviews []Review
+	err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls/%d/reviews?per_page=100", repo, number), nil, &reviews)
+	return reviews, err
+}
+
+// compareCommits returns the subjects of the commits between two refs and the diff between them
+func compareCommits(repo string, base string, head string) (string, string, error) {
+	endpoint := fmt.Sprintf("repos/%s/compare/%s...%s", repo, base, head)
+	var comparison struct {
+		Commits []struct {
+			Commit struct {
+				Message string `json:"message"`
+			} `json:"commit"`
+		} `json:"commits"`
+	}
+	if err := ghAPI("GET", endpoint, nil, &comparison); err != nil {
+		return "", "", err
+	}
+
+	var subjects []string
+	for _, c := range comparison.Commits {
+		subjects = append(subjects, strings.SplitN(c.Commit.Message, "\n", 2)[0])
+	}
+
+	diff, err := ghAPIDiff(endpoint)
+	if err != nil {
+		return "", "", err
+	}
+	return strings.Join(subjects, "\n"), diff, nil
+}
+
+// currentGitHubUser returns the login of the user gh is authenticated as
+func currentGitHubUser() (string, error) {
+	var user struct {
+		Login string `json:"login"`
+	}
+	err := ghAPI("GET", "user", nil, &user)
+	return user.Login, err
+}
+
+// currentPullRequestNumber returns the number of the open PR for the current branch
+func currentPullRequestNumber() (int, error) {
+	cmd := newCommand("gh", "pr", "view", "--json", "number", "-q", ".number")
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to find PR for current branch: %v", err)
+		return 0, fmt.Errorf("failed to find a pull request for the current branch: %v", err)
+	}
+	var number int
+	if _, err := fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &number); err != nil {
+		return 0, fmt.Errorf("unexpected output from gh pr view: %s", string(output))
+	}
+	return number, nil
+}
+
+// createIssue files a new issue and returns its URL
+func createIssue(repo string, title string, body string, labels []string) (string, error) {
+	request := map[string]interface{}{"title": title, "body": body}
+	if len(labels) > 0 {
+		request["labels"] = labels
+	}
+	var response struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := ghAPI("POST", fmt.Sprintf("repos/%s/issues", repo), request, &response); err != nil {
+		return "", err
+	}
+	return response.HTMLURL, nil
+}
+
+// updatePullRequestBodyAPI replaces the body of a PR through the REST API
+func updatePullRequestBodyAPI(repo string, number int, body string) error {
+	return ghAPI("PATCH", fmt.Sprintf("repos/%s/pulls/%d", repo, number), map[string]string{"body": body}, nil)
+}
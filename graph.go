@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CommitGraphConfig controls embedding a Mermaid commit graph in PR descriptions
+type CommitGraphConfig struct {
+	Enabled    bool `json:"enabled"`
+	MinCommits int  `json:"min_commits"` // only add the graph to branches with at least this many commits
+}
+
+// graphCommit is a commit on the branch along with its parents
+type graphCommit struct {
+	SHA     string
+	Parents []string
+	Subject string
+}
+
+// getBranchGraph lists the commits on the current branch that aren't on the target branch, oldest first
+func getBranchGraph(targetBranch string) ([]graphCommit, error) {
+	Log(INFO, "Getting commit graph for branch against %s", targetBranch)
+	cmd := newCommand("git", "log", "--topo-order", "--reverse", "--format=%h%x00%p%x00%s", targetBranch+".."+headRev)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to get commit graph: %v", err)
+		return nil, fmt.Errorf("failed to get commit graph: %v", err)
+	}
+
+	var commits []graphCommit
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		parts := strings.SplitN(line, "\x00", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		commits = append(commits, graphCommit{
+			SHA:     parts[0],
+			Parents: strings.Fields(parts[1]),
+			Subject: parts[2],
+		})
+	}
+	return commits, nil
+}
+
+// renderMermaidGraph renders the commits as a Mermaid flowchart, drawing an edge from each
+// parent to its child. Parents outside the branch are drawn as the target branch.
+func renderMermaidGraph(commits []graphCommit, targetBranch string) string {
+	onBranch := make(map[string]bool, len(commits))
+	for _, c := range commits {
+		onBranch[c.SHA] = true
+	}
+
+	var sb strings.Builder
+	sb.WriteString("```mermaid\ngraph TD\n")
+	sb.WriteString(fmt.Sprintf("  base([\"%s\"])\n", escapeMermaidLabel(targetBranch)))
+	for _, c := range commits {
+		sb.WriteString(fmt.Sprintf("  c%s[\"%s %s\"]\n", c.SHA, c.SHA, escapeMermaidLabel(c.Subject)))
+	}
+	for _, c := range commits {
+		for _, parent := range c.Parents {
+			if onBranch[parent] {
+				sb.WriteString(fmt.Sprintf("  c%s --> c%s\n", parent, c.SHA))
+			} else {
+				sb.WriteString(fmt.Sprintf("  base --> c%s\n", c.SHA))
+			}
+		}
+	}
+	sb.WriteString("```")
+	return sb.String()
+}
+
+// escapeMermaidLabel makes a string safe to use inside a quoted Mermaid node label
+func escapeMermaidLabel(s string) string {
+	// Shorten before escaping, so an escape isn't cut in half
+	if runes := []rune(s); len(runes) > 60 {
+		s = string(runes[:57]) + "..."
+	}
+	return strings.ReplaceAll(s, "\"", "#quot;")
+}
+
+// buildCommitGraphSection renders the commit graph section, or "" if the branch is too small for one
+func buildCommitGraphSection(targetBranch string, graphConfig CommitGraphConfig) (string, error) {
+	commits, err := getBranchGraph(targetBranch)
+	if err != nil {
+		return "", err
+	}
+	if len(commits) < graphConfig.MinCommits {
+		Log(DEBUG, "Branch has %d commits, below the %d needed for a commit graph", len(commits), graphConfig.MinCommits)
+		return "", nil
+	}
+
+	Log(INFO, "Adding commit graph with %d commits to PR message", len(commits))
+	return "## Commit graph\n\n" + renderMermaidGraph(commits, targetBranch), nil
+}
@@ -1,20 +1,63 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"strings"
 	"path/filepath"
 	"encoding/json"
+	"time"
 )
 
 // Config structure to hold file paths and settings
 type Config struct {
-	CommitTemplate string    `json:"commit_template"`
-	PRTemplate     string    `json:"pr_template"`
-	LLM            LLMConfig `json:"llm"`
+	CommitTemplate   string                   `json:"commit_template"`
+	PRTemplate       string                   `json:"pr_template"`
+	AreaTemplates    []AreaTemplate           `json:"pr_area_templates"` // composed into pr_template when the branch touches their paths
+	TemplateRegistry string                   `json:"template_registry"` // git URL of a registry of template packs
+	TemplatePacks    []TemplatePack           `json:"template_packs"`    // installed packs, pinned to a version
+	HumanSections    []HumanSection           `json:"human_sections"`    // written by the author, never by the LLM
+	Calendar         CalendarConfig           `json:"calendar"`          // time zone, locale and sprints for template variables
+	LLM              LLMConfig                `json:"llm"`
+	CommitFormat     *FirstLineFormat         `json:"commit_format"`
+	CommitBudget     MessageBudget            `json:"commit_budget"`
+	PRGraph          CommitGraphConfig        `json:"pr_graph"`
+	Architecture     ArchitectureConfig       `json:"architecture"`
+	Security         SecurityConfig           `json:"security"`
+	Owners           OwnersConfig             `json:"owners"`
+	License          LicenseConfig            `json:"license"`
+	SizeReport       SizeReportConfig         `json:"size_report"`
+	Benchmarks       BenchmarkConfig          `json:"benchmarks"`
+	ReviewEffort     ReviewEffortConfig       `json:"review_effort"`
+	Workspace        WorkspaceConfig          `json:"workspace"`
+	Vendor           VendorConfig             `json:"vendor"`
+	Server           ServerConfig             `json:"server"`
+	Toolchain        ToolchainConfig          `json:"toolchain"`
+	Infra            InfraConfig              `json:"infra"`
+	FollowUps        FollowUpsConfig          `json:"follow_ups"`
+	Telemetry        TelemetryConfig          `json:"telemetry"`
+	Exec             ExecConfig               `json:"exec"`
+	Consent          map[string]ConsentRecord `json:"consent"` // keyed by repository root
+	Judge            JudgeConfig              `json:"judge"`
+	History          HistoryConfig            `json:"history"`
+	Attestation      AttestationConfig        `json:"attestation"`
+	Redaction        RedactionConfig          `json:"redaction"` // applied to every prompt before it's sent
+	Usage            UsageConfig              `json:"usage"`
+	PostProcess      PostProcessConfig        `json:"post_process"` // steps generated messages go through
+	Cache            CacheConfig              `json:"cache"`        // metadata read from GitHub
+	Bot              BotConfig                `json:"bot"`          // who commits gs writes on its own are by
+	Keychain         KeychainConfig           `json:"keychain"`     // keys stored with gs auth login
+	ModelPolicy      ModelPolicyConfig        `json:"model_policy"` // providers and models each class of repository may use
+	Offline          bool                     `json:"offline"`      // turn off everything that needs the network
+	Phabricator      PhabricatorConfig        `json:"phabricator"`
+	SourceHut        SourceHutConfig          `json:"sourcehut"`
+	MergeQueue       MergeQueueConfig         `json:"merge_queue"`
+	Digest           DigestConfig             `json:"digest"` // summaries of merged PRs for gs digest and the server
+	VCS              string                   `json:"vcs"`    // "auto" (default), "git", "jj", "sl" or "hg"
+	Path             string                   `json:"-"`      // the user's own config, where consent and installed packs are written; never the repository's
+	Layers           []string                 `json:"-"`      // every file merged into the config, in order
 }
 
 // expandPath expands the tilde in file paths to the user's home directory
@@ -33,14 +76,32 @@ func expandPath(path string) string {
 	return path
 }
 
-// loadConfig reads the configuration file.
-func loadConfig(configPath string) (Config, error) {
-	Log(INFO, "Loading config from: %s", configPath)
+// envOrFile returns the environment variable name, or the contents of the file named by
+// name_FILE, which is how secrets are usually mounted into containers
+func envOrFile(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	file := os.Getenv(name + "_FILE")
+	if file == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		Log(WARN, "Failed to read %s_FILE %s: %v", name, file, err)
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// loadConfig reads the configuration files, each overriding the ones before it.
+func loadConfig(configPaths ...string) (Config, error) {
+	Log(INFO, "Loading config from: %s", strings.Join(configPaths, ", "))
 	var config Config
-	data, err := ioutil.ReadFile(configPath)
+	data, err := mergeConfigLayers(configPaths)
 	if err != nil {
-		Log(ERROR, "Failed to read config file: %v", err)
-		return config, fmt.Errorf("failed to read config file: %v", err)
+		Log(ERROR, "Failed to load config: %v", err)
+		return config, err
 	}
 	if err := json.Unmarshal(data, &config); err != nil {
 		Log(ERROR, "Failed to parse config file: %v", err)
@@ -51,8 +112,33 @@ func loadConfig(configPath string) (Config, error) {
 	Log(DEBUG, "Expanding template paths")
 	config.CommitTemplate = expandPath(config.CommitTemplate)
 	config.PRTemplate = expandPath(config.PRTemplate)
+	config.Calendar.SprintFile = expandPath(config.Calendar.SprintFile)
+	config.Attestation.KeyFile = expandPath(config.Attestation.KeyFile)
+	config.Attestation.Dir = expandPath(config.Attestation.Dir)
+	for i := range config.AreaTemplates {
+		config.AreaTemplates[i].Template = expandPath(config.AreaTemplates[i].Template)
+		if config.AreaTemplates[i].Name == "" {
+			config.AreaTemplates[i].Name = strings.Join(config.AreaTemplates[i].Paths, ", ")
+		}
+	}
 	
 	// Set default LLM values if not provided
+	if !isValidProvider(config.LLM.Provider) {
+		return config, fmt.Errorf("unknown llm.provider %q in config: use openai, ollama or mock", config.LLM.Provider)
+	}
+	if config.LLM.Provider == "ollama" {
+		applyOllamaDefaults(&config.LLM.Ollama)
+		if config.LLM.Model == "" {
+			config.LLM.Model = defaultOllamaModel
+		}
+		// Every model has to be pulled into the server, so the cheap model defaults to the same one
+		if config.LLM.Pipeline.CheapModel == "" {
+			config.LLM.Pipeline.CheapModel = config.LLM.Model
+		}
+	}
+	if config.LLM.Model == "" && config.LLM.Provider == "mock" {
+		config.LLM.Model = "mock"
+	}
 	if config.LLM.Model == "" {
 		Log(DEBUG, "Setting default LLM model: gpt-4")
 		config.LLM.Model = "gpt-4"
@@ -66,17 +152,272 @@ func loadConfig(configPath string) (Config, error) {
 		config.LLM.MaxTokens = 1000
 	}
 	
+	if err := loadSystemPrompts(&config.LLM); err != nil {
+		return config, err
+	}
+	if err := loadExamples(&config.LLM); err != nil {
+		return config, err
+	}
+	// Fall back to the built-in first-line convention if none is configured. A system prompt
+	// file replaces it, so then there's none.
+	if config.CommitFormat == nil && config.LLM.Prompts.CommitSystem != "" {
+		Log(DEBUG, "No commit_format configured, and llm.commit.system_prompt_file replaces the default")
+		config.CommitFormat = &FirstLineFormat{}
+	}
+	if config.CommitFormat == nil {
+		Log(DEBUG, "No commit_format configured, using default first-line format")
+		defaultFormat := defaultFirstLineFormat()
+		config.CommitFormat = &defaultFormat
+	}
+
+	if config.Security.Label == "" {
+		config.Security.Label = "security-review"
+	}
+	if len(config.Security.Checklist) == 0 {
+		config.Security.Checklist = defaultSecurityChecklist()
+	}
+
+	if len(config.License.Extensions) == 0 {
+		config.License.Extensions = []string{".go", ".js", ".ts", ".tsx", ".py", ".java", ".rs", ".c", ".h", ".cpp"}
+	}
+	if len(config.License.VendorPaths) == 0 {
+		config.License.VendorPaths = []string{"vendor/", "third_party/"}
+	}
+	if len(config.License.Incompatible) == 0 {
+		config.License.Incompatible = []string{"GNU General Public License", "GNU Affero General Public License", "AGPL-3.0", "GPL-2.0", "GPL-3.0", "SSPL"}
+	}
+
+	if len(config.Vendor.Paths) == 0 {
+		config.Vendor.Paths = []string{"vendor/", "third_party/"}
+	}
+
+	if config.Server.Addr == "" {
+		config.Server.Addr = ":8080"
+	}
+	if len(config.Server.DependencyBots) == 0 {
+		config.Server.DependencyBots = []string{"dependabot[bot]", "renovate[bot]"}
+	}
+
+	if len(config.FollowUps.Markers) == 0 {
+		config.FollowUps.Markers = []string{"TODO", "FIXME", "HACK"}
+	}
+
+	if config.ReviewEffort.LinesPerHour == 0 {
+		config.ReviewEffort.LinesPerHour = 300
+	}
+	if config.ReviewEffort.SampleSize == 0 {
+		config.ReviewEffort.SampleSize = 30
+	}
+
+	if !isValidVCSSetting(config.VCS) {
+		return config, fmt.Errorf("unknown vcs %q in config: use auto, git, jj, sl or hg", config.VCS)
+	}
+
+	if config.Exec.TimeoutSeconds == 0 {
+		config.Exec.TimeoutSeconds = 120
+	}
+
+	if config.Server.ShutdownTimeout == 0 {
+		config.Server.ShutdownTimeout = 30
+	}
+	if config.Server.DeliveryDir == "" {
+		config.Server.DeliveryDir = "~/.gitscribe/deliveries"
+	}
+	config.Server.DeliveryDir = expandPath(config.Server.DeliveryDir)
+	if config.Server.Queue.Workers == 0 {
+		config.Server.Queue.Workers = 2
+	}
+	if config.Server.Queue.Capacity == 0 {
+		config.Server.Queue.Capacity = 100
+	}
+	if config.Server.Queue.MaxAttempts == 0 {
+		config.Server.Queue.MaxAttempts = 3
+	}
+	if config.Server.Queue.RetryDelay == 0 {
+		config.Server.Queue.RetryDelay = 10
+	}
+	if config.Server.Freshness.IntervalMinutes == 0 {
+		config.Server.Freshness.IntervalMinutes = 60
+	}
+	if config.Server.Freshness.MinCommits == 0 {
+		config.Server.Freshness.MinCommits = 3
+	}
+	if config.Server.Freshness.MinChangedLines == 0 {
+		config.Server.Freshness.MinChangedLines = 200
+	}
+	if config.Digest.Days == 0 {
+		config.Digest.Days = 7
+	}
+
+	if config.LLM.Pipeline.CheapModel == "" {
+		config.LLM.Pipeline.CheapModel = "gpt-4o-mini"
+	}
+	if config.LLM.Pipeline.StrongModel == "" {
+		config.LLM.Pipeline.StrongModel = config.LLM.Model
+	}
+	if config.LLM.Pipeline.MinDiffBytes == 0 {
+		config.LLM.Pipeline.MinDiffBytes = 20000
+	}
+	if config.LLM.Pipeline.Concurrency <= 0 {
+		config.LLM.Pipeline.Concurrency = defaultSummaryConcurrency
+	}
+	if config.LLM.Pipeline.OnOverflow == "" {
+		config.LLM.Pipeline.OnOverflow = "summarize"
+	}
+	if config.LLM.Pipeline.OnOverflow != "summarize" && config.LLM.Pipeline.OnOverflow != "trim" {
+		return config, fmt.Errorf("unknown llm.pipeline.on_overflow %q in config: use summarize or trim", config.LLM.Pipeline.OnOverflow)
+	}
+	if config.LLM.Vision.Model == "" {
+		config.LLM.Vision.Model = config.LLM.Model
+	}
+	if config.LLM.Vision.MaxImages == 0 {
+		config.LLM.Vision.MaxImages = 4
+	}
+	if config.LLM.Vision.MaxBytes == 0 {
+		config.LLM.Vision.MaxBytes = 1 << 20
+	}
+	if config.LLM.StructuredDiffs.MinBytes == 0 {
+		config.LLM.StructuredDiffs.MinBytes = 4000
+	}
+	if config.LLM.MaxRetries == 0 {
+		config.LLM.MaxRetries = 2
+	}
+	if config.LLM.FallbackModel != "" {
+		config.LLM.FallbackModels = append([]FallbackModel{{Model: config.LLM.FallbackModel}}, config.LLM.FallbackModels...)
+	}
+	if err := config.LLM.Commit.check("llm.commit"); err != nil {
+		return config, err
+	}
+	if err := config.LLM.PR.check("llm.pr"); err != nil {
+		return config, err
+	}
+	for _, tier := range config.LLM.ModelTiers {
+		if tier.Model == "" {
+			return config, fmt.Errorf("an entry of llm.model_tiers in config has no model")
+		}
+	}
+	if mode := strings.ToLower(config.Usage.Mode); mode != "" && mode != "local" && mode != "off" {
+		return config, fmt.Errorf("unknown usage.mode %q in config: use local or off", config.Usage.Mode)
+	}
+	if err := checkCacheConfig(config.Cache); err != nil {
+		return config, err
+	}
+	if err := applyRepoOverrides(&config); err != nil {
+		return config, err
+	}
+	if err := checkKeychainConfig(config.Keychain); err != nil {
+		return config, err
+	}
+	if err := checkBotConfig(config.Bot); err != nil {
+		return config, err
+	}
+	if err := checkModelPolicyConfig(config.ModelPolicy); err != nil {
+		return config, err
+	}
+	if err := checkDigestConfig(config); err != nil {
+		return config, err
+	}
+	if config.Redaction.policy, err = compileRedactionPolicy(config.Redaction); err != nil {
+		return config, fmt.Errorf("invalid redaction policy in config: %v", err)
+	}
+	if err := compilePostProcessing(&config.PostProcess); err != nil {
+		return config, err
+	}
+	for _, fallback := range config.LLM.FallbackModels {
+		if fallback.Model == "" {
+			return config, fmt.Errorf("an entry of llm.fallback_models in config has no model")
+		}
+		if !isValidProvider(fallback.Provider) {
+			return config, fmt.Errorf("unknown provider %q for fallback model %s in config: use openai, ollama or mock", fallback.Provider, fallback.Model)
+		}
+		// A local fallback needs the Ollama server settings even when the model isn't local
+		if fallback.Provider == "ollama" {
+			applyOllamaDefaults(&config.LLM.Ollama)
+		}
+	}
+	if config.LLM.CABundle != "" {
+		if _, err := loadCABundle(config.LLM.CABundle); err != nil {
+			return config, fmt.Errorf("invalid llm.ca_bundle in config: %v", err)
+		}
+	}
+	if config.LLM.TimeoutSeconds == 0 {
+		config.LLM.TimeoutSeconds = 120
+	}
+	if config.LLM.ProseDiffs.MinShare == 0 {
+		config.LLM.ProseDiffs.MinShare = 0.6
+	}
+
+	if config.Owners.SlowSLAHours == 0 {
+		config.Owners.SlowSLAHours = 24
+	}
+
+	if config.Judge.Model == "" {
+		config.Judge.Model = config.LLM.Model
+	}
+	if config.Judge.Threshold == 0 {
+		config.Judge.Threshold = 0.7
+	}
+
 	// Try to get API key from environment if not in config
 	if config.LLM.APIKey == "" {
 		Log(DEBUG, "API key not found in config, checking environment")
-		config.LLM.APIKey = os.Getenv("OPENAI_KEY")
-		if config.LLM.APIKey == "" {
-			Log(WARN, "OPENAI_KEY not found in environment")
-		} else {
+		config.LLM.APIKey = envOrFile("OPENAI_KEY")
+		if config.LLM.APIKey != "" {
 			Log(DEBUG, "OPENAI_KEY found in environment with length: %d", len(config.LLM.APIKey))
 		}
 	}
+	if config.Phabricator.Token == "" {
+		config.Phabricator.Token = envOrFile("PHABRICATOR_TOKEN")
+	}
+	if config.SourceHut.Token == "" {
+		config.SourceHut.Token = envOrFile("SRHT_TOKEN")
+	}
+	// Local servers don't check the key, but requests without one are refused before they're sent
+	if (config.Offline || airgapBuild || config.LLM.Provider == "ollama" || config.LLM.Provider == "mock") && config.LLM.APIKey == "" {
+		config.LLM.APIKey = "local"
+	}
+	// Keys in neither the config nor the environment may have been stored with gs auth login
+	if config.LLM.APIKey == "" {
+		config.LLM.APIKey = keychainKey(config.Keychain, "openai")
+		if config.LLM.APIKey == "" {
+			Log(WARN, "OPENAI_KEY not found in environment or keychain")
+		}
+	}
+	// A fallback on another provider gets that provider's key rather than llm.api_key
+	for i := range config.LLM.FallbackModels {
+		fallback := &config.LLM.FallbackModels[i]
+		switch {
+		case fallback.APIKeyEnv != "":
+			fallback.APIKey = envOrFile(fallback.APIKeyEnv)
+		case fallback.Provider == "" || fallback.Provider == config.LLM.Provider:
+			continue
+		case config.Offline || airgapBuild || fallback.Provider == "ollama" || fallback.Provider == "mock":
+			fallback.APIKey = "local"
+		default:
+			fallback.APIKey = envOrFile("OPENAI_KEY")
+			if fallback.APIKey == "" {
+				fallback.APIKey = keychainKey(config.Keychain, "openai")
+			}
+		}
+		if fallback.APIKey == "" {
+			Log(WARN, "No API key for fallback model %s, so it's skipped: set its api_key_env", fallback.Model)
+		}
+	}
+	if config.Phabricator.Token == "" && config.Phabricator.URL != "" {
+		config.Phabricator.Token = keychainKey(config.Keychain, "phabricator")
+	}
+	if config.SourceHut.Token == "" && len(config.SourceHut.Remotes) > 0 {
+		config.SourceHut.Token = keychainKey(config.Keychain, "sourcehut")
+	}
 	
+	for _, configPath := range configPaths {
+		if absPath, err := filepath.Abs(configPath); err == nil {
+			configPath = absPath
+		}
+		config.Layers = append(config.Layers, configPath)
+	}
+	config.Path = userConfigPath(config.Layers)
+
 	Log(INFO, "Config loaded successfully")
 	return config, nil
 }
@@ -84,11 +425,11 @@ func loadConfig(configPath string) (Config, error) {
 // getStagedDiff retrieves the diff of staged changes.
 func getStagedDiff() (string, error) {
 	Log(INFO, "Getting staged diff from git")
-	cmd := exec.Command("git", "diff", "--cached")
+	cmd := newCommand("git", "diff", "--cached")
 	output, err := cmd.Output()
 	if err != nil {
 		Log(ERROR, "Failed to get staged diff: %v", err)
-		return "", fmt.Errorf("failed to get staged diff: %v", err)
+		return "", newError(ErrGitState, "failed to get staged diff: %v", err)
 	}
 	diffSize := len(output)
 	Log(DEBUG, "Retrieved staged diff (%d bytes)", diffSize)
@@ -96,26 +437,91 @@ func getStagedDiff() (string, error) {
 }
 
 // createCommitMessage generates a commit message using the template file and LLM.
-func createCommitMessage(diff string, templatePath string, llmConfig LLMConfig) (string, error) {
+func createCommitMessage(ctx context.Context, diff string, templatePath string, llmConfig LLMConfig, format FirstLineFormat, budget MessageBudget, style string) (string, error) {
 	Log(INFO, "Creating commit message using template: %s", templatePath)
 	if diff == "" {
 		Log(ERROR, "No changes staged for commit")
-		return "", fmt.Errorf("no changes staged. Please stage changes before committing.")
+		return "", newError(ErrGitState, "no changes staged. Please stage changes before committing.")
 	}
 
 	Log(DEBUG, "Reading commit template file")
-	template, err := ioutil.ReadFile(templatePath)
+	template, err := readTemplate(templatePath, "commit")
 	if err != nil {
 		Log(ERROR, "Failed to read commit template: %v", err)
-		return "", fmt.Errorf("failed to read commit template: %v", err)
+		return "", err
+	}
+
+	// Work out the scope from the changed paths rather than leaving it to the model
+	scope := inferScope(changedPathsFromDiff(diff), format)
+	if scope != "" {
+		Log(INFO, "Inferred commit scope: %s", scope)
+	}
+
+	// Whitespace and comment changes don't need the model, which would only pad them out
+	if message, ok, err := trivialCommitMessage(splitDiffByFile(diff), scope, format); ok || err != nil {
+		if err != nil {
+			return "", err
+		}
+		return postProcess(postProcessSettings.commit, message, postProcessInput{Template: template})
+	}
+	llmConfig = selectModel(diff, llmConfig)
+
+	commitType := ""
+	if format.InferType {
+		commitType, err = inferCommitType(ctx, diff, llmConfig)
+		if err != nil {
+			return "", err
+		}
+		if commitType != "" {
+			Log(INFO, "Inferred commit type: %s", commitType)
+		}
+	}
+	// With both, the scope goes in parentheses after the type, as in "feat(auth): "
+	prefix := scope
+	if commitType != "" && scope != "" {
+		prefix = fmt.Sprintf("%s(%s)", commitType, scope)
+	}
+
+	if proseHeavy(splitDiffByFile(diff), llmConfig.ProseDiffs) {
+		Log(INFO, "Change is mostly documentation, using docs conventions")
+		style += docsStylePrompt
 	}
 
 	// Generate commit message using LLM
 	Log(INFO, "Generating commit message using LLM model: %s", llmConfig.Model)
-	message, err := GenerateCommitMessage(diff, llmConfig, string(template))
+	options := CommitOptions{Format: format, Scope: prefix, Budget: budget, Style: style, Type: commitType, Stream: messageStream(llmConfig)}
+	// Binary diffs of images say nothing, so the vision model describes what they look like
+	visual := stagedVisualChanges(ctx, llmConfig)
+	var message string
+	if usePipeline(diff, llmConfig) {
+		message, err = runPipeline(ctx, "commit message", diff, template, llmConfig, func(summaries string, cheap LLMConfig) (string, error) {
+			return GenerateCommitMessage(ctx, "Summaries of the change to each file:\n"+summaries+visual, cheap, template, options)
+		})
+	} else if overflowsContext(diff, llmConfig) {
+		var summaries string
+		summaries, err = summarizeOverflow(ctx, diff, llmConfig)
+		if err == nil {
+			message, err = GenerateCommitMessage(ctx, "Summaries of the change to each file:\n"+summaries+visual, llmConfig, template, options)
+		}
+	} else {
+		var omitted []string
+		message, omitted, err = generateAroundContentFilter(diff, func(diff string) (string, error) {
+			return GenerateCommitMessage(ctx, promptDiff(diff, llmConfig)+visual, llmConfig, template, options)
+		})
+		if len(omitted) > 0 {
+			Log(WARN, "%s", omissionNote(omitted))
+		}
+	}
 	if err != nil {
 		Log(ERROR, "LLM generation failed: %v", err)
-		return "", fmt.Errorf("LLM generation failed: %v", err)
+		return "", fmt.Errorf("LLM generation failed: %w", err)
+	}
+	input := postProcessInput{Prefix: prefix, Budget: budget, Template: template}
+	if scope == "" {
+		input.CommitType = commitType
+	}
+	if message, err = postProcess(postProcessSettings.commit, message, input); err != nil {
+		return "", err
 	}
 	
 	Log(DEBUG, "Commit message generated successfully (%d chars)", len(message))
@@ -125,10 +531,7 @@ func createCommitMessage(diff string, templatePath string, llmConfig LLMConfig)
 // openInVim allows the user to edit the commit message.
 func openInVim(filename string) error {
 	Log(INFO, "Opening message in vim: %s", filename)
-	cmd := exec.Command("vim", filename)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := &Command{Program: "vim", Args: []string{filename}, Interactive: true}
 	err := cmd.Run()
 	if err != nil {
 		Log(ERROR, "Error while editing with vim: %v", err)
@@ -138,13 +541,31 @@ func openInVim(filename string) error {
 	return err
 }
 
+// editMessage writes a message to a temporary file, lets the user edit it in vim,
+// and returns the edited contents
+func editMessage(message string) (string, error) {
+	tempFile := filepath.Join(os.TempDir(), fmt.Sprintf("git_message_%d.txt", time.Now().UnixNano()))
+	Log(DEBUG, "Creating temporary message file: %s", tempFile)
+	if err := ioutil.WriteFile(tempFile, []byte(message), 0600); err != nil {
+		return "", fmt.Errorf("failed to write temp file: %v", err)
+	}
+	defer os.Remove(tempFile)
+
+	if err := openInVim(tempFile); err != nil {
+		return "", fmt.Errorf("failed to open editor: %v", err)
+	}
+
+	edited, err := ioutil.ReadFile(tempFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read edited message: %v", err)
+	}
+	return strings.TrimSpace(string(edited)), nil
+}
+
 // commitChanges commits using the edited message.
 func commitChanges(messageFile string) error {
 	Log(INFO, "Committing changes with message file: %s", messageFile)
-	cmd := exec.Command("git", "commit", "-F", messageFile)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd := &Command{Program: "git", Args: []string{"commit", "-F", messageFile}, Interactive: true}
 	err := cmd.Run()
 	if err != nil {
 		Log(ERROR, "Failed to commit changes: %v", err)
@@ -158,13 +579,16 @@ func commitChanges(messageFile string) error {
 func getCommitMessages(targetBranch string) (string, error) {
 	Log(INFO, "Getting commit messages unique to the current branch")
 	// Get current branch name
-	cmdBranch := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
+	cmdBranch := newCommand("git", "rev-parse", "--abbrev-ref", "HEAD")
 	currentBranch, err := cmdBranch.Output()
 	if err != nil {
 		Log(ERROR, "Failed to get current branch: %v", err)
-		return "", fmt.Errorf("failed to get current branch: %v", err)
+		return "", newError(ErrGitState, "failed to get current branch: %v", err)
 	}
 	currentBranchStr := strings.TrimSpace(string(currentBranch))
+	if worktreeless() {
+		currentBranchStr = headRev
+	}
 	Log(DEBUG, "Current branch: %s", currentBranchStr)
 	
 	// Get only commits that are in the current branch but not in the target branch
@@ -173,7 +597,7 @@ func getCommitMessages(targetBranch string) (string, error) {
 	
 	// Use git cherry to find commits unique to the current branch
 	// This is more reliable for finding unique commits than complex log commands
-	cmd := exec.Command("git", "cherry", "-v", targetBranch, currentBranchStr)
+	cmd := newCommand("git", "cherry", "-v", targetBranch, currentBranchStr)
 	output, err := cmd.Output()
 	if err != nil {
 		Log(ERROR, "Failed to get unique commits: %v", err)
@@ -203,27 +627,188 @@ func getCommitMessages(targetBranch string) (string, error) {
 	return result, nil
 }
 
+// getCommitMessagesInRange retrieves the subjects of commits reachable from head but not from base
+func getCommitMessagesInRange(base string, head string) (string, error) {
+	Log(INFO, "Getting commit messages in range %s..%s", base, head)
+	cmd := newCommand("git", "log", "--reverse", "--format=%s", base+".."+head)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to get commits in range: %v", err)
+		return "", fmt.Errorf("failed to get commits in range %s..%s: %v", base, head, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// getDiffInRange retrieves the diff of head against its merge base with base
+func getDiffInRange(base string, head string) (string, error) {
+	Log(INFO, "Getting diff for %s...%s", base, head)
+	cmd := newCommand("git", "diff", base+"..."+head)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to get diff in range: %v", err)
+		return "", fmt.Errorf("failed to get diff for %s...%s: %v", base, head, err)
+	}
+	Log(DEBUG, "Retrieved range diff (%d bytes)", len(output))
+	return string(output), nil
+}
+
+// getMergeBase returns the best common ancestor of the target branch and HEAD
+func getMergeBase(targetBranch string) (string, error) {
+	cmd := newCommand("git", "merge-base", targetBranch, headRev)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to get merge base: %v", err)
+		return "", newError(ErrGitState, "failed to get merge base with %s: %v", targetBranch, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// getChangedFilesInRange lists the paths changed on head since its merge base with base
+func getChangedFilesInRange(base string, head string) ([]string, error) {
+	cmd := newCommand("git", "diff", "--name-only", base+"..."+head)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to list changed files: %v", err)
+		return nil, fmt.Errorf("failed to list changed files for %s...%s: %v", base, head, err)
+	}
+	var files []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// getAddedFilesInRange lists the paths added on head since its merge base with base
+func getAddedFilesInRange(base string, head string) ([]string, error) {
+	cmd := newCommand("git", "diff", "--name-only", "--diff-filter=A", base+"..."+head)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to list added files: %v", err)
+		return nil, fmt.Errorf("failed to list added files for %s...%s: %v", base, head, err)
+	}
+	var files []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// withWorktree checks out rev into a temporary worktree, calls fn with its path, and removes it again
+func withWorktree(rev string, fn func(dir string) error) error {
+	dir, err := ioutil.TempDir("", "gitscribe_worktree_")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	Log(DEBUG, "Creating worktree for %s in %s", rev, dir)
+	if err := checkoutWorktree(dir, rev); err != nil {
+		Log(ERROR, "Failed to create worktree: %v", err)
+		return fmt.Errorf("failed to create worktree for %s: %v", rev, err)
+	}
+	defer func() {
+		if err := newCommand("git", "worktree", "remove", "--force", dir).Run(); err != nil {
+			Log(WARN, "Failed to remove worktree %s: %v", dir, err)
+		}
+	}()
+
+	return fn(dir)
+}
+
+// gitShowFile returns the contents of a file at the given revision.
+// A file that doesn't exist at that revision is returned as ok=false rather than an error.
+func gitShowFile(rev string, path string) (string, bool) {
+	cmd := newCommand("git", "show", rev+":"+path)
+	output, err := cmd.Output()
+	if err != nil && isMissingObject(err) {
+		// A partial clone that can't reach its promisor remote can still get the file from the host
+		content, fetchErr := fetchFileFromHost(rev, path)
+		if fetchErr == nil {
+			return content, true
+		}
+		Log(WARN, "%s at %s isn't available locally and couldn't be fetched: %v", path, rev, fetchErr)
+	}
+	if err != nil {
+		Log(DEBUG, "%s does not exist at %s: %v", path, rev, err)
+		return "", false
+	}
+	return string(output), true
+}
+
+// gitListFiles lists the files directly inside dir at the given revision, with their paths from
+// the top of the repository. A directory that doesn't exist has no files.
+func gitListFiles(rev string, dir string) ([]string, error) {
+	// git refuses an empty pathspec, and without one lists the top of the tree
+	args := []string{"ls-tree", "--name-only", "--full-tree", rev}
+	if dir != "" && dir != "." {
+		dir = strings.TrimSuffix(dir, "/") + "/"
+		args = append(args, dir)
+	}
+	cmd := newCommand("git", args...)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files in %s at %s: %v", dir, rev, err)
+	}
+	var files []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
 // createPRMessage generates a PR message using the template file, commit messages, and LLM
-func createPRMessage(commits string, templatePath string, llmConfig LLMConfig) (string, error) {
+func createPRMessage(ctx context.Context, commits string, targetBranch string, templatePath string, areas []AreaTemplate, human []HumanSection, llmConfig LLMConfig) (string, error) {
 	Log(INFO, "Creating PR message using template: %s", templatePath)
 	if commits == "" {
 		Log(ERROR, "No commits found between branches")
-		return "", fmt.Errorf("no commits found between branches. Please make some commits first.")
+		return "", newError(ErrGitState, "no commits found between branches. Please make some commits first.")
 	}
 
 	Log(DEBUG, "Reading PR template file")
-	template, err := ioutil.ReadFile(templatePath)
+	template, err := buildPRTemplate(targetBranch, templatePath, areas)
 	if err != nil {
-		Log(ERROR, "Failed to read PR template: %v", err)
-		return "", fmt.Errorf("failed to read PR template: %v", err)
+		return "", err
 	}
+	// Human-only sections stay out of the prompt and are added back for the author at the end
+	template, humanTemplate := withoutHumanSections(template, human)
 
+	var diff string
+	if llmConfig.Pipeline.Enabled || len(llmConfig.ModelTiers) > 0 {
+		diff, err = currentVCS().BranchDiff(targetBranch)
+		if err != nil {
+			return "", err
+		}
+		llmConfig = selectModel(diff, llmConfig)
+	}
+	llmConfig.Prompts.Language = descriptionLanguage(commits, llmConfig)
 	// Generate PR message using LLM
 	Log(INFO, "Generating PR message using LLM model: %s", llmConfig.Model)
-	message, err := GeneratePRMessage(commits, llmConfig, string(template))
+	visual := branchVisualChanges(ctx, targetBranch, llmConfig)
+	var message string
+	if usePipeline(diff, llmConfig) {
+		message, err = runPipeline(ctx, "PR description", diff, template, llmConfig, func(summaries string, cheap LLMConfig) (string, error) {
+			return GeneratePRMessage(ctx, commits+"\n\nSummaries of the change to each file:\n"+summaries+visual, cheap, template, messageStream(llmConfig))
+		})
+	} else {
+		message, err = GeneratePRMessage(ctx, commits+visual, llmConfig, template, messageStream(llmConfig))
+	}
 	if err != nil {
 		Log(ERROR, "LLM generation failed: %v", err)
-		return "", fmt.Errorf("LLM generation failed: %v", err)
+		return "", fmt.Errorf("LLM generation failed: %w", err)
+	}
+	message, _ = withoutHumanSections(message, human)
+	if llmConfig.Prompts.Language != "" {
+		message = normalizeLanguage(ctx, message, llmConfig.Prompts.Language, llmConfig)
+	}
+	message = appendSections(message, renderHumanSections(human, humanTemplate))
+	if message, err = postProcess(postProcessSettings.pr, message, postProcessInput{Template: template}); err != nil {
+		return "", err
 	}
 	
 	Log(DEBUG, "PR message generated successfully (%d chars)", len(message))
@@ -231,43 +816,42 @@ func createPRMessage(commits string, templatePath string, llmConfig LLMConfig) (
 }
 
 // createPullRequest creates a PR on GitHub using the gh CLI
-func createPullRequest(prMessageFile string, targetBranch string) (string, error) {
+func createPullRequest(prMessageFile string, targetBranch string, extras PRExtras) (string, error) {
 	Log(INFO, "Creating pull request to target branch: %s", targetBranch)
+	if err := requireNetwork("creating pull requests"); err != nil {
+		return "", err
+	}
+	if vcs := currentVCS(); vcs.Name() != "git" {
+		return "", newError(ErrGitState, "creating PRs from %s isn't supported yet. Push the branch yourself and create the PR with gh pr create --head <branch> --body-file %s", vcs.Name(), prMessageFile)
+	}
 	// Check if gh CLI is installed
-	if _, err := exec.LookPath("gh"); err != nil {
+	if !programAvailable("gh") {
 		Log(ERROR, "GitHub CLI (gh) not found")
 		return "", fmt.Errorf("GitHub CLI (gh) not found. Please install it from https://cli.github.com/")
 	}
 	
-	// Get current branch name
-	cmdBranch := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD")
-	currentBranch, err := cmdBranch.Output()
-	if err != nil {
-		Log(ERROR, "Failed to get current branch: %v", err)
-		return "", fmt.Errorf("failed to get current branch: %v", err)
-	}
-	currentBranchStr := strings.TrimSpace(string(currentBranch))
-	Log(DEBUG, "Current branch: %s", currentBranchStr)
-	
-	// Push the current branch to remote
-	Log(INFO, "Pushing commits to remote...")
-	pushCmd := exec.Command("git", "push", "-u", "origin", currentBranchStr)
-	pushCmd.Stdout = os.Stdout
-	pushCmd.Stderr = os.Stderr
-	if err := pushCmd.Run(); err != nil {
-		Log(ERROR, "Failed to push to remote: %v", err)
-		return "", fmt.Errorf("failed to push to remote: %v", err)
+	if _, err := pushCurrentBranch(); err != nil {
+		return "", err
 	}
 	
 	// Create PR using gh CLI
 	Log(INFO, "Creating PR on GitHub...")
-	cmd := exec.Command("gh", "pr", "create", "--base", targetBranch, "--fill", "--body-file", prMessageFile)
+	args := []string{"pr", "create", "--base", targetBranch, "--fill", "--body-file", prMessageFile}
+	if len(extras.Reviewers) > 0 {
+		Log(INFO, "Requesting reviewers: %s", strings.Join(extras.Reviewers, ", "))
+		args = append(args, "--reviewer", strings.Join(extras.Reviewers, ","))
+	}
+	if len(extras.Labels) > 0 {
+		Log(INFO, "Adding labels: %s", strings.Join(extras.Labels, ", "))
+		args = append(args, "--label", strings.Join(extras.Labels, ","))
+	}
+	cmd := newCommand("gh", args...)
 	
 	// Capture the output to get the PR URL
-	output, err := cmd.CombinedOutput()
+	output, err := cmd.Output()
 	if err != nil {
-		Log(ERROR, "Failed to create PR: %v\n%s", err, string(output))
-		return "", fmt.Errorf("failed to create PR: %v\n%s", err, string(output))
+		Log(ERROR, "Failed to create PR: %v", err)
+		return "", fmt.Errorf("failed to create PR: %v", err)
 	}
 	
 	// Extract PR URL from output
@@ -292,9 +876,33 @@ func createPullRequest(prMessageFile string, targetBranch string) (string, error
 	return prURL, nil
 }
 
+// pushCurrentBranch pushes the current branch to origin, setting it as the upstream, and returns
+// its name
+func pushCurrentBranch() (string, error) {
+	cmdBranch := newCommand("git", "rev-parse", "--abbrev-ref", "HEAD")
+	currentBranch, err := cmdBranch.Output()
+	if err != nil {
+		Log(ERROR, "Failed to get current branch: %v", err)
+		return "", newError(ErrGitState, "failed to get current branch: %v", err)
+	}
+	currentBranchStr := strings.TrimSpace(string(currentBranch))
+	Log(DEBUG, "Current branch: %s", currentBranchStr)
+
+	Log(INFO, "Pushing commits to remote...")
+	pushCmd := &Command{Program: "git", Args: []string{"push", "-u", "origin", currentBranchStr}, ShowStderr: true}
+	if err := pushCmd.Run(); err != nil {
+		Log(ERROR, "Failed to push to remote: %v", err)
+		return "", fmt.Errorf("failed to push to remote: %v", err)
+	}
+	return currentBranchStr, nil
+}
+
 // loadConfigFromPrioritizedLocations tries to load config from multiple locations in order of priority
 func loadConfigFromPrioritizedLocations(customPath string) (Config, error) {
 	Log(INFO, "Loading config from prioritized locations")
+	if customPath == "" {
+		customPath = os.Getenv("GITSCRIBE_CONFIG")
+	}
 	// If a custom path is provided, try that first
 	if customPath != "" {
 		Log(DEBUG, "Custom config path provided: %s", customPath)
@@ -302,6 +910,7 @@ func loadConfigFromPrioritizedLocations(customPath string) (Config, error) {
 		config, err := loadConfig(expandedPath)
 		if err == nil {
 			Log(INFO, "Successfully loaded config from custom path")
+			applyProcessSettings(config)
 			return config, nil
 		}
 		// If custom path fails, don't fall back - return the error
@@ -309,47 +918,45 @@ func loadConfigFromPrioritizedLocations(customPath string) (Config, error) {
 		return Config{}, fmt.Errorf("failed to load config from specified path %s: %v", customPath, err)
 	}
 
-	// List of potential config locations in order of priority
-	configLocations := []string{
-		".gitscribe_config.json", // Current working directory
+	// The user's config, with the repository's on top
+	layers := configLayers()
+	if len(layers) == 0 {
+		Log(ERROR, "Could not find config file in any standard location")
+		return Config{}, fmt.Errorf("could not find config file in any standard location: create ~/.gitscribe/.gitscribe_config.json or %s in the repository", repoConfigName)
 	}
-
-	// Add user's home directory location
-	home, err := os.UserHomeDir()
-	if err == nil {
-		homePath := filepath.Join(home, ".gitscribe", ".gitscribe_config.json")
-		Log(DEBUG, "Adding home directory config path: %s", homePath)
-		configLocations = append(configLocations, homePath)
-	} else {
-		Log(WARN, "Could not get user home directory: %v", err)
+	config, err := loadConfig(layers...)
+	if err != nil {
+		return Config{}, err
 	}
+	Log(INFO, "Successfully loaded config from: %s", strings.Join(layers, ", "))
+	applyProcessSettings(config)
+	return config, nil
+}
 
-	// Add executable directory location
-	execPath, err := os.Executable()
-	if err == nil {
-		execDir := filepath.Dir(execPath)
-		execConfigPath := filepath.Join(execDir, ".gitscribe_config.json")
-		Log(DEBUG, "Adding executable directory config path: %s", execConfigPath)
-		configLocations = append(configLocations, execConfigPath)
-	} else {
-		Log(WARN, "Could not get executable path: %v", err)
-	}
+// applyProcessSettings makes the parts of the config that apply to the whole process take effect.
+// They're read without locking, so this is only called once at startup, never on reload.
+func applyProcessSettings(config Config) {
+	execSettings = config.Exec
+	telemetrySettings = config.Telemetry
+	calendarSettings = config.Calendar
+	offlineMode = airgapBuild || config.Offline
+	redactionPolicy = config.Redaction.policy
+	usageSettings = config.Usage
+	postProcessSettings = config.PostProcess
+	cacheSettings = config.Cache
+	botSettings = config.Bot
+	modelPolicySettings = config.ModelPolicy
+	loadedConfig = &config
+}
 
-	// Try each location in order
-	Log(DEBUG, "Trying %d potential config locations", len(configLocations))
-	var lastErr error
-	for _, location := range configLocations {
-		Log(DEBUG, "Trying config location: %s", location)
-		config, err := loadConfig(location)
-		if err == nil {
-			Log(INFO, "Successfully loaded config from: %s", location)
-			return config, nil
-		}
-		lastErr = err
-		Log(DEBUG, "Failed to load from %s: %v", location, err)
+// updatePullRequestBody replaces the body of an existing PR using the gh CLI
+func updatePullRequestBody(prURL string, body string) error {
+	Log(INFO, "Updating body of %s", prURL)
+	cmd := newCommand("gh", "pr", "edit", prURL, "--body-file", "-")
+	cmd.Stdin = strings.NewReader(body)
+	if err := cmd.Run(); err != nil {
+		Log(ERROR, "Failed to update PR body: %v", err)
+		return fmt.Errorf("failed to update PR body: %v", err)
 	}
-
-	// If we get here, we couldn't find a config file
-	Log(ERROR, "Could not find config file in any standard location")
-	return Config{}, fmt.Errorf("could not find config file in any standard location: %v", lastErr)
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testRepo creates a git repository with one commit of files and makes it the working directory
+// for the rest of the test
+func testRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "-A"},
+		{"-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "Initial commit"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, output)
+		}
+	}
+	chdir(t, dir)
+	return dir
+}
+
+// chdir changes the working directory until the test ends
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(previous)
+	})
+}
+
+func TestGitListFiles(t *testing.T) {
+	dir := testRepo(t, map[string]string{
+		"main.go":          "package main\n",
+		"go.mod":           "module example.com/app\n",
+		"pkg/util/util.go": "package util\n",
+		"pkg/pkg.go":       "package pkg\n",
+	})
+	// Paths are from the top of the repository wherever gs runs
+	chdir(t, filepath.Join(dir, "pkg"))
+
+	tests := []struct {
+		dir  string
+		want []string
+	}{
+		{"", []string{"go.mod", "main.go", "pkg"}},
+		{".", []string{"go.mod", "main.go", "pkg"}},
+		{"pkg", []string{"pkg/pkg.go", "pkg/util"}},
+		{"pkg/util/", []string{"pkg/util/util.go"}},
+		{"missing", nil},
+	}
+	for _, test := range tests {
+		files, err := gitListFiles("HEAD", test.dir)
+		if err != nil {
+			t.Errorf("gitListFiles(HEAD, %q) failed: %v", test.dir, err)
+			continue
+		}
+		if !reflect.DeepEqual(files, test.want) {
+			t.Errorf("gitListFiles(HEAD, %q) = %q, want %q", test.dir, files, test.want)
+		}
+	}
+
+	if _, err := gitListFiles("no-such-revision", ""); err == nil {
+		t.Error("gitListFiles of a missing revision succeeded, want an error")
+	}
+}
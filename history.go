@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HistoryConfig controls where the outcome of generated messages is stored. It is off unless a
+// backend is set, and the http backend also needs each user to opt in with gs history opt-in.
+type HistoryConfig struct {
+	Backend     string `json:"backend"`      // "off", "file", "sqlite" or "http"
+	Path        string `json:"path"`         // for file and sqlite, default ~/.gitscribe/history.jsonl or history.db
+	Endpoint    string `json:"endpoint"`     // for http
+	IncludeText bool   `json:"include_text"` // also store the generated and final messages
+}
+
+// MessageRecord is whether a generated message was accepted as is or edited before use
+type MessageRecord struct {
+	Timestamp      string  `json:"timestamp"`
+	Kind           string  `json:"kind"` // "commit" or "pr"
+	Model          string  `json:"model"`
+	Accepted       bool    `json:"accepted"`   // used without changes
+	EditRatio      float64 `json:"edit_ratio"` // share of lines added, removed or changed by the user
+	GeneratedLines int     `json:"generated_lines"`
+	FinalLines     int     `json:"final_lines"`
+	Generated      string  `json:"generated,omitempty"`
+	Final          string  `json:"final,omitempty"`
+}
+
+// HistoryStore is a backend for message records
+type HistoryStore interface {
+	Record(record MessageRecord) error
+	Records() ([]MessageRecord, error)
+}
+
+// historyOptInPath is the per-user marker that allows records to be sent to a remote backend
+func historyOptInPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gitscribe", "history_opt_in"), nil
+}
+
+// historyOptedIn reports whether this user agreed to send message records to a remote backend
+func historyOptedIn() bool {
+	path, err := historyOptInPath()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+// defaultHistoryPath returns the default file for a local backend
+func defaultHistoryPath(name string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gitscribe", name), nil
+}
+
+// openHistoryStore returns the configured backend, or nil if history is off
+func openHistoryStore(config HistoryConfig) (HistoryStore, error) {
+	var err error
+	path := expandPath(config.Path)
+	switch strings.ToLower(config.Backend) {
+	case "", "off":
+		return nil, nil
+	case "file":
+		if path == "" {
+			path, err = defaultHistoryPath("history.jsonl")
+		}
+		return fileHistoryStore{path: path}, err
+	case "sqlite":
+		if path == "" {
+			path, err = defaultHistoryPath("history.db")
+		}
+		return sqliteHistoryStore{path: path}, err
+	case "http":
+		if config.Endpoint == "" {
+			return nil, fmt.Errorf("history.endpoint is required for the http backend")
+		}
+		if err := requireNetwork("the http history backend"); err != nil {
+			return nil, err
+		}
+		if !historyOptedIn() {
+			Log(DEBUG, "Not sending message history, the user hasn't opted in")
+			return nil, nil
+		}
+		return httpHistoryStore{endpoint: config.Endpoint}, nil
+	}
+	return nil, fmt.Errorf("unknown history backend %q", config.Backend)
+}
+
+// fileHistoryStore appends records as JSON lines to a local file
+type fileHistoryStore struct {
+	path string
+}
+
+func (s fileHistoryStore) Record(record MessageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(s.path), 0700)
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+func (s fileHistoryStore) Records() ([]MessageRecord, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []MessageRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var record MessageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			Log(WARN, "Skipping unreadable history record: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// sqliteHistoryStore keeps records in a SQLite database through the sqlite3 command-line tool,
+// which avoids building gs with cgo
+type sqliteHistoryStore struct {
+	path string
+}
+
+// sqliteHistorySchema creates the records table if it doesn't exist yet
+const sqliteHistorySchema = `CREATE TABLE IF NOT EXISTS message_history (
+	timestamp TEXT, kind TEXT, model TEXT, accepted INTEGER, edit_ratio REAL,
+	generated_lines INTEGER, final_lines INTEGER, generated TEXT, final TEXT);`
+
+// sqlQuote quotes a string as an SQL literal
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func (s sqliteHistoryStore) Record(record MessageRecord) error {
+	accepted := 0
+	if record.Accepted {
+		accepted = 1
+	}
+	statement := fmt.Sprintf("%s\nINSERT INTO message_history VALUES (%s, %s, %s, %d, %f, %d, %d, %s, %s);",
+		sqliteHistorySchema, sqlQuote(record.Timestamp), sqlQuote(record.Kind), sqlQuote(record.Model), accepted,
+		record.EditRatio, record.GeneratedLines, record.FinalLines, sqlQuote(record.Generated), sqlQuote(record.Final))
+	os.MkdirAll(filepath.Dir(s.path), 0700)
+	cmd := newCommand("sqlite3", s.path)
+	cmd.Stdin = strings.NewReader(statement)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write history to %s: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s sqliteHistoryStore) Records() ([]MessageRecord, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	cmd := newCommand("sqlite3", "-json", s.path)
+	cmd.Stdin = strings.NewReader(sqliteHistorySchema + "\nSELECT timestamp, kind, model, accepted, edit_ratio, generated_lines, final_lines FROM message_history ORDER BY timestamp;")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history from %s: %v", s.path, err)
+	}
+	if len(bytes.TrimSpace(output)) == 0 {
+		return nil, nil
+	}
+
+	var rows []struct {
+		MessageRecord
+		Accepted int `json:"accepted"`
+	}
+	if err := json.Unmarshal(output, &rows); err != nil {
+		return nil, fmt.Errorf("failed to parse history: %v", err)
+	}
+	records := make([]MessageRecord, len(rows))
+	for i, row := range rows {
+		records[i] = row.MessageRecord
+		records[i].Accepted = row.Accepted == 1
+	}
+	return records, nil
+}
+
+// httpHistoryStore posts each record as JSON to a central endpoint
+type httpHistoryStore struct {
+	endpoint string
+}
+
+func (s httpHistoryStore) Record(record MessageRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(s.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("history endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func (s httpHistoryStore) Records() ([]MessageRecord, error) {
+	return nil, fmt.Errorf("records sent to %s can only be read there", s.endpoint)
+}
+
+// editRatio measures how much of the message the user changed, as the share of lines that
+// were removed from the generated message or added to it
+func editRatio(generated []string, final []string) float64 {
+	counts := make(map[string]int)
+	for _, line := range generated {
+		counts[line]++
+	}
+	kept := 0
+	for _, line := range final {
+		if counts[line] > 0 {
+			counts[line]--
+			kept++
+		}
+	}
+	total := len(generated) + len(final)
+	if total == 0 {
+		return 0
+	}
+	return float64(total-2*kept) / float64(total)
+}
+
+// messageLines splits a message into its non-empty, trimmed lines
+func messageLines(message string) []string {
+	var lines []string
+	for _, line := range strings.Split(message, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// recordMessageHistory records whether the generated message was edited before use. Failures are
+// only logged so history can never break a run.
+func recordMessageHistory(kind string, generated string, final string, config Config) {
+	store, err := openHistoryStore(config.History)
+	if err != nil {
+		Log(WARN, "Message history disabled: %v", err)
+		return
+	}
+	if store == nil {
+		return
+	}
+
+	generatedLines, finalLines := messageLines(generated), messageLines(final)
+	record := MessageRecord{
+		Timestamp:      time.Now().UTC().Format(time.RFC3339),
+		Kind:           kind,
+		Model:          config.LLM.Model,
+		EditRatio:      editRatio(generatedLines, finalLines),
+		GeneratedLines: len(generatedLines),
+		FinalLines:     len(finalLines),
+	}
+	record.Accepted = record.EditRatio == 0
+	if config.History.IncludeText {
+		record.Generated, record.Final = generated, final
+	}
+	if err := store.Record(record); err != nil {
+		Log(WARN, "Failed to record message history: %v", err)
+	}
+}
+
+// runHistoryCommand shows how often generated messages were accepted, and manages the opt-in for
+// sending records to a remote backend
+func runHistoryCommand(args []string) error {
+	if len(args) > 0 && (args[0] == "opt-in" || args[0] == "opt-out") {
+		path, err := historyOptInPath()
+		if err != nil {
+			return fmt.Errorf("failed to find home directory: %v", err)
+		}
+		if args[0] == "opt-out" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to opt out: %v", err)
+			}
+			fmt.Println("Message history will no longer be sent to remote backends.")
+			return nil
+		}
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err := ioutil.WriteFile(path, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0600); err != nil {
+			return fmt.Errorf("failed to opt in: %v", err)
+		}
+		fmt.Println("Message history will be sent to the remote backend set in history.endpoint.")
+		return nil
+	}
+
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	store, err := openHistoryStore(config.History)
+	if err != nil {
+		return err
+	}
+	if store == nil {
+		fmt.Println("No message history. History is off unless history.backend is set, and the http backend also needs gs history opt-in.")
+		return nil
+	}
+	records, err := store.Records()
+	if err != nil {
+		return err
+	}
+
+	type kindStats struct {
+		count, accepted int
+		ratio           float64
+	}
+	stats := make(map[string]*kindStats)
+	for _, record := range records {
+		s, ok := stats[record.Kind]
+		if !ok {
+			s = &kindStats{}
+			stats[record.Kind] = s
+		}
+		s.count++
+		s.ratio += record.EditRatio
+		if record.Accepted {
+			s.accepted++
+		}
+	}
+	kinds := make([]string, 0, len(stats))
+	for kind := range stats {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	fmt.Printf("%-8s %8s %9s %10s\n", "KIND", "MESSAGES", "ACCEPTED", "AVG EDITED")
+	for _, kind := range kinds {
+		s := stats[kind]
+		fmt.Printf("%-8s %8d %8.0f%% %9.0f%%\n", kind, s.count, 100*float64(s.accepted)/float64(s.count), 100*s.ratio/float64(s.count))
+	}
+	return nil
+}
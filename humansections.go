@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HumanSection is a section the author writes themselves, such as a rollout or comms plan. It's
+// never sent to the LLM or filled in by it.
+type HumanSection struct {
+	Heading string   `json:"heading"`
+	Prompts []string `json:"prompts"` // questions for the author, rendered as a checklist
+	Issues  bool     `json:"issues"`  // also add the section to gs issue describe
+}
+
+// humanSectionNote marks a section as written by the author in the rendered document
+const humanSectionNote = "<!-- Written by the author. GitScribe doesn't send this section to the LLM or fill it in. -->"
+
+// sectionKey normalizes a heading the way splitTemplateSections does
+func sectionKey(heading string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimLeft(heading, "#")))
+}
+
+// withoutHumanSections removes the human-only sections from a markdown document, returning the
+// rest and the removed sections by key
+func withoutHumanSections(document string, human []HumanSection) (string, map[string]templateSection) {
+	keys := make(map[string]bool)
+	for _, section := range human {
+		keys[sectionKey(section.Heading)] = true
+	}
+	removed := make(map[string]templateSection)
+	if len(keys) == 0 {
+		return document, removed
+	}
+
+	var parts []string
+	for _, section := range splitTemplateSections(document) {
+		if section.key != "" && keys[section.key] {
+			removed[section.key] = section
+			continue
+		}
+		parts = append(parts, strings.Join(section.lines, "\n"))
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n")) + "\n", removed
+}
+
+// renderHumanSections renders the human-only sections for the author to fill in, keeping what the
+// template had under each heading and adding the configured prompts
+func renderHumanSections(human []HumanSection, fromTemplate map[string]templateSection) []string {
+	var sections []string
+	for _, section := range human {
+		lines := []string{"## " + strings.TrimSpace(strings.TrimLeft(section.Heading, "#"))}
+		if templateSection, ok := fromTemplate[sectionKey(section.Heading)]; ok {
+			lines = []string{templateSection.lines[0]}
+			if body := strings.TrimSpace(strings.Join(templateSection.lines[1:], "\n")); body != "" {
+				lines = append(lines, body)
+			}
+		}
+		lines = append(lines, humanSectionNote)
+		for _, prompt := range section.Prompts {
+			lines = append(lines, fmt.Sprintf("- [ ] %s", prompt))
+		}
+		sections = append(sections, strings.Join(lines, "\n"))
+	}
+	return sections
+}
+
+// issueHumanSections returns the human-only sections that also go in issues
+func issueHumanSections(human []HumanSection) []HumanSection {
+	var sections []HumanSection
+	for _, section := range human {
+		if section.Issues {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
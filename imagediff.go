@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+)
+
+// VisionConfig sends changed images to a vision-capable model so messages can describe visual
+// changes, which a binary diff says nothing about
+type VisionConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Model     string `json:"model"`      // vision-capable model, default llm.model
+	MaxImages int    `json:"max_images"` // changed images described per message, default 4
+	MaxBytes  int    `json:"max_bytes"`  // larger images are left out, default 1 MB
+}
+
+// ImageChange is a changed image with its content before and after, nil if it didn't exist
+type ImageChange struct {
+	Path   string
+	Status string // "added", "modified" or "deleted"
+	Before []byte
+	After  []byte
+}
+
+// imageMediaTypes are the image formats vision models accept, by extension
+var imageMediaTypes = map[string]string{
+	".png":  "image/png",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// imageMediaType returns the media type of an image path, or "" if it isn't an image
+func imageMediaType(path string) string {
+	return imageMediaTypes[strings.ToLower(filepath.Ext(path))]
+}
+
+// imagePart returns a content part with the image as a data URL
+func imagePart(path string, data []byte) ContentPart {
+	url := "data:" + imageMediaType(path) + ";base64," + base64.StdEncoding.EncodeToString(data)
+	return ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: url}}
+}
+
+// changedImages lists the images changed between beforeRev and afterRev and reads both versions.
+// diffArgs select the change for git diff, and an empty afterRev reads the staged version.
+func changedImages(diffArgs []string, beforeRev string, afterRev string, vision VisionConfig) ([]ImageChange, error) {
+	args := append([]string{"diff", "--name-status", "--no-renames"}, diffArgs...)
+	output, err := newCommand("git", args...).Output()
+	if err != nil {
+		return nil, newError(ErrGitState, "failed to list changed files: %v", err)
+	}
+
+	var changes []ImageChange
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 || imageMediaType(fields[1]) == "" {
+			continue
+		}
+		if len(changes) == vision.MaxImages {
+			Log(INFO, "Describing only the first %d changed images", vision.MaxImages)
+			break
+		}
+		change := ImageChange{Path: fields[1], Status: "modified"}
+		switch fields[0] {
+		case "A":
+			change.Status = "added"
+		case "D":
+			change.Status = "deleted"
+		}
+		if change.Status != "added" {
+			if content, ok := gitShowFile(beforeRev, change.Path); ok {
+				change.Before = []byte(content)
+			}
+		}
+		if change.Status != "deleted" {
+			if content, ok := gitShowFile(afterRev, change.Path); ok {
+				change.After = []byte(content)
+			}
+		}
+		if len(change.Before) > vision.MaxBytes || len(change.After) > vision.MaxBytes {
+			Log(WARN, "Leaving %s out of the visual changes, it's larger than %d bytes", change.Path, vision.MaxBytes)
+			continue
+		}
+		if change.Before == nil && change.After == nil {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// useVision reports whether changed images should be sent to the vision model
+func useVision(llmConfig LLMConfig) bool {
+	if !llmConfig.Vision.Enabled {
+		return false
+	}
+	if llmConfig.LocalContextOnly {
+		Log(DEBUG, "Not sending changed images in local context only mode")
+		return false
+	}
+	if vcs := currentVCS(); vcs.Name() != "git" {
+		Log(DEBUG, "Describing changed images isn't supported with %s", vcs.Name())
+		return false
+	}
+	return true
+}
+
+// describeVisualChanges returns a note for the prompt describing how the changed images look
+// different, or "" when nothing visual changed. Failures only leave the note out, the message
+// can still be written from the rest of the change.
+func describeVisualChanges(ctx context.Context, diffArgs []string, beforeRev string, afterRev string, llmConfig LLMConfig) string {
+	changes, err := changedImages(diffArgs, beforeRev, afterRev, llmConfig.Vision)
+	if err == nil && len(changes) == 0 {
+		return ""
+	}
+	var description string
+	if err == nil {
+		Log(INFO, "Describing %d changed images using model: %s", len(changes), llmConfig.Vision.Model)
+		description, err = GenerateVisualChanges(ctx, changes, llmConfig)
+	}
+	if err != nil {
+		Log(WARN, "Leaving the visual changes out of the prompt: %v", err)
+		return ""
+	}
+	return "\n\nHow the changed images look different, described from the images themselves:\n" + description
+}
+
+// stagedVisualChanges describes the images changed by the staged changes
+func stagedVisualChanges(ctx context.Context, llmConfig LLMConfig) string {
+	// Without a working tree nothing is staged, and the images are read from the branch instead
+	if !useVision(llmConfig) || worktreeless() {
+		return ""
+	}
+	return describeVisualChanges(ctx, []string{"--cached"}, "HEAD", "", llmConfig)
+}
+
+// branchVisualChanges describes the images changed on the branch since it forked from targetBranch
+func branchVisualChanges(ctx context.Context, targetBranch string, llmConfig LLMConfig) string {
+	if !useVision(llmConfig) {
+		return ""
+	}
+	output, err := newCommand("git", "merge-base", targetBranch, headRev).Output()
+	if err != nil {
+		Log(WARN, "Leaving the visual changes out of the prompt, no merge base with %s: %v", targetBranch, err)
+		return ""
+	}
+	forkPoint := strings.TrimSpace(string(output))
+	return describeVisualChanges(ctx, []string{forkPoint, headRev}, forkPoint, headRev, llmConfig)
+}
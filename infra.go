@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// InfraConfig adds an "Infra changes" section listing the infrastructure resources the branch
+// adds, changes and destroys
+type InfraConfig struct {
+	Enabled  bool   `json:"enabled"`
+	PlanFile string `json:"plan_file"` // output of terraform show -json, used instead of the diff when it exists
+}
+
+// Infra change actions
+const (
+	infraAdded     = "Added"
+	infraChanged   = "Changed"
+	infraReplaced  = "Replaced"
+	infraDestroyed = "Destroyed"
+)
+
+// infraActions is the order of the groups in the section
+var infraActions = []string{infraAdded, infraChanged, infraReplaced, infraDestroyed}
+
+// InfraResource is one infrastructure resource the branch touches
+type InfraResource struct {
+	Address string // e.g. aws_s3_bucket.logs, Deployment/default/web or the CloudFormation logical ID
+	Kind    string // resource type, such as aws_s3_bucket or AWS::S3::Bucket
+	File    string
+	Action  string
+}
+
+// hclBlockPattern matches the start of a Terraform resource, data source or module block
+var hclBlockPattern = regexp.MustCompile(`^\s*(resource|data|module)\s+"([^"]+)"(?:\s+"([^"]+)")?\s*\{`)
+
+// terraformBlocks returns the resource, data and module blocks of a Terraform file by address,
+// with the block's text, and the type of each
+func terraformBlocks(content string) (map[string]string, map[string]string) {
+	blocks := make(map[string]string)
+	kinds := make(map[string]string)
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		match := hclBlockPattern.FindStringSubmatch(lines[i])
+		if match == nil {
+			continue
+		}
+		address, kind := match[2]+"."+match[3], match[2]
+		switch match[1] {
+		case "data":
+			address = "data." + address
+		case "module":
+			address, kind = "module."+match[2], "module"
+		}
+		// The block ends where its braces balance, ignoring braces in strings
+		depth := 0
+		start := i
+		for ; i < len(lines); i++ {
+			inString := false
+			for j, r := range lines[i] {
+				switch {
+				case r == '"' && (j == 0 || lines[i][j-1] != '\\'):
+					inString = !inString
+				case r == '{' && !inString:
+					depth++
+				case r == '}' && !inString:
+					depth--
+				}
+			}
+			if depth <= 0 {
+				break
+			}
+		}
+		end := i + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+		blocks[address] = normalizeBlock(lines[start:end])
+		kinds[address] = kind
+	}
+	return blocks, kinds
+}
+
+// normalizeBlock joins a block's lines without indentation and blank lines, so reformatting
+// doesn't count as a change
+func normalizeBlock(lines []string) string {
+	var kept []string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
+
+// manifestResources returns the CloudFormation resources or Kubernetes objects in a YAML or JSON
+// file by address, with their flattened content, and the type of each. Files that are neither
+// have no resources.
+func manifestResources(file string, content string) (map[string]string, map[string]string) {
+	resources := make(map[string]string)
+	kinds := make(map[string]string)
+	docs := []string{content}
+	if ext := path.Ext(file); ext == ".yaml" || ext == ".yml" {
+		docs = regexp.MustCompile(`(?m)^---.*$`).Split(content, -1)
+	}
+	for _, doc := range docs {
+		keys, err := parseManifest(file, doc)
+		if err != nil {
+			continue
+		}
+		// Kubernetes objects are identified by kind, namespace and name
+		if keys["kind"] != "" && keys["metadata.name"] != "" {
+			namespace := keys["metadata.namespace"]
+			if namespace == "" {
+				namespace = "default"
+			}
+			address := keys["kind"] + "/" + namespace + "/" + keys["metadata.name"]
+			resources[address] = joinKeys(keys, "")
+			kinds[address] = keys["kind"]
+			continue
+		}
+		// CloudFormation resources are the entries of the Resources mapping
+		for key, value := range keys {
+			if strings.HasPrefix(key, "Resources.") && strings.HasSuffix(key, ".Type") && strings.Count(key, ".") == 2 {
+				logicalID := strings.TrimSuffix(strings.TrimPrefix(key, "Resources."), ".Type")
+				resources[logicalID] = joinKeys(keys, "Resources."+logicalID+".")
+				kinds[logicalID] = value
+			}
+		}
+	}
+	return resources, kinds
+}
+
+// parseManifest flattens a YAML or JSON document into key paths with unquoted values
+func parseManifest(file string, doc string) (map[string]string, error) {
+	if path.Ext(file) == ".json" {
+		keys, err := parseJSONKeys([]byte(doc))
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range keys {
+			keys[key] = strings.Trim(value, `"`)
+		}
+		return keys, nil
+	}
+	keys, err := parseYAMLKeys([]byte(doc))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range keys {
+		keys[key] = strings.Trim(value, `"'`)
+	}
+	return keys, nil
+}
+
+// joinKeys renders the keys under prefix in order, for comparing two versions of a resource
+func joinKeys(keys map[string]string, prefix string) string {
+	var lines []string
+	for _, key := range sortedUnion(keys, nil) {
+		if strings.HasPrefix(key, prefix) {
+			lines = append(lines, key+"="+keys[key])
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isInfraFile reports whether a changed file can hold infrastructure definitions
+func isInfraFile(file string) bool {
+	switch path.Ext(file) {
+	case ".tf", ".yaml", ".yml", ".json":
+		return true
+	}
+	return false
+}
+
+// infraResources returns the resources a file defines, keyed by address
+func infraResources(file string, content string) (map[string]string, map[string]string) {
+	if path.Ext(file) == ".tf" {
+		return terraformBlocks(content)
+	}
+	return manifestResources(file, content)
+}
+
+// diffInfraResources compares the infrastructure definitions of the changed files between the
+// fork point and HEAD. Terraform resources are compared per directory, which is a module, so
+// moving a block between files of a module isn't a change.
+func diffInfraResources(targetBranch string) ([]InfraResource, error) {
+	output, err := newCommand("git", "merge-base", targetBranch, headRev).Output()
+	if err != nil {
+		return nil, newError(ErrGitState, "failed to find the merge base with %s: %v", targetBranch, err)
+	}
+	forkPoint := strings.TrimSpace(string(output))
+	output, err = newCommand("git", "diff", "--name-only", forkPoint, headRev).Output()
+	if err != nil {
+		return nil, newError(ErrGitState, "failed to list changed files: %v", err)
+	}
+
+	type version struct {
+		content string
+		kind    string
+		file    string
+	}
+	before := make(map[string]version)
+	after := make(map[string]version)
+	for _, file := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if !isInfraFile(file) {
+			continue
+		}
+		scope := file
+		if path.Ext(file) == ".tf" {
+			scope = path.Dir(file)
+		}
+		for rev, versions := range map[string]map[string]version{forkPoint: before, headRev: after} {
+			content, ok := gitShowFile(rev, file)
+			if !ok {
+				continue
+			}
+			resources, kinds := infraResources(file, content)
+			for address, text := range resources {
+				versions[scope+"\x00"+address] = version{content: text, kind: kinds[address], file: file}
+			}
+		}
+	}
+
+	var changes []InfraResource
+	keys := make(map[string]string)
+	for key := range before {
+		keys[key] = ""
+	}
+	for key := range after {
+		keys[key] = ""
+	}
+	for _, key := range sortedUnion(keys, nil) {
+		old, inBefore := before[key]
+		current, inAfter := after[key]
+		address := strings.SplitN(key, "\x00", 2)[1]
+		switch {
+		case !inBefore:
+			changes = append(changes, InfraResource{Address: address, Kind: current.kind, File: current.file, Action: infraAdded})
+		case !inAfter:
+			changes = append(changes, InfraResource{Address: address, Kind: old.kind, File: old.file, Action: infraDestroyed})
+		case old.content != current.content:
+			changes = append(changes, InfraResource{Address: address, Kind: current.kind, File: current.file, Action: infraChanged})
+		}
+	}
+	return changes, nil
+}
+
+// readTerraformPlan reads the resource changes of a plan saved with terraform show -json
+func readTerraformPlan(planFile string) ([]InfraResource, error) {
+	data, err := ioutil.ReadFile(planFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan file: %v", err)
+	}
+	var plan struct {
+		ResourceChanges []struct {
+			Address string `json:"address"`
+			Type    string `json:"type"`
+			Change  struct {
+				Actions []string `json:"actions"`
+			} `json:"change"`
+		} `json:"resource_changes"`
+	}
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("%s isn't a plan from terraform show -json: %v", planFile, err)
+	}
+	var changes []InfraResource
+	for _, change := range plan.ResourceChanges {
+		action := ""
+		switch strings.Join(change.Change.Actions, ",") {
+		case "create":
+			action = infraAdded
+		case "update":
+			action = infraChanged
+		case "delete":
+			action = infraDestroyed
+		case "delete,create", "create,delete":
+			action = infraReplaced
+		default:
+			// no-op and read don't change anything
+			continue
+		}
+		changes = append(changes, InfraResource{Address: change.Address, Kind: change.Type, File: planFile, Action: action})
+	}
+	return changes, nil
+}
+
+// formatInfraChanges lists the resources grouped by action, and what they were parsed from
+func formatInfraChanges(changes []InfraResource, source string) string {
+	var sb strings.Builder
+	sb.WriteString(source + "\n")
+	byAction := make(map[string][]InfraResource)
+	for _, change := range changes {
+		byAction[change.Action] = append(byAction[change.Action], change)
+	}
+	for _, action := range infraActions {
+		resources := byAction[action]
+		if len(resources) == 0 {
+			continue
+		}
+		sort.Slice(resources, func(i, j int) bool { return resources[i].Address < resources[j].Address })
+		sb.WriteString(fmt.Sprintf("\n**%s (%d)**\n\n", action, len(resources)))
+		for _, resource := range resources {
+			sb.WriteString(fmt.Sprintf("- `%s` (%s, %s)\n", resource.Address, resource.Kind, resource.File))
+		}
+	}
+	return sb.String()
+}
+
+// buildInfraSection lists the infrastructure changes of the branch and has the model explain
+// their intent separately, so the list itself is exact
+func buildInfraSection(ctx context.Context, targetBranch string, commits string, infra InfraConfig, llmConfig LLMConfig) (string, error) {
+	var changes []InfraResource
+	var source string
+	var err error
+	if _, statErr := os.Stat(infra.PlanFile); infra.PlanFile != "" && statErr == nil {
+		changes, err = readTerraformPlan(infra.PlanFile)
+		source = fmt.Sprintf("From the Terraform plan in `%s`.", infra.PlanFile)
+	} else {
+		if infra.PlanFile != "" {
+			Log(WARN, "No plan file at %s, listing infrastructure changes from the diff", infra.PlanFile)
+		}
+		changes, err = diffInfraResources(targetBranch)
+		source = "From the definitions changed on the branch, not a plan. Resources changed outside them, such as through variables or modules, aren't listed."
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(changes) == 0 {
+		Log(DEBUG, "No infrastructure changes detected")
+		return "", nil
+	}
+	Log(INFO, "Detected %d infrastructure changes", len(changes))
+	list := formatInfraChanges(changes, source)
+
+	diff, err := getDiffInRange(targetBranch, headRev)
+	if err != nil {
+		return "", err
+	}
+	var infraDiff strings.Builder
+	for _, file := range splitDiffByFile(diff) {
+		if isInfraFile(file.Path) {
+			infraDiff.WriteString(file.Content)
+		}
+	}
+	intent, err := GenerateInfraIntent(ctx, list, commits, promptDiff(infraDiff.String(), llmConfig), llmConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to explain infrastructure changes: %w", err)
+	}
+	return "## Infra changes\n\n" + list + "\n### Intent\n\n" + intent, nil
+}
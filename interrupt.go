@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+)
+
+// interruptContext returns a context canceled by Ctrl-C, so a hung request to the API is given up
+// on instead of blocking the terminal. A second Ctrl-C exits straight away.
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// maxContextFileBytes caps how much of each context file is sent to the LLM
+const maxContextFileBytes = 20000
+
+// readCodeContext reads the given files into a single block of context for the LLM
+func readCodeContext(files []string) (string, error) {
+	var sb strings.Builder
+	for _, file := range files {
+		data, err := readWorkingFile(expandPath(file))
+		if err != nil {
+			return "", fmt.Errorf("failed to read context file %s: %v", file, err)
+		}
+		if len(data) > maxContextFileBytes {
+			Log(WARN, "Context file %s is %d bytes, truncating", file, len(data))
+			data = []byte(cutAtRune(string(data), maxContextFileBytes))
+		}
+		sb.WriteString(fmt.Sprintf("File: %s\n```\n%s\n```\n\n", file, string(data)))
+	}
+	return sb.String(), nil
+}
+
+// runIssueCommand dispatches the issue subcommands
+func runIssueCommand(args []string) error {
+	if len(args) == 0 || args[0] != "describe" {
+		return fmt.Errorf("usage: gs issue describe [-file <path>]... \"<bug report>\"")
+	}
+	return runIssueDescribeCommand(args[1:])
+}
+
+// runIssueDescribeCommand turns a terse bug report into a structured issue and files it
+func runIssueDescribeCommand(args []string) error {
+	fs := flag.NewFlagSet("issue describe", flag.ExitOnError)
+	var files, labels stringListFlag
+	fs.Var(&files, "file", "Source file to include as context (can be repeated)")
+	fs.Var(&labels, "label", "Label to apply to the issue (can be repeated)")
+	dryRun := fs.Bool("dry-run", false, "Print the generated issue without filing it")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	report := strings.TrimSpace(strings.Join(fs.Args(), " "))
+	if report == "" {
+		return fmt.Errorf("a bug report is required: gs issue describe \"<bug report>\"")
+	}
+	codeContext, err := readCodeContext(files)
+	if err != nil {
+		return err
+	}
+	if config.LLM.LocalContextOnly {
+		codeContext = "File contents are withheld. Relevant files:\n" + strings.Join(files, "\n")
+	}
+
+	fmt.Println("Generating issue description...")
+	ctx, stop := interruptContext()
+	defer stop()
+	issue, err := GenerateIssueDescription(ctx, report, codeContext, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate issue description: %w", err)
+	}
+	human := issueHumanSections(config.HumanSections)
+	issue, _ = withoutHumanSections(issue, human)
+	issue = appendSections(issue, renderHumanSections(human, nil))
+
+	if *dryRun {
+		fmt.Println("=== Generated Issue (Dry Run) ===")
+		fmt.Println(issue)
+		fmt.Println("=================================")
+		return nil
+	}
+
+	issue, err = editMessage(issue)
+	if err != nil {
+		return err
+	}
+	parts := strings.SplitN(issue, "\n", 2)
+	title := strings.TrimSpace(strings.TrimLeft(parts[0], "# "))
+	if title == "" {
+		fmt.Println("Issue title is empty, not filing.")
+		return nil
+	}
+	body := ""
+	if len(parts) > 1 {
+		body = strings.TrimSpace(parts[1])
+	}
+
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	url, err := createIssue(repo, title, body, labels)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Issue created:", url)
+	return nil
+}
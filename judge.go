@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// JudgeConfig controls the quality gate for text that automated modes would apply without a
+// human reading it first
+type JudgeConfig struct {
+	Enabled   bool    `json:"enabled"`
+	Model     string  `json:"model"`     // default llm.model
+	Threshold float64 `json:"threshold"` // minimum score to apply automatically, default 0.7
+}
+
+// Judgement is the judge's verdict on generated text
+type Judgement struct {
+	Score   float64 `json:"score"`
+	Reasons string  `json:"reasons"`
+}
+
+// acceptCommand is the comment that applies a suggestion the judge held back
+const acceptCommand = "/gitscribe accept"
+
+// judgeGenerated scores generated text against the material it was generated from
+func judgeGenerated(ctx context.Context, kind string, generated string, source string, judgeConfig JudgeConfig, llmConfig LLMConfig) (Judgement, error) {
+	llmConfig.Model = judgeConfig.Model
+	response, err := GenerateJudgement(ctx, kind, generated, source, llmConfig)
+	if err != nil {
+		return Judgement{}, fmt.Errorf("failed to judge %s: %w", kind, err)
+	}
+
+	var judgement Judgement
+	start, end := strings.Index(response, "{"), strings.LastIndex(response, "}")
+	if start == -1 || end < start {
+		return Judgement{}, fmt.Errorf("judge returned no verdict: %s", response)
+	}
+	if err := json.Unmarshal([]byte(response[start:end+1]), &judgement); err != nil {
+		return Judgement{}, fmt.Errorf("failed to parse judge verdict: %v", err)
+	}
+	Log(INFO, "Judge scored %s %.2f: %s", kind, judgement.Score, judgement.Reasons)
+	return judgement, nil
+}
+
+// suggestionMarkers returns the markers that delimit a held-back suggestion in a comment
+func suggestionMarkers(marker string) (string, string) {
+	return fmt.Sprintf("<!-- suggestion:%s -->", marker), fmt.Sprintf("<!-- /suggestion:%s -->", marker)
+}
+
+// postSuggestion posts generated content as a comment for a human to accept instead of applying it
+func postSuggestion(repo string, number int, marker string, content string, judgement Judgement) (string, error) {
+	start, end := suggestionMarkers(marker)
+	comment := fmt.Sprintf("GitScribe generated the following for this PR's description but held it back (confidence %.2f: %s)\n\nReply `%s` to add it to the description.\n\n%s\n%s\n%s",
+		judgement.Score, judgement.Reasons, acceptCommand, start, content, end)
+	return postIssueComment(repo, number, comment)
+}
+
+// extractSuggestion returns the suggested content from a comment, if it holds one for marker
+func extractSuggestion(comment string, marker string) (string, bool) {
+	start, end := suggestionMarkers(marker)
+	startIdx := strings.Index(comment, start)
+	endIdx := strings.Index(comment, end)
+	if startIdx == -1 || endIdx < startIdx {
+		return "", false
+	}
+	return strings.TrimSpace(comment[startIdx+len(start) : endIdx]), true
+}
+
+// canAccept reports whether the commenter may apply a suggestion: the PR's author or anyone with
+// write access to the repository
+func canAccept(comment IssueComment, pr PullRequest) bool {
+	if comment.User.Login == pr.User.Login {
+		return true
+	}
+	switch comment.AuthorAssociation {
+	case "OWNER", "MEMBER", "COLLABORATOR":
+		return true
+	}
+	return false
+}
+
+// acceptSuggestion applies the latest held-back suggestion on a PR to its description
+func acceptSuggestion(repo string, number int, comment IssueComment) error {
+	pr, err := getPullRequest(repo, number)
+	if err != nil {
+		return err
+	}
+	if !canAccept(comment, pr) {
+		Log(INFO, "Ignoring %s from %s on %s#%d, who can't edit the PR", acceptCommand, comment.User.Login, repo, number)
+		return nil
+	}
+
+	comments, err := listIssueComments(repo, number)
+	if err != nil {
+		return err
+	}
+	bot, err := currentGitHubUser()
+	if err != nil {
+		return fmt.Errorf("failed to get the GitHub user suggestions are posted as: %v", err)
+	}
+	content, ok := latestSuggestion(comments, bot, dependencyImpactMarker)
+	if !ok {
+		Log(INFO, "No suggestion to accept on %s#%d", repo, number)
+		return nil
+	}
+	body := replaceMarkedSection(pr.Body, dependencyImpactMarker, content)
+	if err := updatePullRequestBodyAPI(repo, number, body); err != nil {
+		return err
+	}
+	Log(INFO, "Applied suggestion to %s#%d, accepted by %s", repo, number, comment.User.Login)
+	return nil
+}
+
+// latestSuggestion returns the suggestion in the last comment bot posted, if it holds one.
+// Anyone can write the markers into a comment, so only the bot's own are considered.
+func latestSuggestion(comments []IssueComment, bot string, marker string) (string, bool) {
+	for i := len(comments) - 1; i >= 0; i-- {
+		if !strings.EqualFold(comments[i].User.Login, bot) {
+			continue
+		}
+		if content, ok := extractSuggestion(comments[i].Body, marker); ok {
+			return content, true
+		}
+	}
+	return "", false
+}
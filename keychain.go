@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// KeychainConfig controls reading keys from the OS keychain: the macOS Keychain, the Windows
+// Credential Manager or the Secret Service on Linux
+type KeychainConfig struct {
+	Mode string `json:"mode"` // "auto" (default) reads keys that aren't in the config or environment, "off" doesn't
+}
+
+// keychainService is the service gs stores its keys under in the keychain
+const keychainService = "gitscribe"
+
+// keychainSecret is a key gs auth login can store, under its account name in the keychain
+type keychainSecret struct {
+	account string
+	name    string
+	env     string
+}
+
+// keychainSecrets are the keys that can be kept in the keychain
+var keychainSecrets = []keychainSecret{
+	{"openai", "OpenAI API key", "OPENAI_KEY"},
+	{"phabricator", "Phabricator Conduit token", "PHABRICATOR_TOKEN"},
+	{"sourcehut", "SourceHut token", "SRHT_TOKEN"},
+}
+
+// checkKeychainConfig rejects keychain settings that can't be used
+func checkKeychainConfig(config KeychainConfig) error {
+	if mode := strings.ToLower(config.Mode); mode != "" && mode != "auto" && mode != "off" {
+		return fmt.Errorf("unknown keychain.mode %q in config: use auto or off", config.Mode)
+	}
+	return nil
+}
+
+// findKeychainSecret returns the key stored under an account name
+func findKeychainSecret(account string) (keychainSecret, error) {
+	var accounts []string
+	for _, secret := range keychainSecrets {
+		if secret.account == account {
+			return secret, nil
+		}
+		accounts = append(accounts, secret.account)
+	}
+	return keychainSecret{}, fmt.Errorf("unknown service %q: use %s", account, strings.Join(accounts, ", "))
+}
+
+// keychainProgram returns the program that talks to this OS's keychain, if it can be run
+func keychainProgram() (string, error) {
+	program, hint := "secret-tool", "install libsecret-tools"
+	switch runtime.GOOS {
+	case "darwin":
+		program, hint = "security", "it comes with macOS"
+	case "windows":
+		program, hint = "powershell", "it comes with Windows"
+	}
+	if !programAvailable(program) {
+		return "", fmt.Errorf("the keychain can't be used: %s isn't installed or allowed (%s)", program, hint)
+	}
+	return program, nil
+}
+
+// passwordVault is PowerShell that opens the Windows Credential Manager's vault
+const passwordVault = `$ErrorActionPreference = 'Stop'
+[void][Windows.Security.Credentials.PasswordVault, Windows.Security.Credentials, ContentType = WindowsRuntime]
+$vault = New-Object Windows.Security.Credentials.PasswordVault
+`
+
+// powershell returns a command running a script with PowerShell
+func powershell(script string) *Command {
+	return newCommand("powershell", "-NoProfile", "-NonInteractive", "-Command", passwordVault+script)
+}
+
+// readKeychain returns the key stored for an account, or "" if there's none
+func readKeychain(account string) (string, error) {
+	program, err := keychainProgram()
+	if err != nil {
+		return "", err
+	}
+	var cmd *Command
+	switch program {
+	case "security":
+		cmd = newCommand("security", "find-generic-password", "-s", keychainService, "-a", account, "-w")
+	case "powershell":
+		cmd = powershell(fmt.Sprintf("try { $c = $vault.Retrieve('%s', '%s'); $c.RetrievePassword(); $c.Password } catch {}", keychainService, account))
+	default:
+		cmd = newCommand("secret-tool", "lookup", "service", keychainService, "account", account)
+	}
+	output, err := cmd.Output()
+	if commandErr, ok := err.(*CommandError); ok && (commandErr.Stderr == "" || strings.Contains(commandErr.Stderr, "could not be found")) {
+		// Each program exits with an error and nothing else to say when there's no such key
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the keychain: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// writeKeychain stores the key for an account, replacing any stored before. The key is passed
+// on stdin, where other users can't see it the way they can see arguments.
+func writeKeychain(account string, key string) error {
+	program, err := keychainProgram()
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(key, " \t\r\n\"'\\") {
+		return fmt.Errorf("keys with spaces, quotes or backslashes can't be stored")
+	}
+	var cmd *Command
+	switch program {
+	case "security":
+		cmd = newCommand("security", "-i")
+		cmd.Stdin = strings.NewReader(fmt.Sprintf("add-generic-password -U -s %s -a %s -l \"GitScribe %s\" -w \"%s\"\n", keychainService, account, account, key))
+	case "powershell":
+		cmd = powershell(fmt.Sprintf("$vault.Add((New-Object Windows.Security.Credentials.PasswordCredential('%s', '%s', [Console]::In.ReadLine())))", keychainService, account))
+		cmd.Stdin = strings.NewReader(key + "\n")
+	default:
+		cmd = newCommand("secret-tool", "store", "--label", "GitScribe "+account, "service", keychainService, "account", account)
+		cmd.Stdin = strings.NewReader(key)
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to write the keychain: %v", err)
+	}
+	return nil
+}
+
+// deleteKeychain removes the key stored for an account
+func deleteKeychain(account string) error {
+	program, err := keychainProgram()
+	if err != nil {
+		return err
+	}
+	var cmd *Command
+	switch program {
+	case "security":
+		cmd = newCommand("security", "delete-generic-password", "-s", keychainService, "-a", account)
+	case "powershell":
+		cmd = powershell(fmt.Sprintf("try { $vault.Remove($vault.Retrieve('%s', '%s')) } catch {}", keychainService, account))
+	default:
+		cmd = newCommand("secret-tool", "clear", "service", keychainService, "account", account)
+	}
+	if err := cmd.Run(); err != nil && !strings.Contains(err.Error(), "could not be found") {
+		return fmt.Errorf("failed to delete from the keychain: %v", err)
+	}
+	return nil
+}
+
+// keychainKey returns the key stored for an account when the config reads keys from the
+// keychain, or "" if it doesn't or there's none. Failures are only logged, as the key may not be
+// needed.
+func keychainKey(config KeychainConfig, account string) string {
+	if strings.ToLower(config.Mode) == "off" {
+		return ""
+	}
+	key, err := readKeychain(account)
+	if err != nil {
+		Log(DEBUG, "Not reading the %s key from the keychain: %v", account, err)
+		return ""
+	}
+	if key != "" {
+		Log(DEBUG, "Read the %s key from the keychain", account)
+	}
+	return key
+}
+
+// runAuthCommand stores keys in the keychain (gs auth login), removes them (gs auth logout) or
+// shows which are stored (gs auth status)
+func runAuthCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gs auth login|logout|status")
+	}
+	fs := flag.NewFlagSet("auth "+args[0], flag.ExitOnError)
+	account := fs.String("service", "openai", "Key to store or remove: openai, phabricator or sourcehut")
+	logLevelFlag := fs.String("log-level", "none", "Set logging level (debug, info, warn, error, none)")
+	fs.Parse(args[1:])
+	SetLogLevelFromFlag(*logLevelFlag)
+	secret, err := findKeychainSecret(*account)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "login":
+		key, err := promptSecret(fmt.Sprintf("%s: ", secret.name))
+		if err != nil {
+			return err
+		}
+		if key == "" {
+			return fmt.Errorf("no key given, nothing stored")
+		}
+		if err := writeKeychain(secret.account, key); err != nil {
+			return err
+		}
+		fmt.Printf("Stored the %s in the keychain. gs uses it when %s isn't set.\n", secret.name, secret.env)
+		return nil
+	case "logout":
+		if err := deleteKeychain(secret.account); err != nil {
+			return err
+		}
+		fmt.Printf("Removed the %s from the keychain.\n", secret.name)
+		return nil
+	case "status":
+		for _, secret := range keychainSecrets {
+			key, err := readKeychain(secret.account)
+			status := "not stored"
+			switch {
+			case err != nil:
+				return err
+			case key != "":
+				status = "stored"
+			}
+			if envOrFile(secret.env) != "" {
+				status += fmt.Sprintf(", %s overrides it", secret.env)
+			}
+			fmt.Printf("%-12s %s\n", secret.account, status)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown auth command %q: use login, logout or status", args[0])
+}
+
+// promptSecret reads a key from the terminal without showing it, or from stdin when it isn't a
+// terminal, as in echo $KEY | gs auth login
+func promptSecret(prompt string) (string, error) {
+	info, err := os.Stdin.Stat()
+	terminal := err == nil && info.Mode()&os.ModeCharDevice != 0
+	if terminal {
+		fmt.Print(prompt)
+		if runtime.GOOS != "windows" && programAvailable("stty") {
+			(&Command{Program: "stty", Args: []string{"-echo"}, Interactive: true}).Run()
+			defer func() {
+				(&Command{Program: "stty", Args: []string{"echo"}, Interactive: true}).Run()
+				fmt.Println()
+			}()
+		}
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" && !strings.Contains(err.Error(), "EOF") {
+		return "", fmt.Errorf("failed to read the key: %v", err)
+	}
+	return strings.TrimSpace(line), nil
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// outputLanguage is a language gs can recognize in commit messages and descriptions. Latin
+// languages are told apart by common words and letters only they use.
+type outputLanguage struct {
+	code    string
+	name    string
+	words   []string
+	letters string
+}
+
+// outputLanguages are the languages that can be recognized. Words several of them share are left
+// out, as they don't tell them apart.
+var outputLanguages = []outputLanguage{
+	{"en", "English", []string{"the", "and", "of", "to", "for", "with", "is", "when", "this", "that", "from", "add", "adds", "added", "fix", "fixes", "fixed", "remove", "update", "use", "make", "move", "rename", "support", "handle", "allow", "instead", "into", "should", "now"}, ""},
+	{"de", "German", []string{"der", "die", "das", "und", "nicht", "mit", "für", "von", "ist", "wird", "beim", "bei", "auf", "hinzufügen", "hinzugefügt", "beheben", "behoben", "entfernen", "entfernt", "aktualisiert", "fehler", "statt", "jetzt", "wenn", "sich", "neue", "neuen"}, "äöüß"},
+	{"fr", "French", []string{"le", "les", "des", "et", "pour", "avec", "une", "du", "est", "dans", "ajout", "ajoute", "ajouter", "correction", "corrige", "suppression", "supprime", "lors", "au", "aux", "pas", "sur"}, "çêèàùœ"},
+	{"es", "Spanish", []string{"el", "los", "las", "y", "del", "que", "se", "por", "agregar", "añadir", "corregir", "arreglar", "eliminar", "cuando", "nuevo", "nueva", "al"}, "ñ¿¡"},
+	{"pt", "Portuguese", []string{"os", "com", "da", "não", "adicionar", "adiciona", "corrigir", "corrige", "remover", "novo", "nova", "ao", "dos", "das", "foi"}, "ãõ"},
+	{"it", "Italian", []string{"il", "gli", "per", "della", "di", "che", "aggiungi", "aggiunto", "correggi", "corretto", "rimuovi", "nuovo", "nella", "sono"}, ""},
+	{"nl", "Dutch", []string{"het", "en", "van", "voor", "met", "een", "niet", "toevoegen", "toegevoegd", "verwijderen", "verwijderd", "opgelost", "bij", "wanneer", "nieuwe", "wordt"}, "ĳ"},
+	{"ru", "Russian", nil, ""},
+	{"el", "Greek", nil, ""},
+	{"ar", "Arabic", nil, ""},
+	{"he", "Hebrew", nil, ""},
+	{"hi", "Hindi", nil, ""},
+	{"th", "Thai", nil, ""},
+	{"ja", "Japanese", nil, ""},
+	{"zh", "Chinese", nil, ""},
+	{"ko", "Korean", nil, ""},
+}
+
+// languageScripts are the writing systems that give a language away on their own. Japanese is
+// checked before Chinese, as it's written with Chinese characters too.
+var languageScripts = []struct {
+	code  string
+	table *unicode.RangeTable
+}{
+	{"ru", unicode.Cyrillic},
+	{"el", unicode.Greek},
+	{"ar", unicode.Arabic},
+	{"he", unicode.Hebrew},
+	{"hi", unicode.Devanagari},
+	{"th", unicode.Thai},
+	{"ja", unicode.Hiragana},
+	{"ja", unicode.Katakana},
+	{"ko", unicode.Hangul},
+	{"zh", unicode.Han},
+}
+
+var (
+	// codePatterns find the parts of a text that are code rather than prose: fenced blocks, inline
+	// code, URLs, quoted names and identifiers such as snake_case, camelCase, paths and calls
+	codePatterns = []*regexp.Regexp{
+		regexp.MustCompile("(?s)```.*?```"),
+		regexp.MustCompile("`[^`\n]+`"),
+		regexp.MustCompile(`https?://\S+`),
+		regexp.MustCompile(`"[^"\n]*"|'[\w.:/-]+'`),
+		regexp.MustCompile(`[\w.-]*[_/][\w./-]*|\b[a-z]+[A-Z]\w*\b|\b\w+\(\)|\b\w+\.\w+\b`),
+	}
+	// conventionalPrefix is the type and scope starting a conventional commit subject
+	conventionalPrefix = regexp.MustCompile(`^\w+(\([^)]*\))?!?:\s*`)
+	// codePlaceholder is what a masked part of a text is replaced with while it's translated
+	codePlaceholder = regexp.MustCompile(`⟦\d+⟧`)
+)
+
+// findLanguage returns the language with a code or name, as in de or German
+func findLanguage(name string) (outputLanguage, bool) {
+	for _, language := range outputLanguages {
+		if strings.EqualFold(language.code, name) || strings.EqualFold(language.name, name) {
+			return language, true
+		}
+	}
+	return outputLanguage{}, false
+}
+
+// languageName returns the name of the language with a code
+func languageName(code string) string {
+	if language, ok := findLanguage(code); ok {
+		return language.name
+	}
+	return code
+}
+
+// stripCode leaves the prose of a text, without the code and identifiers in it
+func stripCode(text string) string {
+	for _, pattern := range codePatterns {
+		text = pattern.ReplaceAllString(text, " ")
+	}
+	return text
+}
+
+// detectLanguage returns the code of the language a text is written in, or "" if it can't be
+// told. Code and identifiers are left out, so a German sentence about parseConfig is German.
+func detectLanguage(text string) string {
+	text = stripCode(conventionalPrefix.ReplaceAllString(strings.TrimSpace(text), ""))
+
+	letters := 0
+	scripts := map[string]int{}
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		for _, script := range languageScripts {
+			if unicode.Is(script.table, r) {
+				scripts[script.code]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	if scripts["ja"] > 0 {
+		return "ja"
+	}
+	for _, script := range languageScripts {
+		if scripts[script.code]*3 >= letters {
+			return script.code
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	scores := map[string]int{}
+	for _, language := range outputLanguages {
+		for _, word := range words {
+			for _, known := range language.words {
+				if word == known {
+					scores[language.code]++
+				}
+			}
+			if language.letters != "" && strings.ContainsAny(word, language.letters) {
+				scores[language.code]++
+			}
+		}
+	}
+	best, second := "", 0
+	for _, language := range outputLanguages {
+		switch score := scores[language.code]; {
+		case best == "" || score > scores[best]:
+			if best != "" {
+				second = scores[best]
+			}
+			best = language.code
+		case score > second:
+			second = score
+		}
+	}
+	if scores[best] == 0 || scores[best] == second {
+		return ""
+	}
+	return best
+}
+
+// commitLanguages counts the languages the commits, one subject per line, are written in
+func commitLanguages(commits string) (map[string]int, []string) {
+	counts := map[string]int{}
+	var order []string
+	for _, line := range strings.Split(commits, "\n") {
+		code := detectLanguage(line)
+		if code == "" {
+			continue
+		}
+		if counts[code] == 0 {
+			order = append(order, code)
+		}
+		counts[code]++
+	}
+	// Most commits first, and the language of the earlier commit when as many are in each
+	sort.SliceStable(order, func(i, j int) bool {
+		return counts[order[i]] > counts[order[j]]
+	})
+	return counts, order
+}
+
+// descriptionLanguage returns the name of the language the PR description should be written in:
+// llm.language, or with auto the language most commits use when they're in several. It's ""
+// when there's nothing to ask for. Commits in several languages are pointed out.
+func descriptionLanguage(commits string, llmConfig LLMConfig) string {
+	counts, order := commitLanguages(commits)
+	target := ""
+	if configured := llmConfig.Language; configured != "" && !strings.EqualFold(configured, "auto") {
+		target = languageName(configured)
+	} else if len(order) > 1 {
+		target = languageName(order[0])
+	}
+	if len(order) > 1 || (len(order) == 1 && target != "" && languageName(order[0]) != target) {
+		var languages []string
+		for _, code := range order {
+			languages = append(languages, fmt.Sprintf("%s (%d)", languageName(code), counts[code]))
+		}
+		Log(INFO, "The branch's commits are written in %s", strings.Join(languages, ", "))
+		fmt.Fprintf(os.Stderr, "Note: the branch's commits are written in %s, so the description is written in %s.\n", strings.Join(languages, ", "), target)
+	}
+	return target
+}
+
+// languageInstruction asks for text in a language without translating code
+func languageInstruction(language string) string {
+	if language == "" {
+		return ""
+	}
+	return fmt.Sprintf(" Write it in %s, even where the commit messages are in other languages: translate what they say, but keep identifiers, file paths, code, commands and quoted text exactly as they are.", language)
+}
+
+// maskCode replaces the code and identifiers in a text with numbered placeholders, so they come
+// back from a translation unchanged. Code found by a later pattern may hold placeholders of an
+// earlier one, so they're put back in reverse.
+func maskCode(text string) (string, []string) {
+	var masked []string
+	for _, pattern := range codePatterns {
+		text = pattern.ReplaceAllStringFunc(text, func(match string) string {
+			masked = append(masked, match)
+			return fmt.Sprintf("⟦%d⟧", len(masked)-1)
+		})
+	}
+	return text, masked
+}
+
+// unmaskCode puts the masked code back. It fails if the translation lost or repeated a
+// placeholder.
+func unmaskCode(text string, masked []string) (string, error) {
+	for i := len(masked) - 1; i >= 0; i-- {
+		placeholder := fmt.Sprintf("⟦%d⟧", i)
+		if strings.Count(text, placeholder) != 1 {
+			return "", fmt.Errorf("the translation changed the placeholder %s", placeholder)
+		}
+		text = strings.Replace(text, placeholder, masked[i], 1)
+	}
+	if codePlaceholder.MatchString(text) {
+		return "", fmt.Errorf("the translation added placeholders")
+	}
+	return text, nil
+}
+
+// foreignLines returns the lines of a description with enough words to tell that are in another
+// language than the one asked for. Headings come from the template and are left alone.
+func foreignLines(message string, language string) []string {
+	target, ok := findLanguage(language)
+	if !ok {
+		return nil
+	}
+	var foreign []string
+	inFence := false
+	for _, line := range strings.Split(message, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") {
+			inFence = !inFence
+		}
+		if inFence || strings.HasPrefix(trimmed, "#") || len(strings.Fields(stripCode(trimmed))) < 4 {
+			continue
+		}
+		if code := detectLanguage(trimmed); code != "" && code != target.code {
+			foreign = append(foreign, trimmed)
+		}
+	}
+	return foreign
+}
+
+// normalizeLanguage translates the parts of a description the model left in other languages,
+// keeping its code and identifiers as they are. If the translation can't be used, the
+// description is kept as it was.
+func normalizeLanguage(ctx context.Context, message string, language string, llmConfig LLMConfig) string {
+	foreign := foreignLines(message, language)
+	if len(foreign) == 0 {
+		return message
+	}
+	Log(INFO, "Translating %d lines of the description into %s", len(foreign), language)
+	masked, code := maskCode(message)
+	translated, err := GenerateTranslation(ctx, masked, language, llmConfig)
+	if err != nil {
+		Log(WARN, "Failed to translate the description into %s, keeping it as it is: %v", language, err)
+		return message
+	}
+	translated, err = unmaskCode(translated, code)
+	if err != nil {
+		Log(WARN, "Not using the translation of the description into %s: %v", language, err)
+		return message
+	}
+	return translated
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// LicenseConfig describes the license header new files must carry
+type LicenseConfig struct {
+	Enabled      bool     `json:"enabled"`
+	Header       string   `json:"header"`       // text that must appear near the top of new source files
+	Extensions   []string `json:"extensions"`   // file extensions that count as source files
+	VendorPaths  []string `json:"vendor_paths"` // vendored code is checked for incompatible licenses instead of the header
+	Incompatible []string `json:"incompatible"` // license texts that must not appear in vendored code
+	Block        bool     `json:"block"`        // block PR creation when the check fails
+}
+
+// headerSearchLines is how far into a file we look for the license header
+const headerSearchLines = 20
+
+// checkLicenseHeaders checks the files added on the branch for the license header,
+// and added vendored files for incompatible license text
+func checkLicenseHeaders(targetBranch string, license LicenseConfig) (PreflightResult, error) {
+	result := PreflightResult{Name: "License headers", Passed: true, Blocking: license.Block}
+
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return result, err
+	}
+	added, err := getAddedFilesInRange(base, headRev)
+	if err != nil {
+		return result, err
+	}
+
+	for _, file := range added {
+		vendored := false
+		for _, vendorPath := range license.VendorPaths {
+			if matchesPathPattern(file, vendorPath) {
+				vendored = true
+				break
+			}
+		}
+		if !vendored && !hasExtension(file, license.Extensions) {
+			continue
+		}
+
+		contents, ok := gitShowFile(headRev, file)
+		if !ok {
+			continue
+		}
+
+		if vendored {
+			for _, text := range license.Incompatible {
+				if strings.Contains(contents, text) {
+					result.Passed = false
+					result.Messages = append(result.Messages, fmt.Sprintf("%s: vendored code contains incompatible license text %q", file, text))
+					break
+				}
+			}
+			continue
+		}
+
+		if license.Header == "" {
+			continue
+		}
+		head := strings.Join(firstLines(contents, headerSearchLines), "\n")
+		if !strings.Contains(head, license.Header) {
+			result.Passed = false
+			result.Messages = append(result.Messages, fmt.Sprintf("%s: missing license header", file))
+		}
+	}
+
+	Log(INFO, "License check on %d added files: %d problems", len(added), len(result.Messages))
+	return result, nil
+}
+
+// hasExtension reports whether the file has one of the given extensions
+func hasExtension(file string, extensions []string) bool {
+	ext := path.Ext(file)
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// firstLines returns up to n lines from the start of s
+func firstLines(s string, n int) []string {
+	lines := strings.SplitN(s, "\n", n+1)
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	return lines
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"errors"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"github.com/joho/godotenv"
@@ -13,13 +18,38 @@ import (
 	"regexp"
 )
 
+// promptVersion identifies the prompts below in attestations. Bump it when they change.
+const promptVersion = "3"
+
 // LLMConfig holds configuration for the OpenAI API
 type LLMConfig struct {
-	APIKey          string  `json:"api_key"`
-	Model           string  `json:"model"`
-	Temperature     float64 `json:"temperature"`
-	MaxTokens       int     `json:"max_tokens"`
-	EnableQuestions bool    `json:"enable_questions"`
+	Provider         string               `json:"provider"` // "openai" (default), "ollama" or "mock"
+	APIKey           string               `json:"api_key"`
+	Model            string               `json:"model"`
+	Temperature      float64              `json:"temperature"`
+	MaxTokens        int                  `json:"max_tokens"`
+	EnableQuestions  bool                 `json:"enable_questions"`
+	LocalContextOnly bool                 `json:"local_context_only"` // send file paths instead of file contents
+	Endpoint         string               `json:"endpoint"`           // OpenAI-compatible chat completions URL, e.g. a local server
+	Ollama           OllamaConfig         `json:"ollama"`
+	Mock             MockConfig           `json:"mock"`
+	Pipeline         PipelineConfig       `json:"pipeline"`
+	Vision           VisionConfig         `json:"vision"`
+	StructuredDiffs  StructuredDiffConfig `json:"structured_diffs"`
+	ProseDiffs       ProseDiffConfig      `json:"prose_diffs"`
+	FallbackModel    string               `json:"fallback_model"`       // the same as fallback_models with one model
+	FallbackModels   []FallbackModel      `json:"fallback_models"`      // tried in order when the model fails or the prompt doesn't fit its context
+	ModelTiers       []ModelTier          `json:"model_tiers"`          // pick the model by the size of the diff instead of always using model
+	MaxRetries       int                  `json:"max_retries"`          // retries of rate limits and outages, default 2, -1 for none
+	TimeoutSeconds   int                  `json:"timeout_seconds"`      // how long one request may take, default 120, -1 for no limit
+	ContextWindow    int                  `json:"context_window"`       // tokens the model takes, default from the model name
+	Stream           string               `json:"stream"`               // "auto" (default) prints messages as they're generated when stderr is a terminal, "off" doesn't
+	CABundle         string               `json:"ca_bundle"`            // PEM file of CAs to trust besides the system's, e.g. a TLS-intercepting proxy's
+	SkipTLSVerify    bool                 `json:"insecure_skip_verify"` // don't check the provider's certificate at all
+	Commit           GenerationSettings   `json:"commit"`               // model, temperature and max_tokens for commit messages
+	PR               GenerationSettings   `json:"pr"`                   // the same for PR descriptions
+	Language         string               `json:"language"`             // what PR descriptions are written in, such as de or German; "auto" (default) picks the language most commits use
+	Prompts          PromptOverrides      `json:"-"`                    // read from .gitscribe/prompts and the system_prompt_file settings
 }
 
 // ChatMessage represents a message in the OpenAI chat format
@@ -30,20 +60,73 @@ type ChatMessage struct {
 
 // ChatRequest represents the request body for OpenAI chat completions API
 type ChatRequest struct {
-	Model       string        `json:"model"`
-	Messages    []ChatMessage `json:"messages"`
-	Temperature float64       `json:"temperature"`
-	MaxTokens   int           `json:"max_tokens"`
+	Model          string          `json:"model"`
+	Messages       []ChatMessage   `json:"messages"`
+	Temperature    float64         `json:"temperature"`
+	MaxTokens      int             `json:"max_tokens"`
+	PromptCacheKey string          `json:"prompt_cache_key,omitempty"`
+	Stream         bool            `json:"stream,omitempty"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+}
+
+// ResponseFormat asks for a reply in a format, such as JSON matching a schema
+type ResponseFormat struct {
+	Type       string      `json:"type"` // "json_schema" for structured outputs
+	JSONSchema *JSONSchema `json:"json_schema,omitempty"`
+}
+
+// JSONSchema is the schema a structured reply must match
+type JSONSchema struct {
+	Name   string      `json:"name"`
+	Strict bool        `json:"strict"`
+	Schema interface{} `json:"schema"`
+}
+
+// VisionMessage is a chat message whose content mixes text and images, for vision-capable models
+type VisionMessage struct {
+	Role    string        `json:"role"`
+	Content []ContentPart `json:"content"`
+}
+
+// ContentPart is a text or image part of a VisionMessage
+type ContentPart struct {
+	Type     string    `json:"type"` // "text" or "image_url"
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL is an image in a content part, here always a data URL
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// VisionRequest is a chat completions request with image content
+type VisionRequest struct {
+	Model       string          `json:"model"`
+	Messages    []VisionMessage `json:"messages"`
+	Temperature float64         `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens"`
 }
 
 // ChatResponse represents the response from OpenAI chat completions API
 type ChatResponse struct {
 	Choices []struct {
-		Message ChatMessage `json:"message"`
+		Message      ChatMessage `json:"message"`
+		FinishReason string      `json:"finish_reason"`
 	} `json:"choices"`
 	Error *struct {
 		Message string `json:"message"`
+		Type    string `json:"type"`
+		Code    string `json:"code"`
 	} `json:"error,omitempty"`
+	Usage struct {
+		PromptTokens        int `json:"prompt_tokens"`
+		CompletionTokens    int `json:"completion_tokens"`
+		PromptTokensDetails struct {
+			CachedTokens int `json:"cached_tokens"`
+		} `json:"prompt_tokens_details"`
+	} `json:"usage"`
 }
 
 // QuestionResponse represents a question from the LLM and the user's answer
@@ -85,14 +168,9 @@ func NewLLMConfig() LLMConfig {
 	return config
 }
 
-// GenerateCommitMessage uses the OpenAI API to generate a commit message based on the diff
-func GenerateCommitMessage(diff string, config LLMConfig, template string) (string, error) {
-	if config.APIKey == "" {
-		return "", fmt.Errorf("OpenAI API key not found. Set the OPENAI_KEY environment variable")
-	}
-
-	// Create the system prompt using the template
-	systemPrompt := fmt.Sprintf(`You are a professional software engineer who has just finished writing code.
+// defaultCommitPrompt is what the model is told about writing a commit message, unless the
+// repository has its own in .gitscribe/prompts/commit.txt
+const defaultCommitPrompt = `You are a professional software engineer who has just finished writing code.
 	You've staged your changes and are now tasked with writing a commit message. You will be given a git
 	diff and a template. Use the git diff to determine what changes have been made in this commit. This is important
 	for you to write an accurate and thoughtful commit message. Use the template to generate a commit message. 
@@ -100,109 +178,135 @@ func GenerateCommitMessage(diff string, config LLMConfig, template string) (stri
 	alternative. The people reveiwing your commit message are also professional software engineers, 
 	so you can use technical language and do not need to spell out abbreviations such as PR, LLM, FF, etc. 
 	The template is a markdown file, but don't include the comments in your response.
-	The first line of the commit message should be structured as follows:
-	<subdirectory of the repo> <common directory of the file changes>: <brief title of the changes>
-	Example: go ingester_worker: Adds implementation for receiving LLM requests
-	Example: client dashboard_settings: add LLM settings to UI
-	Example: go gql_api: Defines GraphQL API for auth signin
-	Example: database/migrations: Adds new migrations for new tables
-	Example: client map: fixes bug with map view
-	
 	Do not include any markdown headers in your response.
-	The rest of the commit message should be an informative description of the changes you made.
-	Use the following template format for your response:
-	%s`, template)
-
-	// Prepare the request
-	messages := []ChatMessage{
-		{Role: "system", Content: systemPrompt},
-		{Role: "user", Content: fmt.Sprintf("Here is the git diff:\n\n%s", diff)},
-	}
+	The rest of the commit message should be an informative description of the changes you made.`
 
-	requestBody := ChatRequest{
-		Model:       config.Model,
-		Messages:    messages,
-		Temperature: config.Temperature,
-		MaxTokens:   config.MaxTokens,
-	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal request: %v", err)
-	}
-
-	// Make the API request
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %v", err)
-	}
+// defaultPRPrompt is what the model is told about writing a PR description, unless the
+// repository has its own in .gitscribe/prompts/pr.txt
+const defaultPRPrompt = `You are a professional software engineer who has finished a feature branch and is creating a pull request. 
+	You will be given a list of commit messages from the branch and a PR template. Use the template to generate a 
+	comprehensive PR description. The PR description should clearly explain the changes, their purpose, and any 
+	important implementation details.Do not include any other texts about testing, a human who will review 
+	your PR message will fill that part out. IMPORTANT: You MUST include the ENTIRE template in your response, 
+	including ALL sections at the end.`
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.APIKey))
+// CommitOptions holds the rules the generated commit message has to follow
+type CommitOptions struct {
+	Format FirstLineFormat
+	Scope  string
+	Budget MessageBudget
+	Style  string    // style instructions learned from reference commits
+	Type   string    // conventional commit type
+	Stream io.Writer // prints the message as it's generated, if set
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %v", err)
+// GenerateCommitMessage uses the OpenAI API to generate a commit message based on the diff
+func GenerateCommitMessage(ctx context.Context, diff string, config LLMConfig, template string, options CommitOptions) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
+	// Create the system prompt using the template. The repository's own instructions replace the
+	// built-in ones, and the rules from the config still follow them.
+	instructions := defaultCommitPrompt
+	if config.Prompts.Commit != "" {
+		instructions = config.Prompts.Commit
 	}
-
-	var chatResponse ChatResponse
-	if err := json.Unmarshal(body, &chatResponse); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %v", err)
+	systemPrompt := fmt.Sprintf(`%s
+	%s
+	%s
+	Use the following template format for your response:
+	%s`, instructions, buildFirstLinePrompt(options.Format), buildBudgetPrompt(options.Budget), template)
+	if config.Prompts.CommitSystem != "" {
+		systemPrompt = fmt.Sprintf("%s\n\nUse the following template format for your response:\n%s", config.Prompts.CommitSystem, template)
 	}
 
-	// Check for API errors
-	if chatResponse.Error != nil {
-		return "", fmt.Errorf("API error: %s", chatResponse.Error.Message)
+	// Prepare the request, with the team's examples before it
+	request := func(diff string) string {
+		return fmt.Sprintf("Here is the git diff:\n\n%s", diff)
 	}
+	messages := []ChatMessage{{Role: "system", Content: systemPrompt}}
+	messages = append(messages, fewShotMessages(config.Commit.Examples, request, strings.TrimSpace)...)
+	messages = append(messages, ChatMessage{Role: "user", Content: scopePrompt(options.Scope) + typePrompt(options.Type) + options.Style + request(diff)})
 
-	if len(chatResponse.Choices) == 0 {
-		return "", fmt.Errorf("no response from API")
+	response, err := makeStreamingRequest(ctx, messages, config, options.Stream)
+	if err != nil {
+		return "", err
 	}
 
 	// Return the generated commit message
-	return strings.TrimSpace(chatResponse.Choices[0].Message.Content), nil
+	return strings.TrimSpace(response), nil
 }
 
-// GeneratePRMessage uses the OpenAI API to generate a PR message based on commit messages
-func GeneratePRMessage(commits string, config LLMConfig, template string) (string, error) {
+// GeneratePRMessage uses the OpenAI API to generate a PR message based on commit messages. The
+// final description is written to stream as it's generated, if set.
+func GeneratePRMessage(ctx context.Context, commits string, config LLMConfig, template string, stream io.Writer) (string, error) {
 	if config.APIKey == "" {
-		return "", fmt.Errorf("OpenAI API key not found. Set the OPENAI_KEY environment variable")
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
 	}
 
-	// Create the system prompt using the template
-	systemPrompt := fmt.Sprintf(
-	`You are a professional software engineer who has finished a feature branch and is creating a pull request. 
-	You will be given a list of commit messages from the branch and a PR template. Use the template to generate a 
-	comprehensive PR description. The PR description should clearly explain the changes, their purpose, and any 
-	important implementation details.Do not include any other texts about testing, a human who will review 
-	your PR message will fill that part out. IMPORTANT: You MUST include the ENTIRE template in your response, 
-	including ALL sections at the end. %s Use the following template format for your response:
-	%s`, getQuestionsPrompt(config.EnableQuestions), template)
-
-	// Prepare the request
-	messages := []ChatMessage{
-		{Role: "system", Content: systemPrompt},
-		{Role: "user", Content: fmt.Sprintf("Here are the commit messages from the branch:\n\n%s", commits)},
+	// Create the system prompt using the template. Only the first request may ask questions; the
+	// rest are for the description itself.
+	instructions := defaultPRPrompt
+	if config.Prompts.PR != "" {
+		instructions = config.Prompts.PR
+	}
+	systemPrompt := func(questions bool) string {
+		if config.Prompts.PRSystem != "" {
+			// Questions need the reply in the shape requestQuestions reads, so that's still asked for
+			return fmt.Sprintf("%s\n\n%s%s Use the following template format for your response:\n%s", config.Prompts.PRSystem, getQuestionsPrompt(questions), languageInstruction(config.Prompts.Language), template)
+		}
+		return fmt.Sprintf(`%s %s%s Use the following template format for your response:
+	%s`, instructions, getQuestionsPrompt(questions), languageInstruction(config.Prompts.Language), template)
+	}
+	request := func(commits string) string {
+		return fmt.Sprintf("Here are the commit messages from the branch:\n\n%s", commits)
+	}
+	commitsMessage := ChatMessage{Role: "user", Content: request(commits)}
+	// The team's examples come between the system prompt and the request. Replies to the request
+	// that may ask questions are JSON, so the examples' replies are too.
+	conversation := func(questions bool) []ChatMessage {
+		reply := strings.TrimSpace
+		if questions {
+			reply = func(output string) string {
+				data, _ := json.Marshal(questionsReply{Questions: []string{}, Description: output})
+				return string(data)
+			}
+		}
+		messages := []ChatMessage{{Role: "system", Content: systemPrompt(questions)}}
+		messages = append(messages, fewShotMessages(config.PR.Examples, request, reply)...)
+		return append(messages, commitsMessage)
+	}
+	describe := func() (string, error) {
+		response, err := makeStreamingRequest(ctx, conversation(false), config, stream)
+		return strings.TrimSpace(response), err
 	}
 
 	fmt.Println("Generating PR description based on commit messages...")
 	
-	// First API call to generate PR message or ask questions
-	response, err := makeOpenAIRequest(messages, config)
+	if !config.EnableQuestions {
+		return describe()
+	}
+
+	// First API call to generate PR message or ask questions. The reply is JSON, which isn't
+	// worth streaming.
+	reply, ok, err := requestQuestions(ctx, conversation(true), config)
 	if err != nil {
 		return "", err
 	}
+	if !ok {
+		// Without structured outputs the model may have mixed prose with the JSON. Rather than
+		// risk questions in the description, ask again for the description alone.
+		Log(WARN, "The reply wasn't the JSON object asked for, generating the PR description without questions")
+		return describe()
+	}
+	response := reply.Description
 
-	// Check if questions are enabled and if the response contains questions
-	questionResponses, hasQuestions := extractQuestions(response)
-	if hasQuestions && config.EnableQuestions {
+	if len(reply.Questions) > 0 {
+		questionResponses := make([]QuestionResponse, len(reply.Questions))
+		for i, question := range reply.Questions {
+			questionResponses[i] = QuestionResponse{Question: question}
+		}
 		fmt.Printf("The AI has %d questions to help create a better PR description.\n", len(questionResponses))
 		
 		// Get answers from the user
@@ -222,11 +326,9 @@ func GeneratePRMessage(commits string, config LLMConfig, template string) (strin
 			// Create a new messages array that includes all previous context
 			// The OpenAI API doesn't maintain context between separate API calls
 			// so we need to include all messages in the new request
-			newMessages := []ChatMessage{
-				{Role: "system", Content: systemPrompt},
-				{Role: "user", Content: fmt.Sprintf("Here are the commit messages from the branch:\n\n%s", commits)},
-				{Role: "assistant", Content: "I need some additional information to write a better PR description."},
-			}
+			newMessages := append(conversation(false),
+				ChatMessage{Role: "assistant", Content: "I need some additional information to write a better PR description."},
+			)
 			
 			// Add each question and its answer as separate messages to maintain the conversation flow
 			for _, qa := range questionResponses {
@@ -247,28 +349,726 @@ func GeneratePRMessage(commits string, config LLMConfig, template string) (strin
 			fmt.Println("Generating final PR description with your additional context...")
 			
 			// Make a second API call with the additional context
-			response, err = makeOpenAIRequest(newMessages, config)
+			response, err = makeStreamingRequest(ctx, newMessages, config, stream)
 			if err != nil {
 				return "", err
 			}
 		} else {
-			fmt.Println("Proceeding with the initial PR description since no questions were answered.")
-			// Try to extract a PR description from the initial response
-			response = extractPRDescription(response)
+			return describe()
 		}
 	}
+	if strings.TrimSpace(response) == "" {
+		return describe()
+	}
 
 	// Return the generated PR message
 	return strings.TrimSpace(response), nil
 }
 
+// GenerateReviewerDigest uses the OpenAI API to write a short guide for reviewers of a change:
+// the order to read the files in and the areas that deserve the most scrutiny
+func GenerateReviewerDigest(ctx context.Context, commits string, diff string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a senior software engineer helping a colleague review a pull request.
+	You will be given the commit messages and the diff of the pull request. Write a short reviewer digest in markdown
+	with exactly these sections:
+	## Summary
+	Two or three sentences describing what the change does.
+	## Reading order
+	A numbered list of the files a reviewer should read, in the order that makes the change easiest to understand,
+	with a few words on why each file matters.
+	## Risk areas
+	A bulleted list of the parts of the change most likely to contain bugs or cause regressions, and why.
+	Be concise and specific. Do not repeat the diff back.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Here are the commit messages:\n\n%s\n\nHere is the diff:\n\n%s", commits, diff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GeneratePRComment uses the OpenAI API to write a pull request comment in response to the user's prompt.
+// If thread is non-nil the comment is a reply in that review thread and the thread is given as context.
+func GeneratePRComment(ctx context.Context, prompt string, pr PullRequest, commits string, diff string, thread *ReviewThread, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer writing a comment on a pull request on behalf of the user.
+	You will be given the pull request's title, description, commit messages and diff, and possibly a review thread
+	you are replying in. Follow the user's instructions for what the comment should say. Write in markdown, be concise,
+	and only state things that are supported by the pull request contents. Respond with the comment text only.`
+
+	var context strings.Builder
+	context.WriteString(fmt.Sprintf("Pull request #%d: %s\n\n%s\n\n", pr.Number, pr.Title, pr.Body))
+	context.WriteString(fmt.Sprintf("Commit messages:\n%s\n\n", commits))
+	context.WriteString(fmt.Sprintf("Diff:\n%s\n", diff))
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: context.String()},
+	}
+
+	if thread != nil {
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("You are replying in a review thread on %s:\n%s\n\n", thread.Root.Path, thread.Root.DiffHunk))
+		sb.WriteString(fmt.Sprintf("%s: %s\n", thread.Root.User.Login, thread.Root.Body))
+		for _, reply := range thread.Replies {
+			sb.WriteString(fmt.Sprintf("%s: %s\n", reply.User.Login, reply.Body))
+		}
+		messages = append(messages, ChatMessage{Role: "user", Content: sb.String()})
+	}
+
+	messages = append(messages, ChatMessage{Role: "user", Content: prompt})
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateReReviewDigest uses the OpenAI API to summarize what changed in a pull request since a
+// reviewer last looked at it, so they know what to re-review
+func GenerateReReviewDigest(ctx context.Context, pr PullRequest, commits string, diff string, reviewer string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer helping a reviewer who has already reviewed a pull request once.
+	You will be given the pull request's title and description, and the commits and diff added since their last review.
+	Write a short markdown comment titled "What changed since your last review" that lists the changes as bullet points,
+	grouped by file or area, and points out anything that changes behavior the reviewer already approved.
+	Do not describe parts of the pull request that did not change. Respond with the comment text only.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Pull request #%d: %s\n\n%s\n\nThe reviewer is %s.\n\nCommits since their last review:\n%s\n\nDiff since their last review:\n%s",
+			pr.Number, pr.Title, pr.Body, reviewer, commits, diff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateInlineSuggestions uses the OpenAI API to find mechanical fixes, such as typos and
+// unchecked errors, in the lines a pull request adds. The diff's lines are numbered as in the
+// new version of each file; the reply is JSON.
+func GenerateInlineSuggestions(ctx context.Context, pr PullRequest, numberedDiff string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer reviewing a pull request for mechanical mistakes only:
+	typos in comments, strings and identifiers, errors that are returned but never checked, obvious off-by-one mistakes,
+	missing closing of resources and similar fixes whose right form is not a matter of opinion.
+	Do not suggest style changes, refactors or anything a reasonable author could disagree with.
+	Each line of the diff is prefixed with its line number in the new version of the file; removed lines have no number.
+	Only suggest changes to added lines (those marked +). For each fix give the file path, the first and last line numbers
+	it replaces, the exact original text of those lines without the numbers or the +, the replacement lines with the
+	same indentation, and a one-sentence reason.
+	Respond with JSON only: {"suggestions": [{"path": "...", "start_line": 10, "line": 11, "original": "...", "replacement": "...", "reason": "..."}]}
+	Respond with {"suggestions": []} if there is nothing mechanical to fix.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Pull request #%d: %s\n\nDiff:\n%s", pr.Number, pr.Title, numberedDiff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateRangeDiffSummary uses the OpenAI API to summarize a git range-diff between two versions
+// of a pull request's branch, so reviewers know what to look at again after a force-push
+func GenerateRangeDiffSummary(ctx context.Context, pr PullRequest, rangeDiff string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer helping reviewers of a pull request whose branch was rebased or force-pushed.
+	You will be given the pull request's title and description and the output of git range-diff between the old and new versions
+	of the branch. In range-diff output, "=" pairs an unchanged commit, "!" a changed one (followed by a diff of the two patches),
+	"<" a commit that was dropped and ">" a commit that was added.
+	Write a short markdown comment titled "What changed in this push" that says which commits were only rebased,
+	and lists the real changes to changed, added and dropped commits as bullet points, so reviewers know what to re-review.
+	Ignore changes that only come from the new base, such as shifted line numbers or context. Respond with the comment text only.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Pull request #%d: %s\n\n%s\n\nRange diff:\n%s", pr.Number, pr.Title, pr.Body, rangeDiff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateConflictSummary uses the OpenAI API to explain the conflicts a rebase stopped on, so
+// they can be resolved without reading both sides' history
+func GenerateConflictSummary(ctx context.Context, commit string, conflicts string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer helping a colleague resolve the conflicts of a rebase.
+	You will be given the commit being replayed and, for each conflicted file, the commits on the new base that touched it
+	and the conflict hunks. In a hunk, the side between "<<<<<<<" and "=======" is the new base and the side between
+	"=======" and ">>>>>>>" is the commit being replayed.
+	For each file, say in one or two short bullet points what each side changed and how to combine them, keeping the
+	intent of both. Say so when a resolution needs a decision only the author can make. Respond in plain text without a heading.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Commit being replayed:\n%s\n\n%s", commit, conflicts)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateCoverLetter uses the OpenAI API to write the cover letter of an emailed patch series.
+// The first line of the response is the subject and the rest is the body.
+func GenerateCoverLetter(ctx context.Context, commits string, diffstat string, notes string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer sending a patch series to a project's mailing list.
+	You will be given the commit messages of the series in order and its diffstat, and for later versions of the series
+	what changed since the previous version. Write the cover letter: a subject line of at most 60 characters on the first
+	line, without any [PATCH] prefix, then a blank line, then a plain text body wrapped at 72 columns that explains what
+	the series does and why, and how the patches build on each other. Mailing lists read plain text, so don't use markdown
+	headings, tables or code fences. Respond with the cover letter only.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Commits:\n%s\n\nDiffstat:\n%s%s", commits, diffstat, notes)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GeneratePatchNotes uses the OpenAI API to write the note for reviewers that goes below the "---"
+// of an emailed patch, which isn't part of the commit
+func GeneratePatchNotes(ctx context.Context, message string, diff string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer sending a patch to a project's mailing list.
+	You will be given the patch's commit message and diff. Write one to three short plain text sentences for reviewers
+	that go below the "---" line of the email and aren't part of the commit: where to start reading, anything tricky or
+	deliberately left out, and how it was tested if the diff shows it. Don't repeat the commit message and don't use markdown.
+	Respond with the note only, or with nothing if the commit message already says everything reviewers need.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Commit message:\n%s\n\nDiff:\n%s", message, diff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateVisualChanges uses a vision-capable model to describe how changed images look different
+func GenerateVisualChanges(ctx context.Context, changes []ImageChange, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer describing changes to images, such as UI screenshots,
+	icons and diagrams, for a commit message or pull request description. You will be given each changed image's path
+	and its version before and after the change. For each image, describe in one or two short sentences what visibly
+	changed, concretely, e.g. "the Save button moved from the footer to the header and is now brand blue". Mention layout,
+	color, text and added or removed elements. Don't describe what stayed the same and don't guess at why it changed.
+	Respond with one "- path: description" line per image.`
+
+	parts := []ContentPart{{Type: "text", Text: "Here are the changed images:"}}
+	for _, change := range changes {
+		parts = append(parts, ContentPart{Type: "text", Text: fmt.Sprintf("\n%s (%s)", change.Path, change.Status)})
+		if change.Before != nil {
+			parts = append(parts, ContentPart{Type: "text", Text: "Before:"}, imagePart(change.Path, change.Before))
+		}
+		if change.After != nil {
+			parts = append(parts, ContentPart{Type: "text", Text: "After:"}, imagePart(change.Path, change.After))
+		}
+	}
+	// Usage is recorded against the model that saw the images
+	visionConfig := config
+	visionConfig.Model = config.Vision.Model
+	requestBody := VisionRequest{
+		Model: visionConfig.Model,
+		Messages: []VisionMessage{
+			{Role: "system", Content: []ContentPart{{Type: "text", Text: systemPrompt}}},
+			{Role: "user", Content: parts},
+		},
+		Temperature: config.Temperature,
+		MaxTokens:   config.MaxTokens,
+	}
+
+	response, err := sendChatRequest(ctx, requestBody, visionConfig)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateCIFailureDigest uses the OpenAI API to summarize the root causes of failed CI jobs
+func GenerateCIFailureDigest(ctx context.Context, failures string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a senior software engineer triaging failed CI jobs on a pull request.
+	You will be given the names of the failed jobs and steps and the relevant parts of their logs.
+	Write a short markdown digest with one bullet per distinct root cause. For each cause say which jobs it broke,
+	quote the key error line, say whether it looks like a real failure caused by the change or a flaky/infrastructure
+	problem, and give a concrete next step. Group jobs that failed for the same reason. Do not pad the digest.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Here are the failed CI jobs:\n\n%s", failures)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateIssueDescription uses the OpenAI API to turn a terse bug report into a structured issue.
+// The first line of the result is the issue title and the rest is the body.
+func GenerateIssueDescription(ctx context.Context, report string, codeContext string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer filing a bug report for your team.
+	You will be given a terse description of a problem and possibly some of the relevant source code.
+	Respond with a concise issue title on the first line, a blank line, and then a markdown issue body with these sections:
+	## Summary
+	## Steps to reproduce
+	## Expected behavior
+	## Actual behavior
+	## Suspected area
+	Only state what the report and code support. Where information is missing, say what the reporter should add
+	instead of inventing details. In "Suspected area" point at specific files and functions from the code when possible.`
+
+	userContent := fmt.Sprintf("Here is the bug report:\n\n%s", report)
+	if codeContext != "" {
+		userContent += fmt.Sprintf("\n\nHere is the relevant code:\n\n%s", codeContext)
+	}
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: userContent},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateWorkspaceCommitMessages uses the OpenAI API to write coordinated commit messages for related
+// changes staged in several repos. The response has one "=== <repo> ===" block per repo.
+func GenerateWorkspaceCommitMessages(ctx context.Context, diffs map[string]string, repoOrder []string, config LLMConfig, template string) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := fmt.Sprintf(`You are a professional software engineer who has made one logical change that spans several repositories.
+	You will be given the staged git diff of each repository. Write one commit message per repository. Each message must
+	describe the changes in its own repository and briefly mention the related change in the other repositories by name,
+	so that someone reading either history can find the other half. The commit messages should be concise and informative.
+	Do not include any markdown headers in your response.
+	Format your response exactly like this, with one block per repository and nothing else:
+	=== <repository name> ===
+	<commit message>
+	Use the following template format for each commit message:
+	%s`, template)
+
+	var sb strings.Builder
+	for _, repo := range repoOrder {
+		sb.WriteString(fmt.Sprintf("Repository %s:\n%s\n\n", repo, diffs[repo]))
+	}
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: sb.String()},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateUpstreamSummary uses the OpenAI API to explain what changed in updated dependencies
+// and why it matters to the code that uses them
+func GenerateUpstreamSummary(ctx context.Context, updates string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer reviewing a dependency update.
+	You will be given each updated module with its old and new version, the files in our repository that use it,
+	and the upstream release notes or commits between the versions.
+	For each module write a short markdown bullet list covering what changed upstream and why it matters to us:
+	breaking changes, fixed bugs or security issues that affect the files that use it, and anything to test.
+	Leave out upstream changes that don't affect us. Do not include a top-level heading.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: updates},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateDigest uses the OpenAI API to summarize the PRs merged into a repository for people
+// who don't read GitHub
+func GenerateDigest(ctx context.Context, repo string, prs string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are writing the weekly update of a software project for stakeholders who don't read GitHub,
+	such as product managers, support and leadership. You will be given the pull requests merged this week with their
+	titles and descriptions. Write a short plain-language summary of what changed for users and the business: a
+	sentence of overview followed by up to eight bullet points starting with "- ", grouping related pull requests.
+	Mention anything users will notice, fixed problems and risks. Leave out internal refactoring, tests, dependency
+	updates and CI changes unless they matter to users. Avoid jargon, code and pull request numbers.
+	Do not use markdown headings, bold text or links.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Repository: %s\n\nMerged pull requests:\n%s", repo, prs)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateTranslation uses the OpenAI API to translate the parts of a text written in other
+// languages, keeping the placeholders maskCode left for its code
+func GenerateTranslation(ctx context.Context, text string, language string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := fmt.Sprintf(`You are a technical translator. You will be given a document written mostly in %s, with parts in
+	other languages. Translate those parts into %s and leave the parts already in %s as they are. Keep the markdown
+	formatting, headings and line breaks. Code, identifiers and quoted text have been replaced with placeholders such as
+	⟦0⟧: keep every placeholder exactly once, where it belongs in the sentence. Reply with the document only.`, language, language, language)
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: text},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateDependencyImpact uses the OpenAI API to analyze the impact of a bot-created dependency update
+func GenerateDependencyImpact(ctx context.Context, pr PullRequest, manifestDiff string, upstream string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a senior software engineer reviewing an automated dependency update pull request.
+	You will be given the pull request written by the update bot (which often includes release notes), the diff of the
+	dependency manifests, and for each updated module the files in our repository that use it and the upstream
+	release notes or commits. Write a concise markdown impact analysis with these bullet lists:
+	**APIs we use that changed**, **Breaking changes and upstream notes**, **Suggested test focus**.
+	Only mention changes that plausibly affect the files that use the dependency. Say "None found" for empty lists.
+	Do not include a top-level heading.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Pull request: %s\n\n%s\n\nManifest diff:\n%s\n\nUpdated modules:\n%s",
+			pr.Title, pr.Body, manifestDiff, upstream)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateUpgradeNotes uses the OpenAI API to explain a language, runtime or base image upgrade
+func GenerateUpgradeNotes(ctx context.Context, upgrades string, commits string, diff string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer documenting a toolchain upgrade in a pull request.
+	You will be given the detected version changes, the commit messages, and the diff.
+	Write three short markdown paragraphs or bullet lists, each starting with its bold label:
+	**Motivation**: why the upgrade is being made, based on the commits, or the usual reasons for this version if not stated.
+	**Migration steps applied**: the code or config changes in the diff that were needed for the new version, such as
+	replaced deprecated APIs or updated build flags. Only list steps that are actually in the diff.
+	**Residual risk**: known breaking or behavior changes of the new version that the diff does not address and that
+	reviewers should check. Do not include a top-level heading.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Version changes:\n%s\nCommit messages:\n%s\n\nDiff:\n%s", upgrades, commits, diff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateInfraIntent uses the OpenAI API to explain the intent of infrastructure changes whose
+// resources were already listed
+func GenerateInfraIntent(ctx context.Context, resources string, commits string, diff string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer explaining infrastructure changes to the infrastructure
+	reviewers of a pull request. You will be given the resources the change adds, changes, replaces and destroys,
+	which were parsed from the code and are exact, the commit messages, and the diff of the infrastructure files.
+	Explain in a few short bullet points what the change is meant to achieve and why each group of resources changes.
+	Point out anything reviewers should double-check, such as destroyed or replaced resources that hold data, widened
+	access, or changes that look unrelated to the stated intent. Don't repeat the resource list, don't invent resources
+	that aren't in it, and say so when the intent isn't clear from the commits. Do not include a heading.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Resources:\n%s\nCommit messages:\n%s\n\nDiff:\n%s", resources, commits, diff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateCommitType uses the OpenAI API to pick the conventional commit type of a change that
+// can't be classified from its file names alone
+func GenerateCommitType(ctx context.Context, diff string, types []string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := fmt.Sprintf(`You are a professional software engineer classifying a change for a conventional commit message.
+	You will be given a git diff. Respond with exactly one of these commit types and nothing else: %s.
+	Use feat for new behavior, fix for bug fixes, refactor for changes that keep behavior the same, and perf for performance improvements.`,
+		strings.Join(types, ", "))
+
+	config.MaxTokens = 10
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: diff},
+	}
+	return makeOpenAIRequest(ctx, messages, config)
+}
+
+// GenerateFileSummary uses the OpenAI API to summarize the change to one file, as the first
+// stage of the two-stage pipeline
+func GenerateFileSummary(ctx context.Context, path string, diff string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer summarizing one file's part of a larger change.
+	You will be given the diff of a single file. In at most three short sentences, say what changed and why it
+	matters, naming the functions, types or settings involved. Do not speculate about other files and do not
+	use markdown.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("File: %s\n\nDiff:\n%s", path, diff)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateFileSummaries uses the OpenAI API to summarize several small files' diffs in one
+// request. Summaries the reply leaves out are empty.
+func GenerateFileSummaries(ctx context.Context, paths []string, diffs []string, config LLMConfig) ([]string, error) {
+	if config.APIKey == "" {
+		return nil, newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer summarizing files that are part of a larger change.
+	You will be given the diffs of several files. For each file, in at most three short sentences, say what changed
+	and why it matters, naming the functions, types or settings involved. Do not use markdown. Start each file's
+	summary with a line in the form "=== <file path> ===" with the path as given, and summarize every file.`
+
+	var sb strings.Builder
+	for i, path := range paths {
+		sb.WriteString(fmt.Sprintf("File: %s\n\nDiff:\n%s\n\n", path, diffs[i]))
+	}
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: sb.String()},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return nil, err
+	}
+	sections := splitFileSummaries(response)
+	summaries := make([]string, len(paths))
+	for i, path := range paths {
+		summaries[i] = sections[path]
+	}
+	return summaries, nil
+}
+
+// fileSummaryHeader starts a file's summary in a reply summarizing several files
+var fileSummaryHeader = regexp.MustCompile(`(?m)^\s*=== (.+?) ===\s*$`)
+
+// splitFileSummaries splits a reply summarizing several files into the summary of each path
+func splitFileSummaries(response string) map[string]string {
+	sections := make(map[string]string)
+	headers := fileSummaryHeader.FindAllStringSubmatchIndex(response, -1)
+	for i, header := range headers {
+		end := len(response)
+		if i+1 < len(headers) {
+			end = headers[i+1][0]
+		}
+		path := strings.TrimSpace(response[header[2]:header[3]])
+		sections[path] = strings.TrimSpace(response[header[1]:end])
+	}
+	return sections
+}
+
+// GenerateSummaryDigest uses the OpenAI API to condense summaries of the changed files into a
+// shorter list, for changes whose summaries are too large for the model's context
+func GenerateSummaryDigest(ctx context.Context, summaries string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := `You are a professional software engineer condensing notes on a very large change.
+	You will be given a list summarizing the change to each of a group of files. Rewrite it as a shorter list in
+	the same "- path: summary" form, merging files changed for the same reason into one line under their common
+	directory or their paths. Keep every distinct change and the functions, types and settings named, and drop
+	repetition. Return only the list.`
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: summaries},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateFinalMessage uses the OpenAI API to turn a draft commit message or PR description into
+// the final one, as the second stage of the two-stage pipeline
+func GenerateFinalMessage(ctx context.Context, kind string, draft string, summaries string, template string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := fmt.Sprintf(`You are a senior software engineer finalizing a %s written by a colleague.
+	You will be given their draft and a summary of the change to each file. Rewrite the draft so it is accurate to the
+	summaries, complete, and concise. Keep any first-line format, scope and length rules the draft follows, and keep
+	the structure of the template. Return only the final %s.
+	Template:
+	%s`, kind, kind, template)
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Draft:\n%s\n\nSummaries of the changed files:\n%s", draft, summaries)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
+// GenerateJudgement uses the OpenAI API to score generated text against its source material.
+// The response is JSON with a score between 0 and 1 and the reasons for it.
+func GenerateJudgement(ctx context.Context, kind string, generated string, source string, config LLMConfig) (string, error) {
+	if config.APIKey == "" {
+		return "", newError(ErrAuth, "OpenAI API key not found. Set the OPENAI_KEY environment variable")
+	}
+
+	systemPrompt := fmt.Sprintf(`You are a strict reviewer judging an automatically generated %s before it is added to a
+	pull request without a human checking it. You will be given the source material it was generated from and the
+	generated text. Judge whether every claim is supported by the source, nothing important is missing, and it is
+	clear and concise. Respond only with JSON in the form {"score": <number from 0 to 1>, "reasons": "<one or two sentences>"}.
+	Use a score below 0.5 for anything with an unsupported claim.`, kind)
+
+	messages := []ChatMessage{
+		{Role: "system", Content: systemPrompt},
+		{Role: "user", Content: fmt.Sprintf("Source material:\n%s\n\nGenerated %s:\n%s", source, kind, generated)},
+	}
+
+	response, err := makeOpenAIRequest(ctx, messages, config)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(response), nil
+}
+
 // getQuestionsPrompt returns the prompt for questions based on whether the feature is enabled
 func getQuestionsPrompt(enableQuestions bool) string {
 	if enableQuestions {
 		return `
 	If you need additional information to write a more informative PR description, you can ask up to 3 questions.
-	To ask questions, respond with a JSON object in the following format:
-	{"questions": ["question 1", "question 2", "question 3"]}
+	Respond with a JSON object only, with no text around it: either {"questions": ["question 1", "question 2"], "description": ""}
+	to ask questions, or {"questions": [], "description": "<the PR description>"} with the full description following the template.
 	
 	Only ask questions if you genuinely need more context to write a better PR description. Don't ask questions in most cases.
 	`
@@ -277,21 +1077,54 @@ func getQuestionsPrompt(enableQuestions bool) string {
 }
 
 // makeOpenAIRequest makes a request to the OpenAI API and returns the response content
-func makeOpenAIRequest(messages []ChatMessage, config LLMConfig) (string, error) {
+func makeOpenAIRequest(ctx context.Context, messages []ChatMessage, config LLMConfig) (string, error) {
 	requestBody := ChatRequest{
-		Model:       config.Model,
-		Messages:    messages,
-		Temperature: config.Temperature,
-		MaxTokens:   config.MaxTokens,
+		Model:          config.Model,
+		Messages:       messages,
+		Temperature:    config.Temperature,
+		MaxTokens:      config.MaxTokens,
+		PromptCacheKey: promptCacheKey(messages),
 	}
+	return sendChatRequest(ctx, requestBody, config)
+}
 
+// sendChatRequest posts a chat completions request body and returns the reply, retrying and
+// falling back to another model on the failures that allow it
+func sendChatRequest(ctx context.Context, requestBody interface{}, config LLMConfig) (string, error) {
+	requestBody, err := redactRequest(requestBody)
+	if err != nil {
+		return "", err
+	}
+	tokens := 0
+	if body, ok := requestBody.(ChatRequest); ok {
+		tokens = promptTokens(body.Messages)
+	}
+	return retryChat(ctx, config, tokens, func(config LLMConfig) (string, error) {
+		if config.Provider == "ollama" {
+			return sendOllamaRequest(ctx, requestBody, config)
+		}
+		if config.Provider == "mock" {
+			return mockRequest(requestBody, config, nil)
+		}
+		return sendChatRequestOnce(ctx, requestForModel(requestBody, config.Model), config)
+	})
+}
+
+// sendChatRequestOnce posts a chat completions request body and returns the reply
+func sendChatRequestOnce(ctx context.Context, requestBody interface{}, config LLMConfig) (string, error) {
 	jsonData, err := json.Marshal(requestBody)
 	if err != nil {
 		return "", fmt.Errorf("failed to marshal request: %v", err)
 	}
 
+	if err := checkChatEndpoint(config); err != nil {
+		return "", err
+	}
+
 	// Make the API request
-	req, err := http.NewRequest("POST", "https://api.openai.com/v1/chat/completions", bytes.NewBuffer(jsonData))
+	ctx, cancel := requestContext(ctx, config)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", chatEndpoint(config), bytes.NewBuffer(jsonData))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %v", err)
 	}
@@ -299,93 +1132,116 @@ func makeOpenAIRequest(messages []ChatMessage, config LLMConfig) (string, error)
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.APIKey))
 
-	client := &http.Client{}
+	client, err := llmHTTPClient(config)
+	if err != nil {
+		return "", err
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %v", err)
+		err = requestError(ctx, config, fmt.Errorf("failed to send request: %w", err))
+		recordLLMError(err)
+		return "", err
 	}
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
+		return "", requestError(ctx, config, fmt.Errorf("failed to read response: %v", err))
 	}
 
+	// Check for API errors, which providers shape differently
 	var chatResponse ChatResponse
-	if err := json.Unmarshal(body, &chatResponse); err != nil {
-		return "", fmt.Errorf("failed to unmarshal response: %v", err)
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &chatResponse) != nil || chatResponse.Error != nil {
+		err := apiError(resp.StatusCode, resp.Header, body)
+		recordLLMError(err)
+		return "", err
 	}
+	recordLLMUsage(config, chatResponse)
 
-	// Check for API errors
-	if chatResponse.Error != nil {
-		return "", fmt.Errorf("API error: %s", chatResponse.Error.Message)
+	content, err := validateChatResponse(chatResponse, config.MaxTokens)
+	if err != nil {
+		recordLLMError(err)
 	}
+	return content, err
+}
 
-	if len(chatResponse.Choices) == 0 {
-		return "", fmt.Errorf("no response from API")
+// promptCacheKey groups requests that start with the same system prompt, so the provider routes
+// them to the same prompt cache. The static instructions and template always come first and the
+// diff or commits last, which is what lets the provider reuse the cached prefix.
+func promptCacheKey(messages []ChatMessage) string {
+	if len(messages) == 0 || messages[0].Role != "system" {
+		return ""
 	}
+	sum := sha256.Sum256([]byte(messages[0].Content))
+	return "gitscribe-" + hex.EncodeToString(sum[:8])
+}
 
-	return chatResponse.Choices[0].Message.Content, nil
+// questionsReply is the model's answer to the first request for a PR description when it may ask
+// questions: either the questions or the description, never both
+type questionsReply struct {
+	Questions   []string `json:"questions"`
+	Description string   `json:"description"`
 }
 
-// extractQuestions checks if the response contains questions and extracts them
-func extractQuestions(response string) ([]QuestionResponse, bool) {
-	// Try to parse the entire response as JSON first
-	var questionsObj struct {
-		Questions []string `json:"questions"`
-	}
-	
-	// If the entire response is valid JSON with questions
-	if err := json.Unmarshal([]byte(response), &questionsObj); err == nil && len(questionsObj.Questions) > 0 {
-		Log(DEBUG, "Found questions in complete JSON response")
-		return convertToQuestionResponses(questionsObj.Questions), true
-	}
-	
-	// If not, try to find JSON object within text using regex
-	re := regexp.MustCompile(`\{[\s\n]*"questions"[\s\n]*:[\s\n]*\[.*?\][\s\n]*\}`)
-	match := re.FindString(response)
-	
-	if match == "" {
-		Log(DEBUG, "No questions JSON found in response")
-		return nil, false
+// maxQuestions is how many questions the model may ask before writing a PR description
+const maxQuestions = 3
+
+// questionsFormat makes the provider return a questionsReply through structured outputs, so the
+// questions never have to be picked out of prose
+var questionsFormat = &ResponseFormat{Type: "json_schema", JSONSchema: &JSONSchema{
+	Name:   "pr_description_or_questions",
+	Strict: true,
+	Schema: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"questions":   map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"description": map[string]interface{}{"type": "string"},
+		},
+		"required":             []string{"questions", "description"},
+		"additionalProperties": false,
+	},
+}}
+
+// unsupportedResponseFormat reports whether the provider rejected a request because the model
+// can't do structured outputs
+func unsupportedResponseFormat(err error) bool {
+	var providerErr *ProviderError
+	return errors.As(err, &providerErr) && providerErr.Status == http.StatusBadRequest &&
+		(strings.Contains(providerErr.Message, "response_format") || strings.Contains(providerErr.Message, "json_schema"))
+}
+
+// requestQuestions makes the first request for a PR description, which the model answers with
+// questions or the description. It returns false if the reply isn't the JSON object asked for,
+// which only models without structured outputs send.
+func requestQuestions(ctx context.Context, messages []ChatMessage, config LLMConfig) (questionsReply, bool, error) {
+	request := ChatRequest{
+		Model:          config.Model,
+		Messages:       messages,
+		Temperature:    config.Temperature,
+		MaxTokens:      config.MaxTokens,
+		PromptCacheKey: promptCacheKey(messages),
+		ResponseFormat: questionsFormat,
 	}
-	
-	Log(DEBUG, "Found potential questions JSON: %s", match)
-	
-	// Try to parse the extracted JSON
-	if err := json.Unmarshal([]byte(match), &questionsObj); err != nil {
-		Log(WARN, "Failed to parse questions JSON: %v", err)
-		return nil, false
+	response, err := sendChatRequest(ctx, request, config)
+	if unsupportedResponseFormat(err) {
+		Log(INFO, "%s doesn't support structured outputs, asking for the JSON in the prompt only", config.Model)
+		request.ResponseFormat = nil
+		response, err = sendChatRequest(ctx, request, config)
 	}
-	
-	// Skip if no questions were found
-	if len(questionsObj.Questions) == 0 {
-		Log(DEBUG, "Questions array was empty")
-		return nil, false
+	if err != nil {
+		return questionsReply{}, false, err
 	}
-	
-	return convertToQuestionResponses(questionsObj.Questions), true
-}
 
-// Helper function to convert string questions to QuestionResponse objects
-func convertToQuestionResponses(questions []string) []QuestionResponse {
-	// Limit the number of questions to 3
-	maxQuestions := 3
-	if len(questions) > maxQuestions {
-		Log(INFO, "Limiting questions to %d (received %d)", maxQuestions, len(questions))
-		questions = questions[:maxQuestions]
+	var reply questionsReply
+	if err := json.Unmarshal([]byte(strings.TrimSpace(response)), &reply); err != nil {
+		Log(DEBUG, "The reply isn't a questions object: %v", err)
+		return questionsReply{}, false, nil
 	}
-	
-	// Convert to QuestionResponse objects
-	questionResponses := make([]QuestionResponse, len(questions))
-	for i, q := range questions {
-		questionResponses[i] = QuestionResponse{
-			Question: q,
-			Answer:   "", // Will be filled in later
-		}
+	if len(reply.Questions) > maxQuestions {
+		Log(INFO, "Limiting questions to %d (received %d)", maxQuestions, len(reply.Questions))
+		reply.Questions = reply.Questions[:maxQuestions]
 	}
-	
-	return questionResponses
+	return reply, true, nil
 }
 
 // askUserQuestions presents questions to the user and collects answers
@@ -445,53 +1301,3 @@ func formatQuestionsAndAnswers(qas []QuestionResponse) string {
 	
 	return sb.String()
 }
-
-// extractPRDescription attempts to extract a PR description from a response that contains questions
-func extractPRDescription(response string) string {
-	// If the response only contains questions, return an empty string
-	if strings.TrimSpace(response) == "" || strings.HasPrefix(strings.TrimSpace(response), "{\"questions\":") {
-		return ""
-	}
-	
-	// Check if the response contains a JSON object with questions
-	startIdx := strings.Index(response, "{\"questions\":")
-	if startIdx == -1 {
-		// No questions found, return the entire response
-		return response
-	}
-	
-	// Find the end of the JSON object
-	endIdx := -1
-	braceCount := 0
-	for i := startIdx; i < len(response); i++ {
-		if response[i] == '{' {
-			braceCount++
-		} else if response[i] == '}' {
-			braceCount--
-			if braceCount == 0 {
-				endIdx = i
-				break
-			}
-		}
-	}
-	
-	if endIdx == -1 {
-		// Could not find the end of the JSON object, return the entire response
-		return response
-	}
-	
-	// Return everything before the questions and after the questions
-	beforeQuestions := strings.TrimSpace(response[:startIdx])
-	afterQuestions := strings.TrimSpace(response[endIdx+1:])
-	
-	if beforeQuestions != "" && afterQuestions != "" {
-		return beforeQuestions + "\n\n" + afterQuestions
-	} else if beforeQuestions != "" {
-		return beforeQuestions
-	} else if afterQuestions != "" {
-		return afterQuestions
-	}
-	
-	// If we couldn't extract anything, return an empty string
-	return ""
-} 
\ No newline at end of file
@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,17 +20,43 @@ const (
 
 var logLevel = INFO
 
+// maxRecentLogs is how many log lines are kept in memory for crash reports
+const maxRecentLogs = 200
+
+var (
+	// logMu guards recentLogs and runWarnings, as the server logs from many goroutines at once
+	logMu sync.Mutex
+	// recentLogs holds the latest log lines at every level, whatever logLevel is
+	recentLogs []string
+)
+
 // SetLogLevel sets the minimum log level to display
 func SetLogLevel(level LogLevel) {
 	logLevel = level
 }
 
+// SetLogLevelFromFlag sets the log level from its command-line name (debug, info, warn, error, none)
+func SetLogLevelFromFlag(level string) {
+	switch strings.ToLower(level) {
+	case "debug":
+		SetLogLevel(DEBUG)
+	case "info":
+		SetLogLevel(INFO)
+	case "warn", "warning":
+		SetLogLevel(WARN)
+	case "error":
+		SetLogLevel(ERROR)
+	case "none", "":
+		// Set to a level higher than any defined log level to suppress all logs
+		SetLogLevel(ERROR + 1)
+	default:
+		// Default to no logging
+		SetLogLevel(ERROR + 1)
+	}
+}
+
 // Log prints a message with timestamp and level if it meets the minimum level
 func Log(level LogLevel, format string, args ...interface{}) {
-	if level < logLevel {
-		return
-	}
-	
 	levelStr := "INFO"
 	switch level {
 	case DEBUG:
@@ -41,5 +69,37 @@ func Log(level LogLevel, format string, args ...interface{}) {
 	
 	timestamp := time.Now().Format("2025-03-09 15:04:05")
 	message := fmt.Sprintf(format, args...)
-	fmt.Fprintf(os.Stderr, "[%s] %s: %s\n", timestamp, levelStr, message)
-} 
\ No newline at end of file
+	line := fmt.Sprintf("[%s] %s: %s", timestamp, levelStr, message)
+
+	logMu.Lock()
+	recentLogs = append(recentLogs, line)
+	if level == WARN {
+		runWarnings = append(runWarnings, message)
+		if len(runWarnings) > maxRunWarnings {
+			runWarnings = runWarnings[len(runWarnings)-maxRunWarnings:]
+		}
+	}
+	if len(recentLogs) > maxRecentLogs {
+		recentLogs = recentLogs[len(recentLogs)-maxRecentLogs:]
+	}
+	logMu.Unlock()
+
+	if level < logLevel {
+		return
+	}
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// recentLogLines returns a copy of the latest log lines
+func recentLogLines() []string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return append([]string(nil), recentLogs...)
+}
+
+// loggedWarnings returns a copy of the latest warnings logged in this run
+func loggedWarnings() []string {
+	logMu.Lock()
+	defer logMu.Unlock()
+	return append([]string(nil), runWarnings...)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestLogConcurrently logs from many goroutines, as the server's workers do. Run it with -race.
+func TestLogConcurrently(t *testing.T) {
+	previousLevel := logLevel
+	SetLogLevel(ERROR + 1)
+	logMu.Lock()
+	previousLogs, previousWarnings := recentLogs, runWarnings
+	recentLogs, runWarnings = nil, nil
+	logMu.Unlock()
+	defer func() {
+		SetLogLevel(previousLevel)
+		logMu.Lock()
+		recentLogs, runWarnings = previousLogs, previousWarnings
+		logMu.Unlock()
+	}()
+
+	const goroutines, lines = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < lines; j++ {
+				Log(WARN, "worker %d line %d", i, j)
+				recentLogLines()
+				loggedWarnings()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(recentLogLines()); got != maxRecentLogs {
+		t.Errorf("kept %d recent log lines, want %d", got, maxRecentLogs)
+	}
+	if got := len(loggedWarnings()); got != maxRunWarnings {
+		t.Errorf("kept %d warnings, want %d", got, maxRunWarnings)
+	}
+}
@@ -3,43 +3,66 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"time"
-	"strings"
 )
 
 func main() {
+	defer recoverCrash()
+
+	// Dispatch to a subcommand if one was given, e.g. "gs action"
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			runCommand = os.Args[1]
+			if err := command(os.Args[2:]); err != nil {
+				Log(ERROR, "%s failed: %v", os.Args[1], err)
+				fmt.Println("Error:", err)
+				fail(err)
+			}
+			recordRun(nil)
+			return
+		}
+	}
+
 	// Define command-line flags
 	generatePR := flag.Bool("pr", false, "Generate a PR message and prepare for PR creation")
-	targetBranch := flag.String("target", "master", "Target branch for PR (default: master)")
+	targetBranch := flag.String("target", "", "Target branch for PR (default: the repository's default branch, else master)")
 	skipCreate := flag.Bool("skip-create", false, "Skip PR creation on GitHub (only generate message)")
 	configPath := flag.String("config", "", "Path to config file (default: search in standard locations)")
 	dryRun := flag.Bool("dry-run", false, "Generate message but don't commit or create PR")
 	logLevelFlag := flag.String("log-level", "none", "Set logging level (debug, info, warn, error, none)")
+	scopeDirs := flag.Bool("scope-dirs", false, "Choose which changed top-level directories to include before generating a commit message")
+	localContextOnly := flag.Bool("local-context-only", false, "Only send commit messages and file paths to the LLM, not file contents")
+	patchIn := flag.String("patch", "", "Generate the commit message for a .patch or .diff file instead of the staged changes")
+	patchOut := flag.String("patch-out", "", "Write the message and diff to this file as a patch instead of committing")
+	noFixup := flag.Bool("no-fixup", false, "Don't offer a fixup! commit when the staged changes belong to an earlier commit on the branch")
+	styleOf := flag.String("style-of", "", "Write the commit message in the style of an author's commits or a ref range (e.g. v1.0..v1.2)")
+	llmTimeout := flag.Int("llm-timeout", 0, "Seconds a request to the LLM may take before it's given up on (default: llm.timeout_seconds)")
+	infraPlan := flag.String("infra-plan", "", "Terraform plan from terraform show -json to list infrastructure changes from (with -pr)")
+	flag.BoolVar(&showCost, "show-cost", false, "Print the tokens used and their estimated cost when done")
+	flag.BoolVar(&refreshCache, "refresh", false, "Fetch metadata from GitHub again instead of using the cache")
+	flag.Var(&resultFormat, "format", "Report the outcome as text, or as a JSON result envelope on stdout with json")
+	modelFlag := flag.String("model", "", "Model to generate with, overriding llm.commit.model or llm.pr.model and llm.model")
+	var temperatureFlag optionalFloatFlag
+	flag.Var(&temperatureFlag, "temperature", "Sampling temperature from 0 to 2, overriding llm.commit.temperature or llm.pr.temperature and llm.temperature")
+	maxTokensFlag := flag.Int("max-tokens", 0, "Most tokens the reply may have, overriding llm.commit.max_tokens or llm.pr.max_tokens and llm.max_tokens")
+	yes := flag.Bool("yes", false, "Replace the description of the branch's open PR without asking (with -pr)")
+	headRef := flag.String("head", "", "Generate from this ref instead of the working tree, e.g. in a bare repository (needs -dry-run)")
+	gitDir := flag.String("git-dir", "", "Repository to read -head from when it isn't the current directory")
 	flag.Parse()
 
 	// Set log level based on flag
-	switch strings.ToLower(*logLevelFlag) {
-	case "debug":
-		SetLogLevel(DEBUG)
-	case "info":
-		SetLogLevel(INFO)
-	case "warn", "warning":
-		SetLogLevel(WARN)
-	case "error":
-		SetLogLevel(ERROR)
-	case "none", "":
-		// Set to a level higher than any defined log level to suppress all logs
-		SetLogLevel(ERROR + 1)
-	default:
-		// Default to no logging
-		SetLogLevel(ERROR + 1)
-	}
+	SetLogLevelFromFlag(*logLevelFlag)
 
 	Log(INFO, "Starting application")
-	Log(DEBUG, "Command-line flags: pr=%v, target=%s, skip-create=%v, config=%s, dry-run=%v, log-level=%s",
-		*generatePR, *targetBranch, *skipCreate, *configPath, *dryRun, *logLevelFlag)
+	Log(DEBUG, "Command-line flags: pr=%v, target=%s, skip-create=%v, config=%s, dry-run=%v, log-level=%s, scope-dirs=%v",
+		*generatePR, *targetBranch, *skipCreate, *configPath, *dryRun, *logLevelFlag, *scopeDirs)
+
+	if *generatePR {
+		runCommand = "pr"
+	}
 
 	// Load config from appropriate location
 	Log(INFO, "Loading configuration")
@@ -47,47 +70,200 @@ func main() {
 	if err != nil {
 		Log(ERROR, "Failed to load config: %v", err)
 		fmt.Println("Error loading config:", err)
-		os.Exit(1)
+		fail(err)
+	}
+	defer recordRun(nil)
+
+	if *headRef != "" {
+		err := checkWorktreelessFlags(*dryRun, *patchIn, *scopeDirs)
+		if err == nil {
+			err = useHeadRef(*gitDir, *headRef)
+		}
+		if err != nil {
+			Log(ERROR, "Failed to read from %s: %v", *headRef, err)
+			fmt.Println("Error:", err)
+			fail(err)
+		}
+	} else if *gitDir != "" {
+		fmt.Println("Error: -git-dir needs -head <ref> to say what to generate from")
+		fail(newError(ErrUsage, "-git-dir needs -head"))
+	}
+	if *targetBranch == "" {
+		*targetBranch = defaultBranch()
+		Log(INFO, "Targeting the default branch, %s", *targetBranch)
+	}
+
+	if *localContextOnly {
+		config.LLM.LocalContextOnly = true
+	}
+	if *llmTimeout != 0 {
+		config.LLM.TimeoutSeconds = *llmTimeout
+	}
+	generation := config.LLM.Commit
+	if *generatePR {
+		generation = config.LLM.PR
+	}
+	if temperatureFlag.value != nil && !validTemperature(*temperatureFlag.value) {
+		fmt.Println("Error: -temperature must be from 0 to 2")
+		fail(newError(ErrUsage, "-temperature out of range"))
+	}
+	if *maxTokensFlag < 0 {
+		fmt.Println("Error: -max-tokens can't be negative")
+		fail(newError(ErrUsage, "-max-tokens is negative"))
+	}
+	flagGeneration := GenerationSettings{Model: *modelFlag, Temperature: temperatureFlag.value, MaxTokens: *maxTokensFlag}
+	config.LLM = config.LLM.withGeneration(generation.merge(flagGeneration))
+	// Ctrl-C cancels a request to the LLM instead of leaving it hanging
+	ctx, stop := interruptContext()
+	defer stop()
+	if *infraPlan != "" {
+		config.Infra.PlanFile = *infraPlan
+	}
+	if err := ensureConsent(*generatePR, config); err != nil {
+		Log(ERROR, "Consent check failed: %v", err)
+		fmt.Println("Error:", err)
+		fail(err)
+	}
+	// Check the signing key before generating, rather than after the commit or PR is made
+	if config.Attestation.Enabled && !*dryRun {
+		if _, err := loadAttestationKey(config.Attestation); err != nil {
+			Log(ERROR, "Failed to load the attestation key: %v", err)
+			fmt.Println("Error:", err)
+			fail(err)
+		}
+	}
+
+	// Without GitHub the description is still worth writing, so it's saved instead of failing
+	// once it's done
+	if *generatePR && !*skipCreate && !*dryRun {
+		if github := githubAvailable(); !github.Active {
+			noteOmitted("creating the PR", github)
+			*skipCreate = true
+		}
 	}
 
 	var message string
+	var extras PRExtras
+	var patchDiff string
+	vcs := currentVCS()
+	Log(DEBUG, "Using %s for changes", vcs.Name())
+	if vcs.Name() == "git" && !worktreeless() && *patchIn == "" {
+		if err := checkRepoHealth(*generatePR, *targetBranch); err != nil {
+			Log(ERROR, "Repository not ready: %v", err)
+			fmt.Println("Error:", err)
+			fail(err)
+		}
+	}
 
 	if *generatePR {
+		results, err := runPreflightChecks(*targetBranch, config)
+		if err != nil {
+			Log(ERROR, "Failed to run pre-flight checks: %v", err)
+			fmt.Println("Error running pre-flight checks:", err)
+			fail(err)
+		}
+		if printPreflightResults(results) && !*skipCreate && !*dryRun {
+			Log(ERROR, "PR creation blocked by failed pre-flight checks")
+			fmt.Println("Error: PR creation blocked by failed pre-flight checks. Fix the problems above or use -skip-create.")
+			fail(newError(ErrPreflightFailed, "PR creation blocked by failed pre-flight checks"))
+		}
+
 		Log(INFO, "Generating PR message")
 		// Generate PR message
-		commits, err := getCommitMessages(*targetBranch)
+		commits, err := vcs.BranchCommits(*targetBranch)
 		if err != nil {
 			Log(ERROR, "Failed to get commit messages: %v", err)
 			fmt.Println("Error:", err)
-			os.Exit(1)
+			fail(err)
+		}
+
+		commits, err = enrichSubmoduleCommits(*targetBranch, commits)
+		if err != nil {
+			Log(ERROR, "Failed to read submodule commits: %v", err)
+			fmt.Println("Error:", err)
+			fail(err)
 		}
 
-		message, err = createPRMessage(commits, config.PRTemplate, config.LLM)
+		message, err = createPRMessage(ctx, commits, *targetBranch, config.PRTemplate, config.AreaTemplates, config.HumanSections, config.LLM)
 		if err != nil {
 			Log(ERROR, "Failed to create PR message: %v", err)
 			fmt.Println("Error generating PR message:", err)
-			os.Exit(1)
+			fail(err)
+		}
+
+		// Add the deterministic sections and reviewer/label requirements
+		extras, err = buildPRExtras(ctx, *targetBranch, commits, config)
+		if err != nil {
+			Log(ERROR, "Failed to analyze branch: %v", err)
+			fmt.Println("Error analyzing branch:", err)
+			fail(err)
 		}
+		message = appendSections(message, extras.Sections)
 	} else {
 		Log(INFO, "Generating commit message")
 		// Generate commit message (existing functionality)
-		diff, err := getStagedDiff()
+		var diff string
+		if *patchIn != "" {
+			if *patchOut == "" && !*dryRun {
+				fmt.Println("Error: -patch needs -patch-out <file> or -dry-run, as there's nothing staged to commit")
+				fail(newError(ErrUsage, "-patch needs -patch-out or -dry-run"))
+			}
+			diff, err = readPatchFile(*patchIn)
+		} else if worktreeless() {
+			// Without a working tree, the commit describes everything on -head since -target
+			diff, err = getDiffInRange(*targetBranch, headRev)
+		} else {
+			diff, err = vcs.WorkingDiff()
+		}
+		if err != nil {
+			Log(ERROR, "Failed to get diff: %v", err)
+			fmt.Println("Error:", err)
+			fail(err)
+		}
+		patchDiff = diff
+
+		if *patchIn == "" && !*noFixup && !*dryRun && vcs.Name() == "git" {
+			if target, ok := findFixupTarget(*targetBranch, diff); ok && offerFixup(target) {
+				if err := commitFixup(target); err != nil {
+					fmt.Println("Error:", err)
+					fail(err)
+				}
+				recordCommitArtifact()
+				fmt.Printf("Fixup commit created. Run git rebase -i --autosquash %s to squash it.\n", *targetBranch)
+				return
+			}
+		}
+
+		// Vendored code is third-party noise in the prompt
+		diff = stripVendoredDiff(diff, config.Vendor.Paths)
+
+		if *scopeDirs && *patchIn == "" {
+			diff, err = scopeDiffByDirectory(diff)
+			if err != nil {
+				Log(ERROR, "Failed to scope diff by directory: %v", err)
+				fmt.Println("Error:", err)
+				fail(err)
+			}
+		}
+
+		style, err := buildStylePrompt(*styleOf)
 		if err != nil {
-			Log(ERROR, "Failed to get staged diff: %v", err)
+			Log(ERROR, "Failed to learn commit style: %v", err)
 			fmt.Println("Error:", err)
-			os.Exit(1)
+			fail(err)
 		}
 
-		message, err = createCommitMessage(diff, config.CommitTemplate, config.LLM)
+		message, err = createCommitMessage(ctx, diff, config.CommitTemplate, config.LLM, *config.CommitFormat, config.CommitBudget, style)
 		if err != nil {
 			Log(ERROR, "Failed to create commit message: %v", err)
 			fmt.Println("Error generating commit message:", err)
-			os.Exit(1)
+			fail(err)
 		}
 	}
 
 	if *dryRun {
 		Log(INFO, "Dry run mode - displaying message and exiting")
+		runMessage = message
 		fmt.Println("=== Generated Message (Dry Run) ===")
 		fmt.Println(message)
 		fmt.Println("==================================")
@@ -101,7 +277,7 @@ func main() {
 	if err != nil {
 		Log(ERROR, "Failed to create temporary file: %v", err)
 		fmt.Println("Error creating temp file:", err)
-		os.Exit(1)
+		fail(err)
 	}
 	
 	// Only remove the temp file if we're not creating a PR or if it's a commit message
@@ -114,12 +290,12 @@ func main() {
 	if _, err := file.WriteString(message); err != nil {
 		Log(ERROR, "Failed to write to temporary file: %v", err)
 		fmt.Println("Error writing to temp file:", err)
-		os.Exit(1)
+		fail(err)
 	}
 	if err := file.Close(); err != nil {
 		Log(ERROR, "Failed to close temporary file: %v", err)
 		fmt.Println("Error closing temp file:", err)
-		os.Exit(1)
+		fail(err)
 	}
 
 	// Open editor for the user to edit the message
@@ -127,7 +303,20 @@ func main() {
 	if err := openInVim(tempFile); err != nil {
 		Log(ERROR, "Failed to open editor: %v", err)
 		fmt.Println("Error opening editor:", err)
-		os.Exit(1)
+		fail(err)
+	}
+
+	edited, err := ioutil.ReadFile(tempFile)
+	if err != nil {
+		Log(ERROR, "Failed to read edited message: %v", err)
+		fmt.Println("Error reading edited message:", err)
+		fail(err)
+	}
+	runMessage = string(edited)
+	if *generatePR {
+		recordMessageHistory("pr", message, string(edited), config)
+	} else {
+		recordMessageHistory("commit", message, string(edited), config)
 	}
 
 	if *generatePR {
@@ -135,32 +324,121 @@ func main() {
 			// Create PR using GitHub CLI
 			Log(INFO, "Creating PR on GitHub")
 			fmt.Println("Creating PR on GitHub...")
-			prURL, err := createPullRequest(tempFile, *targetBranch)
+			if err := markGenerated(tempFile); err != nil {
+				Log(ERROR, "Failed to mark the generated description: %v", err)
+				fmt.Println("Error:", err)
+				fail(err)
+			}
+			if existing, ok := openPullRequestForBranch(); ok {
+				updated, err := updateOpenPullRequest(existing, tempFile, extras, *yes)
+				if err != nil {
+					Log(ERROR, "Failed to update PR: %v", err)
+					fmt.Println("Error updating PR:", err)
+					fail(err)
+				}
+				if !updated {
+					fmt.Println("Left the PR description unchanged.")
+					return
+				}
+				runArtifacts.PRURL = existing.URL
+				fmt.Println("PR description updated:", existing.URL)
+				if config.Attestation.Enabled {
+					final, err := ioutil.ReadFile(tempFile)
+					if err == nil {
+						err = attestPR(message, string(final), existing.URL, config)
+					}
+					if err != nil {
+						Log(ERROR, "Failed to attest the PR description: %v", err)
+						fmt.Println("Error: the PR was updated, but attesting its description failed:", err)
+						fail(err)
+					}
+				}
+				return
+			}
+			prURL, err := createPullRequest(tempFile, *targetBranch, extras)
 			if err != nil {
 				Log(ERROR, "Failed to create PR: %v", err)
 				fmt.Println("Error creating PR:", err)
-				os.Exit(1)
+				fail(err)
 			}
 			Log(INFO, "PR created successfully: %s", prURL)
+			runArtifacts.PRURL = prURL
 			fmt.Println("PR created successfully!")
 			fmt.Println("PR URL:", prURL)
+			if config.Attestation.Enabled {
+				final, err := ioutil.ReadFile(tempFile)
+				if err == nil {
+					err = attestPR(message, string(final), prURL, config)
+				}
+				if err != nil {
+					Log(ERROR, "Failed to attest the PR description: %v", err)
+					fmt.Println("Error: the PR was created, but attesting its description failed:", err)
+					fail(err)
+				}
+			}
+
+			if config.FollowUps.FileIssues && len(extras.FollowUps) > 0 {
+				Log(INFO, "Filing %d follow-up issues", len(extras.FollowUps))
+				if err := fileFollowUpIssues(extras.FollowUps, prURL, config.FollowUps.IssueLabels); err != nil {
+					Log(ERROR, "Failed to file follow-up issues: %v", err)
+					fmt.Println("Error filing follow-up issues:", err)
+					fail(err)
+				}
+			}
 		} else {
 			// For PR messages without creation, just display the file path
 			Log(INFO, "Skipping PR creation, message saved to file")
+			runArtifacts.MessageFile = tempFile
 			fmt.Printf("PR message saved to: %s\n", tempFile)
 			fmt.Println("You can use this message when creating a PR on GitHub.")
+			if config.Attestation.Enabled {
+				if err := attestPR(message, string(edited), "", config); err != nil {
+					Log(ERROR, "Failed to attest the PR description: %v", err)
+					fmt.Println("Error:", err)
+					fail(err)
+				}
+			}
 		}
+	} else if *patchOut != "" {
+		if err := writePatchFile(*patchOut, string(edited), patchDiff); err != nil {
+			Log(ERROR, "Failed to write patch: %v", err)
+			fmt.Println("Error:", err)
+			fail(err)
+		}
+		runArtifacts.Patch = *patchOut
+		fmt.Println("Patch written to:", *patchOut)
 	} else {
 		// For commit messages, proceed with commit
 		Log(INFO, "Committing changes")
-		if err := commitChanges(tempFile); err != nil {
+		if err := vcs.Describe(tempFile); err != nil {
 			Log(ERROR, "Failed to commit changes: %v", err)
 			fmt.Println("Error committing changes:", err)
-			os.Exit(1)
+			fail(err)
 		}
 		Log(INFO, "Commit completed successfully")
-		fmt.Println("Commit successful!")
+		if vcs.Name() == "git" {
+			recordCommitArtifact()
+		}
+		if vcs.Name() == "jj" {
+			fmt.Println("Described the working-copy change. Run jj new to start the next one.")
+		} else {
+			fmt.Println("Commit successful!")
+		}
+		if config.Attestation.Enabled {
+			if err := attestCommit(message, string(edited), config); err != nil {
+				Log(ERROR, "Failed to attest the commit message: %v", err)
+				fmt.Println("Error: the commit was made, but attesting its message failed:", err)
+				fail(err)
+			}
+		}
 	}
 	
 	Log(INFO, "Application completed successfully")
-} 
\ No newline at end of file
+}
+
+// fail records the failed run, explains what to do about it and exits with a code for its kind
+func fail(err error) {
+	printRemediation(err)
+	recordRun(err)
+	os.Exit(exitCode(err))
+}
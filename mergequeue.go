@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// MergeQueueConfig lists the repository's own merge queue gates on top of what GitHub enforces
+type MergeQueueConfig struct {
+	RequiredLabels []string `json:"required_labels"` // labels a PR needs before it's queued, such as "ready-to-merge"
+	BlockingLabels []string `json:"blocking_labels"` // labels that keep a PR out of the queue, such as "do-not-merge"
+}
+
+// RequiredChecks are the status checks the base branch requires
+type RequiredChecks struct {
+	Contexts   []string
+	Strict     bool // the branch must be up to date with the base before merging
+	MergeQueue bool // the branch is merged through a merge queue
+}
+
+// mqPullRequest is the part of a pull request the merge queue checks look at
+type mqPullRequest struct {
+	PullRequest
+	Draft          bool   `json:"draft"`
+	MergeableState string `json:"mergeable_state"`
+	Labels         []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+}
+
+// requiredChecks reads the status checks that rulesets and classic branch protection require on
+// the branch, and whether it uses a merge queue
+func requiredChecks(repo string, branch string) (RequiredChecks, error) {
+	var required RequiredChecks
+	seen := make(map[string]bool)
+	add := func(context string) {
+		if !seen[context] {
+			seen[context] = true
+			required.Contexts = append(required.Contexts, context)
+		}
+	}
+
+	var rules []struct {
+		Type       string `json:"type"`
+		Parameters struct {
+			RequiredStatusChecks []struct {
+				Context string `json:"context"`
+			} `json:"required_status_checks"`
+			Strict bool `json:"strict_required_status_checks_policy"`
+		} `json:"parameters"`
+	}
+	rulesErr := cachedGhAPI("branch_rules", fmt.Sprintf("repos/%s/rules/branches/%s", repo, branch), &rules)
+	for _, rule := range rules {
+		switch rule.Type {
+		case "required_status_checks":
+			for _, check := range rule.Parameters.RequiredStatusChecks {
+				add(check.Context)
+			}
+			required.Strict = required.Strict || rule.Parameters.Strict
+		case "merge_queue":
+			required.MergeQueue = true
+		}
+	}
+
+	var protection struct {
+		RequiredStatusChecks *struct {
+			Strict   bool     `json:"strict"`
+			Contexts []string `json:"contexts"`
+		} `json:"required_status_checks"`
+	}
+	err := cachedGhAPI("branch_rules", fmt.Sprintf("repos/%s/branches/%s/protection", repo, branch), &protection)
+	if err == nil && protection.RequiredStatusChecks != nil {
+		for _, context := range protection.RequiredStatusChecks.Contexts {
+			add(context)
+		}
+		required.Strict = required.Strict || protection.RequiredStatusChecks.Strict
+	}
+	if rulesErr != nil && err != nil && !strings.Contains(err.Error(), "HTTP 404") {
+		return required, fmt.Errorf("failed to read the rules of %s: %v", branch, rulesErr)
+	}
+	return required, nil
+}
+
+// commitCheckStates returns the state of every check run and commit status on a commit by
+// name: "success", "failure" or "pending"
+func commitCheckStates(repo string, sha string) (map[string]string, error) {
+	states := make(map[string]string)
+	var runs struct {
+		CheckRuns []struct {
+			Name       string `json:"name"`
+			Status     string `json:"status"`
+			Conclusion string `json:"conclusion"`
+		} `json:"check_runs"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/commits/%s/check-runs?per_page=100", repo, sha), nil, &runs); err != nil {
+		return nil, err
+	}
+	for _, run := range runs.CheckRuns {
+		switch {
+		case run.Status != "completed":
+			states[run.Name] = "pending"
+		case run.Conclusion == "success" || run.Conclusion == "neutral" || run.Conclusion == "skipped":
+			states[run.Name] = "success"
+		default:
+			states[run.Name] = "failure"
+		}
+	}
+	var status struct {
+		Statuses []struct {
+			Context string `json:"context"`
+			State   string `json:"state"`
+		} `json:"statuses"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/commits/%s/status", repo, sha), nil, &status); err != nil {
+		return nil, err
+	}
+	for _, s := range status.Statuses {
+		state := s.State
+		if state == "error" {
+			state = "failure"
+		}
+		states[s.Context] = state
+	}
+	return states, nil
+}
+
+// similarCheck returns the check whose name is closest to a required one that didn't run, which
+// usually means the workflow or job was renamed without updating the branch rules
+func similarCheck(required string, states map[string]string) string {
+	want := strings.ToLower(required)
+	for name := range states {
+		have := strings.ToLower(name)
+		if strings.Contains(have, want) || strings.Contains(want, have) {
+			return name
+		}
+	}
+	return ""
+}
+
+// workflowsHandleMergeGroup reports whether any workflow runs on merge_group events, which merge
+// queues need to get required checks for the queued commits
+func workflowsHandleMergeGroup() bool {
+	files, err := gitListFiles("HEAD", ".github/workflows")
+	if err != nil {
+		return false
+	}
+	for _, file := range files {
+		if content, ok := gitShowFile("HEAD", file); ok && strings.Contains(content, "merge_group") {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeQueueFixes are the problems mq-check -fix can fix itself
+type MergeQueueFixes struct {
+	Labels []string // required labels the PR lacks
+	Rebase bool     // the PR is behind its base without conflicts
+}
+
+// checkMergeQueueReadiness checks the PR against the merge queue gates, returning the results
+// and what can be fixed automatically
+func checkMergeQueueReadiness(repo string, pr mqPullRequest, mq MergeQueueConfig) ([]PreflightResult, MergeQueueFixes, error) {
+	var fixes MergeQueueFixes
+	var results []PreflightResult
+	required, err := requiredChecks(repo, pr.Base.Ref)
+	if err != nil {
+		return nil, fixes, err
+	}
+
+	draft := PreflightResult{Name: "Ready for review", Passed: !pr.Draft, Blocking: true}
+	if pr.Draft {
+		draft.Messages = append(draft.Messages, "the PR is a draft, mark it ready with gh pr ready")
+	}
+	results = append(results, draft)
+
+	states, err := commitCheckStates(repo, pr.Head.SHA)
+	if err != nil {
+		return nil, fixes, err
+	}
+	checks := PreflightResult{Name: fmt.Sprintf("Required checks (%d)", len(required.Contexts)), Passed: true, Blocking: true}
+	for _, context := range required.Contexts {
+		state, ok := states[context]
+		switch {
+		case !ok:
+			message := fmt.Sprintf("%s hasn't run on %s", context, pr.Head.SHA[:7])
+			if similar := similarCheck(context, states); similar != "" {
+				message += fmt.Sprintf(". %q did, was it renamed?", similar)
+			}
+			checks.Messages = append(checks.Messages, message)
+		case state != "success":
+			checks.Messages = append(checks.Messages, fmt.Sprintf("%s is %s", context, state))
+		}
+	}
+	checks.Passed = len(checks.Messages) == 0
+	results = append(results, checks)
+
+	if required.MergeQueue {
+		mergeGroup := PreflightResult{Name: "Workflows run on merge_group", Passed: workflowsHandleMergeGroup(), Blocking: true}
+		if !mergeGroup.Passed {
+			mergeGroup.Messages = append(mergeGroup.Messages, "no workflow in .github/workflows runs on merge_group, so queued PRs never get their required checks")
+		}
+		results = append(results, mergeGroup)
+	}
+
+	labels := make(map[string]bool)
+	for _, label := range pr.Labels {
+		labels[label.Name] = true
+	}
+	labelGate := PreflightResult{Name: "Labels", Passed: true, Blocking: true}
+	for _, label := range mq.RequiredLabels {
+		if !labels[label] {
+			fixes.Labels = append(fixes.Labels, label)
+			labelGate.Messages = append(labelGate.Messages, fmt.Sprintf("missing required label %q", label))
+		}
+	}
+	for _, label := range mq.BlockingLabels {
+		if labels[label] {
+			labelGate.Messages = append(labelGate.Messages, fmt.Sprintf("has blocking label %q", label))
+		}
+	}
+	labelGate.Passed = len(labelGate.Messages) == 0
+	results = append(results, labelGate)
+
+	var comparison struct {
+		BehindBy int `json:"behind_by"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/compare/%s...%s", repo, pr.Base.Ref, pr.Head.SHA), nil, &comparison); err != nil {
+		return nil, fixes, err
+	}
+	// Without strict checks the queue tests against the latest base anyway, so being behind is only a warning
+	upToDate := PreflightResult{Name: "Up to date with " + pr.Base.Ref, Passed: comparison.BehindBy == 0, Blocking: required.Strict}
+	if comparison.BehindBy > 0 {
+		upToDate.Messages = append(upToDate.Messages, fmt.Sprintf("%d commits behind %s", comparison.BehindBy, pr.Base.Ref))
+	}
+	if pr.MergeableState == "dirty" {
+		upToDate.Passed, upToDate.Blocking = false, true
+		upToDate.Messages = append(upToDate.Messages, "has conflicts with "+pr.Base.Ref+" that need resolving by hand")
+	}
+	results = append(results, upToDate)
+	fixes.Rebase = comparison.BehindBy > 0 && pr.MergeableState != "dirty"
+	return results, fixes, nil
+}
+
+// runMergeQueueCheckCommand checks whether a PR is ready for the merge queue and prints what's
+// missing, optionally fixing what can be fixed without a human
+func runMergeQueueCheckCommand(args []string) error {
+	fs := flag.NewFlagSet("mq-check", flag.ExitOnError)
+	prNumber := fs.Int("pr", 0, "Number of the pull request (default: the PR of the current branch)")
+	fix := fs.Bool("fix", false, "Rebase the PR onto its base and add missing required labels")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	if *prNumber <= 0 {
+		if *prNumber, err = currentPullRequestNumber(); err != nil {
+			return err
+		}
+	}
+	var pr mqPullRequest
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls/%d", repo, *prNumber), nil, &pr); err != nil {
+		return err
+	}
+
+	results, fixes, err := checkMergeQueueReadiness(repo, pr, config.MergeQueue)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("PR #%d into %s\n", pr.Number, pr.Base.Ref)
+	blocked := printCheckResults("Merge queue readiness", results)
+
+	if *fix && len(fixes.Labels) > 0 {
+		Log(INFO, "Adding labels %s to #%d", strings.Join(fixes.Labels, ", "), pr.Number)
+		if err := ghAPI("POST", fmt.Sprintf("repos/%s/issues/%d/labels", repo, pr.Number), map[string][]string{"labels": fixes.Labels}, nil); err != nil {
+			return fmt.Errorf("failed to add labels: %v", err)
+		}
+		fmt.Printf("Added labels: %s\n", strings.Join(fixes.Labels, ", "))
+	}
+	if *fix && fixes.Rebase {
+		Log(INFO, "Rebasing #%d onto %s", pr.Number, pr.Base.Ref)
+		cmd := &Command{Program: "gh", Args: []string{"pr", "update-branch", fmt.Sprintf("%d", pr.Number), "--rebase", "--repo", repo}, ShowStderr: true}
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("failed to rebase the PR: %v", err)
+		}
+		// The required checks have to pass again on the rebased head
+		fmt.Printf("Rebased onto %s. Run gs mq-check again once the checks on the new head finish.\n", pr.Base.Ref)
+		return fmt.Errorf("PR #%d was rebased and its checks have to run again", pr.Number)
+	}
+	if blocked {
+		return fmt.Errorf("PR #%d isn't ready for the merge queue", pr.Number)
+	}
+	fmt.Println("Ready for the merge queue")
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheConfig controls the cache of metadata read from GitHub, so repeated runs don't ask the API
+// for the same things every time
+type CacheConfig struct {
+	Mode       string         `json:"mode"`        // "local" (default) caches, "off" doesn't
+	Path       string         `json:"path"`        // default ~/.gitscribe/cache
+	TTLMinutes map[string]int `json:"ttl_minutes"` // by kind, overriding cacheTTLs; 0 stops caching a kind
+}
+
+// cacheTTLs are how many minutes each kind of metadata is kept by default
+var cacheTTLs = map[string]int{
+	"repo":           7 * 24 * 60, // the GitHub repository of a checkout
+	"default_branch": 24 * 60,     // the repository's default branch
+	"branch_rules":   60,          // rulesets and branch protection, for approvals and required checks
+	"files":          24 * 60,     // files fetched from GitHub at a commit, such as CODEOWNERS and templates
+	"registry":       60,          // when each template registry was last fetched
+	"summaries":      24 * 60,     // file summaries from large diffs, so gs prefetch and later runs reuse them
+}
+
+// cacheSettings is set when the config is loaded
+var cacheSettings CacheConfig
+
+// refreshCache skips cached metadata for this run and fetches it again, set by -refresh
+var refreshCache bool
+
+// cacheEntry is one cached value, in its own file
+type cacheEntry struct {
+	Key     string          `json:"key"`
+	Fetched string          `json:"fetched"`
+	Value   json.RawMessage `json:"value,omitempty"`
+	Error   string          `json:"error,omitempty"` // a 404, which is an answer too
+}
+
+// checkCacheConfig rejects cache settings that can't be used
+func checkCacheConfig(config CacheConfig) error {
+	if mode := strings.ToLower(config.Mode); mode != "" && mode != "local" && mode != "off" {
+		return fmt.Errorf("unknown cache.mode %q in config: use local or off", config.Mode)
+	}
+	for kind, minutes := range config.TTLMinutes {
+		if _, ok := cacheTTLs[kind]; !ok {
+			return fmt.Errorf("unknown kind %q in cache.ttl_minutes: use %s", kind, strings.Join(cacheKinds(), ", "))
+		}
+		if minutes < 0 {
+			return fmt.Errorf("cache.ttl_minutes.%s in config can't be negative", kind)
+		}
+	}
+	return nil
+}
+
+// cacheKinds returns the kinds of metadata that are cached, sorted
+func cacheKinds() []string {
+	kinds := make([]string, 0, len(cacheTTLs))
+	for kind := range cacheTTLs {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// cacheTTL returns how long a kind of metadata is kept, 0 if it isn't cached
+func cacheTTL(kind string) time.Duration {
+	if strings.ToLower(cacheSettings.Mode) == "off" {
+		return 0
+	}
+	minutes, ok := cacheSettings.TTLMinutes[kind]
+	if !ok {
+		minutes = cacheTTLs[kind]
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// cacheDir returns where cached metadata is kept
+func cacheDir() (string, error) {
+	if cacheSettings.Path != "" {
+		return expandPath(cacheSettings.Path), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gitscribe", "cache"), nil
+}
+
+// cacheFile returns the file a key of a kind is cached in
+func cacheFile(kind string, key string) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(dir, kind, hex.EncodeToString(sum[:8])+".json"), nil
+}
+
+// readCache returns the cached entry for a key if it's younger than its kind's TTL
+func readCache(kind string, key string) (cacheEntry, bool) {
+	var entry cacheEntry
+	ttl := cacheTTL(kind)
+	if refreshCache || ttl == 0 {
+		return entry, false
+	}
+	path, err := cacheFile(kind, key)
+	if err != nil {
+		return entry, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return entry, false
+	}
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Key != key {
+		return entry, false
+	}
+	fetched, err := time.Parse(time.RFC3339, entry.Fetched)
+	if err != nil || time.Since(fetched) > ttl {
+		return entry, false
+	}
+	Log(DEBUG, "Using cached %s for %s from %s", kind, key, entry.Fetched)
+	return entry, true
+}
+
+// writeCache stores a value, or a 404 in errText, for a key. Failures are only logged, as the
+// cache only saves time.
+func writeCache(kind string, key string, value json.RawMessage, errText string) {
+	if cacheTTL(kind) == 0 {
+		return
+	}
+	path, err := cacheFile(kind, key)
+	if err != nil {
+		Log(DEBUG, "Not caching %s, no home directory: %v", kind, err)
+		return
+	}
+	entry := cacheEntry{Key: key, Fetched: time.Now().UTC().Format(time.RFC3339), Value: value, Error: errText}
+	data, _ := json.Marshal(entry)
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		Log(WARN, "Failed to cache %s: %v", kind, err)
+	}
+}
+
+// cachedFetch decodes the cached value for a key into out, or calls fetch and caches what it
+// returns. Errors aren't cached, except for 404s.
+func cachedFetch(kind string, key string, out interface{}, fetch func() (interface{}, error)) error {
+	if entry, ok := readCache(kind, key); ok {
+		if entry.Error != "" {
+			return fmt.Errorf("%s (cached, run with -refresh to ask again)", entry.Error)
+		}
+		if err := json.Unmarshal(entry.Value, out); err == nil {
+			return nil
+		}
+	}
+	value, err := fetch()
+	if err != nil {
+		if strings.Contains(err.Error(), "HTTP 404") {
+			writeCache(kind, key, nil, err.Error())
+		}
+		return err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to cache %s: %v", kind, err)
+	}
+	writeCache(kind, key, data, "")
+	return json.Unmarshal(data, out)
+}
+
+// cachedGhAPI GETs a GitHub API resource through the cache
+func cachedGhAPI(kind string, endpoint string, out interface{}) error {
+	return cachedFetch(kind, endpoint, out, func() (interface{}, error) {
+		var raw json.RawMessage
+		err := ghAPI("GET", endpoint, nil, &raw)
+		return raw, err
+	})
+}
+
+// defaultBranch returns the branch PRs target when -target isn't given: origin's HEAD, or the
+// repository's default branch on GitHub, else master
+func defaultBranch() string {
+	if output, err := newCommand("git", "symbolic-ref", "--quiet", "--short", "refs/remotes/origin/HEAD").Output(); err == nil {
+		if branch := strings.TrimPrefix(strings.TrimSpace(string(output)), "origin/"); branch != "" {
+			return branch
+		}
+	}
+	if requireNetwork("looking up the default branch") == nil && programAvailable("gh") {
+		if repo, err := currentRepo(); err == nil {
+			var branch string
+			err = cachedFetch("default_branch", repo, &branch, func() (interface{}, error) {
+				var info struct {
+					DefaultBranch string `json:"default_branch"`
+				}
+				err := ghAPI("GET", "repos/"+repo, nil, &info)
+				return info.DefaultBranch, err
+			})
+			if err == nil && branch != "" {
+				return branch
+			}
+			Log(DEBUG, "Failed to look up the default branch of %s: %v", repo, err)
+		}
+	}
+	return "master"
+}
+
+// runCacheCommand shows what metadata is cached, or deletes it with gs cache clear [kind...]
+func runCacheCommand(args []string) error {
+	if len(args) > 0 && args[0] == "clear" {
+		fs := flag.NewFlagSet("cache clear", flag.ExitOnError)
+		if _, err := parseCommandFlags(fs, args[1:]); err != nil {
+			return err
+		}
+		dir, err := cacheDir()
+		if err != nil {
+			return fmt.Errorf("failed to find home directory: %v", err)
+		}
+		if fs.NArg() == 0 {
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("failed to clear the cache: %v", err)
+			}
+			fmt.Println("Cache cleared.")
+			return nil
+		}
+		for _, kind := range fs.Args() {
+			if _, ok := cacheTTLs[kind]; !ok {
+				return fmt.Errorf("unknown kind %q: use %s", kind, strings.Join(cacheKinds(), ", "))
+			}
+			if err := os.RemoveAll(filepath.Join(dir, kind)); err != nil {
+				return fmt.Errorf("failed to clear cached %s: %v", kind, err)
+			}
+		}
+		fmt.Printf("Cleared cached %s.\n", strings.Join(fs.Args(), ", "))
+		return nil
+	}
+
+	if _, err := parseCommandFlags(flag.NewFlagSet("cache", flag.ExitOnError), args); err != nil {
+		return err
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		return fmt.Errorf("failed to find home directory: %v", err)
+	}
+	fmt.Printf("Cache in %s\n\n", dir)
+	fmt.Printf("%-16s %8s %8s %10s\n", "KIND", "TTL", "ENTRIES", "EXPIRED")
+	for _, kind := range cacheKinds() {
+		ttl := cacheTTL(kind)
+		entries, expired := 0, 0
+		files, _ := filepath.Glob(filepath.Join(dir, kind, "*.json"))
+		for _, file := range files {
+			var entry cacheEntry
+			data, err := ioutil.ReadFile(file)
+			if err != nil || json.Unmarshal(data, &entry) != nil {
+				continue
+			}
+			entries++
+			if fetched, err := time.Parse(time.RFC3339, entry.Fetched); err != nil || time.Since(fetched) > ttl {
+				expired++
+			}
+		}
+		ttlText := "off"
+		if ttl > 0 {
+			ttlText = strings.TrimSuffix(ttl.String(), "0s")
+			if strings.HasSuffix(ttlText, "h0m") {
+				ttlText = strings.TrimSuffix(ttlText, "0m")
+			}
+		}
+		fmt.Printf("%-16s %8s %8d %10d\n", kind, ttlText, entries, expired)
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricDefinition describes a metric for the Prometheus exposition format
+type metricDefinition struct {
+	Name string
+	Help string
+	Type string // "counter" or "histogram"
+}
+
+// metricDefinitions are all the metrics served at /metrics
+var metricDefinitions = []metricDefinition{
+	{"gitscribe_webhook_requests_total", "Webhook deliveries received, by event and response code.", "counter"},
+	{"gitscribe_webhook_request_duration_seconds", "Time taken to respond to webhook deliveries.", "histogram"},
+	{"gitscribe_pull_request_processing_duration_seconds", "Time taken to process pull request events in the background.", "histogram"},
+	{"gitscribe_queue_jobs_total", "Background jobs, by result (enqueued, rejected, retried, succeeded, failed).", "counter"},
+	{"gitscribe_llm_tokens_total", "Tokens used by LLM requests, by model and type (prompt, completion, cached_prompt).", "counter"},
+	{"gitscribe_stale_descriptions_total", "Stale PR descriptions nudged or refreshed, by result.", "counter"},
+	{"gitscribe_llm_errors_total", "Failed LLM requests, by error kind.", "counter"},
+}
+
+// latencyBuckets are the histogram bucket upper bounds, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	Counts []uint64
+	Sum    float64
+	Count  uint64
+}
+
+// metricsRegistry holds the values of every metric, keyed by name and then by rendered labels
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}
+
+// metrics is the process-wide registry
+var metrics = &metricsRegistry{
+	counters:   make(map[string]map[string]float64),
+	histograms: make(map[string]map[string]*histogram),
+}
+
+// renderLabels turns name/value pairs into a Prometheus label set, e.g. {event="ping"}
+func renderLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var parts []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%s", labels[i], strconv.Quote(labels[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// add increases a counter. labels are name/value pairs.
+func (m *metricsRegistry) add(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counters[name] == nil {
+		m.counters[name] = make(map[string]float64)
+	}
+	m.counters[name][renderLabels(labels)] += value
+}
+
+// observe records a value in a histogram. labels are name/value pairs.
+func (m *metricsRegistry) observe(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.histograms[name] == nil {
+		m.histograms[name] = make(map[string]*histogram)
+	}
+	key := renderLabels(labels)
+	h, ok := m.histograms[name][key]
+	if !ok {
+		h = &histogram{Counts: make([]uint64, len(latencyBuckets))}
+		m.histograms[name][key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if value <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += value
+	h.Count++
+}
+
+// withLabel adds one more label to a rendered label set
+func withLabel(labels string, name string, value string) string {
+	label := fmt.Sprintf("%s=%s", name, strconv.Quote(value))
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + label + "}"
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var sb strings.Builder
+	for _, def := range metricDefinitions {
+		sb.WriteString(fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", def.Name, def.Help, def.Name, def.Type))
+		switch def.Type {
+		case "counter":
+			var keys []string
+			for key := range m.counters[def.Name] {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				sb.WriteString(fmt.Sprintf("%s%s %g\n", def.Name, key, m.counters[def.Name][key]))
+			}
+		case "histogram":
+			var keys []string
+			for key := range m.histograms[def.Name] {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				h := m.histograms[def.Name][key]
+				for i, bound := range latencyBuckets {
+					sb.WriteString(fmt.Sprintf("%s_bucket%s %d\n", def.Name, withLabel(key, "le", strconv.FormatFloat(bound, 'g', -1, 64)), h.Counts[i]))
+				}
+				sb.WriteString(fmt.Sprintf("%s_bucket%s %d\n", def.Name, withLabel(key, "le", "+Inf"), h.Count))
+				sb.WriteString(fmt.Sprintf("%s_sum%s %g\n", def.Name, key, h.Sum))
+				sb.WriteString(fmt.Sprintf("%s_count%s %d\n", def.Name, key, h.Count))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, sb.String())
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrumentWebhooks counts and times the webhook deliveries handled by next
+func instrumentWebhooks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		event := r.Header.Get("X-GitHub-Event")
+		if event == "" {
+			event = "unknown"
+		}
+		metrics.add("gitscribe_webhook_requests_total", 1, "event", event, "code", strconv.Itoa(recorder.status))
+		metrics.observe("gitscribe_webhook_request_duration_seconds", time.Since(started).Seconds(), "event", event)
+	})
+}
+
+// recordLLMUsage counts the tokens used by an LLM response, for metrics and the run's usage
+func recordLLMUsage(llmConfig LLMConfig, response ChatResponse) {
+	addRunUsage(llmConfig, response)
+	model := llmConfig.Model
+	usage := response.Usage
+	Log(DEBUG, "LLM request used %d prompt tokens (%d cached) and %d completion tokens",
+		usage.PromptTokens, usage.PromptTokensDetails.CachedTokens, usage.CompletionTokens)
+	metrics.add("gitscribe_llm_tokens_total", float64(usage.PromptTokens), "model", model, "type", "prompt")
+	metrics.add("gitscribe_llm_tokens_total", float64(usage.CompletionTokens), "model", model, "type", "completion")
+	metrics.add("gitscribe_llm_tokens_total", float64(usage.PromptTokensDetails.CachedTokens), "model", model, "type", "cached_prompt")
+}
+
+// recordLLMError counts a failed LLM request
+func recordLLMError(err error) {
+	metrics.add("gitscribe_llm_errors_total", 1, "kind", string(errorKind(err)))
+}
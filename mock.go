@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// MockConfig sets the replies of the mock provider, which answers without the network so gs can
+// run in CI, demos and tests without an API key
+type MockConfig struct {
+	Responses []MockResponse `json:"responses"` // the first one whose match is in the prompt is the reply
+}
+
+// MockResponse is a canned reply of the mock provider
+type MockResponse struct {
+	Match string `json:"match"` // text the prompt must contain, empty to match every prompt
+	Reply string `json:"reply"`
+}
+
+// mockEndpoint stands in for the chat endpoint of the mock provider in logs and consent records
+const mockEndpoint = "mock://gitscribe"
+
+// Markers in the prompts the mock provider recognizes, to reply in the shape asked for
+var (
+	mockTemplateMarker   = regexp.MustCompile(`(?:template format for (?:your response|each commit message)|\n\s*Template):[ \t]*\n`)
+	mockCommitTypes      = regexp.MustCompile(`commit types and nothing else: ([a-z]+)`)
+	mockWorkspaceRepo    = regexp.MustCompile(`(?m)^Repository (.+):$`)
+	mockSummaryFile      = regexp.MustCompile(`(?m)^File: (.+)$`)
+	mockQuestionsMarker  = `{"questions"`
+	mockJudgementMarker  = `{"score"`
+	mockSuggestionMarker = `{"suggestions"`
+)
+
+// mockReply answers a prompt: with the first matching canned reply, or else the template of the
+// prompt, or JSON in the shape the prompt asks for
+func mockReply(messages []ChatMessage, mock MockConfig) string {
+	var prompt strings.Builder
+	for _, message := range messages {
+		prompt.WriteString(message.Content + "\n")
+	}
+	text := prompt.String()
+	for _, response := range mock.Responses {
+		if strings.Contains(text, response.Match) {
+			return response.Reply
+		}
+	}
+
+	// Templates end the system prompt
+	template := ""
+	for _, message := range messages {
+		if message.Role != "system" {
+			continue
+		}
+		if locations := mockTemplateMarker.FindAllStringIndex(message.Content, -1); len(locations) > 0 {
+			template = strings.TrimSpace(message.Content[locations[len(locations)-1][1]:])
+		}
+	}
+	switch {
+	case strings.Contains(text, mockQuestionsMarker):
+		reply, _ := json.Marshal(questionsReply{Questions: []string{}, Description: mockDescription(template)})
+		return string(reply)
+	case strings.Contains(text, mockJudgementMarker):
+		return `{"score": 1, "reasons": "Mock judgement."}`
+	case strings.Contains(text, mockSuggestionMarker):
+		return `{"suggestions": []}`
+	case mockCommitTypes.MatchString(text):
+		return mockCommitTypes.FindStringSubmatch(text)[1]
+	case strings.Contains(text, "=== <repository name> ==="):
+		var sb strings.Builder
+		for _, match := range mockWorkspaceRepo.FindAllStringSubmatch(text, -1) {
+			sb.WriteString(fmt.Sprintf("=== %s ===\n%s\n\n", match[1], mockDescription(template)))
+		}
+		return sb.String()
+	case strings.Contains(text, "=== <file path> ==="):
+		var sb strings.Builder
+		for _, match := range mockSummaryFile.FindAllStringSubmatch(text, -1) {
+			sb.WriteString(fmt.Sprintf("=== %s ===\n%s\n\n", match[1], mockDescription(template)))
+		}
+		return sb.String()
+	}
+	return mockDescription(template)
+}
+
+// mockDescription is the reply to a prompt for text: its template, or a placeholder without one
+func mockDescription(template string) string {
+	if template == "" {
+		return "Mock reply from the mock LLM provider."
+	}
+	return template
+}
+
+// mockRequest answers a chat request with the mock provider, writing the reply to w if set
+func mockRequest(requestBody interface{}, config LLMConfig, w io.Writer) (string, error) {
+	var request struct {
+		Messages []struct {
+			Role    string          `json:"role"`
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+	}
+	data, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return "", fmt.Errorf("failed to read request: %v", err)
+	}
+	var messages []ChatMessage
+	for _, message := range request.Messages {
+		// Vision requests have a list of parts instead of a string, which the mock leaves out
+		var content string
+		json.Unmarshal(message.Content, &content)
+		messages = append(messages, ChatMessage{Role: message.Role, Content: content})
+	}
+
+	reply := mockReply(messages, config.Mock)
+	Log(DEBUG, "The mock provider replied with %d characters", len(reply))
+	var response ChatResponse
+	response.Usage.PromptTokens = promptTokens(messages)
+	response.Usage.CompletionTokens = estimateTokens(reply)
+	recordLLMUsage(config, response)
+	if w != nil {
+		fmt.Fprintln(w, reply)
+	}
+	return reply, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// ModelPolicyConfig restricts the providers, models and endpoints a repository may send prompts
+// to by its classification, so a confidential repository can't use a public cloud model by
+// mistake. An organization sets it in everyone's global config. A repository's own config can
+// only add a class it must satisfy as well, so it can make the policy stricter but not looser.
+type ModelPolicyConfig struct {
+	DefaultClass       string                `json:"default_class"`       // the class of repositories no entry of repos matches
+	Classification     string                `json:"classification"`      // the same as default_class; in a repository's .gitscribe_config.json, a class it must satisfy as well
+	RepoClassification string                `json:"repo_classification"` // the classification of the repository's config, moved here when the configs are merged
+	Repos              []RepoClassification  `json:"repos"`               // classify repositories by their remotes, first match wins
+	Classes            map[string]ModelRules `json:"classes"`             // what each class may use
+}
+
+// RepoClassification gives the repositories with a matching remote a class
+type RepoClassification struct {
+	Remote         string `json:"remote"` // text the URL of one of the repository's remotes contains, e.g. github.com/acme/
+	Classification string `json:"classification"`
+}
+
+// ModelRules are what a class of repositories may use. An empty list allows anything. Names
+// may use * to match any text.
+type ModelRules struct {
+	Providers []string `json:"providers"` // openai or ollama
+	Models    []string `json:"models"`
+	Endpoints []string `json:"endpoints"` // chat completions URLs, e.g. https://llm.internal.example.com/*
+}
+
+// modelPolicySettings is set when the config is loaded
+var modelPolicySettings ModelPolicyConfig
+
+// policyClass is a class the current repository is in, and why
+type policyClass struct {
+	name   string
+	reason string
+}
+
+// repoClasses are the classes of the current repository, worked out on the first request
+var repoClasses struct {
+	sync.Once
+	classes []policyClass
+}
+
+// moveRepoClassification moves the classification of a repository's config out of the way of
+// the global one, as it's a class the repository must satisfy as well rather than instead
+func moveRepoClassification(layer map[string]interface{}) {
+	policy, ok := layer["model_policy"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	if class, ok := policy["classification"]; ok {
+		delete(policy, "classification")
+		policy["repo_classification"] = class
+	}
+}
+
+// checkModelPolicyConfig rejects a model policy that refers to classes it doesn't define
+func checkModelPolicyConfig(config ModelPolicyConfig) error {
+	classes := []string{config.DefaultClass, config.Classification, config.RepoClassification}
+	for _, repo := range config.Repos {
+		if repo.Remote == "" {
+			return fmt.Errorf("an entry of model_policy.repos in config has no remote")
+		}
+		classes = append(classes, repo.Classification)
+	}
+	for _, class := range classes {
+		if _, ok := config.Classes[class]; class != "" && !ok {
+			return fmt.Errorf("model_policy uses the class %q, which model_policy.classes doesn't define", class)
+		}
+	}
+	for class, rules := range config.Classes {
+		for _, provider := range rules.Providers {
+			if !isValidProvider(provider) {
+				return fmt.Errorf("unknown provider %q in model_policy.classes.%s: use openai, ollama or mock", provider, class)
+			}
+		}
+	}
+	return nil
+}
+
+// repositoryClasses returns the classes of the current repository, which a request must satisfy
+// all of: the class of the first entry of repos that matches, or else default_class, and the one
+// the repository's own config adds
+func repositoryClasses() []policyClass {
+	repoClasses.Do(func() {
+		if class, reason := matchedClass(); class != "" {
+			repoClasses.classes = append(repoClasses.classes, policyClass{class, reason})
+		}
+		if class := modelPolicySettings.RepoClassification; class != "" {
+			repoClasses.classes = append(repoClasses.classes, policyClass{class, "its .gitscribe_config.json says so"})
+		}
+	})
+	return repoClasses.classes
+}
+
+// matchedClass returns the class the global policy gives the current repository and why, or ""
+// if it gives none
+func matchedClass() (string, string) {
+	if len(modelPolicySettings.Repos) > 0 {
+		output, err := newCommand("git", "remote", "-v").Output()
+		if err != nil {
+			Log(DEBUG, "No remotes to classify the repository by: %v", err)
+		}
+		for _, repo := range modelPolicySettings.Repos {
+			for _, line := range strings.Split(string(output), "\n") {
+				if fields := strings.Fields(line); len(fields) > 1 && strings.Contains(fields[1], repo.Remote) {
+					return repo.Classification, fmt.Sprintf("its remote %s contains %s", fields[1], repo.Remote)
+				}
+			}
+		}
+	}
+	if modelPolicySettings.DefaultClass != "" {
+		return modelPolicySettings.DefaultClass, "no entry of model_policy.repos matches it"
+	}
+	if modelPolicySettings.Classification != "" {
+		return modelPolicySettings.Classification, "model_policy.classification says so"
+	}
+	return "", ""
+}
+
+// policyMatch reports whether a name matches a pattern, where * matches any text
+func policyMatch(name string, pattern string) bool {
+	name, pattern = strings.ToLower(name), strings.ToLower(pattern)
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return name == pattern
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i == -1 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return strings.HasSuffix(name, parts[len(parts)-1])
+}
+
+// policyAllows reports whether a list of a class's rules allows a name
+func policyAllows(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if policyMatch(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkModelPolicy refuses a request to a provider, model or endpoint one of the repository's
+// classes doesn't allow. The mock provider sends nothing anywhere, so it's always allowed.
+func checkModelPolicy(llmConfig LLMConfig) error {
+	if llmConfig.Provider == "mock" {
+		return nil
+	}
+	provider := llmConfig.Provider
+	if provider == "" {
+		provider = "openai"
+	}
+	for _, class := range repositoryClasses() {
+		rules := modelPolicySettings.Classes[class.name]
+		var refused string
+		switch {
+		case !policyAllows(rules.Providers, provider):
+			refused = fmt.Sprintf("the %s provider", provider)
+		case !policyAllows(rules.Models, llmConfig.Model):
+			refused = fmt.Sprintf("the model %s", llmConfig.Model)
+		case !policyAllows(rules.Endpoints, chatEndpoint(llmConfig)):
+			refused = chatEndpoint(llmConfig)
+		default:
+			continue
+		}
+		Log(ERROR, "Refusing to send prompts to %s in a %s repository", refused, class.name)
+		return newError(ErrModelNotAllowed, "%s isn't allowed for %s repositories, and this repository is one because %s", refused, class.name, class.reason)
+	}
+	return nil
+}
+
+// allowedModels leaves out the fallback models the model policy doesn't allow. The first model
+// has to be allowed, so a run asking for a model it may not use fails instead of quietly using
+// another.
+func allowedModels(chain []LLMConfig) ([]LLMConfig, error) {
+	var allowed []LLMConfig
+	for i, candidate := range chain {
+		if err := checkModelPolicy(candidate); err != nil {
+			if i == 0 {
+				return nil, err
+			}
+			Log(WARN, "Not falling back to %s: %v", candidate.Model, err)
+			continue
+		}
+		allowed = append(allowed, candidate)
+	}
+	return allowed, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sort"
+)
+
+// ModelTier is the model to use for diffs up to a size, so small changes go to a cheap, fast
+// model and only large ones to a model with a large context
+type ModelTier struct {
+	MaxDiffTokens int    `json:"max_diff_tokens"` // the largest diff the model is used for, 0 for any size
+	Model         string `json:"model"`
+	ContextWindow int    `json:"context_window"` // default from the model name
+}
+
+// diffPromptTokens estimates the tokens a diff takes in a prompt, after notebooks, large JSON and
+// YAML files and documentation are summarized
+func diffPromptTokens(diff string, llmConfig LLMConfig) int {
+	return estimateTokens(summarizeStructuredDiffs(summarizeProseDiffs(diff, llmConfig.ProseDiffs), llmConfig.StructuredDiffs))
+}
+
+// selectModel returns the LLM config with the model of the smallest llm.model_tiers tier the diff
+// fits, or unchanged if there are no tiers or the diff is larger than all of them
+func selectModel(diff string, llmConfig LLMConfig) LLMConfig {
+	if len(llmConfig.ModelTiers) == 0 {
+		return llmConfig
+	}
+	tiers := append([]ModelTier(nil), llmConfig.ModelTiers...)
+	// Tiers without a limit take what's left, after every tier with one
+	sort.SliceStable(tiers, func(i, j int) bool {
+		if tiers[i].MaxDiffTokens == 0 || tiers[j].MaxDiffTokens == 0 {
+			return tiers[j].MaxDiffTokens == 0 && tiers[i].MaxDiffTokens != 0
+		}
+		return tiers[i].MaxDiffTokens < tiers[j].MaxDiffTokens
+	})
+	tokens := diffPromptTokens(diff, llmConfig)
+	for _, tier := range tiers {
+		if tier.MaxDiffTokens == 0 || tokens <= tier.MaxDiffTokens {
+			Log(INFO, "The diff is about %d tokens, using %s", tokens, tier.Model)
+			if tier.Model != llmConfig.Model {
+				llmConfig.Model = tier.Model
+				llmConfig.ContextWindow = tier.ContextWindow
+			}
+			return llmConfig
+		}
+	}
+	Log(INFO, "The diff is about %d tokens, larger than every model tier, using %s", tokens, llmConfig.Model)
+	return llmConfig
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// OllamaConfig points GitScribe at an Ollama server when llm.provider is "ollama"
+type OllamaConfig struct {
+	Host string `json:"host"` // default OLLAMA_HOST or localhost
+	Port int    `json:"port"` // default 11434
+}
+
+// defaultOllamaModel is the model used with Ollama unless llm.model is set
+const defaultOllamaModel = "llama3.1"
+
+// isValidProvider reports whether the config's llm.provider is one GitScribe can talk to
+func isValidProvider(provider string) bool {
+	return provider == "" || provider == "openai" || provider == "ollama" || provider == "mock"
+}
+
+// applyOllamaDefaults fills in the server address, from OLLAMA_HOST like the ollama CLI does
+func applyOllamaDefaults(ollama *OllamaConfig) {
+	if env := os.Getenv("OLLAMA_HOST"); env != "" && ollama.Host == "" {
+		env = strings.TrimPrefix(strings.TrimPrefix(env, "http://"), "https://")
+		if host, port, err := net.SplitHostPort(env); err == nil {
+			ollama.Host = host
+			if ollama.Port == 0 {
+				ollama.Port, _ = strconv.Atoi(port)
+			}
+		} else {
+			ollama.Host = env
+		}
+	}
+	if ollama.Host == "" || ollama.Host == "0.0.0.0" {
+		ollama.Host = "localhost"
+	}
+	if ollama.Port == 0 {
+		ollama.Port = 11434
+	}
+}
+
+// ollamaChatURL returns the chat endpoint of the Ollama server
+func ollamaChatURL(ollama OllamaConfig) string {
+	return "http://" + net.JoinHostPort(ollama.Host, strconv.Itoa(ollama.Port)) + "/api/chat"
+}
+
+// ollamaMessage is a chat message in Ollama's format, which sends images beside the text
+type ollamaMessage struct {
+	Role    string   `json:"role"`
+	Content string   `json:"content"`
+	Images  []string `json:"images,omitempty"` // base64, without a data URL prefix
+}
+
+// ollamaMessages converts a chat completions request body to Ollama messages
+func ollamaMessages(requestBody interface{}) ([]ollamaMessage, error) {
+	var messages []ollamaMessage
+	switch body := requestBody.(type) {
+	case ChatRequest:
+		for _, message := range body.Messages {
+			messages = append(messages, ollamaMessage{Role: message.Role, Content: message.Content})
+		}
+	case VisionRequest:
+		for _, message := range body.Messages {
+			converted := ollamaMessage{Role: message.Role}
+			var text []string
+			for _, part := range message.Content {
+				if part.ImageURL != nil {
+					if idx := strings.Index(part.ImageURL.URL, ";base64,"); idx != -1 {
+						converted.Images = append(converted.Images, part.ImageURL.URL[idx+len(";base64,"):])
+					}
+					// Ollama can't place an image between text, so the text says which one it is
+					text = append(text, fmt.Sprintf("[image %d]", len(converted.Images)))
+					continue
+				}
+				text = append(text, part.Text)
+			}
+			converted.Content = strings.Join(text, "\n")
+			messages = append(messages, converted)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported request type %T", requestBody)
+	}
+	return messages, nil
+}
+
+// sendOllamaRequest sends a chat request to the Ollama server and returns the reply
+func sendOllamaRequest(ctx context.Context, requestBody interface{}, config LLMConfig) (string, error) {
+	return ollamaRequest(ctx, requestBody, config, nil)
+}
+
+// ollamaResponse is a reply from the Ollama server, or one line of it when streaming
+type ollamaResponse struct {
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+// ollamaRequest sends a chat request to the Ollama server, writing the reply to w as it is
+// generated when w is set
+func ollamaRequest(ctx context.Context, requestBody interface{}, config LLMConfig, w io.Writer) (string, error) {
+	messages, err := ollamaMessages(requestBody)
+	if err != nil {
+		return "", err
+	}
+	options := map[string]interface{}{"temperature": config.Temperature, "num_predict": config.MaxTokens}
+	// Ollama uses a small context whatever the model supports, unless asked for more
+	if config.ContextWindow > 0 {
+		options["num_ctx"] = config.ContextWindow
+	}
+	request := map[string]interface{}{
+		"model":    config.Model,
+		"messages": messages,
+		"stream":   w != nil,
+		"options":  options,
+	}
+	// Ollama takes the schema of a structured reply as the format
+	if body, ok := requestBody.(ChatRequest); ok && body.ResponseFormat != nil && body.ResponseFormat.JSONSchema != nil {
+		request["format"] = body.ResponseFormat.JSONSchema.Schema
+	}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+	if err := checkChatEndpoint(config); err != nil {
+		return "", err
+	}
+
+	endpoint := chatEndpoint(config)
+	Log(DEBUG, "Sending request to Ollama at %s with model %s", endpoint, config.Model)
+	ctx, cancel := requestContext(ctx, config)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client, err := llmHTTPClient(config)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		err = requestError(ctx, config, fmt.Errorf("failed to reach Ollama at %s, is ollama serve running? %w", endpoint, err))
+		recordLLMError(err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Streamed replies are one JSON object per line, the last with done set and the token counts
+	var response ollamaResponse
+	var content strings.Builder
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var chunk ollamaResponse
+		if err := decoder.Decode(&chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", requestError(ctx, config, fmt.Errorf("failed to unmarshal response: %v", err))
+		}
+		content.WriteString(chunk.Message.Content)
+		if w != nil {
+			fmt.Fprint(w, chunk.Message.Content)
+		}
+		response = chunk
+		if chunk.Done || chunk.Error != "" {
+			break
+		}
+	}
+	if w != nil {
+		fmt.Fprintln(w)
+	}
+	var usage ChatResponse
+	usage.Usage.PromptTokens = response.PromptEvalCount
+	usage.Usage.CompletionTokens = response.EvalCount
+	recordLLMUsage(config, usage)
+
+	if response.Error != "" || resp.StatusCode != http.StatusOK {
+		message := response.Error
+		if message == "" {
+			message = resp.Status
+		}
+		err := fmt.Errorf("Ollama error: %s", message)
+		if resp.StatusCode == http.StatusNotFound {
+			err = newError(ErrInvalidModel, "Ollama error: %s. Download the model with: ollama pull %s", message, config.Model)
+		} else if strings.Contains(message, "context") {
+			err = newError(ErrContextOverflow, "Ollama error: %s", message)
+		}
+		recordLLMError(err)
+		return "", err
+	}
+	return content.String(), nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// OwnersConfig adds a preview of the approvals the PR will need from CODEOWNERS and branch protection
+type OwnersConfig struct {
+	Enabled      bool               `json:"enabled"`
+	SLAHours     map[string]float64 `json:"sla_hours"`      // review SLA of owners, keyed by handle such as @org/payments
+	SlowSLAHours float64            `json:"slow_sla_hours"` // owners with a longer SLA get a warning, default 24
+}
+
+// codeownersPaths are where GitHub looks for the CODEOWNERS file, in order
+var codeownersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// CodeownersRule is one line of a CODEOWNERS file
+type CodeownersRule struct {
+	Pattern string
+	Owners  []string
+	match   *regexp.Regexp
+}
+
+// ApprovalRequirements is what branch protection and rulesets require before merging into a branch
+type ApprovalRequirements struct {
+	Approvals       int
+	CodeOwnerReview bool
+	Known           bool // false when the rules couldn't be read
+}
+
+// codeownersPattern turns a CODEOWNERS pattern into a regexp for repository paths. The syntax is
+// gitignore's: patterns with a slash other than at the end are relative to the root, others match
+// at any depth, and a pattern matching a directory owns everything below it.
+func codeownersPattern(pattern string) (*regexp.Regexp, error) {
+	directoryOnly := strings.HasSuffix(pattern, "/")
+	trimmed := strings.Trim(pattern, "/")
+	anchored := strings.HasPrefix(pattern, "/") || strings.Contains(trimmed, "/")
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	if !anchored {
+		sb.WriteString("(.*/)?")
+	}
+	for i := 0; i < len(trimmed); i++ {
+		switch {
+		case strings.HasPrefix(trimmed[i:], "**/"):
+			sb.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(trimmed[i:], "**"):
+			sb.WriteString(".*")
+			i++
+		case trimmed[i] == '*':
+			sb.WriteString("[^/]*")
+		case trimmed[i] == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(trimmed[i : i+1]))
+		}
+	}
+	switch {
+	case directoryOnly:
+		sb.WriteString("/.*$")
+	case strings.HasSuffix(trimmed, "/*"):
+		// GitHub doesn't let docs/* own files in subdirectories of docs
+		sb.WriteString("$")
+	default:
+		sb.WriteString("(/.*)?$")
+	}
+	return regexp.Compile(sb.String())
+}
+
+// parseCodeowners parses a CODEOWNERS file, skipping lines it can't use
+func parseCodeowners(content string) []CodeownersRule {
+	var rules []CodeownersRule
+	for number, line := range strings.Split(content, "\n") {
+		if hash := strings.Index(line, "#"); hash != -1 && (hash == 0 || line[hash-1] != '\\') {
+			line = line[:hash]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		match, err := codeownersPattern(fields[0])
+		if err != nil {
+			Log(WARN, "Ignoring CODEOWNERS line %d: %v", number+1, err)
+			continue
+		}
+		rules = append(rules, CodeownersRule{Pattern: fields[0], Owners: fields[1:], match: match})
+	}
+	return rules
+}
+
+// ownersOf returns the owners of a path: those of the last matching rule, which may have none
+func ownersOf(p string, rules []CodeownersRule) []string {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].match.MatchString(p) {
+			return rules[i].Owners
+		}
+	}
+	return nil
+}
+
+// readCodeowners reads the CODEOWNERS file of a branch. GitHub applies the one on the base
+// branch, not the one in the PR.
+func readCodeowners(branch string) ([]CodeownersRule, string, bool) {
+	for _, p := range codeownersPaths {
+		if content, ok := gitShowFile(branch, p); ok {
+			return parseCodeowners(content), p, true
+		}
+	}
+	return nil, "", false
+}
+
+// approvalRequirements reads what the branch's rulesets and classic branch protection require,
+// taking the strictest of both
+func approvalRequirements(repo string, branch string) ApprovalRequirements {
+	var requirements ApprovalRequirements
+	var rules []struct {
+		Type       string `json:"type"`
+		Parameters struct {
+			RequiredApprovingReviewCount int  `json:"required_approving_review_count"`
+			RequireCodeOwnerReview       bool `json:"require_code_owner_review"`
+		} `json:"parameters"`
+	}
+	if err := cachedGhAPI("branch_rules", fmt.Sprintf("repos/%s/rules/branches/%s", repo, branch), &rules); err == nil {
+		requirements.Known = true
+		for _, rule := range rules {
+			if rule.Type != "pull_request" {
+				continue
+			}
+			if rule.Parameters.RequiredApprovingReviewCount > requirements.Approvals {
+				requirements.Approvals = rule.Parameters.RequiredApprovingReviewCount
+			}
+			requirements.CodeOwnerReview = requirements.CodeOwnerReview || rule.Parameters.RequireCodeOwnerReview
+		}
+	} else {
+		Log(DEBUG, "Failed to read rulesets of %s: %v", branch, err)
+	}
+
+	var protection struct {
+		RequiredPullRequestReviews *struct {
+			RequiredApprovingReviewCount int  `json:"required_approving_review_count"`
+			RequireCodeOwnerReviews      bool `json:"require_code_owner_reviews"`
+		} `json:"required_pull_request_reviews"`
+	}
+	err := cachedGhAPI("branch_rules", fmt.Sprintf("repos/%s/branches/%s/protection", repo, branch), &protection)
+	switch {
+	case err == nil:
+		requirements.Known = true
+		if reviews := protection.RequiredPullRequestReviews; reviews != nil {
+			if reviews.RequiredApprovingReviewCount > requirements.Approvals {
+				requirements.Approvals = reviews.RequiredApprovingReviewCount
+			}
+			requirements.CodeOwnerReview = requirements.CodeOwnerReview || reviews.RequireCodeOwnerReviews
+		}
+	case strings.Contains(err.Error(), "HTTP 404"):
+		// Not protected, which is as much as the rulesets already said
+	default:
+		// Reading classic protection needs admin access
+		Log(DEBUG, "Failed to read branch protection of %s: %v", branch, err)
+	}
+	return requirements
+}
+
+// buildApprovalPreview lists the owners whose approval the PR will need and warns about those
+// with slow review SLAs
+func buildApprovalPreview(targetBranch string, owners OwnersConfig) (string, error) {
+	rules, codeownersPath, ok := readCodeowners(targetBranch)
+	if !ok {
+		Log(DEBUG, "No CODEOWNERS file on %s", targetBranch)
+		return "", nil
+	}
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return "", err
+	}
+	files, err := getChangedFilesInRange(base, headRev)
+	if err != nil {
+		return "", err
+	}
+
+	ownedFiles := make(map[string][]string)
+	unowned := 0
+	for _, file := range files {
+		fileOwners := ownersOf(file, rules)
+		if len(fileOwners) == 0 {
+			unowned++
+		}
+		for _, owner := range fileOwners {
+			ownedFiles[owner] = append(ownedFiles[owner], file)
+		}
+	}
+	if len(ownedFiles) == 0 {
+		Log(DEBUG, "None of the changed files have code owners")
+		return "", nil
+	}
+	var handles []string
+	for owner := range ownedFiles {
+		handles = append(handles, owner)
+	}
+	sort.Strings(handles)
+
+	requirements := ApprovalRequirements{}
+	if github := githubAvailable(); !github.Active {
+		noteOmitted("branch protection in Required approvals", github)
+	} else if repo, err := currentRepo(); err == nil {
+		requirements = approvalRequirements(repo, targetBranch)
+	} else {
+		Log(WARN, "Leaving branch protection out of the approval preview: %v", err)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("## Required approvals\n\n")
+	switch {
+	case !requirements.Known:
+		sb.WriteString(fmt.Sprintf("Couldn't read the branch protection of `%s`. These owners from `%s` will be requested for review and may be required to approve:\n", targetBranch, codeownersPath))
+	case requirements.CodeOwnerReview:
+		sb.WriteString(fmt.Sprintf("`%s` requires %d approvals and, for every changed file, one from its code owners in `%s`:\n", targetBranch, requirements.Approvals, codeownersPath))
+	default:
+		sb.WriteString(fmt.Sprintf("`%s` requires %d approvals, not necessarily from code owners. These owners from `%s` will be requested for review:\n", targetBranch, requirements.Approvals, codeownersPath))
+	}
+
+	var slow []string
+	for _, owner := range handles {
+		owned := ownedFiles[owner]
+		listed := owned
+		if len(listed) > 3 {
+			listed = listed[:3]
+		}
+		line := fmt.Sprintf("- %s: `%s`", owner, strings.Join(listed, "`, `"))
+		if len(owned) > len(listed) {
+			line += fmt.Sprintf(" and %d more", len(owned)-len(listed))
+		}
+		if sla, ok := owners.SLAHours[owner]; ok && sla > owners.SlowSLAHours {
+			line += fmt.Sprintf(" (**review SLA %.0f h**)", sla)
+			slow = append(slow, owner)
+		}
+		sb.WriteString(line + "\n")
+	}
+	if unowned > 0 {
+		sb.WriteString(fmt.Sprintf("\n%d changed files have no code owner.\n", unowned))
+	}
+	if len(slow) > 0 {
+		Log(WARN, "Owners with slow review SLAs need to approve: %s", strings.Join(slow, ", "))
+		fmt.Printf("Warning: approval is needed from owners with review SLAs over %.0f h: %s. Plan for the wait or ask them early.\n",
+			owners.SlowSLAHours, strings.Join(slow, ", "))
+	}
+	return strings.TrimRight(sb.String(), "\n"), nil
+}
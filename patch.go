@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// readPatchFile reads a .patch or .diff file to generate a message for. Any header before the
+// diff, such as an existing git format-patch header, is dropped, and plain unified diffs from
+// tools like quilt get git-style file headers so they're handled like git diffs.
+func readPatchFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(expandPath(path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read patch file: %v", err)
+	}
+	diff := normalizePatch(string(data))
+	if diff == "" {
+		return "", fmt.Errorf("%s doesn't contain a diff", path)
+	}
+	Log(DEBUG, "Read patch file %s (%d bytes of diff)", path, len(diff))
+	return diff, nil
+}
+
+// patchPath returns the path from a ---/+++ line without its first component, such as a/ or
+// quilt's foo.orig/, and timestamp
+func patchPath(line string) string {
+	p := strings.SplitN(strings.TrimSpace(line[4:]), "\t", 2)[0]
+	if idx := strings.Index(p, "/"); idx != -1 && p != "/dev/null" {
+		return p[idx+1:]
+	}
+	return p
+}
+
+// normalizePatch strips everything before the first file in a patch and adds a "diff --git"
+// line in front of files that only have ---/+++ headers
+func normalizePatch(patch string) string {
+	lines := strings.SplitAfter(patch, "\n")
+	var sb strings.Builder
+	started, inGitHeader := false, false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			started, inGitHeader = true, true
+		case strings.HasPrefix(line, "@@ "):
+			inGitHeader = false
+		case strings.HasPrefix(line, "--- ") && !inGitHeader && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			// Rewrite the paths git's way so git apply and git am accept the patch
+			oldPath, newPath := patchPath(line), patchPath(lines[i+1])
+			path, from, to := newPath, "a/"+oldPath, "b/"+newPath
+			if newPath == "/dev/null" {
+				path, to = oldPath, newPath
+			} else if oldPath == "/dev/null" {
+				from = oldPath
+			}
+			sb.WriteString(fmt.Sprintf("diff --git a/%s b/%s\n--- %s\n+++ %s\n", path, path, from, to))
+			started = true
+			i++
+			continue
+		case line == "-- \n" && started && !inGitHeader:
+			// The signature separator that ends a format-patch email
+			return sb.String()
+		}
+		if started {
+			sb.WriteString(line)
+		}
+	}
+	return sb.String()
+}
+
+// statBar draws n changed lines as at most 40 characters, like git's --stat
+func statBar(char string, n int) string {
+	if n > 40 {
+		n = 40
+	}
+	return strings.Repeat(char, n)
+}
+
+// patchDiffstat summarizes the files in a diff like git's --stat output
+func patchDiffstat(diff string) string {
+	var sb strings.Builder
+	files := splitDiffByFile(diff)
+	added, removed := 0, 0
+	for _, file := range files {
+		sb.WriteString(fmt.Sprintf(" %s | %d %s%s\n", file.Path, file.Added+file.Removed,
+			statBar("+", file.Added), statBar("-", file.Removed)))
+		added += file.Added
+		removed += file.Removed
+	}
+	sb.WriteString(fmt.Sprintf(" %d files changed, %d insertions(+), %d deletions(-)\n", len(files), added, removed))
+	return sb.String()
+}
+
+// patchAuthor returns the "Name <email>" git would use as the author
+func patchAuthor() (string, error) {
+	output, err := newCommand("git", "var", "GIT_AUTHOR_IDENT").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the author from git config (set user.name and user.email): %v", err)
+	}
+	ident := strings.TrimSpace(string(output))
+	if idx := strings.LastIndex(ident, ">"); idx != -1 {
+		ident = ident[:idx+1]
+	}
+	return ident, nil
+}
+
+// formatPatch writes the message and diff as a git format-patch email, which git am, quilt and
+// mailing lists accept
+func formatPatch(message string, diff string, author string, date time.Time) string {
+	parts := strings.SplitN(strings.TrimSpace(message), "\n", 2)
+	body := ""
+	if len(parts) > 1 {
+		body = strings.TrimSpace(parts[1]) + "\n"
+	}
+	return fmt.Sprintf("From 0000000000000000000000000000000000000000 Mon Sep 17 00:00:00 2001\nFrom: %s\nDate: %s\nSubject: [PATCH] %s\n\n%s---\n%s\n%s",
+		author, date.Format(time.RFC1123Z), strings.TrimSpace(parts[0]), body, patchDiffstat(diff), diff)
+}
+
+// writePatchFile writes the message and diff to path as a patch
+func writePatchFile(path string, message string, diff string) error {
+	author, err := patchAuthor()
+	if err != nil {
+		return err
+	}
+	patch := formatPatch(message, diff, author, time.Now())
+	if err := ioutil.WriteFile(expandPath(path), []byte(patch), 0644); err != nil {
+		return fmt.Errorf("failed to write patch file: %v", err)
+	}
+	return nil
+}
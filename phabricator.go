@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// PhabricatorConfig points gs at a Phabricator install for Differential revisions
+type PhabricatorConfig struct {
+	URL   string `json:"url"`   // e.g. https://phabricator.example.com
+	Token string `json:"token"` // Conduit API token, or PHABRICATOR_TOKEN
+}
+
+// revisionPattern matches a Differential revision ID such as D123
+var revisionPattern = regexp.MustCompile(`^D?(\d+)$`)
+
+// ArcMessage is a description in the fields arc diff and Differential use
+type ArcMessage struct {
+	Title     string
+	Summary   string
+	TestPlan  string
+	Reviewers []string
+}
+
+// String renders the message the way arc diff writes it into the commit message
+func (m ArcMessage) String() string {
+	var sb strings.Builder
+	sb.WriteString(m.Title + "\n\n")
+	sb.WriteString("Summary:\n" + m.Summary + "\n\n")
+	sb.WriteString("Test Plan:\n" + m.TestPlan + "\n")
+	if len(m.Reviewers) > 0 {
+		sb.WriteString("\nReviewers: " + strings.Join(m.Reviewers, ", ") + "\n")
+	}
+	return sb.String()
+}
+
+// toArcMessage splits a markdown description into Differential fields. A first line that isn't
+// a section heading is the title, otherwise the title is fallbackTitle. Sections about testing
+// are the test plan and everything else is the summary.
+func toArcMessage(description string, fallbackTitle string, reviewers []string) ArcMessage {
+	message := ArcMessage{Title: fallbackTitle, Reviewers: reviewers}
+	body := strings.TrimSpace(description)
+	if lines := strings.SplitN(body, "\n", 2); !strings.HasPrefix(lines[0], "##") {
+		message.Title = strings.TrimSpace(strings.TrimLeft(lines[0], "# "))
+		body = ""
+		if len(lines) > 1 {
+			body = lines[1]
+		}
+	}
+
+	var summary, testPlan []string
+	for _, section := range splitTemplateSections(body) {
+		text := strings.TrimSpace(strings.Join(section.lines, "\n"))
+		if section.key != "" {
+			// The field name replaces the heading of the section it came from
+			if content := strings.TrimSpace(strings.Join(section.lines[1:], "\n")); section.key == "summary" || strings.Contains(section.key, "test") {
+				text = content
+			}
+		}
+		switch {
+		case text == "":
+		case strings.Contains(section.key, "test"):
+			testPlan = append(testPlan, text)
+		default:
+			summary = append(summary, text)
+		}
+	}
+	message.Summary = strings.Join(summary, "\n\n")
+	message.TestPlan = strings.TrimSpace(strings.Join(testPlan, "\n\n"))
+	if message.TestPlan == "" {
+		message.TestPlan = "TODO: describe how this was tested"
+	}
+	return message
+}
+
+// conduitCall calls a Conduit API method with the given parameters and decodes its result into out
+func conduitCall(phab PhabricatorConfig, method string, params map[string]interface{}, out interface{}) error {
+	if err := requireNetwork("Phabricator"); err != nil {
+		return err
+	}
+	if phab.URL == "" {
+		return fmt.Errorf("phabricator.url isn't set in the config")
+	}
+	if phab.Token == "" {
+		return newError(ErrAuth, "no Conduit API token. Set phabricator.token or PHABRICATOR_TOKEN")
+	}
+	params["__conduit__"] = map[string]string{"token": phab.Token}
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal Conduit parameters: %v", err)
+	}
+	form := url.Values{"params": {string(encoded)}, "output": {"json"}, "__conduit__": {"1"}}
+
+	Log(DEBUG, "Calling Conduit method %s", method)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.PostForm(strings.TrimRight(phab.URL, "/")+"/api/"+method, form)
+	if err != nil {
+		return fmt.Errorf("failed to call %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read %s response: %v", method, err)
+	}
+
+	var response struct {
+		Result    json.RawMessage `json:"result"`
+		ErrorCode string          `json:"error_code"`
+		ErrorInfo string          `json:"error_info"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unexpected response from %s (%s): %v", method, resp.Status, err)
+	}
+	if response.ErrorCode != "" {
+		Log(ERROR, "Conduit method %s failed: %s %s", method, response.ErrorCode, response.ErrorInfo)
+		kind := ErrUnknown
+		if strings.Contains(response.ErrorCode, "AUTH") {
+			kind = ErrAuth
+		}
+		return newError(kind, "%s failed: %s: %s", method, response.ErrorCode, response.ErrorInfo)
+	}
+	if out != nil {
+		if err := json.Unmarshal(response.Result, out); err != nil {
+			return fmt.Errorf("failed to parse %s result: %v", method, err)
+		}
+	}
+	return nil
+}
+
+// userPHIDs resolves Phabricator usernames to the PHIDs that revision edits need
+func userPHIDs(phab PhabricatorConfig, usernames []string) ([]string, error) {
+	var result struct {
+		Data []struct {
+			PHID   string `json:"phid"`
+			Fields struct {
+				Username string `json:"username"`
+			} `json:"fields"`
+		} `json:"data"`
+	}
+	params := map[string]interface{}{"constraints": map[string]interface{}{"usernames": usernames}}
+	if err := conduitCall(phab, "user.search", params, &result); err != nil {
+		return nil, err
+	}
+	var phids []string
+	found := make(map[string]bool)
+	for _, user := range result.Data {
+		phids = append(phids, user.PHID)
+		found[user.Fields.Username] = true
+	}
+	for _, username := range usernames {
+		if !found[username] {
+			Log(WARN, "No Phabricator user %s, not adding them as a reviewer", username)
+		}
+	}
+	return phids, nil
+}
+
+// updateRevision replaces the title, summary and test plan of a revision and adds its reviewers
+func updateRevision(phab PhabricatorConfig, revision string, message ArcMessage) error {
+	transactions := []map[string]interface{}{
+		{"type": "title", "value": message.Title},
+		{"type": "summary", "value": message.Summary},
+		{"type": "testPlan", "value": message.TestPlan},
+	}
+	if len(message.Reviewers) > 0 {
+		phids, err := userPHIDs(phab, message.Reviewers)
+		if err != nil {
+			return err
+		}
+		if len(phids) > 0 {
+			transactions = append(transactions, map[string]interface{}{"type": "reviewers.add", "value": phids})
+		}
+	}
+	params := map[string]interface{}{"objectIdentifier": revision, "transactions": transactions}
+	return conduitCall(phab, "differential.revision.edit", params, nil)
+}
+
+// runPhabCommand generates a Differential description for the branch, printing it for arc diff or
+// updating an existing revision
+func runPhabCommand(args []string) error {
+	fs := flag.NewFlagSet("phab", flag.ExitOnError)
+	revision := fs.String("revision", "", "Differential revision to update, e.g. D123")
+	targetBranch := fs.String("target", "master", "Branch the revision is against")
+	dryRun := fs.Bool("dry-run", false, "Print the message without updating the revision")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *revision != "" {
+		match := revisionPattern.FindStringSubmatch(*revision)
+		if match == nil {
+			return fmt.Errorf("%q is not a revision ID like D123", *revision)
+		}
+		*revision = "D" + match[1]
+	}
+
+	if err := ensureConsent(true, config); err != nil {
+		return err
+	}
+
+	commits, err := currentVCS().BranchCommits(*targetBranch)
+	if err != nil {
+		return err
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	description, err := createPRMessage(ctx, commits, *targetBranch, config.PRTemplate, config.AreaTemplates, config.HumanSections, config.LLM)
+	if err != nil {
+		return err
+	}
+	extras, err := buildPRExtras(ctx, *targetBranch, commits, config)
+	if err != nil {
+		return err
+	}
+	title := strings.SplitN(commits, "\n", 2)[0]
+	message := toArcMessage(appendSections(description, extras.Sections), title, extras.Reviewers)
+
+	if *dryRun || *revision == "" {
+		fmt.Print(message.String())
+		return nil
+	}
+
+	edited, err := editMessage(message.String())
+	if err != nil {
+		return err
+	}
+	recordMessageHistory("phab", message.String(), edited, config)
+	// Reviewers are the ones the author left in the edited message
+	reviewers := message.Reviewers
+	if match := arcReviewersPattern.FindStringSubmatch(edited); match != nil {
+		reviewers = strings.FieldsFunc(match[1], func(r rune) bool { return r == ',' || r == ' ' })
+		edited = strings.TrimSpace(strings.Replace(edited, match[0], "", 1))
+	}
+	message = toArcMessage(arcToMarkdown(edited), title, reviewers)
+
+	if err := updateRevision(config.Phabricator, *revision, message); err != nil {
+		return err
+	}
+	fmt.Printf("Updated %s/%s\n", strings.TrimRight(config.Phabricator.URL, "/"), *revision)
+	return nil
+}
+
+// arcFieldPattern matches the field labels arc uses in messages
+var arcFieldPattern = regexp.MustCompile(`(?m)^(Summary|Test Plan):\s*$`)
+
+// arcReviewersPattern matches the reviewers field of an arc message
+var arcReviewersPattern = regexp.MustCompile(`(?m)^Reviewers:(.*)$`)
+
+// arcToMarkdown turns an edited arc message back into markdown sections so toArcMessage can
+// split it again
+func arcToMarkdown(message string) string {
+	return arcFieldPattern.ReplaceAllStringFunc(message, func(field string) string {
+		return "## " + strings.TrimSuffix(strings.TrimSpace(field), ":")
+	})
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// PipelineConfig sets up two-stage generation for large changes: a cheap model summarizes each
+// file and writes a draft, and a strong model only writes the final message from those
+type PipelineConfig struct {
+	Enabled      bool   `json:"enabled"`
+	CheapModel   string `json:"cheap_model"`    // per-file summaries and the draft, default gpt-4o-mini
+	StrongModel  string `json:"strong_model"`   // the final message, default llm.model
+	MinDiffBytes int    `json:"min_diff_bytes"` // smaller diffs go straight to the strong model, default 20000
+	Concurrency  int    `json:"concurrency"`    // summaries requested at once, default 4
+	BatchTokens  int    `json:"batch_tokens"`   // small files' diffs summarized in one request, default 6000, -1 for a request per file
+	OnOverflow   string `json:"on_overflow"`    // "summarize" (default) summarizes diffs too large for the context file by file, "trim" trims them
+}
+
+// usePipeline reports whether a diff is large enough to generate in two stages
+func usePipeline(diff string, llmConfig LLMConfig) bool {
+	// Summaries are built from file contents, which mustn't be sent in local-context-only mode
+	return llmConfig.Pipeline.Enabled && !llmConfig.LocalContextOnly && len(diff) >= llmConfig.Pipeline.MinDiffBytes
+}
+
+// withModel returns the LLM config using a different model
+func withModel(llmConfig LLMConfig, model string) LLMConfig {
+	llmConfig.Model = model
+	llmConfig.EnableQuestions = false
+	return llmConfig
+}
+
+// runPipeline generates a message in two stages. draft writes the draft from the file summaries
+// with the cheap model; the strong model then writes the final message.
+func runPipeline(ctx context.Context, kind string, diff string, template string, llmConfig LLMConfig, draft func(summaries string, cheap LLMConfig) (string, error)) (string, error) {
+	cheap := withModel(llmConfig, llmConfig.Pipeline.CheapModel)
+	strong := withModel(llmConfig, llmConfig.Pipeline.StrongModel)
+
+	summaries, err := summarizeFiles(ctx, diff, cheap)
+	if err != nil {
+		return "", err
+	}
+	Log(INFO, "Drafting %s with %s", kind, cheap.Model)
+	draftMessage, err := draft(summaries, cheap)
+	if err != nil {
+		return "", fmt.Errorf("failed to draft %s: %w", kind, err)
+	}
+	Log(INFO, "Writing final %s with %s", kind, strong.Model)
+	return GenerateFinalMessage(ctx, kind, draftMessage, summaries, template, strong)
+}
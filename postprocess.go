@@ -0,0 +1,587 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// defaultWrapWidth is the column width-wrap wraps at, the width git tools expect of commit bodies
+const defaultWrapWidth = 72
+
+// PostProcessConfig lists the steps generated messages go through, in order, before they're shown
+type PostProcessConfig struct {
+	Commit []PostProcessStep `json:"commit"` // default strip-fences, markdown-style, commit-format, width-wrap
+	PR     []PostProcessStep `json:"pr"`     // default strip-fences, markdown-style
+
+	commit []postProcessor // compiled when the config is loaded
+	pr     []postProcessor
+}
+
+// PostProcessStep is one step of a pipeline. Step names the kind of step, the other fields are
+// the settings of the kinds that take them.
+type PostProcessStep struct {
+	Step     string            `json:"step"`
+	Sections []string          `json:"sections"` // enforce-sections: headings every message must have
+	Terms    map[string]string `json:"terms"`    // glossary: word to find, ignoring case, and its spelling
+	Trailers []string          `json:"trailers"` // trailers: lines such as "Signed-off-by: {author}"
+	Width    int               `json:"width"`    // width-wrap: default 72
+	Command  []string          `json:"command"`  // command: reads the message on stdin, prints the new one
+}
+
+// postProcessInput is what steps know about the message besides its text
+type postProcessInput struct {
+	Prefix     string // scope or type prefix the first line must start with
+	CommitType string // conventional commit type, when there's no scope prefix carrying it
+	Budget     MessageBudget
+	Template   string // the template the message was written from
+}
+
+// postProcessor is a compiled step
+type postProcessor struct {
+	name  string
+	apply func(message string, input postProcessInput) (string, error)
+}
+
+// postProcessors compiles each kind of step from its settings. A new kind of step is a new entry;
+// programs outside gs can be plugged in with the command step.
+var postProcessors = map[string]func(step PostProcessStep) (func(string, postProcessInput) (string, error), error){
+	"strip-fences":     compileStripFences,
+	"commit-format":    compileCommitFormat,
+	"enforce-sections": compileEnforceSections,
+	"glossary":         compileGlossary,
+	"trailers":         compileTrailers,
+	"width-wrap":       compileWidthWrap,
+	"markdown-style":   compileMarkdownStyle,
+	"command":          compileCommandStep,
+}
+
+// postProcessSettings is the pipelines of the loaded config
+var postProcessSettings PostProcessConfig
+
+// compilePostProcessing compiles the commit and PR pipelines, using the defaults for ones that
+// aren't configured
+func compilePostProcessing(config *PostProcessConfig) error {
+	if config.Commit == nil {
+		config.Commit = []PostProcessStep{{Step: "strip-fences"}, {Step: "markdown-style"}, {Step: "commit-format"}, {Step: "width-wrap"}}
+	}
+	if config.PR == nil {
+		config.PR = []PostProcessStep{{Step: "strip-fences"}, {Step: "markdown-style"}}
+	}
+	var err error
+	if config.commit, err = compilePipeline(config.Commit); err != nil {
+		return fmt.Errorf("post_process.commit: %v", err)
+	}
+	if config.pr, err = compilePipeline(config.PR); err != nil {
+		return fmt.Errorf("post_process.pr: %v", err)
+	}
+	// commit_format and commit_budget are promises the pipeline can't silently drop
+	for _, step := range config.commit {
+		if step.name == "commit-format" {
+			return nil
+		}
+	}
+	return fmt.Errorf("post_process.commit must include the commit-format step, which applies commit_format and commit_budget")
+}
+
+// compilePipeline compiles steps in order
+func compilePipeline(steps []PostProcessStep) ([]postProcessor, error) {
+	var pipeline []postProcessor
+	for i, step := range steps {
+		compile, ok := postProcessors[step.Step]
+		if !ok {
+			names := make([]string, 0, len(postProcessors))
+			for name := range postProcessors {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown step %q: use %s", step.Step, strings.Join(names, ", "))
+		}
+		apply, err := compile(step)
+		if err != nil {
+			return nil, fmt.Errorf("step %d (%s): %v", i+1, step.Step, err)
+		}
+		pipeline = append(pipeline, postProcessor{name: step.Step, apply: apply})
+	}
+	return pipeline, nil
+}
+
+// postProcess runs a message through a pipeline
+func postProcess(pipeline []postProcessor, message string, input postProcessInput) (string, error) {
+	for _, step := range pipeline {
+		processed, err := step.apply(message, input)
+		if err != nil {
+			return "", fmt.Errorf("post-processing step %s failed: %w", step.name, err)
+		}
+		if processed != message {
+			Log(DEBUG, "Post-processing step %s changed the message", step.name)
+		}
+		message = processed
+	}
+	return message, nil
+}
+
+// fenceLanguages are the info strings of fences models wrap whole messages in
+var fenceLanguages = map[string]bool{"": true, "markdown": true, "md": true, "text": true, "txt": true, "plaintext": true, "gitcommit": true}
+
+// compileStripFences removes a code fence wrapped around the whole message, which models add when
+// they take "write a commit message" as a request for a snippet
+func compileStripFences(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	return func(message string, _ postProcessInput) (string, error) {
+		message = strings.TrimSpace(message)
+		lines := strings.Split(message, "\n")
+		last := len(lines) - 1
+		if last < 1 || !strings.HasPrefix(lines[0], "```") || strings.TrimSpace(lines[last]) != "```" ||
+			!fenceLanguages[strings.ToLower(strings.TrimSpace(strings.TrimLeft(lines[0], "`")))] {
+			return message, nil
+		}
+		// With an odd number of fences inside, the first one closes at one of them and the message
+		// is several blocks rather than one wrapped block
+		fences := 0
+		for _, line := range lines[1:last] {
+			if strings.HasPrefix(strings.TrimSpace(line), "```") {
+				fences++
+			}
+		}
+		if fences%2 != 0 {
+			return message, nil
+		}
+		return strings.TrimSpace(strings.Join(lines[1:last], "\n")), nil
+	}, nil
+}
+
+// compileCommitFormat makes the first line start with the inferred scope and type, and trims the
+// message to commit_budget
+func compileCommitFormat(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	return func(message string, input postProcessInput) (string, error) {
+		message = enforceScopePrefix(message, input.Prefix)
+		message = enforceCommitType(message, input.CommitType)
+		return applyBudget(message, input.Budget), nil
+	}, nil
+}
+
+// compileEnforceSections adds the sections the message is missing, so every description has the
+// headings reviewers and tools look for
+func compileEnforceSections(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	if len(step.Sections) == 0 {
+		return nil, fmt.Errorf("no sections given")
+	}
+	return func(message string, _ postProcessInput) (string, error) {
+		present := make(map[string]bool)
+		markdown := false
+		for _, line := range strings.Split(message, "\n") {
+			if name := sectionName(line); name != "" {
+				present[strings.ToLower(name)] = true
+				markdown = markdown || strings.HasPrefix(strings.TrimSpace(line), "#")
+			}
+		}
+		var missing []string
+		for _, section := range step.Sections {
+			name := strings.TrimSuffix(strings.TrimSpace(strings.TrimLeft(section, "#")), ":")
+			if present[strings.ToLower(name)] {
+				continue
+			}
+			Log(WARN, "The message has no %q section, adding it", name)
+			if markdown {
+				missing = append(missing, "## "+name+"\n\nNone.")
+			} else {
+				missing = append(missing, name+":\nNone.")
+			}
+		}
+		return appendSections(message, missing), nil
+	}, nil
+}
+
+// glossaryTerm is a word to find and how to spell it
+type glossaryTerm struct {
+	pattern  *regexp.Regexp
+	spelling string
+}
+
+// compileGlossary spells product names and terms the way the team does. Code, inline code, URLs
+// and paths are left alone, as spellings there are identifiers.
+func compileGlossary(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	if len(step.Terms) == 0 {
+		return nil, fmt.Errorf("no terms given")
+	}
+	// Longer terms first, so "github actions" wins over "github"
+	words := make([]string, 0, len(step.Terms))
+	for word := range step.Terms {
+		words = append(words, word)
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if len(words[i]) != len(words[j]) {
+			return len(words[i]) > len(words[j])
+		}
+		return words[i] < words[j]
+	})
+	var terms []glossaryTerm
+	for _, word := range words {
+		if strings.TrimSpace(word) == "" {
+			return nil, fmt.Errorf("empty term")
+		}
+		terms = append(terms, glossaryTerm{regexp.MustCompile(`(?i)\b` + regexp.QuoteMeta(word) + `\b`), step.Terms[word]})
+	}
+
+	return func(message string, _ postProcessInput) (string, error) {
+		lines := strings.Split(message, "\n")
+		inFence := false
+		for i, line := range lines {
+			if strings.HasPrefix(strings.TrimSpace(line), "```") {
+				inFence = !inFence
+				continue
+			}
+			if inFence {
+				continue
+			}
+			// Odd parts are between backticks
+			parts := strings.Split(line, "`")
+			for p := 0; p < len(parts); p += 2 {
+				for _, term := range terms {
+					parts[p] = replaceOutsideLinks(parts[p], term)
+				}
+			}
+			lines[i] = strings.Join(parts, "`")
+		}
+		return strings.Join(lines, "\n"), nil
+	}, nil
+}
+
+// replaceOutsideLinks respells a term in text unless it's part of a URL, path, email address or
+// file name
+func replaceOutsideLinks(text string, term glossaryTerm) string {
+	matches := term.pattern.FindAllStringIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+	var sb strings.Builder
+	previous := 0
+	for _, match := range matches {
+		start := strings.LastIndexAny(text[:match[0]], " \t(") + 1
+		end := len(text)
+		if idx := strings.IndexAny(text[match[1]:], " \t)"); idx != -1 {
+			end = match[1] + idx
+		}
+		token := strings.TrimRight(text[start:end], ".,;:!?")
+		sb.WriteString(text[previous:match[0]])
+		if strings.ContainsAny(token, "/@_") || len(token) > match[1]-start && token[match[1]-start] == '.' {
+			sb.WriteString(text[match[0]:match[1]])
+		} else {
+			sb.WriteString(term.spelling)
+		}
+		previous = match[1]
+	}
+	sb.WriteString(text[previous:])
+	return sb.String()
+}
+
+// trailerPattern matches a git trailer line such as "Signed-off-by: Ada <ada@example.com>"
+var trailerPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*: \S`)
+
+// compileTrailers adds trailer lines to the end of the message, once each. {author} is replaced
+// with the "Name <email>" of the git author.
+func compileTrailers(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	if len(step.Trailers) == 0 {
+		return nil, fmt.Errorf("no trailers given")
+	}
+	for _, trailer := range step.Trailers {
+		if !trailerPattern.MatchString(strings.ReplaceAll(trailer, "{author}", "a")) {
+			return nil, fmt.Errorf("%q is not a trailer, which looks like Key: value", trailer)
+		}
+	}
+	return func(message string, _ postProcessInput) (string, error) {
+		message = strings.TrimRight(message, "\n")
+		lines := strings.Split(message, "\n")
+		have := make(map[string]bool)
+		for _, line := range lines {
+			have[strings.TrimSpace(line)] = true
+		}
+		var add []string
+		for _, trailer := range step.Trailers {
+			if strings.Contains(trailer, "{author}") {
+				author, err := patchAuthor()
+				if err != nil {
+					return "", err
+				}
+				trailer = strings.ReplaceAll(trailer, "{author}", author)
+			}
+			if !have[trailer] {
+				add = append(add, trailer)
+				have[trailer] = true
+			}
+		}
+		if len(add) == 0 {
+			return message, nil
+		}
+
+		// Join a trailer block the message already ends with, as git interpret-trailers does
+		if trailerBlock(lines) < len(lines) {
+			return message + "\n" + strings.Join(add, "\n"), nil
+		}
+		return message + "\n\n" + strings.Join(add, "\n"), nil
+	}, nil
+}
+
+// trailerBlock returns the index of the first line of the trailer block the message ends with,
+// or len(lines) if it doesn't end with one. The first paragraph is never a trailer block.
+func trailerBlock(lines []string) int {
+	start := len(lines)
+	for start > 0 && lines[start-1] != "" {
+		start--
+	}
+	if start == 0 || start == len(lines) {
+		return len(lines)
+	}
+	for _, line := range lines[start:] {
+		if !trailerPattern.MatchString(line) {
+			return len(lines)
+		}
+	}
+	return start
+}
+
+// listMarker matches the start of a list item or quote, whose wrapped lines are indented past it
+var listMarker = regexp.MustCompile(`^(\s*)([-*+]|\d+[.)]|>)\s+`)
+
+// compileWidthWrap wraps long lines of prose at the step's width. The first line, code,
+// headings, tables, HTML, trailers and words longer than the width are left as they are.
+func compileWidthWrap(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	width := step.Width
+	if width == 0 {
+		width = defaultWrapWidth
+	}
+	if width < 20 {
+		return nil, fmt.Errorf("width %d is too narrow to wrap at", width)
+	}
+	return func(message string, _ postProcessInput) (string, error) {
+		lines := strings.Split(message, "\n")
+		trailers := trailerBlock(lines)
+		var wrapped []string
+		inFence := false
+		for i, line := range lines {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				inFence = !inFence
+			}
+			if i == 0 || inFence || utf8.RuneCountInString(line) <= width || strings.HasPrefix(trimmed, "```") ||
+				strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "|") || strings.HasPrefix(trimmed, "<") ||
+				strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t") || i >= trailers {
+				wrapped = append(wrapped, line)
+				continue
+			}
+			wrapped = append(wrapped, wrapLine(line, width)...)
+		}
+		return strings.Join(wrapped, "\n"), nil
+	}, nil
+}
+
+// wrapLine breaks a line at spaces so each piece fits in width, indenting the pieces after the
+// first past any list marker
+func wrapLine(line string, width int) []string {
+	first := listMarker.FindString(line)
+	indent := strings.Repeat(" ", utf8.RuneCountInString(first))
+	if strings.HasSuffix(strings.TrimSpace(first), ">") {
+		indent = first
+	}
+	if first == "" {
+		first = line[:len(line)-len(strings.TrimLeft(line, " "))]
+		indent = first
+	}
+	var pieces []string
+	current := first
+	for _, word := range strings.Fields(line[len(first):]) {
+		if current != first && current != indent && utf8.RuneCountInString(current)+1+utf8.RuneCountInString(word) > width {
+			pieces = append(pieces, current)
+			current = indent
+		}
+		if current == first || current == indent {
+			current += word
+		} else {
+			current += " " + word
+		}
+	}
+	return append(pieces, current)
+}
+
+// markdownStyle is how a template writes its markdown
+type markdownStyle struct {
+	levels map[string]int // heading level of each of the template's sections by lowercase name, 0 for "Name:" labels
+	top    int            // level of the template's highest headings, 0 if it has none
+	bullet string         // list marker
+}
+
+var (
+	headingLine     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	boldHeadingLine = regexp.MustCompile(`^\*\*([^*]+?):?\*\*:?$`)
+	bulletLine      = regexp.MustCompile(`^(\s*)[-*+](\s+\S)`)
+	horizontalRule  = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+)
+
+// templateMarkdownStyle reads the headings and list marker a template uses. Without a template,
+// or a list in it, lists use "-".
+func templateMarkdownStyle(template string) markdownStyle {
+	style := markdownStyle{levels: make(map[string]int), bullet: "-"}
+	bulletFound := false
+	inFence := false
+	for _, line := range strings.Split(template, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			inFence = !inFence
+		}
+		if inFence {
+			continue
+		}
+		if match := headingLine.FindStringSubmatch(trimmed); match != nil {
+			level := len(match[1])
+			style.levels[strings.ToLower(match[2])] = level
+			if style.top == 0 || level < style.top {
+				style.top = level
+			}
+			continue
+		}
+		if bulletLine.MatchString(line) && !horizontalRule.MatchString(line) {
+			if !bulletFound {
+				style.bullet, bulletFound = strings.TrimSpace(line)[:1], true
+			}
+			continue
+		}
+		if name := sectionName(line); name != "" {
+			style.levels[strings.ToLower(name)] = 0
+		}
+	}
+	return style
+}
+
+// compileMarkdownStyle formats the message's markdown the way its template does: the template's
+// headings at the template's levels, other headings no higher than its highest, its list marker,
+// and one blank line around headings and code blocks. Code blocks are left as they are.
+func compileMarkdownStyle(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	return func(message string, input postProcessInput) (string, error) {
+		style := templateMarkdownStyle(input.Template)
+		var out []string
+		// blank adds a blank line, unless there's one already or it would start the message
+		blank := func() {
+			if len(out) > 0 && out[len(out)-1] != "" {
+				out = append(out, "")
+			}
+		}
+		inFence, blankAfter := false, false
+		for _, line := range strings.Split(message, "\n") {
+			trimmed := strings.TrimSpace(line)
+			fence := strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~")
+			if inFence {
+				out = append(out, line)
+				if fence {
+					inFence, blankAfter = false, true
+				}
+				continue
+			}
+			if trimmed == "" {
+				blank()
+				continue
+			}
+			if blankAfter {
+				blank()
+				blankAfter = false
+			}
+			if fence {
+				blank()
+				out = append(out, line)
+				inFence = true
+				continue
+			}
+
+			// Bold lines and labels are only taken for headings when the template has them
+			name, level, heading := "", 0, false
+			if match := headingLine.FindStringSubmatch(trimmed); match != nil {
+				name, level, heading = strings.TrimSuffix(match[2], ":"), len(match[1]), true
+			} else if match := boldHeadingLine.FindStringSubmatch(trimmed); match != nil {
+				name = strings.TrimSpace(match[1])
+			} else if !bulletLine.MatchString(line) {
+				name = sectionName(line)
+			}
+			if templateLevel, ok := style.levels[strings.ToLower(name)]; ok && name != "" {
+				level, heading = templateLevel, true
+			} else if heading && level < style.top {
+				level = style.top
+			}
+			switch {
+			case heading && level > 0:
+				blank()
+				out = append(out, strings.Repeat("#", level)+" "+name)
+				blankAfter = true
+			case heading:
+				blank()
+				out = append(out, name+":")
+			default:
+				if match := bulletLine.FindStringSubmatchIndex(line); match != nil && !horizontalRule.MatchString(line) {
+					line = line[:match[3]] + style.bullet + line[match[3]+1:]
+				}
+				out = append(out, line)
+			}
+		}
+		return strings.TrimSpace(strings.Join(out, "\n")), nil
+	}, nil
+}
+
+// compileCommandStep runs a program on the message, for shaping gs doesn't do itself. The program
+// must be allowed in exec.allow.
+func compileCommandStep(step PostProcessStep) (func(string, postProcessInput) (string, error), error) {
+	if len(step.Command) == 0 || step.Command[0] == "" {
+		return nil, fmt.Errorf("no command given")
+	}
+	return func(message string, _ postProcessInput) (string, error) {
+		cmd := &Command{Program: step.Command[0], Args: step.Command[1:], Stdin: strings.NewReader(message)}
+		output, err := cmd.Output()
+		if err != nil {
+			return "", err
+		}
+		processed := strings.TrimSpace(string(output))
+		if processed == "" {
+			return "", fmt.Errorf("%s printed nothing", cmd)
+		}
+		return processed, nil
+	}, nil
+}
+
+// runPostProcessCommand runs a file through the configured commit or PR pipeline and prints the
+// result, so teams can check their steps without generating anything
+func runPostProcessCommand(args []string) error {
+	fs := flag.NewFlagSet("postprocess", flag.ExitOnError)
+	pr := fs.Bool("pr", false, "Use the PR pipeline instead of the commit one")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: gs postprocess [-pr] <file>, or - for stdin")
+	}
+	var data []byte
+	if fs.Arg(0) == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(fs.Arg(0))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", fs.Arg(0), err)
+	}
+
+	// Templates that can't be read only leave the markdown-style step without a style to follow
+	template, _ := readTemplate(config.CommitTemplate, "commit")
+	pipeline, input := config.PostProcess.commit, postProcessInput{Budget: config.CommitBudget, Template: template}
+	if *pr {
+		template, _ = readTemplate(config.PRTemplate, "PR")
+		pipeline, input = config.PostProcess.pr, postProcessInput{Template: template}
+	}
+	message, err := postProcess(pipeline, string(data), input)
+	if err != nil {
+		return err
+	}
+	fmt.Println(message)
+	return nil
+}
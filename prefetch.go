@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// prefetchInterval is how often gs prefetch checks whether the staged changes changed
+const prefetchInterval = time.Second
+
+// summaryCacheKey identifies a chunk's summary by everything it's made from, so a changed
+// file, model or prompt is summarized again
+func summaryCacheKey(chunk summaryChunk, llmConfig LLMConfig) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{chatEndpoint(llmConfig), llmConfig.Model, promptVersion, chunk.name, chunk.diff}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedSummary returns the summary of a chunk made before, if it's still cached
+func cachedSummary(chunk summaryChunk, llmConfig LLMConfig) (string, bool) {
+	entry, ok := readCache("summaries", summaryCacheKey(chunk, llmConfig))
+	if !ok || entry.Error != "" {
+		return "", false
+	}
+	var summary string
+	if err := json.Unmarshal(entry.Value, &summary); err != nil || summary == "" {
+		return "", false
+	}
+	return summary, true
+}
+
+// cacheSummary keeps the summary of a chunk for the next run
+func cacheSummary(chunk summaryChunk, llmConfig LLMConfig, summary string) {
+	data, _ := json.Marshal(summary)
+	writeCache("summaries", summaryCacheKey(chunk, llmConfig), data, "")
+}
+
+// prefetchSummaries summarizes the files of a staged diff the way generating its commit message
+// would, so that only the message is left to write. It returns how many files it summarized,
+// none if the diff is small enough to be sent whole.
+func prefetchSummaries(ctx context.Context, diff string, llmConfig LLMConfig) (int, error) {
+	if diff == "" {
+		return 0, nil
+	}
+	llmConfig = selectModel(diff, llmConfig)
+	switch {
+	case usePipeline(diff, llmConfig):
+		llmConfig = withModel(llmConfig, llmConfig.Pipeline.CheapModel)
+	case overflowsContext(diff, llmConfig):
+		if llmConfig.Pipeline.Enabled {
+			llmConfig = withModel(llmConfig, llmConfig.Pipeline.CheapModel)
+		}
+	default:
+		return 0, nil
+	}
+	files := splitDiffByFile(diff)
+	if _, err := summarizeChunks(ctx, fileChunks(files, llmConfig), llmConfig); err != nil {
+		return 0, err
+	}
+	return len(files), nil
+}
+
+// runPrefetchCommand watches the index and summarizes the staged files in the background while
+// the user is still staging, so gs only has to write the message from the summaries
+func runPrefetchCommand(args []string) error {
+	fs := flag.NewFlagSet("prefetch", flag.ExitOnError)
+	model := fs.String("model", "", "Model the commit message will be generated with, as with gs -model")
+	once := fs.Bool("once", false, "Summarize what's staged now and exit instead of watching")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if cacheTTL("summaries") == 0 {
+		return fmt.Errorf("gs prefetch keeps summaries in the cache, which cache.mode or cache.ttl_minutes.summaries turns off")
+	}
+	if err := ensureConsent(false, config); err != nil {
+		return err
+	}
+	config.LLM = config.LLM.withGeneration(config.LLM.Commit.merge(GenerationSettings{Model: *model}))
+	output, err := newCommand("git", "rev-parse", "--git-path", "index").Output()
+	if err != nil {
+		return newError(ErrGitState, "not in a git repository: %v", err)
+	}
+	index := []string{strings.TrimSpace(string(output))}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	if !*once {
+		fmt.Println("Summarizing staged files as they're staged. Press Ctrl-C to stop.")
+	}
+	var stamps map[string]fileStamp
+	for {
+		if current := fileStamps(index); stamps == nil || stampsChanged(stamps, current) {
+			stamps = current
+			err := prefetchStaged(ctx, config)
+			if *once || ctx.Err() != nil {
+				return err
+			}
+			if err != nil {
+				fmt.Println("Error:", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(prefetchInterval):
+		}
+	}
+}
+
+// prefetchStaged summarizes the staged changes and says what it did
+func prefetchStaged(ctx context.Context, config Config) error {
+	diff, err := getStagedDiff()
+	if err != nil {
+		return err
+	}
+	// As gs leaves out vendored code when it generates the message
+	diff = stripVendoredDiff(diff, config.Vendor.Paths)
+	files, err := prefetchSummaries(ctx, diff, config.LLM)
+	switch {
+	case err != nil:
+		return fmt.Errorf("failed to summarize the staged files: %w", err)
+	case files == 0:
+		fmt.Println("The staged changes are small enough to be sent whole, nothing to summarize.")
+	default:
+		fmt.Printf("%d staged files summarized, run gs to write the commit message.\n", files)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PreflightResult is the outcome of one check run before a PR is created
+type PreflightResult struct {
+	Name     string
+	Passed   bool
+	Blocking bool // a failed blocking check prevents PR creation
+	Messages []string
+}
+
+// runPreflightChecks runs the configured checks against the branch
+func runPreflightChecks(targetBranch string, config Config) ([]PreflightResult, error) {
+	Log(INFO, "Running pre-flight checks")
+	var results []PreflightResult
+
+	if config.License.Enabled {
+		result, err := checkLicenseHeaders(targetBranch, config.License)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// printPreflightResults shows the check results and reports whether any blocking check failed
+func printPreflightResults(results []PreflightResult) bool {
+	return printCheckResults("Pre-flight checks", results)
+}
+
+// printCheckResults prints check results under a title and reports whether a blocking check failed
+func printCheckResults(title string, results []PreflightResult) bool {
+	if len(results) == 0 {
+		return false
+	}
+
+	blocked := false
+	banner := "=== " + title + " ==="
+	fmt.Println(banner)
+	for _, result := range results {
+		status := "PASS"
+		if !result.Passed {
+			status = "WARN"
+			if result.Blocking {
+				status = "FAIL"
+				blocked = true
+			}
+		}
+		fmt.Printf("[%s] %s\n", status, result.Name)
+		for _, message := range result.Messages {
+			fmt.Printf("       %s\n", message)
+		}
+	}
+	fmt.Println(strings.Repeat("=", len(banner)))
+	return blocked
+}
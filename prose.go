@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// ProseDiffConfig controls word diffs for changes that are mostly documentation
+type ProseDiffConfig struct {
+	Raw      bool    `json:"raw"`       // always send line diffs
+	MinShare float64 `json:"min_share"` // share of changed lines in prose files that makes a change docs-heavy, default 0.6
+}
+
+// proseDiffNote tells the model how to read word diffs
+const proseDiffNote = `This change is mostly prose. Diffs of prose files are word diffs, with removed words in [-...-] and added words in {+...+}.
+Describe what changed in the content, such as sections rewritten, added or removed, rather than the edited lines.
+
+`
+
+// docsStylePrompt adjusts commit messages for changes that are mostly documentation
+const docsStylePrompt = `This change is mostly documentation. Write the message the way documentation changes are described:
+use the docs type if the message has a type, name the documents or sections changed, and say what content was added,
+rewritten or removed, such as "rewrite the auth section and add a migration guide". Don't describe individual line edits.
+
+`
+
+// isProsePath reports whether the file is prose, whose line diffs are mostly reflowed paragraphs
+func isProsePath(p string) bool {
+	switch strings.ToLower(path.Ext(p)) {
+	case ".md", ".mdx", ".rst", ".adoc", ".txt":
+		return true
+	}
+	return false
+}
+
+// proseHeavy reports whether most of the changed lines are in prose files
+func proseHeavy(files []FileDiff, prose ProseDiffConfig) bool {
+	if prose.Raw {
+		return false
+	}
+	proseLines, total := 0, 0
+	for _, file := range files {
+		total += file.Added + file.Removed
+		if isProsePath(file.Path) {
+			proseLines += file.Added + file.Removed
+		}
+	}
+	return total > 0 && float64(proseLines) >= prose.MinShare*float64(total)
+}
+
+// wordDiff returns a file's diff as a word diff, or its diff when the file was added or deleted,
+// where every word is new or gone anyway
+func wordDiff(file FileDiff) string {
+	match := indexLinePattern.FindStringSubmatch(file.Content)
+	if match == nil || strings.Trim(match[1], "0") == "" || strings.Trim(match[2], "0") == "" {
+		return file.Content
+	}
+	// Paragraphs are usually one line, so one line of context is plenty
+	output, err := newCommand("git", "diff", "--no-color", "--word-diff=plain", "-U1", match[1], match[2]).Output()
+	if err != nil {
+		Log(DEBUG, "Sending the line diff of %s: %v", file.Path, err)
+		return file.Content
+	}
+	hunks := string(output)
+	idx := strings.Index(hunks, "\n@@")
+	if idx == -1 {
+		return file.Content
+	}
+	header := strings.SplitN(file.Content, "\n", 2)[0]
+	return header + "\n" + hunks[idx+1:]
+}
+
+// summarizeProseDiffs replaces the diffs of prose files with word diffs when the change is mostly
+// prose, so the model sees which words changed instead of rewrapped lines
+func summarizeProseDiffs(diff string, prose ProseDiffConfig) string {
+	files := splitDiffByFile(diff)
+	if !proseHeavy(files, prose) {
+		return diff
+	}
+	var sb strings.Builder
+	sb.WriteString(proseDiffNote)
+	for _, file := range files {
+		if isProsePath(file.Path) {
+			file.Content = wordDiff(file)
+		}
+		sb.WriteString(file.Content)
+	}
+	return sb.String()
+}
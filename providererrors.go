@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProviderError is an error response from the chat completions API, with the fields providers
+// use to say what went wrong
+type ProviderError struct {
+	Status     int
+	Type       string
+	Code       string
+	Message    string
+	RetryAfter time.Duration // from the Retry-After header, 0 if not given
+}
+
+func (e *ProviderError) Error() string {
+	if e.Code != "" && !strings.Contains(e.Message, e.Code) {
+		return fmt.Sprintf("API error: %s (%s)", e.Message, e.Code)
+	}
+	return "API error: " + e.Message
+}
+
+// parseProviderError reads an error response. Providers differ: OpenAI and Azure send an error
+// object whose code may be a number, others a bare string or only a status.
+func parseProviderError(status int, header http.Header, body []byte) *ProviderError {
+	providerErr := &ProviderError{Status: status}
+	var payload struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		var object struct {
+			Message string          `json:"message"`
+			Type    string          `json:"type"`
+			Code    json.RawMessage `json:"code"`
+		}
+		if err := json.Unmarshal(payload.Error, &object); err == nil {
+			providerErr.Message, providerErr.Type = object.Message, object.Type
+			providerErr.Code = strings.Trim(string(object.Code), `"`)
+			if providerErr.Code == "null" {
+				providerErr.Code = ""
+			}
+		} else {
+			json.Unmarshal(payload.Error, &providerErr.Message)
+		}
+		if providerErr.Message == "" {
+			providerErr.Message = payload.Message
+		}
+	}
+	if providerErr.Message == "" {
+		providerErr.Message = http.StatusText(status)
+	}
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		providerErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return providerErr
+}
+
+// providerErrorKind maps a provider error to the kind of failure it is
+func providerErrorKind(e *ProviderError) ErrorKind {
+	message := strings.ToLower(e.Message)
+	switch {
+	case e.Code == "insufficient_quota" || e.Type == "insufficient_quota" || strings.Contains(message, "exceeded your current quota") || e.Status == http.StatusPaymentRequired:
+		return ErrQuota
+	case e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden || e.Code == "invalid_api_key" || e.Type == "authentication_error":
+		return ErrAuth
+	case e.Code == "content_filter" || e.Code == "content_policy_violation" || strings.Contains(message, "content management policy"):
+		return ErrContentFilter
+	case e.Code == "context_length_exceeded" || strings.Contains(message, "maximum context length"):
+		return ErrContextOverflow
+	case e.Code == "model_not_found" || e.Type == "not_found_error" || (strings.Contains(message, "model") && (strings.Contains(message, "does not exist") || strings.Contains(message, "not found"))):
+		return ErrInvalidModel
+	case e.Status == http.StatusTooManyRequests || e.Code == "rate_limit_exceeded" || e.Type == "rate_limit_error":
+		return ErrRateLimit
+	case e.Status >= 500 || e.Type == "server_error" || e.Type == "overloaded_error":
+		return ErrProviderUnavailable
+	}
+	return ErrUnknown
+}
+
+// apiError turns an error response from the API into an error of the matching kind
+func apiError(status int, header http.Header, body []byte) error {
+	providerErr := parseProviderError(status, header, body)
+	return &GSError{Kind: providerErrorKind(providerErr), Err: providerErr}
+}
+
+// validateChatResponse checks a successful response has a usable reply. A filtered reply is an
+// error, and one cut off by max_tokens is kept with a warning.
+func validateChatResponse(response ChatResponse, maxTokens int) (string, error) {
+	if len(response.Choices) == 0 {
+		return "", newError(ErrProviderUnavailable, "no response from API")
+	}
+	choice := response.Choices[0]
+	switch choice.FinishReason {
+	case "content_filter":
+		return "", newError(ErrContentFilter, "the provider's content filter blocked the reply")
+	case "length":
+		if choice.Message.Content == "" {
+			return "", newError(ErrContextOverflow, "the reply was cut off before any text, raise llm.max_tokens")
+		}
+		Log(WARN, "The reply was cut off at llm.max_tokens (%d), raise it if the message is incomplete", maxTokens)
+	}
+	if strings.TrimSpace(choice.Message.Content) == "" {
+		return "", newError(ErrProviderUnavailable, "the API returned an empty reply")
+	}
+	return choice.Message.Content, nil
+}
+
+// requestForModel returns a copy of a chat completions request body for another model
+func requestForModel(requestBody interface{}, model string) interface{} {
+	switch body := requestBody.(type) {
+	case ChatRequest:
+		body.Model = model
+		return body
+	case VisionRequest:
+		body.Model = model
+		return body
+	}
+	return requestBody
+}
+
+// requestContext bounds one request to the API by llm.timeout_seconds
+func requestContext(ctx context.Context, config LLMConfig) (context.Context, context.CancelFunc) {
+	if config.TimeoutSeconds <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(config.TimeoutSeconds)*time.Second)
+}
+
+// requestError describes a request that failed before the whole reply arrived, telling a timeout
+// or Ctrl-C apart from a network failure and explaining proxy and certificate failures
+func requestError(ctx context.Context, config LLMConfig, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return newError(ErrProviderUnavailable, "no reply from %s within %ds, raise llm.timeout_seconds or -llm-timeout if the model is slow: %w", config.Model, config.TimeoutSeconds, ctx.Err())
+	case context.Canceled:
+		return newError(ErrCanceled, "request to %s canceled: %w", config.Model, ctx.Err())
+	}
+	return networkHint(err)
+}
+
+// retryChat sends a chat request of about promptTokens tokens, retrying rate limits and outages
+// with backoff, then trying each of llm.fallback_models once for failures another model may not
+// have. Models whose context the prompt doesn't fit are skipped.
+func retryChat(ctx context.Context, config LLMConfig, promptTokens int, send func(LLMConfig) (string, error)) (string, error) {
+	chain, err := allowedModels(fittingModels(modelChain(config), promptTokens))
+	if err != nil {
+		return "", err
+	}
+	for i, candidate := range chain {
+		if err = requireConsent(candidate); err != nil {
+			break
+		}
+		var response string
+		if i == 0 {
+			response, err = retryModel(ctx, candidate, send)
+		} else {
+			response, err = send(candidate)
+		}
+		if err == nil {
+			recordModelUsed(candidate)
+			return response, nil
+		}
+		if !fallsBack(errorKind(err)) || streamed(err) || i == len(chain)-1 {
+			break
+		}
+		Log(WARN, "%s failed: %v. Falling back to %s", candidate.Model, err, chain[i+1].Model)
+	}
+	return "", err
+}
+
+// retryModel sends a chat request to one model, retrying rate limits and outages with backoff.
+// Timeouts aren't retried, as each attempt would add the whole timeout to the wait, and neither
+// are requests that already printed part of their reply.
+func retryModel(ctx context.Context, config LLMConfig, send func(LLMConfig) (string, error)) (string, error) {
+	retries := config.MaxRetries
+	if retries < 0 {
+		retries = 0
+	}
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		var response string
+		if response, err = send(config); err == nil {
+			return response, nil
+		}
+		kind := errorKind(err)
+		if kind != ErrRateLimit && kind != ErrProviderUnavailable || errors.Is(err, context.DeadlineExceeded) || streamed(err) || attempt == retries {
+			break
+		}
+		delay := time.Duration(1<<uint(attempt)) * 2 * time.Second
+		var providerErr *ProviderError
+		if errors.As(err, &providerErr) && providerErr.RetryAfter > 0 {
+			delay = providerErr.RetryAfter
+		}
+		if delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+		Log(WARN, "%v, retrying in %s", err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", newError(ErrCanceled, "request to %s canceled: %w", config.Model, ctx.Err())
+		}
+	}
+	return "", err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// llmClients holds a client for each TLS setup, so connections to the provider are reused
+var llmClients sync.Map
+
+// loadCABundle returns the system CAs with the certificates of a PEM file added
+func loadCABundle(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(expandPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read llm.ca_bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("llm.ca_bundle %s has no PEM certificates", path)
+	}
+	return pool, nil
+}
+
+// llmHTTPClient returns the client requests to the provider are sent with. Like every client in
+// gs it goes through the proxy in HTTPS_PROXY or HTTP_PROXY unless NO_PROXY names the host, and
+// it also trusts llm.ca_bundle, for proxies that intercept TLS.
+func llmHTTPClient(config LLMConfig) (*http.Client, error) {
+	if config.CABundle == "" && !config.SkipTLSVerify {
+		return http.DefaultClient, nil
+	}
+	key := fmt.Sprintf("%s|%t", config.CABundle, config.SkipTLSVerify)
+	if client, ok := llmClients.Load(key); ok {
+		return client.(*http.Client), nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.SkipTLSVerify}
+	if config.CABundle != "" {
+		pool, err := loadCABundle(config.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.SkipTLSVerify {
+		Log(WARN, "llm.insecure_skip_verify is set, not checking the certificate of %s", chatEndpoint(config))
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client, _ := llmClients.LoadOrStore(key, &http.Client{Transport: transport})
+	return client.(*http.Client), nil
+}
+
+// networkHint explains the failures to reach the provider that come from the network between, such
+// as a proxy that intercepts TLS with a certificate the system doesn't trust
+func networkHint(err error) error {
+	var unknownAuthority x509.UnknownAuthorityError
+	var verification *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &unknownAuthority) || errors.As(err, &verification):
+		return fmt.Errorf("%w. If a proxy on your network intercepts TLS, set llm.ca_bundle to a PEM file of its CA certificate", err)
+	case strings.Contains(err.Error(), "proxyconnect"):
+		return fmt.Errorf("%w. Check the proxy in HTTPS_PROXY or HTTP_PROXY, or add the provider's host to NO_PROXY", err)
+	}
+	return err
+}
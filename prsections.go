@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// PRExtras is what deterministic analysis of the branch adds to a PR on top of the generated description
+type PRExtras struct {
+	Sections  []string
+	Reviewers []string
+	Labels    []string
+	FollowUps []FollowUp
+}
+
+// buildPRExtras runs the enabled branch analyses and collects their sections, reviewers and labels
+func buildPRExtras(ctx context.Context, targetBranch string, commits string, config Config) (PRExtras, error) {
+	var extras PRExtras
+
+	if config.PRGraph.Enabled {
+		section, err := buildCommitGraphSection(targetBranch, config.PRGraph)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if config.Architecture.Enabled {
+		section, err := buildArchitectureImpact(targetBranch, config.Architecture)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if len(config.SizeReport.Command) > 0 {
+		section, err := buildSizeReportSection(targetBranch, config.SizeReport)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if len(config.Benchmarks.Packages) > 0 || config.Benchmarks.BenchstatFile != "" {
+		section, err := buildBenchmarkSection(targetBranch, config.Benchmarks)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if config.ReviewEffort.Enabled {
+		section, err := buildReviewEffortSection(targetBranch, config.ReviewEffort, config.Vendor.Paths)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if config.Vendor.SummarizeUpstream {
+		section, err := buildUpstreamChangesSection(ctx, targetBranch, config.Vendor, config.LLM)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if config.Toolchain.Enabled {
+		section, err := buildToolchainUpgradeSection(ctx, targetBranch, commits, config.Vendor.Paths, config.LLM)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if config.Infra.Enabled {
+		section, err := buildInfraSection(ctx, targetBranch, commits, config.Infra, config.LLM)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if config.FollowUps.Enabled {
+		if err := applyFollowUps(targetBranch, config.FollowUps, config.Vendor.Paths, &extras); err != nil {
+			return extras, err
+		}
+	}
+
+	if config.Owners.Enabled {
+		section, err := buildApprovalPreview(targetBranch, config.Owners)
+		if err != nil {
+			return extras, err
+		}
+		extras.addSection(section)
+	}
+
+	if len(config.Security.Paths) > 0 {
+		if err := applySecurityEscalation(targetBranch, config.Security, &extras); err != nil {
+			return extras, err
+		}
+	}
+
+	return extras, nil
+}
+
+// addSection appends a section, ignoring empty ones
+func (e *PRExtras) addSection(section string) {
+	if section != "" {
+		e.Sections = append(e.Sections, section)
+	}
+}
+
+// appendSections adds the sections to the end of the message, separated by blank lines
+func appendSections(message string, sections []string) string {
+	if len(sections) == 0 {
+		return message
+	}
+	return strings.TrimRight(message, "\n") + "\n\n" + strings.Join(sections, "\n\n")
+}
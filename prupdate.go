@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// bodyDiffContext is how many unchanged lines are shown around each change to a PR body
+const bodyDiffContext = 3
+
+// maxBodyDiffCells bounds the table used to diff two PR bodies. Larger bodies are shown as
+// entirely replaced.
+const maxBodyDiffCells = 4000000
+
+// BranchPullRequest is the PR of the current branch, as gh pr view reports it
+type BranchPullRequest struct {
+	URL   string `json:"url"`
+	Body  string `json:"body"`
+	State string `json:"state"`
+}
+
+// bodyDiffLine is one line of the diff between two PR bodies: ' ' kept, '-' removed, '+' added
+type bodyDiffLine struct {
+	op   byte
+	text string
+}
+
+// openPullRequestForBranch returns the open PR of the current branch, if it has one
+func openPullRequestForBranch() (BranchPullRequest, bool) {
+	var pr BranchPullRequest
+	if requireNetwork("looking up the branch's PR") != nil || !programAvailable("gh") {
+		return pr, false
+	}
+	output, err := newCommand("gh", "pr", "view", "--json", "url,body,state").Output()
+	if err != nil {
+		Log(DEBUG, "The current branch has no PR: %v", err)
+		return pr, false
+	}
+	if err := json.Unmarshal(output, &pr); err != nil {
+		Log(WARN, "Failed to parse gh pr view output: %v", err)
+		return pr, false
+	}
+	return pr, pr.State == "OPEN"
+}
+
+// bodyLines splits a PR body into lines, ignoring the carriage returns GitHub keeps from browsers
+func bodyLines(body string) []string {
+	body = strings.TrimRight(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	if body == "" {
+		return nil
+	}
+	return strings.Split(body, "\n")
+}
+
+// diffBodyLines returns the line diff between two bodies, from their longest common subsequence
+func diffBodyLines(a []string, b []string) []bodyDiffLine {
+	var diff []bodyDiffLine
+	if len(a)*len(b) > maxBodyDiffCells {
+		for _, line := range a {
+			diff = append(diff, bodyDiffLine{'-', line})
+		}
+		for _, line := range b {
+			diff = append(diff, bodyDiffLine{'+', line})
+		}
+		return diff
+	}
+	// common[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			diff = append(diff, bodyDiffLine{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || common[i+1][j] >= common[i][j+1]):
+			diff = append(diff, bodyDiffLine{'-', a[i]})
+			i++
+		default:
+			diff = append(diff, bodyDiffLine{'+', b[j]})
+			j++
+		}
+	}
+	return diff
+}
+
+// renderBodyDiff shows how the proposed body differs from the current one, with a few lines of
+// context around each change, in red and green when color is set
+func renderBodyDiff(current string, proposed string, color bool) string {
+	diff := diffBodyLines(bodyLines(current), bodyLines(proposed))
+	show := make([]bool, len(diff))
+	removed, added := 0, 0
+	for i, line := range diff {
+		if line.op == ' ' {
+			continue
+		}
+		if line.op == '-' {
+			removed++
+		} else {
+			added++
+		}
+		for k := i - bodyDiffContext; k <= i+bodyDiffContext; k++ {
+			if k >= 0 && k < len(diff) {
+				show[k] = true
+			}
+		}
+	}
+
+	paint := func(code string, text string) string {
+		if !color {
+			return text
+		}
+		return "\033[" + code + "m" + text + "\033[0m"
+	}
+	var sb strings.Builder
+	for i, line := range diff {
+		if !show[i] {
+			if i > 0 && show[i-1] {
+				sb.WriteString(paint("36", "   ...") + "\n")
+			}
+			continue
+		}
+		switch line.op {
+		case '-':
+			sb.WriteString(paint("31", "-  "+line.text) + "\n")
+		case '+':
+			sb.WriteString(paint("32", "+  "+line.text) + "\n")
+		default:
+			sb.WriteString("   " + line.text + "\n")
+		}
+	}
+	sb.WriteString(fmt.Sprintf("\n%d lines removed, %d added.\n", removed, added))
+	return sb.String()
+}
+
+// colorOutput reports whether stdout is a terminal that colors should be used on
+func colorOutput() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmBodyUpdate shows what replacing the PR's body would change and asks whether to go ahead,
+// so nothing someone wrote in the description by hand is lost unseen. yes skips the question.
+func confirmBodyUpdate(pr BranchPullRequest, proposed string, yes bool) (bool, error) {
+	if strings.Join(bodyLines(pr.Body), "\n") == strings.Join(bodyLines(proposed), "\n") {
+		fmt.Printf("The description of %s is already up to date.\n", pr.URL)
+		return false, nil
+	}
+	fmt.Printf("%s already has a description. Replacing it changes:\n\n", pr.URL)
+	fmt.Print(renderBodyDiff(pr.Body, proposed, colorOutput()))
+	if yes {
+		return true, nil
+	}
+	if info, err := os.Stdin.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false, fmt.Errorf("not replacing the description of %s without confirmation; run with -yes to replace it", pr.URL)
+	}
+	fmt.Print("Replace the description? [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(answer)) == "y", nil
+}
+
+// updateOpenPullRequest replaces the body of the branch's open PR with the message in
+// prMessageFile once the user confirms, pushing the branch and adding the extras' reviewers and
+// labels. It returns false if the description was left as it was.
+func updateOpenPullRequest(pr BranchPullRequest, prMessageFile string, extras PRExtras, yes bool) (bool, error) {
+	proposed, err := ioutil.ReadFile(prMessageFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read PR message: %v", err)
+	}
+	if ok, err := confirmBodyUpdate(pr, string(proposed), yes); !ok || err != nil {
+		return false, err
+	}
+	if _, err := pushCurrentBranch(); err != nil {
+		return false, err
+	}
+
+	Log(INFO, "Updating body of %s", pr.URL)
+	args := []string{"pr", "edit", pr.URL, "--body-file", prMessageFile}
+	if len(extras.Reviewers) > 0 {
+		args = append(args, "--add-reviewer", strings.Join(extras.Reviewers, ","))
+	}
+	if len(extras.Labels) > 0 {
+		args = append(args, "--add-label", strings.Join(extras.Labels, ","))
+	}
+	if err := newCommand("gh", args...).Run(); err != nil {
+		Log(ERROR, "Failed to update PR body: %v", err)
+		return false, fmt.Errorf("failed to update PR body: %v", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// QueueConfig controls the background job queue of server mode
+type QueueConfig struct {
+	Workers     int `json:"workers"`      // jobs processed concurrently, default 2
+	Capacity    int `json:"capacity"`     // jobs waiting before deliveries are rejected, default 100
+	MaxAttempts int `json:"max_attempts"` // attempts per job including the first, default 3
+	RetryDelay  int `json:"retry_delay"`  // seconds before the first retry, doubled for each further one; default 10
+}
+
+// errQueueFull is returned when there's no room for another job
+var errQueueFull = errors.New("job queue is full")
+
+// job is a webhook delivery waiting to be processed
+type job struct {
+	Delivery string
+	Event    WebhookPullRequestEvent
+	Attempt  int
+}
+
+// jobQueue decouples receiving deliveries from processing them. The in-memory queue is used
+// by default; a queue backed by an external service such as SQS or Redis can implement this
+// to share work between replicas.
+type jobQueue interface {
+	// Enqueue adds a job, returning errQueueFull if the queue is at capacity
+	Enqueue(j job) error
+	// Start processes jobs with handle on the configured number of workers
+	Start(handle func(j job))
+	// Close stops taking jobs. Jobs already queued are still processed.
+	Close()
+}
+
+// memoryQueue is a bounded in-process job queue
+type memoryQueue struct {
+	jobs    chan job
+	workers int
+	once    sync.Once
+}
+
+// newMemoryQueue creates an in-memory queue with the configured capacity and workers
+func newMemoryQueue(config QueueConfig) *memoryQueue {
+	return &memoryQueue{jobs: make(chan job, config.Capacity), workers: config.Workers}
+}
+
+func (q *memoryQueue) Enqueue(j job) (err error) {
+	// Sending on a closed channel panics, which means we're shutting down
+	defer func() {
+		if recover() != nil {
+			err = errQueueFull
+		}
+	}()
+	select {
+	case q.jobs <- j:
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (q *memoryQueue) Start(handle func(j job)) {
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			defer recoverCrash()
+			for j := range q.jobs {
+				handle(j)
+			}
+		}()
+	}
+}
+
+func (q *memoryQueue) Close() {
+	q.once.Do(func() {
+		close(q.jobs)
+	})
+}
+
+// retryable reports whether a failed job is worth trying again. Configuration and
+// authentication problems won't fix themselves.
+func retryable(err error) bool {
+	switch errorKind(err) {
+	case ErrRateLimit, ErrProviderUnavailable, ErrUnknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryDelay is how long to wait before the given attempt, doubling each time
+func retryDelay(config QueueConfig, attempt int) time.Duration {
+	delay := time.Duration(config.RetryDelay) * time.Second
+	for i := 2; i < attempt; i++ {
+		delay *= 2
+	}
+	return delay
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// getRangeDiff compares two versions of a branch with git range-diff. With a base, both versions
+// are taken as the commits since base; otherwise since the merge base of the two heads.
+func getRangeDiff(base string, oldHead string, newHead string, patches bool) (string, error) {
+	args := []string{"range-diff", "--no-color"}
+	if !patches {
+		args = append(args, "--no-patch")
+	}
+	if base != "" {
+		args = append(args, base, oldHead, newHead)
+	} else {
+		args = append(args, oldHead+"..."+newHead)
+	}
+	output, err := newCommand("git", args...).Output()
+	if err != nil {
+		Log(ERROR, "Failed to run range-diff: %v", err)
+		return "", newError(ErrGitState, "failed to compare %s and %s (fetch the old head first if it was force-pushed away): %v", oldHead, newHead, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// runRangeDiffCommand posts a comment summarizing what changed between two versions of a PR's
+// branch after a rebase or force-push
+func runRangeDiffCommand(args []string) error {
+	fs := flag.NewFlagSet("rangediff", flag.ExitOnError)
+	prNumber := fs.Int("pr", 0, "Number of the pull request (default: the one for the current branch)")
+	base := fs.String("base", "", "Base both versions were built on (default: the merge base of the two heads)")
+	dryRun := fs.Bool("dry-run", false, "Print the generated comment without posting it")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: gs rangediff [-pr <number>] [-base <ref>] <old-head> <new-head>")
+	}
+	oldHead, newHead := fs.Arg(0), fs.Arg(1)
+
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	if *prNumber <= 0 {
+		if *prNumber, err = currentPullRequestNumber(); err != nil {
+			return err
+		}
+	}
+	pr, err := getPullRequest(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+
+	// Without file contents, the pairing of old and new commits is all that can be sent
+	rangeDiff, err := getRangeDiff(*base, oldHead, newHead, !config.LLM.LocalContextOnly)
+	if err != nil {
+		return err
+	}
+	if rangeDiff == "" {
+		fmt.Printf("%s and %s have the same commits.\n", oldHead, newHead)
+		return nil
+	}
+	Log(DEBUG, "Range diff is %d bytes", len(rangeDiff))
+
+	fmt.Println("Summarizing changes between the two versions...")
+	ctx, stop := interruptContext()
+	defer stop()
+	comment, err := GenerateRangeDiffSummary(ctx, pr, rangeDiff, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to summarize range diff: %w", err)
+	}
+	comment = fmt.Sprintf("%s\n\n<sub>Compared %s with %s.</sub>", comment, shortRef(oldHead), shortRef(newHead))
+
+	if *dryRun {
+		fmt.Println("=== Generated Comment (Dry Run) ===")
+		fmt.Println(comment)
+		fmt.Println("===================================")
+		return nil
+	}
+
+	url, err := postIssueComment(repo, *prNumber, comment)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Comment posted:", url)
+	return nil
+}
+
+// shortRef abbreviates a commit SHA, leaving branch and tag names as they are
+func shortRef(ref string) string {
+	if len(ref) == 40 && strings.Trim(ref, "0123456789abcdef") == "" {
+		return ref[:7]
+	}
+	return ref
+}
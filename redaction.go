@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactionConfig is the policy every prompt is checked against before it's sent to a provider
+type RedactionConfig struct {
+	Packs []string        `json:"packs"` // built-in packs (secrets, pci, hipaa) or paths to pack files
+	Rules []RedactionRule `json:"rules"` // rules of this config only
+
+	policy *RedactionPolicy // compiled when the config is loaded
+}
+
+// RedactionPack is a named set of rules, written by a security team and shared as a JSON file
+type RedactionPack struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Rules       []RedactionRule `json:"rules"`
+}
+
+// RedactionRule matches sensitive text in a prompt, by a regular expression or a list of terms
+type RedactionRule struct {
+	Name        string   `json:"name"`
+	Pattern     string   `json:"pattern"`     // Go regular expression
+	Terms       []string `json:"terms"`       // whole words, ignoring case, such as internal codenames
+	Validate    string   `json:"validate"`    // "luhn" only matches numbers with a valid card check digit
+	Action      string   `json:"action"`      // "redact" (default) replaces matches, "block" refuses to send the prompt
+	Replacement string   `json:"replacement"` // default [REDACTED:<name>], $1 and so on insert groups of pattern
+}
+
+// RedactionPolicy is the compiled rules of every pack, in order
+type RedactionPolicy struct {
+	rules []compiledRedactionRule
+}
+
+type compiledRedactionRule struct {
+	RedactionRule
+	pack    string
+	pattern *regexp.Regexp
+}
+
+// RedactionHit is how often a rule matched a prompt
+type RedactionHit struct {
+	Pack    string
+	Rule    string
+	Count   int
+	Blocked bool
+}
+
+// redactionPolicy is the policy of the loaded config, nil when there are no rules
+var redactionPolicy *RedactionPolicy
+
+// builtinRedactionPacks are the packs that ship with GitScribe
+var builtinRedactionPacks = map[string]RedactionPack{
+	"secrets": {Name: "secrets", Description: "API keys, tokens, private keys and passwords", Rules: []RedactionRule{
+		{Name: "private-key", Pattern: `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+		{Name: "openai-key", Pattern: `sk-[A-Za-z0-9_-]{20,}`},
+		{Name: "github-token", Pattern: `gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,}`},
+		{Name: "aws-access-key", Pattern: `\b(AKIA|ASIA)[0-9A-Z]{16}\b`},
+		{Name: "slack-token", Pattern: `xox[abposr]-[A-Za-z0-9-]{10,}`},
+		{Name: "assigned-secret", Pattern: `(?i)((?:password|passwd|secret|api[_-]?key|access[_-]?token)["']?\s*[:=]\s*["']?)[^\s"',;]{8,}`, Replacement: "${1}[REDACTED:assigned-secret]"},
+	}},
+	"pci": {Name: "pci", Description: "Payment card data (PCI DSS)", Rules: []RedactionRule{
+		{Name: "card-number", Pattern: `\b\d(?:[ -]?\d){12,18}\b`, Validate: "luhn"},
+		{Name: "card-security-code", Pattern: `(?i)(\b(?:cvv2?|cvc2?|card security code)["']?\s*[:=]?\s*["']?)\d{3,4}\b`, Replacement: "${1}[REDACTED:card-security-code]"},
+	}},
+	"hipaa": {Name: "hipaa", Description: "Identifiers of protected health information (HIPAA)", Rules: []RedactionRule{
+		{Name: "ssn", Pattern: `\b\d{3}-\d{2}-\d{4}\b`},
+		{Name: "medical-record-number", Pattern: `(?i)(\b(?:MRN|medical record (?:number|no\.?))\s*[:#]?\s*)[A-Z0-9-]{5,}`, Replacement: "${1}[REDACTED:medical-record-number]"},
+		{Name: "date-of-birth", Pattern: `(?i)(\b(?:DOB|date of birth|birth ?date)["']?\s*[:=]?\s*["']?)\d{1,4}[-/.]\d{1,2}[-/.]\d{1,4}`, Replacement: "${1}[REDACTED:date-of-birth]"},
+		{Name: "email", Pattern: `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`},
+		{Name: "phone", Pattern: `(?:\+1[ .-]?)?\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b`},
+	}},
+}
+
+// loadRedactionPack returns a built-in pack by name or reads a pack file
+func loadRedactionPack(name string) (RedactionPack, error) {
+	if pack, ok := builtinRedactionPacks[name]; ok {
+		return pack, nil
+	}
+	var pack RedactionPack
+	data, err := ioutil.ReadFile(expandPath(name))
+	if err != nil {
+		return pack, fmt.Errorf("redaction pack %s is neither built in (secrets, pci, hipaa) nor a readable file: %v", name, err)
+	}
+	if err := json.Unmarshal(data, &pack); err != nil {
+		return pack, fmt.Errorf("failed to parse redaction pack %s: %v", name, err)
+	}
+	if pack.Name == "" {
+		pack.Name = name
+	}
+	return pack, nil
+}
+
+// compileRedactionRule checks a rule and compiles its pattern or terms
+func compileRedactionRule(pack string, rule RedactionRule) (compiledRedactionRule, error) {
+	compiled := compiledRedactionRule{RedactionRule: rule, pack: pack}
+	if rule.Name == "" {
+		return compiled, fmt.Errorf("a rule of redaction pack %s has no name", pack)
+	}
+	expression := rule.Pattern
+	if len(rule.Terms) > 0 {
+		if expression != "" {
+			return compiled, fmt.Errorf("redaction rule %s/%s has both a pattern and terms, use one", pack, rule.Name)
+		}
+		quoted := make([]string, len(rule.Terms))
+		for i, term := range rule.Terms {
+			quoted[i] = regexp.QuoteMeta(term)
+		}
+		expression = `(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`
+	}
+	if expression == "" {
+		return compiled, fmt.Errorf("redaction rule %s/%s needs a pattern or terms", pack, rule.Name)
+	}
+	var err error
+	if compiled.pattern, err = regexp.Compile(expression); err != nil {
+		return compiled, fmt.Errorf("redaction rule %s/%s has an invalid pattern: %v", pack, rule.Name, err)
+	}
+	switch rule.Action {
+	case "":
+		compiled.Action = "redact"
+	case "redact", "block":
+	default:
+		return compiled, fmt.Errorf("redaction rule %s/%s has unknown action %q: use redact or block", pack, rule.Name, rule.Action)
+	}
+	if rule.Validate != "" && rule.Validate != "luhn" {
+		return compiled, fmt.Errorf("redaction rule %s/%s has unknown validate %q: use luhn", pack, rule.Name, rule.Validate)
+	}
+	if compiled.Replacement == "" {
+		compiled.Replacement = "[REDACTED:" + rule.Name + "]"
+	}
+	return compiled, nil
+}
+
+// compileRedactionPolicy loads the configured packs and compiles their rules, then the config's
+// own. It returns nil if there are none.
+func compileRedactionPolicy(config RedactionConfig) (*RedactionPolicy, error) {
+	policy := &RedactionPolicy{}
+	packs := make([]RedactionPack, 0, len(config.Packs)+1)
+	for _, name := range config.Packs {
+		pack, err := loadRedactionPack(name)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, pack)
+	}
+	packs = append(packs, RedactionPack{Name: "config", Rules: config.Rules})
+	for _, pack := range packs {
+		for _, rule := range pack.Rules {
+			compiled, err := compileRedactionRule(pack.Name, rule)
+			if err != nil {
+				return nil, err
+			}
+			policy.rules = append(policy.rules, compiled)
+		}
+	}
+	if len(policy.rules) == 0 {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// luhnValid reports whether the digits in s have a valid Luhn check digit, as card numbers do
+func luhnValid(s string) bool {
+	sum, digits := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		if s[i] < '0' || s[i] > '9' {
+			continue
+		}
+		d := int(s[i] - '0')
+		if digits%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
+
+// Apply runs the rules over text in order and returns it redacted, with the rules that matched.
+// A hit with Blocked set means the text mustn't be sent at all.
+func (p *RedactionPolicy) Apply(text string) (string, []RedactionHit) {
+	if p == nil {
+		return text, nil
+	}
+	var hits []RedactionHit
+	for _, rule := range p.rules {
+		count := 0
+		text = rule.pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.Validate == "luhn" && !luhnValid(match) {
+				return match
+			}
+			count++
+			if rule.Action == "block" {
+				return match
+			}
+			groups := rule.pattern.FindStringSubmatchIndex(match)
+			return string(rule.pattern.ExpandString(nil, rule.Replacement, match, groups))
+		})
+		if count > 0 {
+			hits = append(hits, RedactionHit{Pack: rule.pack, Rule: rule.Name, Count: count, Blocked: rule.Action == "block"})
+		}
+	}
+	return text, hits
+}
+
+// describeRedactionHits lists hits as pack/rule (count)
+func describeRedactionHits(hits []RedactionHit) string {
+	parts := make([]string, len(hits))
+	for i, hit := range hits {
+		parts[i] = fmt.Sprintf("%s/%s (%d)", hit.Pack, hit.Rule, hit.Count)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// redactText applies the loaded policy to one part of a prompt, failing if a block rule matched
+func redactText(text string, hits *[]RedactionHit) (string, error) {
+	redacted, found := redactionPolicy.Apply(text)
+	for _, hit := range found {
+		if hit.Blocked {
+			return "", newError(ErrPolicyBlocked, "the prompt matches redaction rule %s/%s, which blocks sending it to the provider", hit.Pack, hit.Rule)
+		}
+	}
+	*hits = append(*hits, found...)
+	return redacted, nil
+}
+
+// redactMessages returns the messages with the loaded redaction policy applied
+func redactMessages(messages []ChatMessage) ([]ChatMessage, error) {
+	if redactionPolicy == nil {
+		return messages, nil
+	}
+	var hits []RedactionHit
+	redacted := make([]ChatMessage, len(messages))
+	for i, message := range messages {
+		var err error
+		redacted[i] = message
+		if redacted[i].Content, err = redactText(message.Content, &hits); err != nil {
+			return nil, err
+		}
+	}
+	if len(hits) > 0 {
+		Log(INFO, "Redacted %s from the prompt", describeRedactionHits(hits))
+	}
+	return redacted, nil
+}
+
+// redactRequest returns a copy of a chat completions request body with the loaded redaction
+// policy applied to its text
+func redactRequest(requestBody interface{}) (interface{}, error) {
+	if redactionPolicy == nil {
+		return requestBody, nil
+	}
+	switch body := requestBody.(type) {
+	case ChatRequest:
+		messages, err := redactMessages(body.Messages)
+		body.Messages = messages
+		return body, err
+	case VisionRequest:
+		var hits []RedactionHit
+		messages := make([]VisionMessage, len(body.Messages))
+		for i, message := range body.Messages {
+			messages[i] = VisionMessage{Role: message.Role, Content: append([]ContentPart(nil), message.Content...)}
+			for j := range messages[i].Content {
+				var err error
+				if messages[i].Content[j].Text, err = redactText(messages[i].Content[j].Text, &hits); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(hits) > 0 {
+			Log(INFO, "Redacted %s from the prompt", describeRedactionHits(hits))
+		}
+		body.Messages = messages
+		return body, nil
+	}
+	return nil, fmt.Errorf("can't apply the redaction policy to a %T request", requestBody)
+}
+
+// runRedactCommand lists the rules of the configured policy or shows what it does to a file, so
+// security teams can check their packs before rolling them out
+func runRedactCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gs redact list|test")
+	}
+	fs := flag.NewFlagSet("redact "+args[0], flag.ExitOnError)
+	var packs stringListFlag
+	fs.Var(&packs, "pack", "Use this pack instead of the configured policy (can be repeated)")
+	config, err := parseCommandFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	policy := config.Redaction.policy
+	if len(packs) > 0 {
+		if policy, err = compileRedactionPolicy(RedactionConfig{Packs: packs}); err != nil {
+			return err
+		}
+	}
+
+	switch args[0] {
+	case "list":
+		if policy == nil {
+			fmt.Println("No redaction rules are configured. Add packs under redaction.packs.")
+			return nil
+		}
+		for _, rule := range policy.rules {
+			fmt.Printf("%s/%s: %s %s\n", rule.pack, rule.Name, rule.Action, rule.pattern)
+		}
+		names := make([]string, 0, len(builtinRedactionPacks))
+		for name := range builtinRedactionPacks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Println("\nBuilt-in packs:", strings.Join(names, ", "))
+		return nil
+	case "test":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: gs redact test [-pack <pack>] <file>, or - for stdin")
+		}
+		var data []byte
+		if fs.Arg(0) == "-" {
+			data, err = ioutil.ReadAll(os.Stdin)
+		} else {
+			data, err = ioutil.ReadFile(fs.Arg(0))
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", fs.Arg(0), err)
+		}
+		redacted, hits := policy.Apply(string(data))
+		fmt.Print(redacted)
+		fmt.Fprintln(os.Stderr)
+		if len(hits) == 0 {
+			fmt.Fprintln(os.Stderr, "No rules matched.")
+			return nil
+		}
+		for _, hit := range hits {
+			action := "redacted"
+			if hit.Blocked {
+				action = "blocks sending"
+			}
+			fmt.Fprintf(os.Stderr, "%s/%s: %d matches, %s\n", hit.Pack, hit.Rule, hit.Count, action)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown redact command %q: use list or test", args[0])
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRedactionPolicyApply(t *testing.T) {
+	policy, err := compileRedactionPolicy(RedactionConfig{
+		Packs: []string{"secrets", "pci"},
+		Rules: []RedactionRule{
+			{Name: "codename", Terms: []string{"Bluebird"}},
+			{Name: "export-control", Pattern: `ITAR-\d+`, Action: "block"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		text string
+		want string
+		hits []RedactionHit
+	}{
+		{
+			name: "nothing to redact",
+			text: "Fix the retry loop",
+			want: "Fix the retry loop",
+		},
+		{
+			name: "api key",
+			text: "key := \"sk-abcdefghijklmnopqrstuvwx\"",
+			want: "key := \"[REDACTED:openai-key]\"",
+			hits: []RedactionHit{{Pack: "secrets", Rule: "openai-key", Count: 1}},
+		},
+		{
+			name: "assigned secret keeps its name",
+			text: "password = hunter2hunter2",
+			want: "password = [REDACTED:assigned-secret]",
+			hits: []RedactionHit{{Pack: "secrets", Rule: "assigned-secret", Count: 1}},
+		},
+		{
+			name: "card numbers only with a valid check digit",
+			text: "paid with 4111 1111 1111 1111, order 4111 1111 1111 1112",
+			want: "paid with [REDACTED:card-number], order 4111 1111 1111 1112",
+			hits: []RedactionHit{{Pack: "pci", Rule: "card-number", Count: 1}},
+		},
+		{
+			name: "terms are whole words ignoring case",
+			text: "Ship BLUEBIRD, not bluebirds",
+			want: "Ship [REDACTED:codename], not bluebirds",
+			hits: []RedactionHit{{Pack: "config", Rule: "codename", Count: 1}},
+		},
+		{
+			name: "block leaves the text and reports it",
+			text: "Covered by ITAR-1234",
+			want: "Covered by ITAR-1234",
+			hits: []RedactionHit{{Pack: "config", Rule: "export-control", Count: 1, Blocked: true}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, hits := policy.Apply(test.text)
+			if got != test.want {
+				t.Errorf("Apply(%q) = %q, want %q", test.text, got, test.want)
+			}
+			if !reflect.DeepEqual(hits, test.hits) {
+				t.Errorf("Apply(%q) hits = %+v, want %+v", test.text, hits, test.hits)
+			}
+		})
+	}
+}
+
+func TestRedactTextBlocks(t *testing.T) {
+	policy, err := compileRedactionPolicy(RedactionConfig{Rules: []RedactionRule{{Name: "secret-project", Terms: []string{"Nightjar"}, Action: "block"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := redactionPolicy
+	redactionPolicy = policy
+	defer func() { redactionPolicy = previous }()
+
+	var hits []RedactionHit
+	if _, err := redactText("Rename the Nightjar flag", &hits); errorKind(err) != ErrPolicyBlocked {
+		t.Errorf("redactText of a blocked term = %v, want a policy_blocked error", err)
+	}
+	if text, err := redactText("Rename the flag", &hits); err != nil || text != "Rename the flag" {
+		t.Errorf("redactText = %q, %v, want the text unchanged", text, err)
+	}
+}
+
+func TestCompileRedactionRuleErrors(t *testing.T) {
+	tests := []struct {
+		rule RedactionRule
+		want string
+	}{
+		{RedactionRule{Pattern: "x"}, "has no name"},
+		{RedactionRule{Name: "r"}, "needs a pattern or terms"},
+		{RedactionRule{Name: "r", Pattern: "x", Terms: []string{"y"}}, "both a pattern and terms"},
+		{RedactionRule{Name: "r", Pattern: "("}, "invalid pattern"},
+		{RedactionRule{Name: "r", Pattern: "x", Action: "drop"}, "unknown action"},
+		{RedactionRule{Name: "r", Pattern: "x", Validate: "iban"}, "unknown validate"},
+	}
+	for _, test := range tests {
+		if _, err := compileRedactionRule("test", test.rule); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("compileRedactionRule(%+v) = %v, want an error containing %q", test.rule, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TemplatePack pins a template pack installed from a registry
+type TemplatePack struct {
+	Name     string `json:"name"`
+	Registry string `json:"registry"`
+	Version  string `json:"version"` // the pack's tag, or the registry commit for untagged packs
+	Commit   string `json:"commit"`
+}
+
+// TemplatePackInfo is the pack.json of a template pack, naming its templates relative to the pack
+type TemplatePackInfo struct {
+	Description    string         `json:"description"`
+	CommitTemplate string         `json:"commit_template"`
+	PRTemplate     string         `json:"pr_template"`
+	AreaTemplates  []AreaTemplate `json:"pr_area_templates"`
+}
+
+// files returns the template files of the pack
+func (info TemplatePackInfo) files() []string {
+	var files []string
+	for _, file := range []string{info.CommitTemplate, info.PRTemplate} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	for _, area := range info.AreaTemplates {
+		files = append(files, area.Template)
+	}
+	return files
+}
+
+// registryCache fetches a registry into a bare clone under ~/.gitscribe/registries and returns
+// its directory. A clone fetched within the cache's registry TTL is used as it is unless fresh is
+// set.
+func registryCache(url string, fresh bool) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %v", err)
+	}
+	sum := sha256.Sum256([]byte(url))
+	dir := filepath.Join(home, ".gitscribe", "registries", hex.EncodeToString(sum[:6]))
+	if _, err := os.Stat(dir); err != nil {
+		Log(INFO, "Cloning template registry %s", url)
+		if err := newCommand("git", "clone", "--quiet", "--bare", url, dir).Run(); err != nil {
+			return "", fmt.Errorf("failed to clone template registry %s: %v", url, err)
+		}
+		writeCache("registry", url, json.RawMessage("true"), "")
+		return dir, nil
+	}
+	if _, ok := readCache("registry", url); ok && !fresh {
+		return dir, nil
+	}
+	Log(INFO, "Fetching template registry %s", url)
+	if err := newCommand("git", "-C", dir, "fetch", "--quiet", "--force", "--tags", "--prune", "origin", "+refs/heads/*:refs/heads/*").Run(); err != nil {
+		return "", fmt.Errorf("failed to fetch template registry %s: %v", url, err)
+	}
+	writeCache("registry", url, json.RawMessage("true"), "")
+	return dir, nil
+}
+
+// registryFile reads a file from a registry at a commit
+func registryFile(dir string, rev string, p string) ([]byte, error) {
+	return newCommand("git", "-C", dir, "show", rev+":"+p).Output()
+}
+
+// registryPacks lists the packs in a registry: the top-level directories with a pack.json
+func registryPacks(dir string) ([]string, error) {
+	output, err := newCommand("git", "-C", dir, "ls-tree", "--name-only", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list template packs: %v", err)
+	}
+	var packs []string
+	for _, name := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if _, err := registryFile(dir, "HEAD", name+"/pack.json"); err == nil {
+			packs = append(packs, name)
+		}
+	}
+	return packs, nil
+}
+
+// packVersions returns the tagged versions of a pack, newest first. Versions are tags named
+// <pack>/<version>, such as go-service/v1.2.0.
+func packVersions(dir string, pack string) []string {
+	output, err := newCommand("git", "-C", dir, "tag", "--list", pack+"/*").Output()
+	if err != nil {
+		return nil
+	}
+	var versions []string
+	for _, tag := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if tag != "" {
+			versions = append(versions, strings.TrimPrefix(tag, pack+"/"))
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return compareVersions(versions[i], versions[j]) > 0 })
+	return versions
+}
+
+// resolvePack finds the commit of a pack version: the latest tag when version is empty, or the
+// registry's HEAD for packs without tags
+func resolvePack(dir string, registry string, pack string, version string) (TemplatePack, error) {
+	rev := "HEAD"
+	if version == "" {
+		if versions := packVersions(dir, pack); len(versions) > 0 {
+			version = versions[0]
+		}
+	}
+	if version != "" {
+		rev = pack + "/" + version
+	}
+	output, err := newCommand("git", "-C", dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}").Output()
+	if err != nil {
+		// Untagged versions can be pinned by registry commit
+		if output, err = newCommand("git", "-C", dir, "rev-parse", "--verify", "--quiet", version+"^{commit}").Output(); err != nil {
+			return TemplatePack{}, fmt.Errorf("%s has no version %s", pack, version)
+		}
+	}
+	commit := strings.TrimSpace(string(output))
+	if version == "" {
+		version = commit[:12]
+	}
+	if _, err := registryFile(dir, commit, pack+"/pack.json"); err != nil {
+		return TemplatePack{}, fmt.Errorf("%s isn't a template pack at %s", pack, version)
+	}
+	return TemplatePack{Name: pack, Registry: registry, Version: version, Commit: commit}, nil
+}
+
+// readPackInfo reads the pack.json of a pack at its pinned commit
+func readPackInfo(dir string, pin TemplatePack) (TemplatePackInfo, error) {
+	var info TemplatePackInfo
+	data, err := registryFile(dir, pin.Commit, pin.Name+"/pack.json")
+	if err != nil {
+		return info, fmt.Errorf("failed to read %s/pack.json: %v", pin.Name, err)
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, fmt.Errorf("failed to parse %s/pack.json: %v", pin.Name, err)
+	}
+	for _, file := range info.files() {
+		if strings.HasPrefix(file, "/") || strings.Contains(file, "..") {
+			return info, fmt.Errorf("%s/pack.json names %s, which is outside the pack", pin.Name, file)
+		}
+	}
+	return info, nil
+}
+
+// packDir returns where a pack's templates are installed, next to the config that uses them
+func packDir(configPath string, pack string) string {
+	return filepath.Join(filepath.Dir(configPath), ".gitscribe-templates", pack)
+}
+
+// installPack writes a pack's templates next to the config, points the config's templates at
+// them and pins the pack's version in the config
+func installPack(configPath string, dir string, pin TemplatePack) error {
+	info, err := readPackInfo(dir, pin)
+	if err != nil {
+		return err
+	}
+	target := packDir(configPath, pin.Name)
+	os.RemoveAll(target)
+	for _, file := range info.files() {
+		content, err := registryFile(dir, pin.Commit, pin.Name+"/"+file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s from %s: %v", file, pin.Name, err)
+		}
+		p := filepath.Join(target, filepath.FromSlash(file))
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", p, err)
+		}
+	}
+
+	raw := make(map[string]interface{})
+	if data, err := ioutil.ReadFile(configPath); err == nil {
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", configPath, err)
+		}
+	}
+	// The packs are installed for the user, in their own config, which applies in every directory
+	configured := target
+	if info.CommitTemplate != "" {
+		raw["commit_template"] = filepath.Join(configured, filepath.FromSlash(info.CommitTemplate))
+	}
+	if info.PRTemplate != "" {
+		raw["pr_template"] = filepath.Join(configured, filepath.FromSlash(info.PRTemplate))
+	}
+	// The pack's areas replace those it installed before and those with the same names
+	packAreas := make(map[string]bool)
+	for _, area := range info.AreaTemplates {
+		packAreas[area.Name] = true
+	}
+	var areas []interface{}
+	existing, _ := raw["pr_area_templates"].([]interface{})
+	for _, area := range existing {
+		object, _ := area.(map[string]interface{})
+		name, _ := object["name"].(string)
+		template, _ := object["template"].(string)
+		if packAreas[name] || strings.HasPrefix(template, configured+string(filepath.Separator)) {
+			continue
+		}
+		areas = append(areas, area)
+	}
+	for _, area := range info.AreaTemplates {
+		area.Template = filepath.Join(configured, filepath.FromSlash(area.Template))
+		areas = append(areas, area)
+	}
+	if len(areas) > 0 {
+		raw["pr_area_templates"] = areas
+	}
+
+	var pins []interface{}
+	existing, _ = raw["template_packs"].([]interface{})
+	for _, pack := range existing {
+		if object, _ := pack.(map[string]interface{}); object["name"] != pin.Name {
+			pins = append(pins, pack)
+		}
+	}
+	raw["template_packs"] = append(pins, pin)
+
+	data, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+	// The config can hold the API key
+	os.MkdirAll(filepath.Dir(configPath), 0700)
+	return ioutil.WriteFile(configPath, append(data, '\n'), 0600)
+}
+
+// packDrift lists the installed templates of a pack that differ from its pinned version
+func packDrift(configPath string, dir string, pin TemplatePack) ([]string, error) {
+	info, err := readPackInfo(dir, pin)
+	if err != nil {
+		return nil, err
+	}
+	var drift []string
+	for _, file := range info.files() {
+		pinned, err := registryFile(dir, pin.Commit, pin.Name+"/"+file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from %s: %v", file, pin.Name, err)
+		}
+		p := filepath.Join(packDir(configPath, pin.Name), filepath.FromSlash(file))
+		installed, err := ioutil.ReadFile(p)
+		switch {
+		case err != nil:
+			drift = append(drift, p+" is missing")
+		case string(installed) != string(pinned):
+			drift = append(drift, p+" was edited")
+		}
+	}
+	return drift, nil
+}
+
+// runTemplatesCommand dispatches the templates subcommands
+func runTemplatesCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gs templates list|install|update|check")
+	}
+	switch args[0] {
+	case "list":
+		return runTemplatesListCommand(args[1:])
+	case "install":
+		return runTemplatesInstallCommand(args[1:], false)
+	case "update":
+		return runTemplatesInstallCommand(args[1:], true)
+	case "check":
+		return runTemplatesCheckCommand(args[1:])
+	}
+	return fmt.Errorf("unknown templates command %q: use list, install, update or check", args[0])
+}
+
+// runTemplatesListCommand lists the packs in a registry with their versions
+func runTemplatesListCommand(args []string) error {
+	fs := flag.NewFlagSet("templates list", flag.ExitOnError)
+	registry := fs.String("registry", "", "Git URL of the template registry (default: template_registry from the config)")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if *registry == "" {
+		*registry = config.TemplateRegistry
+	}
+	if *registry == "" {
+		return fmt.Errorf("no template registry: set template_registry in the config or pass -registry")
+	}
+	dir, err := registryCache(*registry, false)
+	if err != nil {
+		return err
+	}
+	packs, err := registryPacks(dir)
+	if err != nil {
+		return err
+	}
+	pinned := make(map[string]string)
+	for _, pin := range config.TemplatePacks {
+		pinned[pin.Name] = pin.Version
+	}
+	fmt.Printf("Template packs in %s:\n", *registry)
+	for _, pack := range packs {
+		var info TemplatePackInfo
+		if data, err := registryFile(dir, "HEAD", pack+"/pack.json"); err == nil {
+			json.Unmarshal(data, &info)
+		}
+		line := "  " + pack
+		if versions := packVersions(dir, pack); len(versions) > 0 {
+			line += " " + versions[0]
+		}
+		if version, ok := pinned[pack]; ok {
+			line += fmt.Sprintf(" (installed: %s)", version)
+		}
+		if info.Description != "" {
+			line += " - " + info.Description
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// runTemplatesInstallCommand installs packs given as <pack>[@<version>], or reinstalls the pinned
+// ones. With update, packs move to their latest version instead.
+func runTemplatesInstallCommand(args []string, update bool) error {
+	name := "templates install"
+	if update {
+		name = "templates update"
+	}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	registry := fs.String("registry", "", "Git URL of the template registry (default: template_registry from the config)")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	var requested []TemplatePack
+	for _, arg := range fs.Args() {
+		parts := strings.SplitN(arg, "@", 2)
+		pin := TemplatePack{Name: parts[0], Registry: *registry}
+		if len(parts) == 2 {
+			pin.Version = parts[1]
+		}
+		// Installed packs stay with their registry unless another is given
+		for _, installed := range config.TemplatePacks {
+			if installed.Name == pin.Name && pin.Registry == "" {
+				pin.Registry = installed.Registry
+			}
+		}
+		if pin.Registry == "" {
+			pin.Registry = config.TemplateRegistry
+		}
+		requested = append(requested, pin)
+	}
+	if len(requested) == 0 {
+		// Without arguments, install what the config pins, e.g. after cloning a repo
+		requested = config.TemplatePacks
+		if len(requested) == 0 {
+			return fmt.Errorf("no template packs pinned in %s, name the packs to install", config.Path)
+		}
+	}
+
+	for _, pin := range requested {
+		if pin.Registry == "" {
+			return fmt.Errorf("no template registry for %s: set template_registry in the config or pass -registry", pin.Name)
+		}
+		dir, err := registryCache(pin.Registry, update)
+		if err != nil {
+			return err
+		}
+		switch {
+		case update:
+			pin, err = resolvePack(dir, pin.Registry, pin.Name, "")
+		case pin.Commit == "":
+			pin, err = resolvePack(dir, pin.Registry, pin.Name, pin.Version)
+		}
+		if err != nil {
+			return err
+		}
+		if err := installPack(config.Path, dir, pin); err != nil {
+			return err
+		}
+		fmt.Printf("Installed %s %s to %s\n", pin.Name, pin.Version, packDir(config.Path, pin.Name))
+	}
+	fmt.Printf("Pinned in %s.\n", config.Path)
+	return nil
+}
+
+// runTemplatesCheckCommand reports installed packs whose templates were edited by hand or have a
+// newer version, failing on edits so CI can catch copies drifting from the registry
+func runTemplatesCheckCommand(args []string) error {
+	fs := flag.NewFlagSet("templates check", flag.ExitOnError)
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(config.TemplatePacks) == 0 {
+		fmt.Println("No template packs installed.")
+		return nil
+	}
+
+	drifted := false
+	for _, pin := range config.TemplatePacks {
+		dir, err := registryCache(pin.Registry, false)
+		if err != nil {
+			return err
+		}
+		drift, err := packDrift(config.Path, dir, pin)
+		if err != nil {
+			return err
+		}
+		status := "up to date"
+		if versions := packVersions(dir, pin.Name); len(versions) > 0 && versions[0] != pin.Version {
+			status = fmt.Sprintf("%s is available, run gs templates update %s", versions[0], pin.Name)
+		}
+		fmt.Printf("%s %s: %s\n", pin.Name, pin.Version, status)
+		for _, file := range drift {
+			fmt.Printf("  %s\n", file)
+		}
+		drifted = drifted || len(drift) > 0
+	}
+	if drifted {
+		return fmt.Errorf("installed templates differ from their pinned versions. Change them in the registry, or run gs templates install to restore them")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often the server checks the config and templates for changes
+const configPollInterval = 2 * time.Second
+
+// fileStamp identifies a version of a file well enough to notice it changed
+type fileStamp struct {
+	ModTime time.Time
+	Size    int64
+}
+
+// watchedFiles returns the files whose changes should reload the config
+func watchedFiles(config Config) []string {
+	return append(append([]string{}, config.Layers...), config.templateFiles()...)
+}
+
+// fileStamps records the current version of each file. Missing files get a zero stamp.
+func fileStamps(files []string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp, len(files))
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			stamps[file] = fileStamp{ModTime: info.ModTime(), Size: info.Size()}
+		} else {
+			stamps[file] = fileStamp{}
+		}
+	}
+	return stamps
+}
+
+// stampsChanged reports whether any file differs between the two sets of stamps
+func stampsChanged(before map[string]fileStamp, after map[string]fileStamp) bool {
+	if len(before) != len(after) {
+		return true
+	}
+	for file, stamp := range after {
+		if previous, ok := before[file]; !ok || !previous.ModTime.Equal(stamp.ModTime) || previous.Size != stamp.Size {
+			return true
+		}
+	}
+	return false
+}
+
+// validateReloadedConfig checks a reloaded config before it replaces the running one
+func validateReloadedConfig(config Config, running Config) error {
+	for _, template := range config.templateFiles() {
+		if _, err := ioutil.ReadFile(template); err != nil {
+			return templateError("configured", err)
+		}
+	}
+	if config.Server.Addr != running.Server.Addr {
+		return fmt.Errorf("server.addr changed from %s to %s, which needs a restart", running.Server.Addr, config.Server.Addr)
+	}
+	return nil
+}
+
+// reloadConfig loads the config again and swaps it in if it's valid. A bad config is logged
+// and the running one is kept.
+func reloadConfig(server *webhookServer, addr string) {
+	running := server.currentConfig()
+	Log(INFO, "Reloading config from %s", strings.Join(running.Layers, ", "))
+
+	config, err := loadConfig(running.Layers...)
+	if err == nil {
+		config, err = prepareServerConfig(config, addr)
+	}
+	if err == nil {
+		err = validateReloadedConfig(config, running)
+	}
+	if err != nil {
+		Log(ERROR, "Keeping the current config, the new one is invalid: %v", err)
+		return
+	}
+
+	server.setConfig(config)
+	Log(INFO, "Config reloaded. Changes to exec and telemetry settings take effect after a restart")
+}
+
+// watchConfig reloads the server's config when the config file or a template changes, or when
+// the process receives SIGHUP
+func watchConfig(server *webhookServer, addr string) {
+	defer recoverCrash()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	stamps := fileStamps(watchedFiles(server.currentConfig()))
+	for {
+		select {
+		case <-hangup:
+			Log(INFO, "Received SIGHUP")
+			reloadConfig(server, addr)
+		case <-ticker.C:
+			current := fileStamps(watchedFiles(server.currentConfig()))
+			if !stampsChanged(stamps, current) {
+				continue
+			}
+			reloadConfig(server, addr)
+		}
+		// Watch whatever the config points at now, including templates it newly references
+		stamps = fileStamps(watchedFiles(server.currentConfig()))
+	}
+}
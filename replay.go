@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+)
+
+// runReplayCommand lists recorded webhook deliveries or processes failed ones again
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("serve replay", flag.ExitOnError)
+	deliveryID := fs.String("delivery", "", "ID of the delivery to replay, whatever its status")
+	list := fs.Bool("list", false, "List recorded deliveries instead of replaying failed ones")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	// Replayed deliveries are handled as the server would
+	serverConsent = true
+	store, err := newDeliveryStore(config.Server.DeliveryDir)
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		records, err := store.List("")
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			fmt.Printf("%s  %s  %-10s %-12s attempts=%d %s\n", record.ID, record.ReceivedAt.Format("2006-01-02 15:04:05"), record.Event, record.Status, record.Attempts, record.Error)
+		}
+		return nil
+	}
+
+	var records []DeliveryRecord
+	if *deliveryID != "" {
+		record, err := store.Get(*deliveryID)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	} else {
+		records, err = store.List(deliveryFailed)
+		if err != nil {
+			return err
+		}
+	}
+	if len(records) == 0 {
+		fmt.Println("No failed deliveries to replay.")
+		return nil
+	}
+
+	server := &webhookServer{config: config, deliveries: store}
+	failed := 0
+	for _, record := range records {
+		fmt.Printf("Replaying delivery %s (%s, attempt %d)...\n", record.ID, record.Event, record.Attempts+1)
+		if err := replayDelivery(server, record); err != nil {
+			fmt.Printf("  failed: %v\n", err)
+			failed++
+			continue
+		}
+		fmt.Println("  done")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deliveries failed again", failed, len(records))
+	}
+	return nil
+}
+
+// replayDelivery processes a recorded delivery again and records the new outcome
+func replayDelivery(server *webhookServer, record DeliveryRecord) error {
+	var process func() error
+	switch record.Event {
+	case "pull_request":
+		var event WebhookPullRequestEvent
+		if err := json.Unmarshal(record.Payload, &event); err != nil {
+			return fmt.Errorf("failed to parse payload: %v", err)
+		}
+		process = func() error {
+			ctx, stop := interruptContext()
+			defer stop()
+			return server.handlePullRequest(ctx, event)
+		}
+	case "issue_comment":
+		var event WebhookIssueCommentEvent
+		if err := json.Unmarshal(record.Payload, &event); err != nil {
+			return fmt.Errorf("failed to parse payload: %v", err)
+		}
+		process = func() error { return handleIssueComment(event) }
+	default:
+		return fmt.Errorf("can't replay %s events", record.Event)
+	}
+	if err := server.deliveries.Retry(record); err != nil {
+		return fmt.Errorf("failed to record retry: %v", err)
+	}
+
+	err := process()
+	if recordErr := server.deliveries.Finish(record.ID, err); recordErr != nil {
+		Log(ERROR, "Failed to record outcome of delivery %s: %v", record.ID, recordErr)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// repoOperation is a git operation that can stop partway, leaving a file in the git directory
+// until it's continued or aborted
+type repoOperation struct {
+	name    string
+	marker  string
+	command string
+}
+
+// repoOperations are the operations checked for before gs commits or opens a PR
+var repoOperations = []repoOperation{
+	{"rebase", "rebase-merge", "git rebase"},
+	{"rebase", "rebase-apply", "git rebase"},
+	{"merge", "MERGE_HEAD", "git merge"},
+	{"cherry-pick", "CHERRY_PICK_HEAD", "git cherry-pick"},
+	{"revert", "REVERT_HEAD", "git revert"},
+	{"bisect", "BISECT_LOG", "git bisect"},
+}
+
+// gitPathExists reports whether a file or directory exists in the git directory
+func gitPathExists(name string) bool {
+	output, err := newCommand("git", "rev-parse", "--git-path", name).Output()
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(strings.TrimSpace(string(output)))
+	return err == nil
+}
+
+// operationInProgress returns the operation the repository is in the middle of, if any
+func operationInProgress() (repoOperation, bool) {
+	for _, operation := range repoOperations {
+		if gitPathExists(operation.marker) {
+			return operation, true
+		}
+	}
+	return repoOperation{}, false
+}
+
+// headDetached reports whether HEAD is a commit rather than a branch
+func headDetached() bool {
+	return newCommand("git", "symbolic-ref", "-q", "HEAD").Run() != nil
+}
+
+// shallowRepository reports whether the repository was cloned without its full history
+func shallowRepository() bool {
+	output, err := newCommand("git", "rev-parse", "--is-shallow-repository").Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+// checkRepoHealth looks at the state of the repository before anything is generated. States a
+// commit or PR can't be made from sensibly fail with what to do about them, and the rest are
+// explained so the result isn't a surprise.
+func checkRepoHealth(generatePR bool, targetBranch string) error {
+	if newCommand("git", "rev-parse", "--git-dir").Run() != nil {
+		// Not in a repository, which reading the changes reports
+		return nil
+	}
+	conflicts, err := conflictedFiles()
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return newError(ErrGitState, "%d files still have conflicts (%s): resolve them and git add them first", len(conflicts), strings.Join(conflicts, ", "))
+	}
+
+	operation, inProgress := operationInProgress()
+	if generatePR {
+		switch {
+		case inProgress:
+			return newError(ErrGitState, "a %s is in progress, so the branch isn't finished: run %s --continue or %s --abort first", operation.name, operation.command, operation.command)
+		case headDetached():
+			return newError(ErrGitState, "HEAD is detached, so there's no branch to open a PR from: check out a branch first, or use -head <ref> -dry-run to describe the commits")
+		case shallowRepository():
+			if _, err := getMergeBase(targetBranch); err != nil {
+				return newError(ErrGitState, "the repository is a shallow clone and doesn't have the commit where the branch forked from %s: fetch more history with git fetch --deepen=100 or git fetch --unshallow", targetBranch)
+			}
+			Log(INFO, "Shallow clone, but the merge base with %s is there", targetBranch)
+		}
+		return nil
+	}
+
+	switch {
+	case inProgress && operation.name == "merge":
+		fmt.Fprintln(os.Stderr, "Note: a merge is in progress. The message describes everything it brings in, and committing finishes it.")
+	case inProgress && operation.name == "bisect":
+		fmt.Fprintln(os.Stderr, "Note: a bisect is in progress, so the commit is made on the commit being tested. Run git bisect reset to go back to your branch first.")
+	case inProgress:
+		fmt.Fprintf(os.Stderr, "Note: a %s is in progress, so this makes a new commit in the middle of it. Run %s --continue instead to keep the original commit and its message.\n", operation.name, operation.command)
+	case headDetached():
+		fmt.Fprintln(os.Stderr, "Note: HEAD is detached, so the commit won't be on a branch. Create one with git switch -c <name> to keep it.")
+	}
+	if inProgress {
+		Log(WARN, "A %s is in progress", operation.name)
+	}
+	return nil
+}
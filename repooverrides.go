@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// repoOverrideDir is the directory at the root of a repository that holds its own prompts and
+// templates, so a team can keep its conventions with its code
+const repoOverrideDir = ".gitscribe"
+
+// PromptOverrides replace the built-in system prompts of commit messages and PR descriptions
+type PromptOverrides struct {
+	Commit       string // the repository's instructions, which the first-line format, budget and template rules still follow
+	PR           string
+	CommitSystem string // the whole system prompt, from llm.commit.system_prompt_file, which only the template follows
+	PRSystem     string
+	Language     string // the language to write the PR description in, chosen from llm.language and the branch's commits
+}
+
+// applyRepoOverrides uses the prompts and templates the repository keeps in .gitscribe:
+// prompts/commit.txt and prompts/pr.txt replace the built-in instructions, templates/commit.txt
+// and templates/pr.md replace commit_template and pr_template
+func applyRepoOverrides(config *Config) error {
+	output, err := newCommand("git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		// Outside a repository, or in a bare one, there's nothing to override with
+		return nil
+	}
+	dir := filepath.Join(strings.TrimSpace(string(output)), repoOverrideDir)
+
+	templates := []struct {
+		name string
+		path *string
+	}{{"commit.txt", &config.CommitTemplate}, {"pr.md", &config.PRTemplate}}
+	for _, template := range templates {
+		location := filepath.Join(dir, "templates", template.name)
+		if _, err := os.Stat(location); err == nil {
+			Log(INFO, "Using the repository's template %s", location)
+			*template.path = location
+		}
+	}
+
+	prompts := []struct {
+		name   string
+		prompt *string
+	}{{"commit.txt", &config.LLM.Prompts.Commit}, {"pr.txt", &config.LLM.Prompts.PR}}
+	for _, prompt := range prompts {
+		location := filepath.Join(dir, "prompts", prompt.name)
+		data, err := ioutil.ReadFile(location)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return fmt.Errorf("failed to read the repository's prompt %s: %v", location, err)
+		case strings.TrimSpace(string(data)) == "":
+			Log(WARN, "Ignoring the repository's prompt %s, which is empty", location)
+			continue
+		}
+		Log(INFO, "Using the repository's prompt %s", location)
+		*prompt.prompt = strings.TrimSpace(string(data))
+	}
+	return nil
+}
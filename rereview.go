@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// lastReviewBy returns the most recent review submitted by the given user
+func lastReviewBy(reviews []Review, reviewer string) (Review, bool) {
+	var last Review
+	found := false
+	for _, review := range reviews {
+		// Pending reviews haven't been submitted and have no commit yet
+		if review.User.Login != reviewer || review.State == "PENDING" || review.CommitID == "" {
+			continue
+		}
+		if !found || review.SubmittedAt >= last.SubmittedAt {
+			last = review
+			found = true
+		}
+	}
+	return last, found
+}
+
+// runReReviewCommand posts a "what changed since you last looked" comment covering the
+// commits pushed since a reviewer's last review
+func runReReviewCommand(args []string) error {
+	fs := flag.NewFlagSet("rereview", flag.ExitOnError)
+	prNumber := fs.Int("pr", 0, "Number of the pull request")
+	reviewer := fs.String("reviewer", "", "Login of the reviewer (default: the authenticated gh user)")
+	dryRun := fs.Bool("dry-run", false, "Print the generated comment without posting it")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *prNumber <= 0 {
+		return fmt.Errorf("a pull request number is required: gs rereview -pr <number>")
+	}
+
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	if *reviewer == "" {
+		*reviewer, err = currentGitHubUser()
+		if err != nil {
+			return err
+		}
+	}
+
+	pr, err := getPullRequest(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+	reviews, err := listReviews(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+	review, ok := lastReviewBy(reviews, *reviewer)
+	if !ok {
+		return fmt.Errorf("%s has not reviewed PR #%d yet", *reviewer, *prNumber)
+	}
+	if review.CommitID == pr.Head.SHA {
+		fmt.Printf("Nothing has changed since %s's last review.\n", *reviewer)
+		return nil
+	}
+	Log(INFO, "Last review by %s was at %s (%s)", *reviewer, review.CommitID, review.SubmittedAt)
+
+	commits, diff, err := compareCommits(repo, review.CommitID, pr.Head.SHA)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Summarizing changes since %s's last review...\n", *reviewer)
+	ctx, stop := interruptContext()
+	defer stop()
+	comment, err := GenerateReReviewDigest(ctx, pr, commits, promptDiff(diff, config.LLM), *reviewer, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate re-review digest: %w", err)
+	}
+	comment = fmt.Sprintf("@%s\n\n%s", *reviewer, comment)
+
+	if *dryRun {
+		fmt.Println("=== Generated Comment (Dry Run) ===")
+		fmt.Println(comment)
+		fmt.Println("===================================")
+		return nil
+	}
+
+	url, err := postIssueComment(repo, *prNumber, comment)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Comment posted:", url)
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// resultVersion is the version of the result envelope's schema, raised when a field changes
+// meaning or is removed. New fields can be added without raising it.
+const resultVersion = 1
+
+// RunResult is the envelope -format json prints on stdout when a run ends, for scripts and CI
+// steps to read instead of the output meant for people
+type RunResult struct {
+	Version    int           `json:"version"`
+	Status     string        `json:"status"` // "ok" or "error"
+	Command    string        `json:"command"`
+	ExitCode   int           `json:"exit_code"`
+	Error      *ResultError  `json:"error,omitempty"`
+	Warnings   []string      `json:"warnings"`
+	Message    string        `json:"message,omitempty"` // the commit message or PR description, as it was used
+	Artifacts  RunArtifacts  `json:"artifacts"`
+	Usage      []UsageRecord `json:"usage"`
+	Cost       *float64      `json:"cost"` // in dollars, null if a model's price isn't known
+	DurationMs int64         `json:"duration_ms"`
+}
+
+// ResultError is why a run failed
+type ResultError struct {
+	Kind    ErrorKind `json:"kind"`
+	Message string    `json:"message"`
+	Hint    string    `json:"hint,omitempty"`
+}
+
+// RunArtifacts are what a run made, each set only if it was made
+type RunArtifacts struct {
+	Commit      string `json:"commit,omitempty"`       // the commit made, with git
+	PRURL       string `json:"pr_url,omitempty"`       // the PR created or updated
+	Patch       string `json:"patch,omitempty"`        // the file written with -patch-out
+	MessageFile string `json:"message_file,omitempty"` // the description saved with -skip-create
+}
+
+// runArtifacts and runMessage are filled in as the run makes things, for the result envelope
+var (
+	runArtifacts RunArtifacts
+	runMessage   string
+)
+
+// runWarnings are the latest warnings logged in this run, whatever the log level. logMu guards
+// them.
+var runWarnings []string
+
+// maxRunWarnings is how many warnings runWarnings keeps, as gs serve logs for as long as it runs
+const maxRunWarnings = 100
+
+// resultFormat is how the outcome of the run is reported, set by -format
+var resultFormat formatFlag = "text"
+
+// resultStdout is where the result envelope is written. The rest of the output goes to stderr
+// with -format json, so stdout only holds the envelope.
+var resultStdout = os.Stdout
+
+// formatFlag is the -format flag: text for people, or json for the result envelope
+type formatFlag string
+
+func (f *formatFlag) String() string {
+	return string(*f)
+}
+
+func (f *formatFlag) Set(value string) error {
+	switch value {
+	case "text":
+		os.Stdout = resultStdout
+	case "json":
+		os.Stdout = os.Stderr
+	default:
+		return fmt.Errorf("unknown format %q: use text or json", value)
+	}
+	*f = formatFlag(value)
+	return nil
+}
+
+// writeResult prints the result envelope of the run with -format json
+func writeResult(runErr error) {
+	if resultFormat != "json" {
+		return
+	}
+	result := RunResult{
+		Version:    resultVersion,
+		Status:     "ok",
+		Command:    runCommand,
+		Warnings:   loggedWarnings(),
+		Message:    runMessage,
+		Artifacts:  runArtifacts,
+		Usage:      runUsageRecords(),
+		DurationMs: time.Since(runStarted).Milliseconds(),
+	}
+	if runErr != nil {
+		result.Status = "error"
+		result.ExitCode = exitCode(runErr)
+		result.Error = &ResultError{Kind: errorKind(runErr), Message: runErr.Error(), Hint: remediations[errorKind(runErr)]}
+	}
+	if result.Warnings == nil {
+		result.Warnings = []string{}
+	}
+	if result.Usage == nil {
+		result.Usage = []UsageRecord{}
+	}
+	cost, priced := 0.0, true
+	for _, record := range result.Usage {
+		cost += record.Cost
+		priced = priced && record.Priced
+	}
+	if priced {
+		result.Cost = &cost
+	}
+	data, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintln(resultStdout, string(data))
+}
+
+// recordCommitArtifact records the commit just made at HEAD for the result envelope
+func recordCommitArtifact() {
+	output, err := newCommand("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		Log(WARN, "Failed to read the commit just made: %v", err)
+		return
+	}
+	runArtifacts.Commit = strings.TrimSpace(string(output))
+}
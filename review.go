@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// InlineSuggestion is a mechanical fix to lines a pull request adds, posted as a suggestion the
+// author can apply with one click
+type InlineSuggestion struct {
+	Path        string `json:"path"`
+	StartLine   int    `json:"start_line"` // first line replaced, in the new version of the file
+	Line        int    `json:"line"`       // last line replaced
+	Original    string `json:"original"`
+	Replacement string `json:"replacement"`
+	Reason      string `json:"reason"`
+}
+
+// numberDiff prefixes the added and context lines of a file's diff with their line numbers in
+// the new version of the file, so the model can say which lines a fix replaces
+func numberDiff(file FileDiff) string {
+	var sb strings.Builder
+	number := 0
+	inHunk := false
+	for _, line := range strings.Split(strings.TrimSuffix(file.Content, "\n"), "\n") {
+		if match := hunkHeader.FindStringSubmatch(line); match != nil {
+			number, _ = strconv.Atoi(match[1])
+			inHunk = true
+			sb.WriteString(line + "\n")
+			continue
+		}
+		if !inHunk || line == "" || line[0] == '\\' {
+			sb.WriteString(line + "\n")
+			continue
+		}
+		switch line[0] {
+		case '+', ' ':
+			sb.WriteString(fmt.Sprintf("%5d %s\n", number, line))
+			number++
+		default:
+			sb.WriteString("      " + line + "\n")
+		}
+	}
+	return sb.String()
+}
+
+// numberedReviewDiff numbers the diff of every file that isn't vendored, leaving out the files
+// that don't fit in the model's context and returning which
+func numberedReviewDiff(files []FileDiff, vendorPaths []string, llmConfig LLMConfig) (string, []string) {
+	var sb strings.Builder
+	var skipped []string
+	budget := diffTokenBudget(llmConfig)
+	for _, file := range files {
+		if isVendoredPath(file.Path, vendorPaths) {
+			continue
+		}
+		numbered := numberDiff(file)
+		if estimateTokens(sb.String()+numbered) > budget {
+			skipped = append(skipped, file.Path)
+			continue
+		}
+		sb.WriteString(numbered)
+	}
+	return sb.String(), skipped
+}
+
+// parseInlineSuggestions decodes the model's reply
+func parseInlineSuggestions(response string) ([]InlineSuggestion, error) {
+	var reply struct {
+		Suggestions []InlineSuggestion `json:"suggestions"`
+	}
+	start, end := strings.Index(response, "{"), strings.LastIndex(response, "}")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("the model returned no suggestions: %s", response)
+	}
+	if err := json.Unmarshal([]byte(response[start:end+1]), &reply); err != nil {
+		return nil, fmt.Errorf("failed to parse suggestions: %v", err)
+	}
+	return reply.Suggestions, nil
+}
+
+// trimLines removes trailing whitespace from every line, so a suggestion's original text matches
+// however the model copied it
+func trimLines(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkSuggestions keeps the suggestions that replace lines the PR adds, whose original text
+// matches those lines and that change something. Suggestions overlapping an earlier one are
+// dropped, as GitHub can't apply both.
+func checkSuggestions(suggestions []InlineSuggestion, files []FileDiff, vendorPaths []string) []InlineSuggestion {
+	added := make(map[string]map[int]string)
+	for _, file := range files {
+		if isVendoredPath(file.Path, vendorPaths) {
+			continue
+		}
+		added[file.Path] = make(map[int]string)
+		for _, line := range addedLines(file) {
+			added[file.Path][line.Number] = line.Text
+		}
+	}
+
+	var kept []InlineSuggestion
+	covered := make(map[string]map[int]bool)
+	for _, suggestion := range suggestions {
+		if suggestion.StartLine == 0 {
+			suggestion.StartLine = suggestion.Line
+		}
+		lines, ok := added[suggestion.Path]
+		if !ok || suggestion.StartLine < 1 || suggestion.StartLine > suggestion.Line {
+			Log(DEBUG, "Dropping suggestion for %s:%d, not on a changed file", suggestion.Path, suggestion.Line)
+			continue
+		}
+		var original []string
+		usable := true
+		for n := suggestion.StartLine; n <= suggestion.Line && usable; n++ {
+			text, isAdded := lines[n]
+			usable = isAdded && !covered[suggestion.Path][n]
+			original = append(original, text)
+		}
+		if !usable {
+			Log(DEBUG, "Dropping suggestion for %s:%d-%d, not on lines the PR adds or overlapping another", suggestion.Path, suggestion.StartLine, suggestion.Line)
+			continue
+		}
+		if trimLines(strings.Join(original, "\n")) != trimLines(suggestion.Original) {
+			Log(DEBUG, "Dropping suggestion for %s:%d-%d, its original text doesn't match the diff", suggestion.Path, suggestion.StartLine, suggestion.Line)
+			continue
+		}
+		suggestion.Replacement = strings.TrimRight(suggestion.Replacement, "\n")
+		if trimLines(suggestion.Replacement) == trimLines(suggestion.Original) {
+			continue
+		}
+		if covered[suggestion.Path] == nil {
+			covered[suggestion.Path] = make(map[int]bool)
+		}
+		for n := suggestion.StartLine; n <= suggestion.Line; n++ {
+			covered[suggestion.Path][n] = true
+		}
+		kept = append(kept, suggestion)
+	}
+	return kept
+}
+
+// suggestionComment renders a suggestion as a review comment holding a suggestion block
+func suggestionComment(suggestion InlineSuggestion) DraftReviewComment {
+	// The fence must be longer than any run of backticks in the replacement
+	fence := "```"
+	for strings.Contains(suggestion.Replacement, fence) {
+		fence += "`"
+	}
+	body := fence + "suggestion\n"
+	if suggestion.Replacement != "" {
+		body += suggestion.Replacement + "\n"
+	}
+	body += fence
+	if suggestion.Reason != "" {
+		body = suggestion.Reason + "\n\n" + body
+	}
+	comment := DraftReviewComment{Path: suggestion.Path, Line: suggestion.Line, Side: "RIGHT", Body: body}
+	if suggestion.StartLine < suggestion.Line {
+		comment.StartLine, comment.StartSide = suggestion.StartLine, "RIGHT"
+	}
+	return comment
+}
+
+// runReviewCommand reviews a pull request for mechanical fixes such as typos and unchecked
+// errors, and posts them as suggestions the author can apply with one click
+func runReviewCommand(args []string) error {
+	fs := flag.NewFlagSet("review", flag.ExitOnError)
+	prNumber := fs.Int("pr", 0, "Number of the pull request to review")
+	maxSuggestions := fs.Int("max", 20, "Most suggestions to post")
+	dryRun := fs.Bool("dry-run", false, "Print the suggestions without posting them")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if *prNumber <= 0 {
+		return fmt.Errorf("a pull request number is required: gs review -pr <number>")
+	}
+
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	pr, err := getPullRequest(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+	diff, err := getPullRequestDiff(repo, *prNumber)
+	if err != nil {
+		return err
+	}
+	files := splitDiffByFile(diff)
+	numbered, skipped := numberedReviewDiff(files, config.Vendor.Paths, config.LLM)
+	if len(skipped) > 0 {
+		Log(WARN, "The diff is too large for %s's context, not reviewing %s", config.LLM.Model, strings.Join(skipped, ", "))
+	}
+	if strings.TrimSpace(numbered) == "" {
+		fmt.Println("Nothing to review.")
+		return nil
+	}
+
+	fmt.Println("Looking for mechanical fixes...")
+	ctx, stop := interruptContext()
+	defer stop()
+	response, err := GenerateInlineSuggestions(ctx, pr, numbered, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate suggestions: %w", err)
+	}
+	suggestions, err := parseInlineSuggestions(response)
+	if err != nil {
+		return err
+	}
+	found := len(suggestions)
+	suggestions = checkSuggestions(suggestions, files, config.Vendor.Paths)
+	Log(INFO, "The model suggested %d fixes, %d of them apply to the diff", found, len(suggestions))
+	if len(suggestions) > *maxSuggestions {
+		suggestions = suggestions[:*maxSuggestions]
+	}
+	if len(suggestions) == 0 {
+		fmt.Println("No mechanical fixes found.")
+		return nil
+	}
+
+	comments := make([]DraftReviewComment, len(suggestions))
+	for i, suggestion := range suggestions {
+		comments[i] = suggestionComment(suggestion)
+	}
+
+	if *dryRun {
+		fmt.Println("=== Suggestions (Dry Run) ===")
+		for _, comment := range comments {
+			lines := strconv.Itoa(comment.Line)
+			if comment.StartLine != 0 {
+				lines = fmt.Sprintf("%d-%d", comment.StartLine, comment.Line)
+			}
+			fmt.Printf("%s:%s\n%s\n\n", comment.Path, lines, comment.Body)
+		}
+		fmt.Println("=============================")
+		return nil
+	}
+
+	body := fmt.Sprintf("GitScribe found %d mechanical fixes. Apply the ones you agree with from the suggestions below.", len(comments))
+	url, err := postReview(repo, *prNumber, pr.Head.SHA, body, comments)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Review posted:", url)
+	return nil
+}
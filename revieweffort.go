@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReviewEffortConfig adds an estimate of how long the PR will take to review
+type ReviewEffortConfig struct {
+	Enabled      bool `json:"enabled"`
+	LinesPerHour int  `json:"lines_per_hour"` // weighted lines a reviewer gets through in an hour, default 300
+	SampleSize   int  `json:"sample_size"`    // recently merged PRs to compare with, default 30
+}
+
+// minutesPerFile is the fixed cost of switching to each changed file
+const minutesPerFile = 2
+
+// ReviewStat is how long a merged PR waited for its first review, cached so each PR is only
+// fetched once
+type ReviewStat struct {
+	Number           int     `json:"number"`
+	Lines            int     `json:"lines"`
+	FirstReviewHours float64 `json:"first_review_hours"` // -1 if it was merged without a review
+}
+
+// reviewWeight is how much a changed line in the file counts towards review effort
+func reviewWeight(p string, vendorPaths []string) float64 {
+	base := filepath.Base(p)
+	for _, lockFile := range lockFiles {
+		if base == lockFile {
+			return 0
+		}
+	}
+	switch {
+	case isVendoredPath(p, vendorPaths):
+		return 0
+	case isTestPath(p):
+		return 0.5
+	case isDocsPath(p):
+		return 0.25
+	}
+	return 1
+}
+
+// estimateReviewMinutes estimates reviewer time from the weighted lines changed, returning the
+// estimate, the weighted lines and the files that count
+func estimateReviewMinutes(files []FileDiff, vendorPaths []string, linesPerHour int) (int, int, int) {
+	weighted := 0.0
+	counted := 0
+	for _, file := range files {
+		weight := reviewWeight(file.Path, vendorPaths)
+		if weight == 0 {
+			continue
+		}
+		weighted += weight * float64(file.Added+file.Removed)
+		counted++
+	}
+	minutes := weighted/float64(linesPerHour)*60 + float64(counted*minutesPerFile)
+	// Round up to five minutes, the estimate isn't more precise than that
+	return int(math.Ceil(minutes/5)) * 5, int(weighted), counted
+}
+
+// formatMinutes renders a duration in minutes the way people plan time
+func formatMinutes(minutes int) string {
+	if minutes < 60 {
+		return fmt.Sprintf("%d min", minutes)
+	}
+	return fmt.Sprintf("%.1f h", float64(minutes)/60)
+}
+
+// reviewStatsPath returns the cache of review stats for a repository
+func reviewStatsPath(repo string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gitscribe", "review_stats", strings.Replace(repo, "/", "_", -1)+".json"), nil
+}
+
+// loadReviewStats reads the cached stats of a repository
+func loadReviewStats(path string) map[int]ReviewStat {
+	stats := make(map[int]ReviewStat)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return stats
+	}
+	var cached []ReviewStat
+	if err := json.Unmarshal(data, &cached); err != nil {
+		Log(WARN, "Ignoring unreadable review stats cache %s: %v", path, err)
+		return stats
+	}
+	for _, stat := range cached {
+		stats[stat.Number] = stat
+	}
+	return stats
+}
+
+// saveReviewStats writes the stats cache
+func saveReviewStats(path string, stats map[int]ReviewStat) error {
+	cached := make([]ReviewStat, 0, len(stats))
+	for _, stat := range stats {
+		cached = append(cached, stat)
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].Number < cached[j].Number })
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(path), 0700)
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// fetchReviewStat works out how long a merged PR waited for its first review by someone other
+// than its author
+func fetchReviewStat(repo string, number int) (ReviewStat, error) {
+	var pr struct {
+		Additions int    `json:"additions"`
+		Deletions int    `json:"deletions"`
+		CreatedAt string `json:"created_at"`
+		User      struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls/%d", repo, number), nil, &pr); err != nil {
+		return ReviewStat{}, err
+	}
+	reviews, err := listReviews(repo, number)
+	if err != nil {
+		return ReviewStat{}, err
+	}
+
+	stat := ReviewStat{Number: number, Lines: pr.Additions + pr.Deletions, FirstReviewHours: -1}
+	created, err := time.Parse(time.RFC3339, pr.CreatedAt)
+	if err != nil {
+		return stat, fmt.Errorf("unexpected creation time %q on #%d", pr.CreatedAt, number)
+	}
+	for _, review := range reviews {
+		submitted, err := time.Parse(time.RFC3339, review.SubmittedAt)
+		if err != nil || review.User.Login == pr.User.Login {
+			continue
+		}
+		if hours := submitted.Sub(created).Hours(); stat.FirstReviewHours < 0 || hours < stat.FirstReviewHours {
+			stat.FirstReviewHours = hours
+		}
+	}
+	return stat, nil
+}
+
+// recentReviewStats returns the review stats of the repository's most recently merged PRs,
+// fetching the ones that aren't cached yet
+func recentReviewStats(repo string, sampleSize int) ([]ReviewStat, error) {
+	var closed []struct {
+		Number   int     `json:"number"`
+		MergedAt *string `json:"merged_at"`
+	}
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/pulls?state=closed&sort=updated&direction=desc&per_page=%d", repo, sampleSize), nil, &closed); err != nil {
+		return nil, err
+	}
+
+	path, err := reviewStatsPath(repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find home directory: %v", err)
+	}
+	cache := loadReviewStats(path)
+	var stats []ReviewStat
+	fetched := 0
+	for _, pr := range closed {
+		if pr.MergedAt == nil {
+			continue
+		}
+		stat, ok := cache[pr.Number]
+		if !ok {
+			if stat, err = fetchReviewStat(repo, pr.Number); err != nil {
+				Log(WARN, "Skipping review stats of %s#%d: %v", repo, pr.Number, err)
+				continue
+			}
+			cache[pr.Number] = stat
+			fetched++
+		}
+		stats = append(stats, stat)
+	}
+	if fetched > 0 {
+		Log(DEBUG, "Fetched review stats of %d PRs in %s", fetched, repo)
+		if err := saveReviewStats(path, cache); err != nil {
+			Log(WARN, "Failed to cache review stats: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+// medianFirstReview returns the median wait for a first review among reviewed PRs between half
+// and twice the size of lines, and how many there were
+func medianFirstReview(stats []ReviewStat, lines int) (float64, int) {
+	var hours []float64
+	for _, stat := range stats {
+		if stat.FirstReviewHours >= 0 && stat.Lines*2 >= lines && stat.Lines <= lines*2 {
+			hours = append(hours, stat.FirstReviewHours)
+		}
+	}
+	if len(hours) == 0 {
+		return 0, 0
+	}
+	sort.Float64s(hours)
+	middle := len(hours) / 2
+	if len(hours)%2 == 0 {
+		return (hours[middle-1] + hours[middle]) / 2, len(hours)
+	}
+	return hours[middle], len(hours)
+}
+
+// buildReviewEffortSection estimates how long the branch will take to review and, when the
+// hosting API is reachable, how long similar PRs waited for a first review
+func buildReviewEffortSection(targetBranch string, effortConfig ReviewEffortConfig, vendorPaths []string) (string, error) {
+	diff, err := getDiffInRange(targetBranch, headRev)
+	if err != nil {
+		return "", err
+	}
+	files := splitDiffByFile(diff)
+	if len(files) == 0 {
+		return "", nil
+	}
+	minutes, weighted, counted := estimateReviewMinutes(files, vendorPaths, effortConfig.LinesPerHour)
+
+	var sb strings.Builder
+	sb.WriteString("## Review effort\n\n")
+	sb.WriteString(fmt.Sprintf("Estimated review time: **~%s** for %d weighted lines in %d files. Tests count half, docs a quarter, lock files and vendored code not at all.\n",
+		formatMinutes(minutes), weighted, counted))
+
+	lines := 0
+	for _, file := range files {
+		lines += file.Added + file.Removed
+	}
+	if github := githubAvailable(); !github.Active {
+		noteOmitted("review history in Review effort", github)
+		return sb.String(), nil
+	}
+	repo, err := currentRepo()
+	if err == nil {
+		var stats []ReviewStat
+		if stats, err = recentReviewStats(repo, effortConfig.SampleSize); err == nil {
+			if median, similar := medianFirstReview(stats, lines); similar > 0 {
+				sb.WriteString(fmt.Sprintf("\nMerged PRs of similar size waited a median of %.1f h for their first review (%d of the last %d merged PRs).\n",
+					median, similar, len(stats)))
+			}
+		}
+	}
+	if err != nil {
+		// The estimate stands on its own, history only adds context
+		Log(WARN, "Leaving review history out of the review effort estimate: %v", err)
+	}
+	return sb.String(), nil
+}
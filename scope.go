@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// changedPathsFromDiff extracts the paths of all files touched by a unified git diff
+func changedPathsFromDiff(diff string) []string {
+	var paths []string
+	for _, line := range strings.Split(diff, "\n") {
+		if !strings.HasPrefix(line, "diff --git ") {
+			continue
+		}
+		// Format is "diff --git a/<path> b/<path>", use the b/ side so renames report the new path
+		idx := strings.LastIndex(line, " b/")
+		if idx == -1 {
+			continue
+		}
+		paths = append(paths, line[idx+3:])
+	}
+	return paths
+}
+
+// commonDirectory returns the longest directory prefix shared by all paths
+func commonDirectory(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+
+	common := strings.Split(path.Dir(paths[0]), "/")
+	for _, p := range paths[1:] {
+		parts := strings.Split(path.Dir(p), "/")
+		n := 0
+		for n < len(common) && n < len(parts) && common[n] == parts[n] {
+			n++
+		}
+		common = common[:n]
+	}
+
+	dir := strings.Join(common, "/")
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// inferScope deterministically computes the commit scope from the changed paths.
+// Scope rules take precedence; otherwise the scope is the top-level directory
+// followed by the deepest common directory, e.g. "go ingester_worker".
+func inferScope(paths []string, format FirstLineFormat) string {
+	if !format.InferScope || len(paths) == 0 {
+		return ""
+	}
+
+	// Pick the longest rule path that covers every changed path. "api" covers "api/v1" but not "apigw".
+	var bestRule *ScopeRule
+	for i, rule := range format.ScopeRules {
+		if rule.Path == "" {
+			continue
+		}
+		coversAll := true
+		for _, p := range paths {
+			if !hasPathPrefix(p, rule.Path) {
+				coversAll = false
+				break
+			}
+		}
+		if coversAll && (bestRule == nil || len(rule.Path) > len(bestRule.Path)) {
+			bestRule = &format.ScopeRules[i]
+		}
+	}
+	if bestRule != nil {
+		Log(DEBUG, "Scope rule %s matched all changed paths", bestRule.Path)
+		return bestRule.Scope
+	}
+
+	dir := commonDirectory(paths)
+	if dir == "" {
+		Log(DEBUG, "Changed paths share no common directory, not inferring a scope")
+		return ""
+	}
+
+	parts := strings.Split(dir, "/")
+	if len(parts) == 1 {
+		return parts[0]
+	}
+	return parts[0] + " " + parts[len(parts)-1]
+}
+
+// enforceScopePrefix makes sure the first line of the message starts with the inferred scope,
+// replacing whatever scope the model wrote if it differs
+func enforceScopePrefix(message string, scope string) string {
+	if scope == "" {
+		return message
+	}
+
+	prefix := scope + ": "
+	lines := strings.SplitN(message, "\n", 2)
+	firstLine := strings.TrimSpace(lines[0])
+	if strings.HasPrefix(firstLine, prefix) {
+		return message
+	}
+
+	Log(WARN, "Generated first line does not start with scope %q, rewriting it", scope)
+	title := firstLine
+	if idx := strings.Index(firstLine, ": "); idx != -1 {
+		title = firstLine[idx+2:]
+	}
+	lines[0] = prefix + title
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestInferScopeRules(t *testing.T) {
+	format := FirstLineFormat{
+		InferScope: true,
+		ScopeRules: []ScopeRule{
+			{Path: "api", Scope: "api"},
+			{Path: "api/v2/", Scope: "api-v2"},
+		},
+	}
+	tests := []struct {
+		paths []string
+		want  string
+	}{
+		{[]string{"api/handler.go", "api/v1/users.go"}, "api"},
+		{[]string{"api/v2/users.go", "api/v2"}, "api-v2"},
+		{[]string{"api"}, "api"},
+		// A sibling whose name starts with the rule's path isn't under it
+		{[]string{"apigw/routes.go"}, "apigw"},
+		{[]string{"api/v2x/users.go"}, "api"},
+	}
+	for _, test := range tests {
+		if got := inferScope(test.paths, format); got != test.want {
+			t.Errorf("inferScope(%q) = %q, want %q", test.paths, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// SecurityConfig lists the paths that need a security review when touched
+type SecurityConfig struct {
+	Paths     []string `json:"paths"`
+	Reviewers []string `json:"reviewers"`
+	Label     string   `json:"label"`
+	Checklist []string `json:"checklist"`
+}
+
+// defaultSecurityChecklist is used when the config doesn't provide its own checklist
+func defaultSecurityChecklist() []string {
+	return []string{
+		"Input from users or external systems is validated",
+		"Authentication and authorization checks are in place for new entry points",
+		"No secrets, keys or credentials are added to the code or logs",
+		"Cryptographic primitives come from vetted libraries and use safe defaults",
+		"Sensitive data is not logged or exposed in error messages",
+	}
+}
+
+// matchesPathPattern reports whether p matches the pattern. Patterns containing glob
+// characters are matched with path.Match against the whole path and each of its parent
+// directories; other patterns are treated as path prefixes.
+func matchesPathPattern(p string, pattern string) bool {
+	if !strings.ContainsAny(pattern, "*?[") {
+		return hasPathPrefix(p, pattern)
+	}
+	pattern = strings.TrimSuffix(pattern, "/")
+	for candidate := p; candidate != "." && candidate != "/"; candidate = path.Dir(candidate) {
+		if ok, _ := path.Match(pattern, candidate); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitiveFiles returns the changed files that match any of the security-sensitive patterns
+func sensitiveFiles(files []string, patterns []string) []string {
+	var matched []string
+	for _, file := range files {
+		for _, pattern := range patterns {
+			if matchesPathPattern(file, pattern) {
+				matched = append(matched, file)
+				break
+			}
+		}
+	}
+	return matched
+}
+
+// applySecurityEscalation adds the security reviewers, label and checklist when the branch
+// touches security-sensitive paths
+func applySecurityEscalation(targetBranch string, security SecurityConfig, extras *PRExtras) error {
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return err
+	}
+	files, err := getChangedFilesInRange(base, headRev)
+	if err != nil {
+		return err
+	}
+
+	touched := sensitiveFiles(files, security.Paths)
+	if len(touched) == 0 {
+		Log(DEBUG, "No security-sensitive paths touched")
+		return nil
+	}
+
+	Log(INFO, "%d security-sensitive files touched, escalating to security review", len(touched))
+	fmt.Printf("This branch touches %d security-sensitive files; requesting a security review.\n", len(touched))
+	extras.Reviewers = append(extras.Reviewers, security.Reviewers...)
+	if security.Label != "" {
+		extras.Labels = append(extras.Labels, security.Label)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("## Security checklist\n\nThis PR touches security-sensitive paths:\n")
+	for _, file := range touched {
+		sb.WriteString(fmt.Sprintf("- `%s`\n", file))
+	}
+	sb.WriteString("\n")
+	for _, item := range security.Checklist {
+		sb.WriteString(fmt.Sprintf("- [ ] %s\n", item))
+	}
+	extras.addSection(strings.TrimRight(sb.String(), "\n"))
+	return nil
+}
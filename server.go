@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ServerConfig configures the webhook server started by "gs serve"
+type ServerConfig struct {
+	Addr            string             `json:"addr"`
+	WebhookSecret   string             `json:"webhook_secret"`
+	DependencyBots  []string           `json:"dependency_bots"`
+	DeliveryDir     string             `json:"delivery_dir"`     // where deliveries are recorded, shared between replicas; default ~/.gitscribe/deliveries
+	ShutdownTimeout int                `json:"shutdown_timeout"` // seconds to wait for in-flight work on shutdown, default 30
+	Queue           QueueConfig        `json:"queue"`
+	Freshness       FreshnessConfig    `json:"freshness"`
+	Digest          ServerDigestConfig `json:"digest"`
+}
+
+// WebhookPullRequestEvent is the subset of a pull_request webhook payload that we use
+type WebhookPullRequestEvent struct {
+	Action      string      `json:"action"`
+	PullRequest PullRequest `json:"pull_request"`
+	Repository  struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// WebhookIssueCommentEvent is the subset of an issue_comment webhook payload that we use
+type WebhookIssueCommentEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number      int       `json:"number"`
+		PullRequest *struct{} `json:"pull_request"`
+	} `json:"issue"`
+	Comment    IssueComment `json:"comment"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+}
+
+// isAcceptCommand reports whether the event is a new comment on a PR accepting a suggestion
+func (e WebhookIssueCommentEvent) isAcceptCommand() bool {
+	return e.Action == "created" && e.Issue.PullRequest != nil && strings.TrimSpace(e.Comment.Body) == acceptCommand
+}
+
+// maxWebhookBodyBytes caps the size of webhook payloads we accept
+const maxWebhookBodyBytes = 10 << 20
+
+// verifyWebhookSignature checks the X-Hub-Signature-256 header against the shared secret
+func verifyWebhookSignature(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// webhookServer handles GitHub webhook deliveries. The config can be swapped while requests are
+// in flight, so it's only read through currentConfig.
+type webhookServer struct {
+	mu         sync.RWMutex
+	config     Config
+	deliveries *deliveryStore
+	queue      jobQueue
+	jobs       sync.WaitGroup // jobs queued or being processed, including ones waiting to retry
+	draining   int32          // set once shutdown has started
+}
+
+// currentConfig returns the config to use for one delivery
+func (s *webhookServer) currentConfig() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// setConfig replaces the config for deliveries that arrive from now on
+func (s *webhookServer) setConfig(config Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+}
+
+// ServeHTTP validates a webhook delivery and dispatches it by event type
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	if !verifyWebhookSignature(s.currentConfig().Server.WebhookSecret, body, r.Header.Get("X-Hub-Signature-256")) {
+		Log(WARN, "Rejected webhook delivery %s with invalid signature", r.Header.Get("X-GitHub-Delivery"))
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	event := r.Header.Get("X-GitHub-Event")
+	delivery := r.Header.Get("X-GitHub-Delivery")
+	Log(INFO, "Received %s webhook (delivery %s)", event, delivery)
+
+	switch event {
+	case "ping":
+		w.WriteHeader(http.StatusOK)
+		return
+	case "pull_request":
+		var payload WebhookPullRequestEvent
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		claimed, err := s.deliveries.Claim(delivery, event, body)
+		if err != nil {
+			Log(ERROR, "Failed to record delivery %s: %v", delivery, err)
+			http.Error(w, "failed to record delivery", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			Log(INFO, "Skipping duplicate delivery %s", delivery)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// Generation takes longer than GitHub waits for a response, so queue it and acknowledge
+		s.jobs.Add(1)
+		if err := s.queue.Enqueue(job{Delivery: delivery, Event: payload, Attempt: 1}); err != nil {
+			Log(WARN, "Rejecting delivery %s: %v", delivery, err)
+			metrics.add("gitscribe_queue_jobs_total", 1, "result", "rejected")
+			// Recorded as failed so it can be replayed, but counted only as rejected
+			s.recordOutcome(delivery, err)
+			http.Error(w, "server busy, replay the delivery later", http.StatusServiceUnavailable)
+			return
+		}
+		metrics.add("gitscribe_queue_jobs_total", 1, "result", "enqueued")
+		w.WriteHeader(http.StatusAccepted)
+	case "issue_comment":
+		var payload WebhookIssueCommentEvent
+		if err := json.Unmarshal(body, &payload); err != nil {
+			http.Error(w, "invalid payload", http.StatusBadRequest)
+			return
+		}
+		if !payload.isAcceptCommand() {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		claimed, err := s.deliveries.Claim(delivery, event, body)
+		if err != nil {
+			Log(ERROR, "Failed to record delivery %s: %v", delivery, err)
+			http.Error(w, "failed to record delivery", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			Log(INFO, "Skipping duplicate delivery %s", delivery)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		s.jobs.Add(1)
+		go func() {
+			defer recoverDelivery(delivery, func(err error) { s.finishJob(delivery, err) })
+			s.finishJob(delivery, handleIssueComment(payload))
+		}()
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		Log(DEBUG, "Ignoring %s event", event)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// processJob handles a queued delivery, retrying transient failures with a growing delay
+func (s *webhookServer) processJob(j job) {
+	defer recoverDelivery(j.Delivery, func(err error) { s.finishJob(j.Delivery, err) })
+	// Deliveries outlive the request that queued them; llm.timeout_seconds bounds each API call
+	err := s.handlePullRequest(context.Background(), j.Event)
+	queueConfig := s.currentConfig().Server.Queue
+	if err == nil || !retryable(err) || j.Attempt >= queueConfig.MaxAttempts {
+		s.finishJob(j.Delivery, err)
+		return
+	}
+
+	j.Attempt++
+	delay := retryDelay(queueConfig, j.Attempt)
+	Log(WARN, "Delivery %s failed, retrying in %s (attempt %d of %d): %v", j.Delivery, delay, j.Attempt, queueConfig.MaxAttempts, err)
+	metrics.add("gitscribe_queue_jobs_total", 1, "result", "retried")
+	if record, getErr := s.deliveries.Get(j.Delivery); getErr == nil {
+		if retryErr := s.deliveries.Retry(record); retryErr != nil {
+			Log(WARN, "Failed to record retry of delivery %s: %v", j.Delivery, retryErr)
+		}
+	}
+	time.AfterFunc(delay, func() {
+		if enqueueErr := s.queue.Enqueue(j); enqueueErr != nil {
+			s.finishJob(j.Delivery, fmt.Errorf("failed to retry: %v, after: %w", enqueueErr, err))
+		}
+	})
+}
+
+// finishJob records the final outcome of a delivery
+func (s *webhookServer) finishJob(delivery string, err error) {
+	if err != nil {
+		Log(ERROR, "Delivery %s failed, replay it with gs serve replay -delivery %s: %v", delivery, delivery, err)
+		metrics.add("gitscribe_queue_jobs_total", 1, "result", "failed")
+	} else {
+		metrics.add("gitscribe_queue_jobs_total", 1, "result", "succeeded")
+	}
+	s.recordOutcome(delivery, err)
+}
+
+// recordOutcome records the outcome of a delivery in the store, without counting it
+func (s *webhookServer) recordOutcome(delivery string, err error) {
+	defer s.jobs.Done()
+	if recordErr := s.deliveries.Finish(delivery, err); recordErr != nil {
+		Log(ERROR, "Failed to record outcome of delivery %s: %v", delivery, recordErr)
+	}
+}
+
+// handlePullRequest processes a pull_request event
+func (s *webhookServer) handlePullRequest(ctx context.Context, event WebhookPullRequestEvent) error {
+	switch event.Action {
+	case "opened", "reopened", "synchronize":
+	default:
+		Log(DEBUG, "Ignoring pull_request action %s", event.Action)
+		return nil
+	}
+
+	config := s.currentConfig()
+	repo, pr := event.Repository.FullName, event.PullRequest
+	if !isDependencyBotPR(pr, config.Server.DependencyBots) {
+		return nil
+	}
+
+	started := time.Now()
+	result := "success"
+	err := enrichDependencyPR(ctx, repo, pr, config)
+	if err != nil {
+		err = fmt.Errorf("failed to enrich dependency PR %s#%d: %w", repo, pr.Number, err)
+		result = "error"
+	}
+	metrics.observe("gitscribe_pull_request_processing_duration_seconds", time.Since(started).Seconds(), "job", "dependency", "result", result)
+	return err
+}
+
+// prepareServerConfig applies the command-line and environment overrides to the server config and
+// checks it can be served
+func prepareServerConfig(config Config, addr string) (Config, error) {
+	if addr != "" {
+		config.Server.Addr = addr
+	}
+	if config.Server.WebhookSecret == "" {
+		config.Server.WebhookSecret = envOrFile("GITSCRIBE_WEBHOOK_SECRET")
+	}
+	if config.Server.WebhookSecret == "" {
+		return config, fmt.Errorf("a webhook secret is required. Set server.webhook_secret or GITSCRIBE_WEBHOOK_SECRET")
+	}
+	return config, nil
+}
+
+// handleIssueComment applies a held-back suggestion when someone accepts it
+func handleIssueComment(event WebhookIssueCommentEvent) error {
+	if !event.isAcceptCommand() {
+		return nil
+	}
+	return acceptSuggestion(event.Repository.FullName, event.Issue.Number, event.Comment)
+}
+
+// runServeCommand starts the webhook server
+func runServeCommand(args []string) error {
+	if len(args) > 0 && args[0] == "replay" {
+		return runReplayCommand(args[1:])
+	}
+
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "", "Address to listen on (default: server.addr from the config, or :8080)")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := requireNetwork("server mode"); err != nil {
+		return err
+	}
+	serverConsent = true
+	config, err = prepareServerConfig(config, *addr)
+	if err != nil {
+		return err
+	}
+
+	// gh reads its token from GH_TOKEN, so make a mounted token file available to it
+	if os.Getenv("GH_TOKEN") == "" {
+		if token := envOrFile("GH_TOKEN"); token != "" {
+			os.Setenv("GH_TOKEN", token)
+		}
+	}
+
+	deliveries, err := newDeliveryStore(config.Server.DeliveryDir)
+	if err != nil {
+		return err
+	}
+	deliveries.Prune()
+	deliveries.FailStale()
+	server := &webhookServer{config: config, deliveries: deliveries, queue: newMemoryQueue(config.Server.Queue)}
+	server.queue.Start(server.processJob)
+	go watchConfig(server, *addr)
+	go watchFreshness(server)
+	go watchDigest(server)
+
+	mux := http.NewServeMux()
+	mux.Handle("/webhook", instrumentWebhooks(server))
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", server.serveReady)
+	httpServer := &http.Server{Addr: config.Server.Addr, Handler: mux}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- httpServer.ListenAndServe()
+	}()
+
+	fmt.Printf("Listening for GitHub webhooks on %s/webhook, metrics on %s/metrics\n", config.Server.Addr, config.Server.Addr)
+	Log(INFO, "Starting webhook server on %s", config.Server.Addr)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stop:
+		Log(INFO, "Received %s, shutting down", sig)
+	}
+	return server.shutdown(httpServer, time.Duration(config.Server.ShutdownTimeout)*time.Second)
+}
+
+// serveReady reports whether the server can take deliveries. It fails once shutdown has started
+// so load balancers stop sending traffic while in-flight work drains.
+func (s *webhookServer) serveReady(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if !programAvailable("gh") {
+		http.Error(w, "GitHub CLI (gh) not found", http.StatusServiceUnavailable)
+		return
+	}
+	if s.currentConfig().LLM.APIKey == "" {
+		http.Error(w, "no OpenAI API key configured", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// shutdown stops accepting deliveries and waits for in-flight requests and background jobs to
+// finish, up to timeout
+func (s *webhookServer) shutdown(httpServer *http.Server, timeout time.Duration) error {
+	atomic.StoreInt32(&s.draining, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := httpServer.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to shut down the server cleanly: %v", err)
+	}
+	s.queue.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		Log(INFO, "All background jobs finished")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for background jobs after %s", timeout)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SizeReportConfig configures the command that reports artifact sizes. The command is run
+// on the merge base and on HEAD, and must print one "<artifact> <size in bytes>" pair per line.
+type SizeReportConfig struct {
+	Command []string `json:"command"`
+}
+
+// runSizeReport runs the size report command in dir and parses its output
+func runSizeReport(command []string, dir string) (map[string]int64, error) {
+	Log(INFO, "Running size report in %s: %s", dir, strings.Join(command, " "))
+	cmd := &Command{Program: command[0], Args: command[1:], Dir: dir, ShowStderr: true, Timeout: longCommandTimeout}
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Size report command failed: %v", err)
+		return nil, fmt.Errorf("size report command failed in %s: %v", dir, err)
+	}
+
+	sizes := make(map[string]int64)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			Log(DEBUG, "Ignoring size report line: %s", line)
+			continue
+		}
+		sizes[strings.Join(fields[:len(fields)-1], " ")] = size
+	}
+	return sizes, nil
+}
+
+// formatBytes renders a byte count with a binary unit
+func formatBytes(n int64) string {
+	abs := n
+	if abs < 0 {
+		abs = -abs
+	}
+	switch {
+	case abs >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+	case abs >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
+
+// formatSignedBytes is formatBytes with an explicit sign for growth
+func formatSignedBytes(n int64) string {
+	if n > 0 {
+		return "+" + formatBytes(n)
+	}
+	return formatBytes(n)
+}
+
+// renderSizeTable renders the before/after sizes as a markdown table
+func renderSizeTable(before map[string]int64, after map[string]int64) string {
+	names := make(map[string]bool)
+	for name := range before {
+		names[name] = true
+	}
+	for name := range after {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var sb strings.Builder
+	sb.WriteString("| Artifact | Before | After | Delta |\n")
+	sb.WriteString("|---|---:|---:|---:|\n")
+	for _, name := range sorted {
+		b, hadBefore := before[name]
+		a, hasAfter := after[name]
+		beforeStr, afterStr := "-", "-"
+		if hadBefore {
+			beforeStr = formatBytes(b)
+		}
+		if hasAfter {
+			afterStr = formatBytes(a)
+		}
+
+		delta := "new"
+		switch {
+		case !hasAfter:
+			delta = "removed"
+		case hadBefore && b != 0:
+			delta = fmt.Sprintf("%s (%+.2f%%)", formatSignedBytes(a-b), float64(a-b)*100/float64(b))
+		case hadBefore:
+			delta = formatSignedBytes(a - b)
+		}
+		sb.WriteString(fmt.Sprintf("| %s | %s | %s | %s |\n", name, beforeStr, afterStr, delta))
+	}
+	return sb.String()
+}
+
+// buildSizeReportSection runs the size report on the merge base and HEAD and renders the delta
+func buildSizeReportSection(targetBranch string, sizeConfig SizeReportConfig) (string, error) {
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Println("Running size report on the base and head of the branch...")
+	var before map[string]int64
+	err = withWorktree(base, func(dir string) error {
+		before, err = runSizeReport(sizeConfig.Command, dir)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	var after map[string]int64
+	err = withHeadTree(func(dir string) error {
+		after, err = runSizeReport(sizeConfig.Command, dir)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(before) == 0 && len(after) == 0 {
+		Log(WARN, "Size report command produced no sizes")
+		return "", nil
+	}
+	return "## Build artifact size\n\n" + strings.TrimRight(renderSizeTable(before, after), "\n"), nil
+}
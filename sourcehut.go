@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SourceHutConfig configures sending patch series to lists.sr.ht mailing lists
+type SourceHutConfig struct {
+	Remotes map[string]SourceHutRemote `json:"remotes"` // keyed by git remote name
+	Token   string                     `json:"token"`   // lists.sr.ht personal access token, or SRHT_TOKEN
+}
+
+// SourceHutRemote is the mailing list that patches for a remote go to
+type SourceHutRemote struct {
+	List   string `json:"list"`   // e.g. "~alice/project-devel"
+	Prefix string `json:"prefix"` // subject prefix, default "PATCH"
+	API    string `json:"api"`    // lists.sr.ht instance, default https://lists.sr.ht
+}
+
+// coverSubjectPlaceholder and coverBlurbPlaceholder are what git format-patch leaves in the cover
+// letter for the author to replace
+const (
+	coverSubjectPlaceholder = "*** SUBJECT HERE ***"
+	coverBlurbPlaceholder   = "*** BLURB HERE ***"
+)
+
+// apiURL returns the lists.sr.ht instance of the remote
+func (r SourceHutRemote) apiURL() string {
+	if r.API == "" {
+		return "https://lists.sr.ht"
+	}
+	return strings.TrimRight(r.API, "/")
+}
+
+// address returns the list's posting address, e.g. ~alice/project-devel@lists.sr.ht
+func (r SourceHutRemote) address() string {
+	host := "lists.sr.ht"
+	if u, err := url.Parse(r.apiURL()); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return r.List + "@" + host
+}
+
+// srhtQuery runs a GraphQL query against the lists.sr.ht API and decodes its data into out
+func srhtQuery(remote SourceHutRemote, token string, query string, variables map[string]interface{}, out interface{}) error {
+	if err := requireNetwork("the lists.sr.ht API"); err != nil {
+		return err
+	}
+	if token == "" {
+		return newError(ErrAuth, "no lists.sr.ht token. Set sourcehut.token or SRHT_TOKEN")
+	}
+	data, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", remote.apiURL()+"/query", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call lists.sr.ht: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read lists.sr.ht response: %v", err)
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return newError(ErrAuth, "lists.sr.ht refused the token: %s", resp.Status)
+	}
+
+	var response struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unexpected response from lists.sr.ht (%s): %v", resp.Status, err)
+	}
+	if len(response.Errors) > 0 {
+		return fmt.Errorf("lists.sr.ht: %s", response.Errors[0].Message)
+	}
+	if out != nil {
+		return json.Unmarshal(response.Data, out)
+	}
+	return nil
+}
+
+// checkMailingList makes sure the remote's list exists before anything is sent to it
+func checkMailingList(remote SourceHutRemote, token string) error {
+	parts := strings.SplitN(strings.TrimPrefix(remote.List, "~"), "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("list %q should look like ~owner/name", remote.List)
+	}
+	owner, name := parts[0], parts[1]
+	var result struct {
+		User *struct {
+			List *struct {
+				ID int `json:"id"`
+			} `json:"list"`
+		} `json:"user"`
+	}
+	query := `query($owner: String!, $name: String!) { user(username: $owner) { list(name: $name) { id } } }`
+	if err := srhtQuery(remote, token, query, map[string]interface{}{"owner": owner, "name": name}, &result); err != nil {
+		return err
+	}
+	if result.User == nil || result.User.List == nil {
+		return fmt.Errorf("there is no mailing list %s on %s", remote.List, remote.apiURL())
+	}
+	return nil
+}
+
+// supersedePatchset marks the previous version of a series as superseded on the list
+func supersedePatchset(remote SourceHutRemote, token string, id int) error {
+	query := `mutation($id: Int!) { updatePatchset(id: $id, status: SUPERSEDED) { id } }`
+	return srhtQuery(remote, token, query, map[string]interface{}{"id": id}, nil)
+}
+
+// formatPatchSeries writes the branch's patches and a cover letter to dir, returning their paths
+// in order with the cover letter first
+func formatPatchSeries(targetBranch string, dir string, prefix string, version int) ([]string, error) {
+	args := []string{"format-patch", "--cover-letter", "--subject-prefix=" + prefix, "-o", dir}
+	if version > 1 {
+		args = append(args, fmt.Sprintf("-v%d", version))
+	}
+	output, err := newCommand("git", append(args, targetBranch+"..HEAD")...).Output()
+	if err != nil {
+		return nil, newError(ErrGitState, "failed to format patches: %v", err)
+	}
+	var files []string
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	sort.Strings(files)
+	if len(files) < 2 {
+		return nil, newError(ErrGitState, "no commits on the branch ahead of %s", targetBranch)
+	}
+	return files, nil
+}
+
+// fillCoverLetter replaces the placeholders git format-patch leaves in the cover letter
+func fillCoverLetter(path string, letter string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read cover letter: %v", err)
+	}
+	parts := strings.SplitN(letter, "\n", 2)
+	body := ""
+	if len(parts) > 1 {
+		body = strings.TrimSpace(parts[1])
+	}
+	content := strings.Replace(string(data), coverSubjectPlaceholder, strings.TrimSpace(parts[0]), 1)
+	content = strings.Replace(content, coverBlurbPlaceholder, body, 1)
+	return ioutil.WriteFile(path, []byte(content), 0600)
+}
+
+// addPatchNotes generates a note for reviewers and puts it below the "---" line of the patch,
+// where git am leaves it out of the commit
+func addPatchNotes(ctx context.Context, path string, llmConfig LLMConfig) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read patch: %v", err)
+	}
+	parts := strings.SplitN(string(data), "\n---\n", 2)
+	if len(parts) != 2 {
+		Log(WARN, "No --- line in %s, leaving it without notes", path)
+		return nil
+	}
+	notes, err := GeneratePatchNotes(ctx, parts[0], promptDiff(parts[1], llmConfig), llmConfig)
+	if err != nil {
+		return fmt.Errorf("failed to generate notes for %s: %w", filepath.Base(path), err)
+	}
+	if notes == "" {
+		return nil
+	}
+	content := parts[0] + "\n---\n" + notes + "\n\n" + parts[1]
+	return ioutil.WriteFile(path, []byte(content), 0600)
+}
+
+// runSourceHutCommand formats the branch as a patch series with a generated cover letter and
+// per-patch notes and mails it to the remote's lists.sr.ht list
+func runSourceHutCommand(args []string) error {
+	fs := flag.NewFlagSet("srht", flag.ExitOnError)
+	remoteName := fs.String("remote", "origin", "Git remote whose mailing list to send to")
+	targetBranch := fs.String("target", "master", "Branch the series is against")
+	version := fs.Int("v", 1, "Version of the series, for re-rolls")
+	previous := fs.String("previous", "", "Head of the previous version, to describe what changed in the cover letter")
+	supersedes := fs.Int("supersedes", 0, "lists.sr.ht patchset ID of the previous version, marked superseded after sending")
+	noNotes := fs.Bool("no-notes", false, "Don't generate notes below the --- of each patch")
+	dryRun := fs.Bool("dry-run", false, "Write the series to a directory without sending it")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	remote, ok := config.SourceHut.Remotes[*remoteName]
+	if !ok || remote.List == "" {
+		return fmt.Errorf("no mailing list configured for remote %s. Add it under sourcehut.remotes in the config", *remoteName)
+	}
+	if remote.Prefix == "" {
+		remote.Prefix = "PATCH"
+	}
+	if err := ensureConsent(true, config); err != nil {
+		return err
+	}
+	if !*dryRun && config.SourceHut.Token != "" {
+		if err := checkMailingList(remote, config.SourceHut.Token); err != nil {
+			return err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "gitscribe-series-")
+	if err != nil {
+		return fmt.Errorf("failed to create series directory: %v", err)
+	}
+	files, err := formatPatchSeries(*targetBranch, dir, remote.Prefix, *version)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Formatted %d patches for %s\n", len(files)-1, remote.address())
+
+	commits, err := newCommand("git", "log", "--reverse", "--format=%B", *targetBranch+"..HEAD").Output()
+	if err != nil {
+		return newError(ErrGitState, "failed to read commit messages: %v", err)
+	}
+	diffstat, err := newCommand("git", "diff", "--stat", *targetBranch+"...HEAD").Output()
+	if err != nil {
+		return newError(ErrGitState, "failed to get diffstat: %v", err)
+	}
+	notes := ""
+	if *previous != "" {
+		rangeDiff, err := getRangeDiff(*targetBranch, *previous, "HEAD", true)
+		if err != nil {
+			return err
+		}
+		notes = fmt.Sprintf("\n\nThis is v%d. Changes since the previous version (git range-diff):\n%s", *version, rangeDiff)
+	}
+	fmt.Println("Writing cover letter...")
+	ctx, stop := interruptContext()
+	defer stop()
+	letter, err := GenerateCoverLetter(ctx, string(commits), string(diffstat), notes, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to generate cover letter: %w", err)
+	}
+	if err := fillCoverLetter(files[0], letter); err != nil {
+		return err
+	}
+	if !*noNotes {
+		for _, file := range files[1:] {
+			fmt.Printf("Writing notes for %s...\n", filepath.Base(file))
+			if err := addPatchNotes(ctx, file, config.LLM); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *dryRun {
+		fmt.Printf("Series written to %s. Send it with: git send-email --to=%s %s/*.patch\n", dir, remote.address(), dir)
+		return nil
+	}
+	defer os.RemoveAll(dir)
+
+	if err := openInVim(files[0]); err != nil {
+		return fmt.Errorf("failed to open editor: %v", err)
+	}
+	sendArgs := append([]string{"send-email", "--to=" + remote.address()}, files...)
+	if err := (&Command{Program: "git", Args: sendArgs, Interactive: true}).Run(); err != nil {
+		return fmt.Errorf("failed to send the series: %v", err)
+	}
+	fmt.Printf("Sent to %s\n", remote.address())
+
+	if *supersedes > 0 {
+		if err := supersedePatchset(remote, config.SourceHut.Token, *supersedes); err != nil {
+			Log(WARN, "Failed to mark patchset %d superseded: %v", *supersedes, err)
+			fmt.Printf("Warning: couldn't mark patchset %d as superseded: %v\n", *supersedes, err)
+		} else {
+			fmt.Printf("Marked patchset %d as superseded\n", *supersedes)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// gitConfigBool reports whether a boolean git config setting is on
+func gitConfigBool(key string) bool {
+	output, err := newCommand("git", "config", "--bool", "--get", key).Output()
+	return err == nil && strings.TrimSpace(string(output)) == "true"
+}
+
+// isSparseCheckout reports whether only part of the repository is checked out, so files outside
+// the sparse patterns aren't on disk even though they're in every commit
+func isSparseCheckout() bool {
+	return gitConfigBool("core.sparseCheckout")
+}
+
+// sparsePatterns returns the sparse-checkout patterns of the current checkout and whether they
+// are in cone mode
+func sparsePatterns() ([]string, bool, error) {
+	output, err := newCommand("git", "sparse-checkout", "list").Output()
+	if err != nil {
+		return nil, false, newError(ErrGitState, "failed to list sparse-checkout patterns: %v", err)
+	}
+	var patterns []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, gitConfigBool("core.sparseCheckoutCone"), nil
+}
+
+// checkoutWorktree checks out rev into dir as a new worktree. In a sparse checkout only the same
+// paths are checked out, so builds and benchmarks of a big monorepo don't materialize all of it.
+func checkoutWorktree(dir string, rev string) error {
+	if !isSparseCheckout() {
+		return newCommand("git", "worktree", "add", "--detach", dir, rev).Run()
+	}
+	patterns, cone, err := sparsePatterns()
+	if err != nil {
+		return err
+	}
+	Log(DEBUG, "Checking out worktree with the %d sparse-checkout patterns of this checkout", len(patterns))
+	if err := newCommand("git", "worktree", "add", "--no-checkout", "--detach", dir, rev).Run(); err != nil {
+		return err
+	}
+	mode := "--no-cone"
+	if cone {
+		mode = "--cone"
+	}
+	if err := newCommand("git", append([]string{"-C", dir, "sparse-checkout", "set", mode}, patterns...)...).Run(); err != nil {
+		return err
+	}
+	return newCommand("git", "-C", dir, "checkout", "--detach", rev).Run()
+}
+
+// isMissingObject reports whether a git failure came from an object a partial clone hasn't
+// fetched, such as a blob outside the sparse cone when the promisor remote can't be reached
+func isMissingObject(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "promisor") || strings.Contains(message, "could not fetch") || strings.Contains(message, "missing blob")
+}
+
+// fetchFileFromHost fetches a file at a commit from the hosting API, for blobs a partial clone
+// doesn't have. Files are cached by commit.
+func fetchFileFromHost(rev string, path string) (string, error) {
+	repo, err := currentRepo()
+	if err != nil {
+		return "", err
+	}
+	output, err := newCommand("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}").Output()
+	if err != nil {
+		return "", newError(ErrGitState, "unknown revision %s: %v", rev, err)
+	}
+	sha := strings.TrimSpace(string(output))
+	var content string
+	err = cachedFetch("files", fmt.Sprintf("%s/%s@%s", repo, path, sha), &content, func() (interface{}, error) {
+		Log(INFO, "Fetching %s at %s from %s, it isn't available locally", path, sha[:7], repo)
+		escaped := strings.Split(path, "/")
+		for i := range escaped {
+			escaped[i] = url.PathEscape(escaped[i])
+		}
+		endpoint := fmt.Sprintf("repos/%s/contents/%s", repo, strings.Join(escaped, "/"))
+		content, err := ghAPIRaw(endpoint+"?ref="+sha, "application/vnd.github.raw")
+		if err != nil && errorKind(err) != ErrCapabilityDisabled {
+			// A local commit that hasn't been pushed can't have changed a file outside the checkout,
+			// so the default branch's copy is close enough for context
+			Log(WARN, "Failed to fetch %s at %s, using the default branch's copy: %v", path, sha[:7], err)
+			content, err = ghAPIRaw(endpoint, "application/vnd.github.raw")
+		}
+		return content, err
+	})
+	return content, err
+}
+
+// readWorkingFile reads a file of the repository from disk, or when a sparse checkout left it out,
+// from HEAD, fetching it from the hosting API if git doesn't have it either
+func readWorkingFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil || !os.IsNotExist(err) || !isSparseCheckout() {
+		return data, err
+	}
+	root, rootErr := repoRoot()
+	abs, absErr := filepath.Abs(path)
+	if rootErr != nil || absErr != nil {
+		return data, err
+	}
+	rel, relErr := filepath.Rel(root, abs)
+	if relErr != nil || strings.HasPrefix(rel, "..") {
+		return data, err
+	}
+	rel = filepath.ToSlash(rel)
+
+	Log(DEBUG, "%s isn't checked out, reading it from HEAD", rel)
+	output, showErr := newCommand("git", "show", "HEAD:"+rel).Output()
+	if showErr == nil {
+		return output, nil
+	}
+	if !isMissingObject(showErr) {
+		return data, err
+	}
+	content, fetchErr := fetchFileFromHost("HEAD", rel)
+	if fetchErr != nil {
+		return nil, fmt.Errorf("%s isn't checked out and couldn't be fetched: %v", rel, fetchErr)
+	}
+	return []byte(content), nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// StreamOptions asks for the token usage at the end of a streamed response
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// chatStreamChunk is one server-sent event of a streamed chat completion
+type chatStreamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error json.RawMessage `json:"error"`
+}
+
+// messageStream returns where generated messages are printed as they arrive: stderr when it's a
+// terminal and llm.stream isn't "off", so scripts reading stdout only get the final message
+func messageStream(llmConfig LLMConfig) io.Writer {
+	if llmConfig.Stream == "off" {
+		return nil
+	}
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return os.Stderr
+}
+
+// makeStreamingRequest makes a chat request like makeOpenAIRequest, writing the reply to w as it
+// is generated. Without a writer it waits for the whole reply.
+func makeStreamingRequest(ctx context.Context, messages []ChatMessage, config LLMConfig, w io.Writer) (string, error) {
+	if w == nil {
+		return makeOpenAIRequest(ctx, messages, config)
+	}
+	messages, err := redactMessages(messages)
+	if err != nil {
+		return "", err
+	}
+	return retryChat(ctx, config, promptTokens(messages), func(config LLMConfig) (string, error) {
+		out := &countingWriter{w: w}
+		var content string
+		var err error
+		switch config.Provider {
+		case "ollama":
+			content, err = ollamaRequest(ctx, ChatRequest{Messages: messages}, config, out)
+		case "mock":
+			content, err = mockRequest(ChatRequest{Messages: messages}, config, out)
+		default:
+			content, err = streamChatRequest(ctx, messages, config, out)
+		}
+		// Retrying or falling back would print the reply again after the part already printed
+		if err != nil && out.written > 0 {
+			fmt.Fprintln(w)
+			return "", &streamedError{err}
+		}
+		return content, err
+	})
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w       io.Writer
+	written int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.written += n
+	return n, err
+}
+
+// streamedError is a request that failed after part of its reply was printed, so it's neither
+// retried nor sent to a fallback model
+type streamedError struct {
+	err error
+}
+
+func (e *streamedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *streamedError) Unwrap() error {
+	return e.err
+}
+
+// streamed reports whether err is a request that failed after part of its reply was printed
+func streamed(err error) bool {
+	var streamedErr *streamedError
+	return errors.As(err, &streamedErr)
+}
+
+// streamChatRequest makes one streamed chat completions request
+func streamChatRequest(ctx context.Context, messages []ChatMessage, config LLMConfig, w io.Writer) (string, error) {
+	requestBody := ChatRequest{
+		Model:          config.Model,
+		Messages:       messages,
+		Temperature:    config.Temperature,
+		MaxTokens:      config.MaxTokens,
+		PromptCacheKey: promptCacheKey(messages),
+		Stream:         true,
+		StreamOptions:  &StreamOptions{IncludeUsage: true},
+	}
+	jsonData, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %v", err)
+	}
+	if err := checkChatEndpoint(config); err != nil {
+		return "", err
+	}
+
+	ctx, cancel := requestContext(ctx, config)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", chatEndpoint(config), bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", config.APIKey))
+
+	client, err := llmHTTPClient(config)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		err = requestError(ctx, config, fmt.Errorf("failed to send request: %w", err))
+		recordLLMError(err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Errors come back as a normal JSON response
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", requestError(ctx, config, fmt.Errorf("failed to read response: %v", err))
+		}
+		var chatResponse ChatResponse
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(body, &chatResponse) != nil || chatResponse.Error != nil {
+			err := apiError(resp.StatusCode, resp.Header, body)
+			recordLLMError(err)
+			return "", err
+		}
+		recordLLMUsage(config, chatResponse)
+		// The server ignored stream, so the reply came whole
+		content, err := validateChatResponse(chatResponse, config.MaxTokens)
+		if err != nil {
+			recordLLMError(err)
+			return "", err
+		}
+		fmt.Fprintln(w, content)
+		return content, nil
+	}
+
+	var content strings.Builder
+	var usage ChatResponse
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+		var chunk chatStreamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("failed to unmarshal stream chunk: %v", err)
+		}
+		// Errors in the middle of a stream come as an event of their own
+		if chunk.Error != nil {
+			err := apiError(http.StatusInternalServerError, resp.Header, []byte(data))
+			recordLLMError(err)
+			return "", err
+		}
+		if chunk.Usage != nil {
+			usage.Usage.PromptTokens = chunk.Usage.PromptTokens
+			usage.Usage.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			if choice.FinishReason == "content_filter" {
+				return "", newError(ErrContentFilter, "the provider's content filter blocked the reply")
+			}
+			content.WriteString(choice.Delta.Content)
+			fmt.Fprint(w, choice.Delta.Content)
+		}
+	}
+	fmt.Fprintln(w)
+	if err := scanner.Err(); err != nil {
+		err = requestError(ctx, config, fmt.Errorf("failed to read response stream: %v", err))
+		recordLLMError(err)
+		return "", err
+	}
+	recordLLMUsage(config, usage)
+	if strings.TrimSpace(content.String()) == "" {
+		return "", newError(ErrProviderUnavailable, "the API returned an empty reply")
+	}
+	return content.String(), nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// StructuredDiffConfig controls how diffs of notebooks and JSON and YAML files are summarized
+// before they're put in a prompt
+type StructuredDiffConfig struct {
+	Raw      bool `json:"raw"`       // send these diffs as they are
+	MinBytes int  `json:"min_bytes"` // smaller JSON and YAML diffs are sent as they are, default 4000
+}
+
+// maxStructuredChanges is how many changed keys are listed for one file
+const maxStructuredChanges = 100
+
+// indexLinePattern matches the blob IDs in the index line of a git diff
+var indexLinePattern = regexp.MustCompile(`(?m)^index ([0-9a-f]+)\.\.([0-9a-f]+)`)
+
+// structuredKind returns "notebook", "json" or "yaml" for files whose diffs are summarized, or ""
+func structuredKind(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ipynb":
+		return "notebook"
+	case ".json":
+		return "json"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return ""
+}
+
+// readBlob returns the content of a blob in a diff's index line, or nil for the missing side of
+// an added or deleted file
+func readBlob(id string) ([]byte, error) {
+	if strings.Trim(id, "0") == "" {
+		return nil, nil
+	}
+	return newCommand("git", "cat-file", "blob", id).Output()
+}
+
+// summarizeStructuredDiffs replaces the diffs of notebooks and large JSON and YAML files with
+// what changed in their structure, leaving the rest of the diff as it is
+func summarizeStructuredDiffs(diff string, structured StructuredDiffConfig) string {
+	if structured.Raw {
+		return diff
+	}
+	files := splitDiffByFile(diff)
+	changed := false
+	for i, file := range files {
+		if content := structuredFileDiff(file, structured); content != file.Content {
+			files[i].Content = content
+			changed = true
+		}
+	}
+	if !changed {
+		return diff
+	}
+	var sb strings.Builder
+	for _, file := range files {
+		sb.WriteString(file.Content)
+	}
+	return sb.String()
+}
+
+// structuredFileDiff returns the summary of one file's diff, or its diff when it isn't summarized
+func structuredFileDiff(file FileDiff, structured StructuredDiffConfig) string {
+	kind := structuredKind(file.Path)
+	if structured.Raw || kind == "" || (kind != "notebook" && len(file.Content) < structured.MinBytes) {
+		return file.Content
+	}
+	match := indexLinePattern.FindStringSubmatch(file.Content)
+	if match == nil {
+		return file.Content
+	}
+	before, err := readBlob(match[1])
+	if err == nil {
+		var after []byte
+		after, err = readBlob(match[2])
+		if err == nil {
+			var summary string
+			if summary, err = summarizeStructuredChange(kind, file.Path, before, after); err == nil {
+				Log(DEBUG, "Summarized the %d byte diff of %s as %d bytes", len(file.Content), file.Path, len(summary))
+				header := strings.SplitN(file.Content, "\n", 2)[0]
+				return header + "\n" + summary
+			}
+		}
+	}
+	Log(DEBUG, "Sending the raw diff of %s: %v", file.Path, err)
+	return file.Content
+}
+
+// summarizeStructuredChange describes the change between two versions of a structured file
+func summarizeStructuredChange(kind string, path string, before []byte, after []byte) (string, error) {
+	if kind == "notebook" {
+		return notebookDiff(path, before, after)
+	}
+	parse := parseJSONKeys
+	if kind == "yaml" {
+		parse = parseYAMLKeys
+	}
+	beforeKeys, err := parse(before)
+	if err != nil {
+		return "", err
+	}
+	afterKeys, err := parse(after)
+	if err != nil {
+		return "", err
+	}
+	return keyChanges(path, beforeKeys, afterKeys), nil
+}
+
+// parseJSONKeys flattens a JSON document into its leaf values by key path, such as
+// "spec.containers[0].image"
+func parseJSONKeys(data []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	if data == nil {
+		return keys, nil
+	}
+	var document interface{}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("not valid JSON: %v", err)
+	}
+	flattenJSON("", document, keys)
+	return keys, nil
+}
+
+// flattenJSON adds the leaf values under prefix to keys
+func flattenJSON(prefix string, value interface{}, keys map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if prefix != "" {
+				key = prefix + "." + key
+			}
+			flattenJSON(key, child, keys)
+		}
+		if len(v) == 0 {
+			keys[prefix] = "{}"
+		}
+	case []interface{}:
+		for i, child := range v {
+			flattenJSON(fmt.Sprintf("%s[%d]", prefix, i), child, keys)
+		}
+		if len(v) == 0 {
+			keys[prefix] = "[]"
+		}
+	default:
+		encoded, _ := json.Marshal(v)
+		keys[prefix] = string(encoded)
+	}
+}
+
+// parseYAMLKeys flattens the block mappings and sequences of a YAML document into leaf values by
+// key path. It covers what config files use, not all of YAML, and multi-line scalars are joined
+// into one value.
+func parseYAMLKeys(data []byte) (map[string]string, error) {
+	keys := make(map[string]string)
+	type level struct {
+		indent int
+		path   string
+		items  int  // sequence items seen at this level
+		item   bool // a sequence item rather than a key
+	}
+	stack := []level{{indent: -1}}
+	multiline := ""
+	multilineIndent := -1
+	document := 0
+
+	for number, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if multiline != "" {
+			if trimmed == "" || indent > multilineIndent {
+				keys[multiline] = strings.TrimSpace(keys[multiline] + " " + trimmed)
+				continue
+			}
+			multiline = ""
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if trimmed == "---" {
+			document++
+			stack = []level{{indent: -1, path: fmt.Sprintf("[doc %d]", document)}}
+			continue
+		}
+		if strings.HasPrefix(line, "\t") {
+			return nil, fmt.Errorf("tab indentation on line %d", number+1)
+		}
+		// Sequences can be indented as far as the key they belong to
+		isItem := strings.HasPrefix(trimmed, "- ") || trimmed == "-"
+		for len(stack) > 1 {
+			top := stack[len(stack)-1]
+			if top.indent < indent || (isItem && top.indent == indent && !top.item) {
+				break
+			}
+			stack = stack[:len(stack)-1]
+		}
+		parent := &stack[len(stack)-1]
+
+		if isItem {
+			item := fmt.Sprintf("%s[%d]", parent.path, parent.items)
+			parent.items++
+			stack = append(stack, level{indent: indent, path: item, item: true})
+			trimmed = strings.TrimSpace(strings.TrimPrefix(trimmed, "-"))
+			if trimmed == "" {
+				continue
+			}
+			// The mapping of "- key: value" items is indented past the dash
+			indent += 2
+			if !strings.Contains(trimmed, ": ") && !strings.HasSuffix(trimmed, ":") {
+				keys[item] = trimmed
+				continue
+			}
+			parent = &stack[len(stack)-1]
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 || (parts[1] != "" && !strings.HasPrefix(parts[1], " ")) {
+			return nil, fmt.Errorf("unsupported YAML on line %d", number+1)
+		}
+		key := strings.Trim(strings.TrimSpace(parts[0]), `"'`)
+		if parent.path != "" {
+			key = parent.path + "." + key
+		}
+		value := strings.TrimSpace(parts[1])
+		if hash := strings.Index(value, " #"); hash != -1 {
+			value = strings.TrimSpace(value[:hash])
+		}
+		switch value {
+		case "":
+			stack = append(stack, level{indent: indent, path: key})
+		case "|", ">", "|-", ">-":
+			keys[key] = ""
+			multiline, multilineIndent = key, indent
+		default:
+			keys[key] = value
+		}
+	}
+	return keys, nil
+}
+
+// keyChanges lists the keys added, removed and changed between two flattened documents
+func keyChanges(path string, before map[string]string, after map[string]string) string {
+	var lines []string
+	for _, key := range sortedUnion(before, after) {
+		old, inBefore := before[key]
+		value, inAfter := after[key]
+		switch {
+		case !inBefore:
+			lines = append(lines, fmt.Sprintf("added   %s: %s", key, shortValue(value)))
+		case !inAfter:
+			lines = append(lines, fmt.Sprintf("removed %s: %s", key, shortValue(old)))
+		case old != value:
+			lines = append(lines, fmt.Sprintf("changed %s: %s -> %s", key, shortValue(old), shortValue(value)))
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d changed keys in %s, which had %d keys before and %d after. Its raw diff is left out:\n", len(lines), path, len(before), len(after)))
+	for i, line := range lines {
+		if i == maxStructuredChanges {
+			sb.WriteString(fmt.Sprintf("... and %d more\n", len(lines)-i))
+			break
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+// shortValue truncates long values in key change lists
+func shortValue(value string) string {
+	if len(value) > 80 {
+		return cutAtRune(value, 77) + "..."
+	}
+	return value
+}
+
+// notebookDiff diffs the cell sources of two versions of a Jupyter notebook, leaving out outputs,
+// execution counts and metadata
+func notebookDiff(path string, before []byte, after []byte) (string, error) {
+	beforeCells, err := notebookCells(before)
+	if err != nil {
+		return "", err
+	}
+	afterCells, err := notebookCells(after)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := ioutil.TempDir("", "gitscribe-notebook-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	beforePath, afterPath := filepath.Join(dir, "before"), filepath.Join(dir, "after")
+	if err := ioutil.WriteFile(beforePath, []byte(beforeCells), 0600); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(afterPath, []byte(afterCells), 0600); err != nil {
+		return "", err
+	}
+	// git diff --no-index exits with 1 when the files differ
+	output, err := newCommand("git", "diff", "--no-index", "--no-prefix", beforePath, afterPath).Output()
+	if err != nil && len(output) == 0 {
+		return "", err
+	}
+	hunks := string(output)
+	if idx := strings.Index(hunks, "\n@@"); idx != -1 {
+		hunks = hunks[idx+1:]
+	} else {
+		hunks = "Only outputs or metadata changed.\n"
+	}
+	return fmt.Sprintf("Changes to the cells of %s, with outputs and execution counts left out:\n%s", path, hunks), nil
+}
+
+// notebookCells renders the cells of a notebook as text, one "# %% [type]" header per cell
+func notebookCells(data []byte) (string, error) {
+	if data == nil {
+		return "", nil
+	}
+	var notebook struct {
+		Cells []struct {
+			CellType string          `json:"cell_type"`
+			Source   json.RawMessage `json:"source"`
+		} `json:"cells"`
+	}
+	if err := json.Unmarshal(data, &notebook); err != nil {
+		return "", fmt.Errorf("not a valid notebook: %v", err)
+	}
+	var sb strings.Builder
+	for _, cell := range notebook.Cells {
+		// Sources are either one string or a list of lines
+		var source string
+		if err := json.Unmarshal(cell.Source, &source); err != nil {
+			var lines []string
+			if err := json.Unmarshal(cell.Source, &lines); err != nil {
+				return "", fmt.Errorf("unexpected cell source: %v", err)
+			}
+			source = strings.Join(lines, "")
+		}
+		sb.WriteString(fmt.Sprintf("# %%%% [%s]\n%s\n", cell.CellType, strings.TrimRight(source, "\n")))
+	}
+	return sb.String(), nil
+}
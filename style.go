@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxStyleReferenceCommits caps how many commits are read to learn a reference style
+const maxStyleReferenceCommits = 50
+
+// StyleProfile describes how a set of reference commit messages are written
+type StyleProfile struct {
+	Source       string
+	Count        int
+	Imperative   int      // subjects starting with an imperative verb rather than a past or -ing form
+	ScopePrefix  int      // subjects starting with "scope: "
+	TrailingDot  int      // subjects ending with a period
+	Capitalized  int      // subjects starting with a capital letter
+	WithBody     int      // messages with a body after the subject
+	WithBullets  int      // bodies written as bullet lists
+	SubjectChars int      // total subject length
+	BodyLines    int      // total body length in lines
+	Examples     []string // a few subjects to imitate
+}
+
+// scopePrefixPattern matches a "scope: " or "scope(sub): " subject prefix
+var scopePrefixPattern = regexp.MustCompile(`^[\w./-]+(\([\w./-]+\))?!?: `)
+
+// referenceMessages reads the commit messages of an author, or of a range when the reference
+// contains "..", most recent first
+func referenceMessages(reference string) ([]string, error) {
+	args := []string{"log", "--no-merges", fmt.Sprintf("-n%d", maxStyleReferenceCommits), "--format=%B%x00"}
+	if strings.Contains(reference, "..") {
+		args = append(args, reference)
+	} else {
+		args = append(args, "--author="+reference)
+	}
+	output, err := newCommand("git", args...).Output()
+	if err != nil {
+		return nil, newError(ErrGitState, "failed to read commits for %s: %v", reference, err)
+	}
+
+	var messages []string
+	for _, message := range strings.Split(string(output), "\x00") {
+		if message = strings.TrimSpace(message); message != "" {
+			messages = append(messages, message)
+		}
+	}
+	if len(messages) == 0 {
+		return nil, newError(ErrGitState, "no commits found for %s", reference)
+	}
+	return messages, nil
+}
+
+// extractStyle measures the style features of the reference messages
+func extractStyle(source string, messages []string) StyleProfile {
+	profile := StyleProfile{Source: source, Count: len(messages)}
+	for _, message := range messages {
+		parts := strings.SplitN(message, "\n", 2)
+		subject := strings.TrimSpace(parts[0])
+		profile.SubjectChars += len(subject)
+		if len(profile.Examples) < 5 {
+			profile.Examples = append(profile.Examples, subject)
+		}
+
+		if scopePrefixPattern.MatchString(subject) {
+			profile.ScopePrefix++
+			subject = scopePrefixPattern.ReplaceAllString(subject, "")
+		}
+		if strings.HasSuffix(subject, ".") {
+			profile.TrailingDot++
+		}
+		if first, _ := utf8.DecodeRuneInString(subject); subject != "" && !unicode.IsLower(first) {
+			profile.Capitalized++
+		}
+		if words := strings.Fields(strings.ToLower(subject)); len(words) > 0 {
+			verb := words[0]
+			if !strings.HasSuffix(verb, "ed") && !strings.HasSuffix(verb, "ing") && !(strings.HasSuffix(verb, "s") && !strings.HasSuffix(verb, "ss")) {
+				profile.Imperative++
+			}
+		}
+
+		if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+			continue
+		}
+		profile.WithBody++
+		bullets := false
+		for _, line := range strings.Split(strings.TrimSpace(parts[1]), "\n") {
+			profile.BodyLines++
+			trimmed := strings.TrimSpace(line)
+			bullets = bullets || strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* ")
+		}
+		if bullets {
+			profile.WithBullets++
+		}
+	}
+	return profile
+}
+
+// mostly reports whether at least half of the reference messages have a feature
+func (p StyleProfile) mostly(n int) bool {
+	return n*2 >= p.Count
+}
+
+// prompt describes the style for the LLM to follow
+func (p StyleProfile) prompt() string {
+	var rules []string
+	if p.mostly(p.Imperative) {
+		rules = append(rules, "Write the first line in the imperative mood (\"Add\", not \"Added\" or \"Adds\").")
+	} else {
+		rules = append(rules, "Write the first line in the past tense or third person (\"Added\" or \"Adds\"), not the imperative.")
+	}
+	if !p.mostly(p.ScopePrefix) {
+		rules = append(rules, "Don't start the first line with a \"scope: \" prefix unless one is required.")
+	}
+	if p.mostly(p.Capitalized) {
+		rules = append(rules, "Start the first line with a capital letter.")
+	} else {
+		rules = append(rules, "Start the first line with a lowercase letter.")
+	}
+	if p.mostly(p.TrailingDot) {
+		rules = append(rules, "End the first line with a period.")
+	} else {
+		rules = append(rules, "Don't end the first line with a period.")
+	}
+	rules = append(rules, fmt.Sprintf("Keep the first line around %d characters.", p.SubjectChars/p.Count))
+	switch {
+	case !p.mostly(p.WithBody):
+		rules = append(rules, "Usually write only the first line, adding a short body only if the change needs explaining.")
+	case p.WithBullets*2 >= p.WithBody:
+		rules = append(rules, fmt.Sprintf("Write the body as a bullet list of about %d lines.", p.BodyLines/p.WithBody))
+	default:
+		rules = append(rules, fmt.Sprintf("Write the body as prose of about %d lines.", p.BodyLines/p.WithBody))
+	}
+
+	return fmt.Sprintf("Match the style of these reference commit messages (%s):\n- %s\nExamples of their first lines:\n%s\n\n",
+		p.Source, strings.Join(rules, "\n- "), strings.Join(p.Examples, "\n"))
+}
+
+// buildStylePrompt learns the commit message style of an author or ref range and describes it
+// for the LLM. An empty reference returns an empty prompt.
+func buildStylePrompt(reference string) (string, error) {
+	if reference == "" {
+		return "", nil
+	}
+	messages, err := referenceMessages(reference)
+	if err != nil {
+		return "", err
+	}
+	profile := extractStyle(reference, messages)
+	Log(INFO, "Learned commit style from %d commits (%s)", profile.Count, reference)
+	return profile.prompt(), nil
+}
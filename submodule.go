@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SubmoduleBump is a change of a submodule pointer from one commit to another
+type SubmoduleBump struct {
+	Path   string
+	OldSHA string
+	NewSHA string
+}
+
+// getSubmoduleBumps inspects the raw diff of the branch and returns its submodule pointer changes,
+// along with whether the branch changes anything other than submodule pointers
+func getSubmoduleBumps(base string, head string) ([]SubmoduleBump, bool, error) {
+	cmd := newCommand("git", "diff", "--raw", "--no-abbrev", base+"..."+head)
+	output, err := cmd.Output()
+	if err != nil {
+		Log(ERROR, "Failed to get raw diff: %v", err)
+		return nil, false, fmt.Errorf("failed to get raw diff for %s...%s: %v", base, head, err)
+	}
+
+	var bumps []SubmoduleBump
+	otherChanges := false
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		// Format is ":<old mode> <new mode> <old sha> <new sha> <status>\t<path>"
+		parts := strings.SplitN(line, "\t", 2)
+		fields := strings.Fields(parts[0])
+		if len(parts) != 2 || len(fields) < 5 {
+			continue
+		}
+		if fields[0] == ":160000" && fields[1] == "160000" {
+			bumps = append(bumps, SubmoduleBump{Path: parts[1], OldSHA: fields[2], NewSHA: fields[3]})
+		} else {
+			otherChanges = true
+		}
+	}
+	return bumps, otherChanges, nil
+}
+
+// submoduleLog returns the subjects of the commits a submodule bump pulls in, fetching the
+// submodule's history if the new commit isn't available locally yet
+func submoduleLog(bump SubmoduleBump) (string, error) {
+	logCmd := func() ([]byte, error) {
+		return newCommand("git", "-C", bump.Path, "log", "--reverse", "--format=%h %s", bump.OldSHA+".."+bump.NewSHA).Output()
+	}
+
+	output, err := logCmd()
+	if err != nil {
+		Log(INFO, "Commits for %s not available locally, fetching", bump.Path)
+		if fetchErr := newCommand("git", "-C", bump.Path, "fetch", "--quiet").Run(); fetchErr != nil {
+			Log(ERROR, "Failed to fetch submodule %s: %v", bump.Path, fetchErr)
+			return "", fmt.Errorf("failed to fetch submodule %s: %v. Run git submodule update --init", bump.Path, fetchErr)
+		}
+		output, err = logCmd()
+		if err != nil {
+			Log(ERROR, "Failed to get submodule log for %s: %v", bump.Path, err)
+			return "", fmt.Errorf("failed to get commits of submodule %s between %s and %s: %v", bump.Path, bump.OldSHA[:7], bump.NewSHA[:7], err)
+		}
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// enrichSubmoduleCommits replaces the branch's "update submodule" commits with the commits pulled
+// in from the submodules when the branch does nothing but bump submodule pointers
+func enrichSubmoduleCommits(targetBranch string, commits string) (string, error) {
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return "", err
+	}
+	bumps, otherChanges, err := getSubmoduleBumps(base, headRev)
+	if err != nil {
+		return "", err
+	}
+	if len(bumps) == 0 || otherChanges {
+		return commits, nil
+	}
+
+	Log(INFO, "Branch only bumps %d submodules, describing their commits instead", len(bumps))
+	var sb strings.Builder
+	sb.WriteString(commits)
+	sb.WriteString("\n\nThis branch only updates submodule pointers. Describe what changed inside each submodule using these commits:\n")
+	for _, bump := range bumps {
+		log, err := submoduleLog(bump)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(fmt.Sprintf("\nSubmodule %s (%s..%s):\n%s\n", bump.Path, bump.OldSHA[:7], bump.NewSHA[:7], log))
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// defaultSummaryConcurrency is how many summaries are requested at once unless
+// llm.pipeline.concurrency says otherwise
+const defaultSummaryConcurrency = 4
+
+// defaultBatchTokens is how many tokens of small files' diffs are summarized in one request unless
+// llm.pipeline.batch_tokens says otherwise
+const defaultBatchTokens = 6000
+
+// maxCondenseRounds is how many times summaries too large for the context are condensed before
+// giving up
+const maxCondenseRounds = 3
+
+// summaryChunk is a piece of one file's diff small enough to summarize in one request
+type summaryChunk struct {
+	file  int    // index into the diff's files
+	name  string // the file's path, and which part this is if there are several
+	part  int
+	parts int
+	diff  string
+}
+
+// overflowsContext reports whether a diff is too large for the model's context and should be
+// summarized file by file rather than trimmed
+func overflowsContext(diff string, llmConfig LLMConfig) bool {
+	// Summaries are built from file contents, which mustn't be sent in local-context-only mode
+	if llmConfig.LocalContextOnly || llmConfig.Pipeline.OnOverflow == "trim" {
+		return false
+	}
+	return diffPromptTokens(diff, llmConfig) > diffTokenBudget(llmConfig)
+}
+
+// packChunks packs units of text, in order, into chunks that each fit in budget tokens, starting
+// every chunk with prefix. A unit larger than the budget gets a chunk of its own.
+func packChunks(prefix string, units []string, budget int) []string {
+	var chunks []string
+	var sb strings.Builder
+	base := estimateTokens(prefix)
+	tokens := base
+	for _, unit := range units {
+		unitTokens := estimateTokens(unit)
+		if sb.Len() > 0 && tokens+unitTokens > budget {
+			chunks = append(chunks, prefix+sb.String())
+			sb.Reset()
+			tokens = base
+		}
+		sb.WriteString(unit)
+		tokens += unitTokens
+	}
+	if sb.Len() > 0 {
+		chunks = append(chunks, prefix+sb.String())
+	}
+	return chunks
+}
+
+// chunkFileDiff splits a file's diff into pieces that each fit in budget tokens, between hunks
+// where it can and between lines of a hunk that doesn't fit on its own. Every piece starts with
+// the file's diff header.
+func chunkFileDiff(diff string, budget int) []string {
+	if estimateTokens(diff) <= budget {
+		return []string{diff}
+	}
+	header, hunks := splitHunks(diff)
+	var units []string
+	if len(hunks) == 0 {
+		parts := strings.SplitAfterN(diff, "\n", 2)
+		header = parts[0]
+		if len(parts) == 2 {
+			units = strings.SplitAfter(parts[1], "\n")
+		}
+	}
+	for _, hunk := range hunks {
+		if estimateTokens(header+hunk.header+hunk.body) <= budget {
+			units = append(units, hunk.header+hunk.body)
+			continue
+		}
+		lines := strings.SplitAfter(hunk.body, "\n")
+		lines[0] = hunk.header + lines[0]
+		units = append(units, lines...)
+	}
+	return packChunks(header, units, budget)
+}
+
+// forEachConcurrently calls fn for 0 to n-1 with at most workers calls at once. After the first
+// error no more calls are started, the context passed to the running ones is canceled and that
+// error is returned.
+func forEachConcurrently(ctx context.Context, n int, workers int, fn func(ctx context.Context, i int) error) error {
+	if workers < 1 {
+		workers = defaultSummaryConcurrency
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	for i := 0; i < n && ctx.Err() == nil; i++ {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(indexes)
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		return newError(ErrCanceled, "canceled: %w", ctx.Err())
+	}
+	return firstErr
+}
+
+// summarizeFiles summarizes the change to each file in the diff. Files too large for one
+// request are summarized in parts, and summaries too large for the model's context together
+// are condensed until they fit.
+func summarizeFiles(ctx context.Context, diff string, llmConfig LLMConfig) (string, error) {
+	files := splitDiffByFile(diff)
+	chunks := fileChunks(files, llmConfig)
+	summaries, err := summarizeChunks(ctx, chunks, llmConfig)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([][]string, len(files))
+	for i, chunk := range chunks {
+		parts[chunk.file] = append(parts[chunk.file], summaries[i])
+	}
+	var sb strings.Builder
+	for i, file := range files {
+		sb.WriteString(fmt.Sprintf("- %s (+%d -%d): %s\n", file.Path, file.Added, file.Removed, strings.Join(parts[i], " ")))
+	}
+	return condenseSummaries(ctx, sb.String(), llmConfig)
+}
+
+// fileChunks splits the files of a diff into the chunks they are summarized in
+func fileChunks(files []FileDiff, llmConfig LLMConfig) []summaryChunk {
+	budget := diffTokenBudget(llmConfig)
+	var chunks []summaryChunk
+	for i, file := range files {
+		pieces := chunkFileDiff(structuredFileDiff(file, llmConfig.StructuredDiffs), budget)
+		for part, piece := range pieces {
+			name := file.Path
+			if len(pieces) > 1 {
+				name = fmt.Sprintf("%s (part %d of %d)", name, part+1, len(pieces))
+			}
+			chunks = append(chunks, summaryChunk{file: i, name: name, part: part, parts: len(pieces), diff: piece})
+		}
+	}
+	return chunks
+}
+
+// summarizeChunks summarizes each chunk, taking the ones summarized before, such as by gs
+// prefetch, from the cache
+func summarizeChunks(ctx context.Context, chunks []summaryChunk, llmConfig LLMConfig) ([]string, error) {
+	summaries := make([]string, len(chunks))
+	var pending []summaryChunk
+	var indexes []int
+	for i, chunk := range chunks {
+		if summary, ok := cachedSummary(chunk, llmConfig); ok {
+			summaries[i] = summary
+			continue
+		}
+		pending = append(pending, chunk)
+		indexes = append(indexes, i)
+	}
+	if len(pending) == 0 {
+		Log(INFO, "Using %d cached file summaries", len(chunks))
+		return summaries, nil
+	}
+	requests := batchChunks(pending, llmConfig)
+	Log(INFO, "Summarizing %d chunks in %d requests with %s, %d were cached", len(pending), len(requests), llmConfig.Model, len(chunks)-len(pending))
+
+	err := forEachConcurrently(ctx, len(requests), llmConfig.Pipeline.Concurrency, func(ctx context.Context, i int) error {
+		batch := requests[i]
+		if len(batch) > 1 {
+			paths := make([]string, len(batch))
+			diffs := make([]string, len(batch))
+			for j, c := range batch {
+				paths[j], diffs[j] = pending[c].name, pending[c].diff
+			}
+			batchSummaries, err := GenerateFileSummaries(ctx, paths, diffs, llmConfig)
+			switch {
+			case errorKind(err) == ErrContentFilter:
+				// Summarized one by one, only the file the filter refuses is left out
+				Log(WARN, "%v. Summarizing the %d files of the batch one by one", err, len(batch))
+			case err != nil:
+				return fmt.Errorf("failed to summarize %s and %d other files: %w", paths[0], len(batch)-1, err)
+			default:
+				for j, c := range batch {
+					summaries[indexes[c]] = batchSummaries[j]
+					if batchSummaries[j] != "" {
+						cacheSummary(pending[c], llmConfig, batchSummaries[j])
+					}
+				}
+			}
+		}
+		for _, c := range batch {
+			if summaries[indexes[c]] != "" {
+				continue
+			}
+			if len(batch) > 1 {
+				Log(DEBUG, "The batched reply left out %s, summarizing it on its own", pending[c].name)
+			}
+			summary, err := summarizeChunk(ctx, pending[c], llmConfig)
+			if err != nil {
+				return err
+			}
+			summaries[indexes[c]] = summary
+		}
+		return nil
+	})
+	return summaries, err
+}
+
+// batchChunks groups the chunks to summarize into requests: files small enough are packed into
+// batches of up to llm.pipeline.batch_tokens tokens, and every other chunk gets a request of its
+// own. Each request is a list of indexes into chunks.
+func batchChunks(chunks []summaryChunk, llmConfig LLMConfig) [][]int {
+	budget := llmConfig.Pipeline.BatchTokens
+	if budget == 0 {
+		budget = defaultBatchTokens
+	}
+	if limit := diffTokenBudget(llmConfig); budget > limit {
+		budget = limit
+	}
+	var requests [][]int
+	var batch []int
+	tokens := 0
+	for i, chunk := range chunks {
+		chunkTokens := estimateTokens(chunk.diff)
+		// Files taking up much of a batch gain little from sharing it
+		if budget < 0 || chunk.parts > 1 || chunkTokens > budget/4 {
+			requests = append(requests, []int{i})
+			continue
+		}
+		if len(batch) > 0 && tokens+chunkTokens > budget {
+			requests = append(requests, batch)
+			batch, tokens = nil, 0
+		}
+		batch = append(batch, i)
+		tokens += chunkTokens
+	}
+	if len(batch) > 0 {
+		requests = append(requests, batch)
+	}
+	return requests
+}
+
+// summarizeChunk summarizes one chunk in a request of its own
+func summarizeChunk(ctx context.Context, chunk summaryChunk, llmConfig LLMConfig) (string, error) {
+	summary, err := GenerateFileSummary(ctx, chunk.name, chunk.diff, llmConfig)
+	// One file the content filter refuses shouldn't sink the whole message
+	if errorKind(err) == ErrContentFilter {
+		Log(WARN, "%v. Leaving the changes to %s out of the summaries", err, chunk.name)
+		return "left out because the provider's content filter blocked it", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize %s: %w", chunk.name, err)
+	}
+	cacheSummary(chunk, llmConfig, summary)
+	return summary, nil
+}
+
+// condenseSummaries summarizes batches of file summaries again until they fit in the model's
+// context, for changes to so many files that even their summaries don't
+func condenseSummaries(ctx context.Context, summaries string, llmConfig LLMConfig) (string, error) {
+	budget := diffTokenBudget(llmConfig)
+	for round := 1; estimateTokens(summaries) > budget; round++ {
+		if round > maxCondenseRounds {
+			return "", newError(ErrContextOverflow, "the file summaries are still about %d tokens after condensing them %d times, more than the %d that fit %s's context", estimateTokens(summaries), maxCondenseRounds, budget, llmConfig.Model)
+		}
+		// Half the budget per batch, so condensing two batches at least halves the total
+		batches := packChunks("", strings.SplitAfter(summaries, "\n"), budget/2)
+		Log(INFO, "File summaries are about %d tokens, condensing them in %d batches", estimateTokens(summaries), len(batches))
+		condensed := make([]string, len(batches))
+		err := forEachConcurrently(ctx, len(batches), llmConfig.Pipeline.Concurrency, func(ctx context.Context, i int) error {
+			var err error
+			condensed[i], err = GenerateSummaryDigest(ctx, batches[i], llmConfig)
+			return err
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to condense file summaries: %w", err)
+		}
+		summaries = strings.Join(condensed, "\n") + "\n"
+	}
+	return summaries, nil
+}
+
+// summarizeOverflow summarizes a diff too large for the model's context file by file, with the
+// pipeline's cheap model when two-stage generation is on and the model itself otherwise
+func summarizeOverflow(ctx context.Context, diff string, llmConfig LLMConfig) (string, error) {
+	model := llmConfig.Model
+	if llmConfig.Pipeline.Enabled {
+		model = llmConfig.Pipeline.CheapModel
+	}
+	Log(WARN, "The diff is about %d tokens, more than the %d that fit %s's context. Summarizing it file by file", estimateTokens(diff), diffTokenBudget(llmConfig), llmConfig.Model)
+	return summarizeFiles(ctx, diff, withModel(llmConfig, model))
+}
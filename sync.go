@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// syncStateFile keeps the head from before a sync in the git directory, so the range-diff can
+// still be summarized after the rebase stops for conflicts
+const syncStateFile = "gitscribe-sync"
+
+// syncStatePath returns where the head from before the current sync is kept
+func syncStatePath() (string, error) {
+	output, err := newCommand("git", "rev-parse", "--git-path", syncStateFile).Output()
+	if err != nil {
+		return "", newError(ErrGitState, "not in a git repository: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// rebaseInProgress reports whether a rebase stopped and is waiting to be continued
+func rebaseInProgress() bool {
+	for _, dir := range []string{"rebase-merge", "rebase-apply"} {
+		output, err := newCommand("git", "rev-parse", "--git-path", dir).Output()
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(strings.TrimSpace(string(output))); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictedFiles lists the files with unresolved conflicts
+func conflictedFiles() ([]string, error) {
+	output, err := newCommand("git", "diff", "--name-only", "--diff-filter=U").Output()
+	if err != nil {
+		return nil, newError(ErrGitState, "failed to list conflicted files: %v", err)
+	}
+	var files []string
+	for _, file := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// conflictHunks returns the conflict markers of a file with a few lines of context around each
+func conflictHunks(content string) string {
+	lines := strings.Split(content, "\n")
+	var hunks []string
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "<<<<<<< ") {
+			continue
+		}
+		start := i - 3
+		if start < 0 {
+			start = 0
+		}
+		for i < len(lines) && !strings.HasPrefix(lines[i], ">>>>>>> ") {
+			i++
+		}
+		end := i + 4
+		if end > len(lines) {
+			end = len(lines)
+		}
+		hunks = append(hunks, strings.Join(lines[start:end], "\n"))
+	}
+	return strings.Join(hunks, "\n...\n")
+}
+
+// summarizeConflicts explains the conflicts the rebase stopped on: what the commit being replayed
+// meant to do and what the base changed underneath it
+func summarizeConflicts(ctx context.Context, files []string, oldBase string, newBase string, llmConfig LLMConfig) (string, error) {
+	output, err := newCommand("git", "log", "-1", "--format=%h %B", "REBASE_HEAD").Output()
+	if err != nil {
+		return "", newError(ErrGitState, "failed to read the commit being rebased: %v", err)
+	}
+	commit := strings.TrimSpace(string(output))
+
+	var sb strings.Builder
+	for _, file := range files {
+		sb.WriteString(fmt.Sprintf("=== %s ===\n", file))
+		upstream, err := newCommand("git", "log", "--format=%h %s", oldBase+".."+newBase, "--", file).Output()
+		if err == nil && len(upstream) > 0 {
+			sb.WriteString("Commits on the base that touched it:\n" + string(upstream))
+		}
+		// Without file contents, the commits are all that can be sent
+		if llmConfig.LocalContextOnly {
+			continue
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			Log(WARN, "Failed to read %s: %v", file, err)
+			continue
+		}
+		if hunks := conflictHunks(string(content)); hunks != "" {
+			sb.WriteString("Conflicts:\n" + hunks + "\n")
+		}
+	}
+	return GenerateConflictSummary(ctx, commit, sb.String(), llmConfig)
+}
+
+// runSyncCommand rebases the branch onto the latest base, force-pushes it and posts a comment
+// summarizing the range-diff on its PR. When the rebase stops for conflicts, it explains them and
+// picks up again with -continue once they're resolved.
+func runSyncCommand(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	remote := fs.String("remote", "origin", "Remote to fetch the base from and push to")
+	targetBranch := fs.String("target", "", "Branch to rebase onto (default: the PR's base, or master)")
+	continueSync := fs.Bool("continue", false, "Continue after resolving the conflicts the last sync stopped on")
+	noPush := fs.Bool("no-push", false, "Rebase without pushing or commenting")
+	noComment := fs.Bool("no-comment", false, "Push without posting the range-diff summary")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+
+	statePath, err := syncStatePath()
+	if err != nil {
+		return err
+	}
+
+	// The PR gives the base to rebase onto and where the summary goes
+	var pr PullRequest
+	repo := ""
+	if !*noPush && !*noComment {
+		if repo, err = currentRepo(); err == nil {
+			var number int
+			if number, err = currentPullRequestNumber(); err == nil {
+				pr, err = getPullRequest(repo, number)
+			}
+		}
+		if err != nil {
+			Log(WARN, "Not commenting on a pull request: %v", err)
+			pr = PullRequest{}
+		}
+	}
+	if *targetBranch == "" {
+		*targetBranch = pr.Base.Ref
+	}
+	if *targetBranch == "" {
+		*targetBranch = "master"
+	}
+	newBase := *remote + "/" + *targetBranch
+
+	var oldHead string
+	if *continueSync {
+		state, err := ioutil.ReadFile(statePath)
+		if err != nil {
+			return newError(ErrGitState, "no sync to continue, run gs sync first")
+		}
+		oldHead = strings.TrimSpace(string(state))
+		if rebaseInProgress() {
+			// Keep the replayed commits' messages instead of opening the editor for each
+			cmd := botGit("-c", "core.editor=true", "rebase", "--continue")
+			cmd.ShowStderr = true
+			if err := cmd.Run(); err != nil {
+				return stopForConflicts(ctx, oldHead, newBase, config.LLM, err)
+			}
+		}
+	} else {
+		if rebaseInProgress() {
+			return newError(ErrGitState, "a rebase is in progress. Finish it and run gs sync -continue, or abort it with git rebase --abort")
+		}
+		output, err := newCommand("git", "status", "--porcelain", "--untracked-files=no").Output()
+		if err != nil {
+			return newError(ErrGitState, "failed to check the working tree: %v", err)
+		}
+		if strings.TrimSpace(string(output)) != "" {
+			return newError(ErrGitState, "the working tree has uncommitted changes, commit or stash them first")
+		}
+		output, err = newCommand("git", "rev-parse", "HEAD").Output()
+		if err != nil {
+			return newError(ErrGitState, "failed to read HEAD: %v", err)
+		}
+		oldHead = strings.TrimSpace(string(output))
+
+		fmt.Printf("Fetching %s from %s...\n", *targetBranch, *remote)
+		if err := newCommand("git", "fetch", *remote, *targetBranch).Run(); err != nil {
+			return fmt.Errorf("failed to fetch %s: %v", newBase, err)
+		}
+		if err := newCommand("git", "merge-base", "--is-ancestor", newBase, "HEAD").Run(); err == nil {
+			fmt.Printf("Already up to date with %s.\n", newBase)
+			return nil
+		}
+		if err := ioutil.WriteFile(statePath, []byte(oldHead+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to save the sync state: %v", err)
+		}
+
+		fmt.Printf("Rebasing onto %s...\n", newBase)
+		// The replayed commits keep their authors, with the bot as committer if one is configured
+		if err := botGit("rebase", newBase).Run(); err != nil {
+			return stopForConflicts(ctx, oldHead, newBase, config.LLM, err)
+		}
+	}
+	os.Remove(statePath)
+
+	// During a stopped rebase HEAD is detached, so the branch is only known now
+	output, err := newCommand("git", "rev-parse", "--abbrev-ref", "HEAD").Output()
+	if err != nil {
+		return newError(ErrGitState, "failed to get current branch: %v", err)
+	}
+	branch := strings.TrimSpace(string(output))
+
+	newHead, err := newCommand("git", "rev-parse", "HEAD").Output()
+	if err != nil {
+		return newError(ErrGitState, "failed to read HEAD: %v", err)
+	}
+	fmt.Printf("Rebased %s onto %s.\n", branch, newBase)
+	if *noPush {
+		return nil
+	}
+
+	// The lease is the remote branch as last fetched, so commits someone else pushed aren't lost
+	cmd := &Command{Program: "git", Args: []string{"push", "--force-with-lease", *remote, "HEAD:" + branch}, ShowStderr: true}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to push %s (if the push was rejected, someone else pushed to it: fetch and check their commits): %v", branch, err)
+	}
+	fmt.Printf("Pushed %s.\n", branch)
+	if *noComment || pr.Number == 0 {
+		return nil
+	}
+
+	rangeDiff, err := getRangeDiff(newBase, oldHead, "HEAD", !config.LLM.LocalContextOnly)
+	if err != nil {
+		return err
+	}
+	if rangeDiff == "" {
+		return nil
+	}
+	fmt.Println("Summarizing changes between the two versions...")
+	comment, err := GenerateRangeDiffSummary(ctx, pr, rangeDiff, config.LLM)
+	if err != nil {
+		return fmt.Errorf("failed to summarize range diff: %w", err)
+	}
+	comment = fmt.Sprintf("%s\n\n<sub>Rebased onto %s. Compared %s with %s.</sub>", comment, *targetBranch, shortRef(oldHead), shortRef(strings.TrimSpace(string(newHead))))
+	url, err := postIssueComment(repo, pr.Number, comment)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Comment posted:", url)
+	return nil
+}
+
+// stopForConflicts explains the conflicts a rebase stopped on and how to carry on
+func stopForConflicts(ctx context.Context, oldHead string, newBase string, llmConfig LLMConfig, rebaseErr error) error {
+	files, err := conflictedFiles()
+	if err != nil || len(files) == 0 {
+		return fmt.Errorf("rebase onto %s failed: %v", newBase, rebaseErr)
+	}
+	fmt.Printf("The rebase stopped on conflicts in %s.\n", strings.Join(files, ", "))
+
+	oldBase, err := newCommand("git", "merge-base", oldHead, newBase).Output()
+	if err != nil {
+		return newError(ErrGitState, "failed to find the old base: %v", err)
+	}
+	fmt.Println("Summarizing the conflicts...")
+	summary, err := summarizeConflicts(ctx, files, strings.TrimSpace(string(oldBase)), newBase, llmConfig)
+	if err != nil {
+		Log(WARN, "Failed to summarize conflicts: %v", err)
+	} else {
+		fmt.Println()
+		fmt.Println(summary)
+		fmt.Println()
+	}
+	fmt.Println("Resolve the conflicts, git add the files and run gs sync -continue. To give up, run git rebase --abort.")
+	return newError(ErrGitState, "rebase onto %s stopped on conflicts", newBase)
+}
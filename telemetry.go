@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TelemetryConfig controls usage telemetry. It is off unless explicitly enabled.
+// "local" only aggregates counts on this machine; "remote" also sends each event to the endpoint.
+type TelemetryConfig struct {
+	Mode     string `json:"mode"` // "off", "local" or "remote"
+	Endpoint string `json:"endpoint"`
+}
+
+// TelemetryEvent is what is recorded for one run. It never contains code, diffs, prompts or messages.
+type TelemetryEvent struct {
+	InstallID     string `json:"install_id"`
+	Command       string `json:"command"`
+	DurationMs    int64  `json:"duration_ms"`
+	Success       bool   `json:"success"`
+	ErrorCategory string `json:"error_category,omitempty"`
+	OS            string `json:"os"`
+	Timestamp     string `json:"timestamp"`
+}
+
+// CommandStats aggregates the runs of one command
+type CommandStats struct {
+	Runs     int            `json:"runs"`
+	Failures int            `json:"failures"`
+	TotalMs  int64          `json:"total_ms"`
+	Errors   map[string]int `json:"errors"`
+}
+
+// TelemetryStore is the local aggregate kept in ~/.gitscribe/telemetry.json
+type TelemetryStore struct {
+	InstallID string                   `json:"install_id"`
+	Commands  map[string]*CommandStats `json:"commands"`
+}
+
+// telemetrySettings is set when the config is loaded
+var telemetrySettings TelemetryConfig
+
+// runCommand names the command being run, for telemetry
+var runCommand = "commit"
+
+// runStarted is when the process started, for measuring latency
+var runStarted = time.Now()
+
+// telemetryPath returns where the local telemetry aggregate is stored
+func telemetryPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gitscribe", "telemetry.json"), nil
+}
+
+// loadTelemetryStore reads the local aggregate, creating a new one with a random install ID if needed
+func loadTelemetryStore(path string) TelemetryStore {
+	store := TelemetryStore{Commands: make(map[string]*CommandStats)}
+	if data, err := ioutil.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &store); err != nil {
+			Log(WARN, "Ignoring unreadable telemetry store: %v", err)
+		}
+	}
+	if store.Commands == nil {
+		store.Commands = make(map[string]*CommandStats)
+	}
+	if store.InstallID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		store.InstallID = hex.EncodeToString(id)
+	}
+	return store
+}
+
+// errorCategory classifies an error without recording its message
+func errorCategory(err error) string {
+	return string(errorKind(err))
+}
+
+// recordRun records the tokens this run used, prints the result envelope with -format json and
+// records the outcome if telemetry is enabled. Failures to record are only logged so telemetry
+// can never break a run.
+func recordRun(runErr error) {
+	saveRunUsage()
+	writeResult(runErr)
+	mode := strings.ToLower(telemetrySettings.Mode)
+	if mode != "local" && mode != "remote" {
+		return
+	}
+
+	path, err := telemetryPath()
+	if err != nil {
+		Log(DEBUG, "Telemetry disabled, no home directory: %v", err)
+		return
+	}
+	store := loadTelemetryStore(path)
+
+	event := TelemetryEvent{
+		InstallID:  store.InstallID,
+		Command:    runCommand,
+		DurationMs: time.Since(runStarted).Milliseconds(),
+		Success:    runErr == nil,
+		OS:         runtime.GOOS,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if runErr != nil {
+		event.ErrorCategory = errorCategory(runErr)
+	}
+
+	stats, ok := store.Commands[event.Command]
+	if !ok {
+		stats = &CommandStats{}
+		store.Commands[event.Command] = stats
+	}
+	if stats.Errors == nil {
+		stats.Errors = make(map[string]int)
+	}
+	stats.Runs++
+	stats.TotalMs += event.DurationMs
+	if !event.Success {
+		stats.Failures++
+		stats.Errors[event.ErrorCategory]++
+	}
+
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err == nil {
+		os.MkdirAll(filepath.Dir(path), 0700)
+		err = ioutil.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		Log(DEBUG, "Failed to save telemetry: %v", err)
+	}
+
+	if mode == "remote" && telemetrySettings.Endpoint != "" && !offlineMode {
+		sendTelemetryEvent(telemetrySettings.Endpoint, event)
+	}
+}
+
+// sendTelemetryEvent posts a single event to the telemetry endpoint with a short timeout
+func sendTelemetryEvent(endpoint string, event TelemetryEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		Log(DEBUG, "Failed to send telemetry: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// runTelemetryCommand shows or resets the local telemetry aggregate
+func runTelemetryCommand(args []string) error {
+	path, err := telemetryPath()
+	if err != nil {
+		return fmt.Errorf("failed to find home directory: %v", err)
+	}
+
+	if len(args) > 0 && args[0] == "reset" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to reset telemetry: %v", err)
+		}
+		fmt.Println("Local telemetry data deleted.")
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		fmt.Println("No telemetry recorded. Telemetry is off unless telemetry.mode is set to local or remote.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read telemetry: %v", err)
+	}
+	var store TelemetryStore
+	if err := json.Unmarshal(data, &store); err != nil {
+		return fmt.Errorf("failed to parse telemetry: %v", err)
+	}
+
+	names := make([]string, 0, len(store.Commands))
+	for name := range store.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("%-12s %6s %8s %12s  %s\n", "COMMAND", "RUNS", "FAILURES", "AVG LATENCY", "ERRORS")
+	for _, name := range names {
+		stats := store.Commands[name]
+		avg := time.Duration(0)
+		if stats.Runs > 0 {
+			avg = time.Duration(stats.TotalMs/int64(stats.Runs)) * time.Millisecond
+		}
+		var errors []string
+		for category, count := range stats.Errors {
+			errors = append(errors, fmt.Sprintf("%s=%d", category, count))
+		}
+		sort.Strings(errors)
+		fmt.Printf("%-12s %6d %8d %12s  %s\n", name, stats.Runs, stats.Failures, avg, strings.Join(errors, " "))
+	}
+	return nil
+}
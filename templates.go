@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// AreaTemplate is a PR template for changes under some paths, such as client code or migrations
+type AreaTemplate struct {
+	Name     string   `json:"name"`
+	Paths    []string `json:"paths"` // path prefixes or globs, as in security.paths
+	Template string   `json:"template"`
+}
+
+// templateSection is a markdown section of a template, keyed by its normalized heading
+type templateSection struct {
+	key   string
+	lines []string
+}
+
+// templateFiles lists every template file the config references
+func (c Config) templateFiles() []string {
+	var files []string
+	for _, template := range []string{c.CommitTemplate, c.PRTemplate} {
+		if template != "" {
+			files = append(files, template)
+		}
+	}
+	for _, area := range c.AreaTemplates {
+		files = append(files, area.Template)
+	}
+	return files
+}
+
+// matchingAreas returns the areas that the changed files touch, in config order
+func matchingAreas(files []string, areas []AreaTemplate) []AreaTemplate {
+	var matched []AreaTemplate
+	for _, area := range areas {
+	files:
+		for _, file := range files {
+			for _, pattern := range area.Paths {
+				if matchesPathPattern(file, pattern) {
+					matched = append(matched, area)
+					break files
+				}
+			}
+		}
+	}
+	return matched
+}
+
+// splitTemplateSections splits a markdown template at its headings. Text before the first
+// heading is a section with an empty key.
+func splitTemplateSections(template string) []templateSection {
+	sections := []templateSection{{}}
+	for _, line := range strings.Split(strings.TrimRight(template, "\n"), "\n") {
+		if strings.HasPrefix(line, "#") {
+			sections = append(sections, templateSection{key: sectionKey(line)})
+		}
+		current := &sections[len(sections)-1]
+		current.lines = append(current.lines, line)
+	}
+	return sections
+}
+
+// readTemplate reads a template file and fills in its date and sprint variables
+func readTemplate(path string, name string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", templateError(name, err)
+	}
+	return renderTemplateVars(string(data))
+}
+
+// composeTemplates merges templates into one. Sections keep the order they first appear in.
+// A section heading used by several templates appears once, with the lines the later
+// templates add appended to it, so each area's required items are kept without repeats.
+func composeTemplates(templates []string) string {
+	var order []string
+	merged := make(map[string]*templateSection)
+	for _, template := range templates {
+		for _, section := range splitTemplateSections(template) {
+			existing, ok := merged[section.key]
+			if !ok {
+				section := section
+				merged[section.key] = &section
+				order = append(order, section.key)
+				continue
+			}
+			seen := make(map[string]bool)
+			for _, line := range existing.lines {
+				seen[strings.TrimSpace(line)] = true
+			}
+			for i, line := range section.lines {
+				// The first line of a keyed section is its heading, which is already there
+				if trimmed := strings.TrimSpace(line); (i > 0 || section.key == "") && trimmed != "" && !seen[trimmed] {
+					existing.lines = append(existing.lines, line)
+					seen[trimmed] = true
+				}
+			}
+		}
+	}
+
+	var parts []string
+	for _, key := range order {
+		if text := strings.TrimSpace(strings.Join(merged[key].lines, "\n")); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// buildPRTemplate returns the PR template for the branch: the configured template, with the
+// sections of every area template the branch touches composed into it
+func buildPRTemplate(targetBranch string, templatePath string, areas []AreaTemplate) (string, error) {
+	template, err := readTemplate(templatePath, "PR")
+	if err != nil {
+		Log(ERROR, "Failed to read PR template: %v", err)
+		return "", err
+	}
+	if len(areas) == 0 {
+		return template, nil
+	}
+
+	files, err := getChangedFilesInRange(targetBranch, headRev)
+	if err != nil {
+		return "", err
+	}
+	matched := matchingAreas(files, areas)
+	if len(matched) == 0 {
+		return template, nil
+	}
+
+	templates := []string{template}
+	var names []string
+	for _, area := range matched {
+		data, err := readTemplate(area.Template, fmt.Sprintf("%s area", area.Name))
+		if err != nil {
+			return "", err
+		}
+		templates = append(templates, data)
+		names = append(names, area.Name)
+	}
+	Log(INFO, "Composing PR template for areas: %s", strings.Join(names, ", "))
+	return composeTemplates(templates), nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FollowUpsConfig controls the "Known follow-ups" section built from TODO-style comments
+type FollowUpsConfig struct {
+	Enabled     bool     `json:"enabled"`
+	Markers     []string `json:"markers"`      // default TODO, FIXME, HACK
+	FileIssues  bool     `json:"file_issues"`  // file an issue for each follow-up when the PR is created
+	IssueLabels []string `json:"issue_labels"` // labels for the filed issues
+}
+
+// FollowUp is a TODO-style comment added on the branch
+type FollowUp struct {
+	File   string
+	Line   int
+	Marker string
+	Text   string
+}
+
+// AddedLine is a line added by a diff along with its line number in the new file
+type AddedLine struct {
+	Number int
+	Text   string
+}
+
+// hunkHeader matches "@@ -a,b +c,d @@" and captures the new-file start line
+var hunkHeader = regexp.MustCompile(`^@@ -\d+(?:,\d+)? \+(\d+)(?:,\d+)? @@`)
+
+// addedLines returns the lines a file diff adds, numbered as in the new version of the file
+func addedLines(file FileDiff) []AddedLine {
+	var lines []AddedLine
+	number := 0
+	inHunk := false
+	for _, line := range strings.Split(file.Content, "\n") {
+		if match := hunkHeader.FindStringSubmatch(line); match != nil {
+			number, _ = strconv.Atoi(match[1])
+			inHunk = true
+			continue
+		}
+		if !inHunk || line == "" {
+			continue
+		}
+		switch line[0] {
+		case '+':
+			lines = append(lines, AddedLine{Number: number, Text: line[1:]})
+			number++
+		case ' ':
+			number++
+		}
+	}
+	return lines
+}
+
+// findFollowUps scans the added lines of a diff for TODO-style comments
+func findFollowUps(diff string, markers []string, vendorPaths []string) []FollowUp {
+	quoted := make([]string, len(markers))
+	for i, marker := range markers {
+		quoted[i] = regexp.QuoteMeta(marker)
+	}
+	// Require a comment leader before the marker so identifiers like "todoList" don't match
+	pattern := regexp.MustCompile(`(?://|#|/\*|<!--|--|;)\s*(` + strings.Join(quoted, "|") + `)\b[:(]?\s*(.*)`)
+
+	var followUps []FollowUp
+	for _, file := range splitDiffByFile(diff) {
+		if isVendoredPath(file.Path, vendorPaths) {
+			continue
+		}
+		for _, line := range addedLines(file) {
+			match := pattern.FindStringSubmatch(line.Text)
+			if match == nil {
+				continue
+			}
+			text := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(match[2]), "*/"))
+			text = strings.TrimSpace(strings.TrimSuffix(text, "-->"))
+			followUps = append(followUps, FollowUp{File: file.Path, Line: line.Number, Marker: match[1], Text: text})
+		}
+	}
+	return followUps
+}
+
+// renderFollowUpsSection renders the follow-ups as a markdown list
+func renderFollowUpsSection(followUps []FollowUp) string {
+	var sb strings.Builder
+	sb.WriteString("## Known follow-ups\n\n")
+	for _, f := range followUps {
+		sb.WriteString(fmt.Sprintf("- `%s:%d` %s: %s\n", f.File, f.Line, f.Marker, f.Text))
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// applyFollowUps adds the follow-ups section and remembers the follow-ups so issues can be
+// filed once the PR exists
+func applyFollowUps(targetBranch string, followUpsConfig FollowUpsConfig, vendorPaths []string, extras *PRExtras) error {
+	diff, err := getDiffInRange(targetBranch, headRev)
+	if err != nil {
+		return err
+	}
+	followUps := findFollowUps(diff, followUpsConfig.Markers, vendorPaths)
+	Log(INFO, "Found %d follow-up comments on the branch", len(followUps))
+	if len(followUps) == 0 {
+		return nil
+	}
+	extras.addSection(renderFollowUpsSection(followUps))
+	extras.FollowUps = followUps
+	return nil
+}
+
+// fileFollowUpIssues files one issue per follow-up, linking back to the PR
+func fileFollowUpIssues(followUps []FollowUp, prURL string, labels []string) error {
+	repo, err := currentRepo()
+	if err != nil {
+		return err
+	}
+	for _, f := range followUps {
+		title := fmt.Sprintf("%s: %s", f.Marker, f.Text)
+		if len(title) > 100 {
+			title = cutAtRune(title, 97) + "..."
+		}
+		body := fmt.Sprintf("Follow-up left in `%s` line %d by %s:\n\n> %s: %s", f.File, f.Line, prURL, f.Marker, f.Text)
+		url, err := createIssue(repo, title, body, labels)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Filed follow-up issue:", url)
+	}
+	return nil
+}
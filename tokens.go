@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenPattern splits text into the pieces GPT tokenizers split it into before merging: words
+// with the space or symbol before them, up to three digits, runs of symbols and whitespace
+var tokenPattern = regexp.MustCompile(`'(?i:[sdmt]|ll|ve|re)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+`)
+
+// modelContextWindows are the context windows of model families in tokens, matched by the
+// longest prefix of the model name
+var modelContextWindows = map[string]int{
+	"gpt-5": 400000, "gpt-4.1": 1047576, "gpt-4o": 128000, "gpt-4-turbo": 128000, "gpt-4-32k": 32768, "gpt-4": 8192,
+	"gpt-3.5-turbo": 16385, "o1": 200000, "o3": 200000, "o4": 200000, "claude": 200000, "gemini": 1000000,
+	"llama3.1": 128000, "llama3.2": 128000, "llama3": 8192, "mistral": 32768, "mixtral": 32768, "qwen": 32768,
+	"deepseek": 64000, "codellama": 16384, "phi3": 4096,
+}
+
+const (
+	defaultContextWindow = 8192 // for models not in modelContextWindows
+	ollamaContextWindow  = 4096 // Ollama's own default, whatever the model supports
+	promptOverheadTokens = 2000 // instructions and template sent along with the diff
+	defaultReplyTokens   = 1024 // kept free for the reply when llm.max_tokens isn't set
+)
+
+// estimateTokens estimates the number of tokens text is for GPT-style tokenizers. Common words
+// are one token and long identifiers about one per five letters, runs of symbols about one per
+// three, which is close enough to size a request without shipping the tokenizer's vocabulary.
+func estimateTokens(text string) int {
+	tokens := 0
+	for _, piece := range tokenPattern.FindAllString(text, -1) {
+		word := strings.TrimLeftFunc(piece, func(r rune) bool { return !unicode.IsLetter(r) })
+		length := utf8.RuneCountInString(word)
+		switch {
+		case word == "":
+			// Digits, symbols and whitespace
+			tokens += (utf8.RuneCountInString(strings.TrimSpace(piece)) + 2) / 3
+			if strings.TrimSpace(piece) == "" {
+				tokens++
+			}
+		case length != len(word):
+			// Letters outside ASCII, such as CJK, are about a token each
+			tokens += length
+		default:
+			tokens += (length + 4) / 5
+		}
+	}
+	return tokens
+}
+
+// contextWindow returns the number of tokens the model can take, from llm.context_window or
+// the model name
+func contextWindow(llmConfig LLMConfig) int {
+	if llmConfig.ContextWindow > 0 {
+		return llmConfig.ContextWindow
+	}
+	if llmConfig.Provider == "ollama" {
+		return ollamaContextWindow
+	}
+	window, longest := defaultContextWindow, 0
+	model := strings.ToLower(llmConfig.Model)
+	for prefix, tokens := range modelContextWindows {
+		if strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			window, longest = tokens, len(prefix)
+		}
+	}
+	return window
+}
+
+// diffTokenBudget returns how many tokens of diff fit in a request to the model or the fallback
+// with the largest context, leaving room for the instructions and the reply
+func diffTokenBudget(llmConfig LLMConfig) int {
+	reply := llmConfig.MaxTokens
+	if reply <= 0 {
+		reply = defaultReplyTokens
+	}
+	budget := largestContextWindow(llmConfig) - reply - promptOverheadTokens - exampleTokens(llmConfig)
+	if budget < 1000 {
+		budget = 1000
+	}
+	return budget
+}
+
+// diffHunk is one hunk of a file's diff
+type diffHunk struct {
+	header string // the @@ line, with the enclosing function if git found one
+	body   string
+}
+
+// splitHunks splits a file's diff into the lines before the first hunk and its hunks
+func splitHunks(content string) (string, []diffHunk) {
+	idx := strings.Index(content, "\n@@")
+	if idx == -1 {
+		return content, nil
+	}
+	header := content[:idx+1]
+	var hunks []diffHunk
+	for _, part := range strings.SplitAfter(content[idx+1:], "\n") {
+		if strings.HasPrefix(part, "@@") {
+			hunks = append(hunks, diffHunk{header: part})
+		} else if len(hunks) > 0 {
+			hunks[len(hunks)-1].body += part
+		}
+	}
+	return header, hunks
+}
+
+// elidedHunkBody stands in for the lines of a hunk left out
+func elidedHunkBody(body string) string {
+	added, removed := 0, 0
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, "+") {
+			added++
+		} else if strings.HasPrefix(line, "-") {
+			removed++
+		}
+	}
+	return fmt.Sprintf("(%d lines added and %d removed, left out to fit the model's context)\n", added, removed)
+}
+
+// fitDiff trims a diff that won't fit in the model's context window, so the request doesn't
+// fail with a context length error. Lock files go first, then files big enough to crowd out the
+// rest, then the bodies of the largest hunks. If even that's too much, only the file names and
+// line counts are kept.
+func fitDiff(diff string, llmConfig LLMConfig) string {
+	budget := diffTokenBudget(llmConfig)
+	total := estimateTokens(diff)
+	if total <= budget {
+		return diff
+	}
+	files := splitDiffByFile(diff)
+	if len(files) == 0 {
+		return diff
+	}
+	tokens := make([]int, len(files))
+	for i, file := range files {
+		tokens[i] = estimateTokens(file.Content)
+	}
+	var trimmed []string
+	elide := func(i int, reason string) {
+		header := strings.SplitN(files[i].Content, "\n", 2)[0]
+		files[i].Content = fmt.Sprintf("%s\n(%d lines added and %d removed, %s)\n", header, files[i].Added, files[i].Removed, reason)
+		updated := estimateTokens(files[i].Content)
+		total += updated - tokens[i]
+		tokens[i] = updated
+	}
+
+	var locks []string
+	for i, file := range files {
+		for _, lockFile := range lockFiles {
+			if path.Base(file.Path) == lockFile {
+				elide(i, "lock file left out to fit the model's context")
+				locks = append(locks, file.Path)
+			}
+		}
+	}
+	if len(locks) > 0 {
+		trimmed = append(trimmed, "lock files ("+strings.Join(locks, ", ")+")")
+	}
+
+	// A file that doesn't fit on its own, such as generated code, would crowd out the rest
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return tokens[order[a]] > tokens[order[b]] })
+	var large []string
+	for _, i := range order {
+		if total <= budget || tokens[i] <= budget {
+			break
+		}
+		elide(i, "left out to fit the model's context")
+		large = append(large, files[i].Path)
+	}
+	if len(large) > 0 {
+		trimmed = append(trimmed, "the largest files ("+strings.Join(large, ", ")+")")
+	}
+
+	if total > budget {
+		type hunkRef struct{ file, hunk, tokens int }
+		headers := make([]string, len(files))
+		hunks := make([][]diffHunk, len(files))
+		var refs []hunkRef
+		for i, file := range files {
+			headers[i], hunks[i] = splitHunks(file.Content)
+			for j, hunk := range hunks[i] {
+				refs = append(refs, hunkRef{i, j, estimateTokens(hunk.body)})
+			}
+		}
+		sort.SliceStable(refs, func(a, b int) bool { return refs[a].tokens > refs[b].tokens })
+		elided := 0
+		for _, ref := range refs {
+			if total <= budget {
+				break
+			}
+			hunk := &hunks[ref.file][ref.hunk]
+			hunk.body = elidedHunkBody(hunk.body)
+			total += estimateTokens(hunk.body) - ref.tokens
+			elided++
+		}
+		for i := range files {
+			if len(hunks[i]) == 0 {
+				continue
+			}
+			var sb strings.Builder
+			sb.WriteString(headers[i])
+			for _, hunk := range hunks[i] {
+				sb.WriteString(hunk.header)
+				sb.WriteString(hunk.body)
+			}
+			files[i].Content = sb.String()
+		}
+		if elided > 0 {
+			trimmed = append(trimmed, fmt.Sprintf("the bodies of the %d largest hunks", elided))
+		}
+	}
+
+	var sb strings.Builder
+	if total > budget {
+		Log(WARN, "The diff doesn't fit %s's context even trimmed, sending only the changed files", llmConfig.Model)
+		sb.WriteString("The diff is too large for the model's context. Changed files with lines added and removed:\n")
+		for _, file := range files {
+			sb.WriteString(fmt.Sprintf("%s (+%d -%d)\n", file.Path, file.Added, file.Removed))
+		}
+		return sb.String()
+	}
+	Log(WARN, "The diff is about %d tokens, more than the %d that fit %s's context. Left out %s", estimateTokens(diff), budget, llmConfig.Model, strings.Join(trimmed, ", "))
+	sb.WriteString(fmt.Sprintf("This diff was trimmed to fit the model's context: %s were left out. Describe those changes from their file names, function names and line counts.\n\n", strings.Join(trimmed, ", ")))
+	for _, file := range files {
+		sb.WriteString(file.Content)
+	}
+	return sb.String()
+}
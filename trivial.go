@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// Kinds of trivial change, which get a deterministic commit message instead of a generated one
+const (
+	trivialEmpty      = "empty"
+	trivialMode       = "mode"
+	trivialWhitespace = "whitespace"
+	trivialComments   = "comments"
+)
+
+// commentPrefixes are the line comment and block comment starts of languages by extension. Lines
+// inside a block comment are recognised by blockCommentLine.
+var commentPrefixes = map[string][]string{
+	".go": {"//", "/*"}, ".js": {"//", "/*"}, ".jsx": {"//", "/*"}, ".ts": {"//", "/*"}, ".tsx": {"//", "/*"},
+	".java": {"//", "/*"}, ".kt": {"//", "/*"}, ".scala": {"//", "/*"}, ".swift": {"//", "/*"},
+	".c": {"//", "/*"}, ".h": {"//", "/*"}, ".cc": {"//", "/*"}, ".cpp": {"//", "/*"}, ".hpp": {"//", "/*"},
+	".cs": {"//", "/*"}, ".rs": {"//", "/*"}, ".php": {"//", "/*", "#"}, ".proto": {"//", "/*"},
+	".py": {"#"}, ".rb": {"#"}, ".sh": {"#"}, ".bash": {"#"}, ".pl": {"#"}, ".r": {"#"}, ".tf": {"#", "//", "/*"},
+	".yaml": {"#"}, ".yml": {"#"}, ".toml": {"#"}, ".cfg": {"#"}, ".ini": {"#", ";"},
+	".sql": {"--"}, ".lua": {"--"}, ".hs": {"--"},
+	".html": {"<!--", "-->"}, ".xml": {"<!--", "-->"}, ".vue": {"<!--", "-->", "//", "/*"},
+}
+
+// isCommentLine reports whether a changed line of a file is blank or a comment
+func isCommentLine(file string, line string) bool {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" {
+		return true
+	}
+	prefixes, ok := commentPrefixes[strings.ToLower(path.Ext(file))]
+	if !ok && (path.Base(file) == "Makefile" || path.Base(file) == "Dockerfile") {
+		prefixes = []string{"#"}
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(trimmed, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockCommentLine reports whether a changed line inside a /* */ comment is part of it, such as
+// "* text" or "*/". A bare "*" at the start of a line is a dereference outside one.
+func blockCommentLine(line string) bool {
+	trimmed := strings.TrimSpace(line)
+	return trimmed == "*" || strings.HasPrefix(trimmed, "* ") || strings.HasPrefix(trimmed, "*/")
+}
+
+// inBlockComment reports whether a /* */ comment is still open after a line of a file, given
+// whether one was open before it
+func inBlockComment(file string, line string, open bool) bool {
+	hasBlocks := false
+	for _, prefix := range commentPrefixes[strings.ToLower(path.Ext(file))] {
+		hasBlocks = hasBlocks || prefix == "/*"
+	}
+	if !hasBlocks {
+		return false
+	}
+	for {
+		marker := "/*"
+		if open {
+			marker = "*/"
+		}
+		i := strings.Index(line, marker)
+		if i == -1 {
+			return open
+		}
+		open, line = !open, line[i+len(marker):]
+	}
+}
+
+// trivialChange classifies a diff that needs no model to describe, returning "" for the rest.
+// Added, deleted, renamed and binary files are never trivial.
+func trivialChange(files []FileDiff) string {
+	changed, modes := 0, 0
+	comments := true
+	for _, file := range files {
+		if strings.Contains(file.Content, "\nBinary files ") || strings.Contains(file.Content, "\nGIT binary patch") ||
+			strings.Contains(file.Content, "\nrename from ") || strings.Contains(file.Content, "\ncopy from ") ||
+			strings.Contains(file.Content, "\nnew file mode ") || strings.Contains(file.Content, "\ndeleted file mode ") {
+			return ""
+		}
+		if strings.Contains(file.Content, "\nold mode ") {
+			modes++
+		}
+		changed += file.Added + file.Removed
+		// Only a block comment the hunk opened counts, as a hunk starting inside one can't be told
+		// from code
+		block := false
+		for _, line := range strings.Split(file.Content, "\n") {
+			if strings.HasPrefix(line, "@@") {
+				block = false
+				continue
+			}
+			if line == "" || strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "---") {
+				continue
+			}
+			if line[0] == '+' || line[0] == '-' {
+				comments = comments && (isCommentLine(file.Path, line[1:]) || block && blockCommentLine(line[1:]))
+			}
+			block = inBlockComment(file.Path, line[1:], block)
+		}
+	}
+	switch {
+	case changed == 0 && modes == 0:
+		return trivialEmpty
+	case changed == 0:
+		return trivialMode
+	case whitespaceOnly(files):
+		return trivialWhitespace
+	case comments:
+		return trivialComments
+	}
+	return ""
+}
+
+// describeFiles names up to two files, or counts them
+func describeFiles(files []FileDiff) string {
+	switch len(files) {
+	case 1:
+		return path.Base(files[0].Path)
+	case 2:
+		return path.Base(files[0].Path) + " and " + path.Base(files[1].Path)
+	}
+	return fmt.Sprintf("%d files", len(files))
+}
+
+// trivialCommitMessage returns a deterministic message for a trivial change, so no API call is
+// spent on a description the model would pad out. Staged diffs without any change are refused.
+func trivialCommitMessage(files []FileDiff, scope string, format FirstLineFormat) (string, bool, error) {
+	kind := trivialChange(files)
+	var commitType, title string
+	switch kind {
+	case "":
+		return "", false, nil
+	case trivialEmpty:
+		return "", false, newError(ErrGitState, "the staged changes don't change any file content. Stage the changes you meant to commit, or write the message yourself with git commit -m")
+	case trivialMode:
+		commitType, title = "chore", "Change file mode of "+describeFiles(files)
+		if strings.Contains(files[0].Content, "\nnew mode 100755") {
+			title = "Make " + describeFiles(files) + " executable"
+		}
+	case trivialWhitespace:
+		commitType, title = "style", "Fix whitespace in "+describeFiles(files)
+	case trivialComments:
+		commitType, title = "docs", "Update comments in "+describeFiles(files)
+	}
+	Log(INFO, "Change is %s only, using a deterministic commit message", kind)
+
+	prefix := scope
+	if format.InferType {
+		prefix = commitType
+		if scope != "" {
+			prefix = fmt.Sprintf("%s(%s)", commitType, scope)
+		}
+	}
+	if prefix != "" {
+		// Conventional subjects are lowercase after the prefix
+		_, size := utf8.DecodeRuneInString(title)
+		title = prefix + ": " + strings.ToLower(title[:size]) + title[size:]
+	}
+	return title, true, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTrivialChangeComments(t *testing.T) {
+	tests := []struct {
+		name string
+		hunk []string
+		want string
+	}{
+		{
+			name: "line comment",
+			hunk: []string{"-// Count the lines", "+// Count the changed lines", " func count() {"},
+			want: trivialComments,
+		},
+		{
+			name: "inside a block comment",
+			hunk: []string{" /*", "- * Count the lines", "+ * Count the changed lines", " */"},
+			want: trivialComments,
+		},
+		{
+			name: "dereference",
+			hunk: []string{" func reset(count *int) {", "-\t*count = 1", "+\t*count = 0", " }"},
+			want: "",
+		},
+		{
+			name: "dereference after a closed block comment",
+			hunk: []string{" /* Reset the count */", "-*count = 1", "+*count = 0"},
+			want: "",
+		},
+		{
+			name: "block comment opened before the hunk",
+			hunk: []string{" * Count the lines", "-* count = 1", "+* count = 0"},
+			want: "",
+		},
+	}
+	for _, test := range tests {
+		added, removed := 0, 0
+		for _, line := range test.hunk {
+			switch line[0] {
+			case '+':
+				added++
+			case '-':
+				removed++
+			}
+		}
+		file := FileDiff{
+			Path:    "count.go",
+			Content: "diff --git a/count.go b/count.go\n--- a/count.go\n+++ b/count.go\n@@ -1,4 +1,4 @@\n" + strings.Join(test.hunk, "\n") + "\n",
+			Added:   added,
+			Removed: removed,
+		}
+		if got := trivialChange([]FileDiff{file}); got != test.want {
+			t.Errorf("%s: trivialChange = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// tutorialDiff is the sample change the tutorial writes a commit message for
+const tutorialDiff = `diff --git a/client/http.go b/client/http.go
+index 3b18e51..9f2c4d7 100644
+--- a/client/http.go
++++ b/client/http.go
+@@ -12,9 +12,22 @@ type Client struct {
+
+ // Get fetches the URL and returns the response body
+ func (c *Client) Get(url string) ([]byte, error) {
+-	resp, err := c.http.Get(url)
+-	if err != nil {
+-		return nil, err
++	var resp *http.Response
++	var err error
++	// Retry connection errors and 5xx responses, which are usually brief outages
++	for attempt := 0; attempt < c.maxAttempts; attempt++ {
++		resp, err = c.http.Get(url)
++		if err == nil && resp.StatusCode < 500 {
++			break
++		}
++		if err == nil {
++			resp.Body.Close()
++		}
++		time.Sleep(time.Duration(attempt+1) * 200 * time.Millisecond)
++	}
++	if err != nil {
++		return nil, fmt.Errorf("get %s: %w", url, err)
+ 	}
+ 	defer resp.Body.Close()
+ 	return io.ReadAll(resp.Body)
+`
+
+// tutorialTemplate is used for the sample when the configured commit template can't be read
+const tutorialTemplate = `<Summary of the change in one line>
+
+<Why the change was needed and what it does>
+`
+
+// tutorialOption is a config option the tutorial explains
+type tutorialOption struct {
+	key         string
+	explanation string
+	value       string
+}
+
+// tutorialPause waits for Enter and reports whether the user wants to go on
+func tutorialPause(reader *bufio.Reader) bool {
+	fmt.Print("\nPress Enter to continue, or q to quit: ")
+	answer, err := reader.ReadString('\n')
+	fmt.Println()
+	return err == nil && strings.ToLower(strings.TrimSpace(answer)) != "q"
+}
+
+// tutorialChecks checks what GitScribe needs, saying how to fix each problem
+func tutorialChecks(config Config, configErr error) []PreflightResult {
+	var results []PreflightResult
+	check := func(name string, passed bool, blocking bool, messages ...string) {
+		if passed {
+			messages = nil
+		}
+		results = append(results, PreflightResult{Name: name, Passed: passed, Blocking: blocking, Messages: messages})
+	}
+
+	check("git is installed", programAvailable("git"), true, "Install git from https://git-scm.com/downloads")
+	_, err := repoRoot()
+	check("In a git repository", err == nil, false, "Run gs from inside the repository you're committing to")
+
+	if configErr != nil {
+		check("Config file found", false, true,
+			fmt.Sprintf("%v", configErr),
+			"Create .gitscribe_config.json in the repository or ~/.gitscribe/.gitscribe_config.json with at least:",
+			`{"commit_template": "~/.gitscribe/commit_template.md", "pr_template": "~/.gitscribe/pr_template.md"}`)
+		return results
+	}
+	check("Config file found ("+strings.Join(config.Layers, ", ")+")", true, true)
+	for _, template := range []struct{ name, path string }{{"Commit template", config.CommitTemplate}, {"PR template", config.PRTemplate}} {
+		_, err := ioutil.ReadFile(template.path)
+		check(fmt.Sprintf("%s readable (%s)", template.name, template.path), err == nil, template.name == "Commit template",
+			fmt.Sprintf("%v", err), "Create the file or point the config at an existing template, or install a template pack with gs templates install")
+	}
+
+	if config.LLM.Provider == "ollama" {
+		check("Ollama configured", true, true)
+	} else if config.LLM.Provider == "mock" {
+		check("Mock provider configured, no API key needed", true, true)
+	} else {
+		check("OpenAI API key set", config.LLM.APIKey != "", true, "Set the OPENAI_KEY environment variable or llm.api_key in the config, or run gs auth login")
+	}
+	err = checkChatEndpoint(config.LLM)
+	check("LLM endpoint allowed ("+chatEndpoint(config.LLM)+")", err == nil, true, fmt.Sprintf("%v", err))
+
+	ghReady := programAvailable("gh") && newCommand("gh", "auth", "status").Run() == nil
+	check("GitHub CLI installed and logged in (for gs -pr)", ghReady, false, "Install gh from https://cli.github.com/ and run gh auth login")
+	return results
+}
+
+// tutorialOptions lists the options most setups change, with their current values
+func tutorialOptions(config Config) []tutorialOption {
+	apiKey := "not set"
+	if config.LLM.APIKey != "" {
+		apiKey = "set"
+	}
+	format := "default"
+	if config.CommitFormat != nil && config.CommitFormat.Pattern != defaultFirstLineFormat().Pattern {
+		format = config.CommitFormat.Pattern
+	}
+	var limits []string
+	if config.CommitBudget.MaxSubjectLength > 0 {
+		limits = append(limits, fmt.Sprintf("subject %d characters", config.CommitBudget.MaxSubjectLength))
+	}
+	if config.CommitBudget.MaxBodyLength > 0 {
+		limits = append(limits, fmt.Sprintf("body %d characters", config.CommitBudget.MaxBodyLength))
+	}
+	budget := "no limits"
+	if len(limits) > 0 {
+		budget = strings.Join(limits, ", ")
+	}
+	return []tutorialOption{
+		{"commit_template", "The template commit messages are written to. Its sections and comments guide the model.", config.CommitTemplate},
+		{"pr_template", "The template PR descriptions are written to, used by gs -pr.", config.PRTemplate},
+		{"llm.model", "The model that writes messages. Smaller models are cheaper, larger ones follow templates better.", config.LLM.Model},
+		{"llm.api_key", "The API key. Prefer the OPENAI_KEY environment variable so the key stays out of the config.", apiKey},
+		{"llm.provider, llm.endpoint", "Where requests go: OpenAI by default, ollama for local models or any OpenAI-compatible endpoint.", strings.Trim(config.LLM.Provider+" "+config.LLM.Endpoint, " ")},
+		{"llm.enable_questions", "Lets the model ask you questions before writing a PR description.", fmt.Sprintf("%v", config.LLM.EnableQuestions)},
+		{"llm.local_context_only", "Sends file paths and line counts instead of file contents, for code that mustn't leave the machine.", fmt.Sprintf("%v", config.LLM.LocalContextOnly)},
+		{"commit_format", "The shape of the first line, such as conventional commits with an inferred type and scope.", format},
+		{"commit_budget", "Length limits for the subject and body, enforced after generation.", budget},
+		{"human_sections", "PR sections only the author writes, such as a rollout plan.", fmt.Sprintf("%d configured", len(config.HumanSections))},
+		{"pr_area_templates", "Extra PR template sections for changes under some paths, such as migrations.", fmt.Sprintf("%d configured", len(config.AreaTemplates))},
+		{"offline", "Turns off everything that needs the network except a local model.", fmt.Sprintf("%v", config.Offline)},
+	}
+}
+
+// runTutorialCommand walks a new user through GitScribe: it checks their environment, writes a
+// commit message for a sample change and explains the options most setups change
+func runTutorialCommand(args []string) error {
+	fs := flag.NewFlagSet("tutorial", flag.ExitOnError)
+	// A missing config is what most new users need help with, so it's reported rather than fatal
+	config, configErr := parseCommandFlags(fs, args)
+	reader := bufio.NewReader(os.Stdin)
+
+	fmt.Println("Welcome to GitScribe. This tutorial checks your setup, writes a commit message for a sample")
+	fmt.Println("change so you can see what to expect, and explains the options you're most likely to change.")
+	fmt.Println()
+
+	blocked := printCheckResults("Step 1 of 3: Your environment", tutorialChecks(config, configErr))
+	if blocked {
+		fmt.Println("\nFix the FAIL items above and run gs tutorial again to try the sample.")
+		return nil
+	}
+	if !tutorialPause(reader) {
+		return nil
+	}
+
+	fmt.Println("=== Step 2 of 3: A sample commit ===")
+	fmt.Println("When you run gs, it reads your staged changes with git diff --cached. Here is a sample change:")
+	fmt.Println()
+	os.Stdout.WriteString(tutorialDiff)
+	fmt.Println()
+	template, err := readTemplate(config.CommitTemplate, "commit")
+	if err != nil {
+		template = tutorialTemplate
+	}
+	fmt.Printf("GitScribe sends the diff and your commit template to %s. This is sample code, so nothing from\n", config.LLM.Model)
+	fmt.Println("your repository is sent. Writing the message...")
+	fmt.Println()
+
+	ctx, stop := interruptContext()
+	defer stop()
+	options := CommitOptions{Format: *config.CommitFormat, Budget: config.CommitBudget, Stream: messageStream(config.LLM)}
+	message, err := GenerateCommitMessage(ctx, tutorialDiff, config.LLM, template, options)
+	if err != nil {
+		printRemediation(err)
+		return fmt.Errorf("failed to generate the sample message: %w", err)
+	}
+	if options.Stream == nil {
+		fmt.Println(message)
+	}
+	fmt.Println()
+	fmt.Println("In a real run the message opens in vim so you can edit it, and closing the editor commits.")
+	fmt.Println("Use -dry-run to only print it. gs -pr does the same for a PR description from your branch's commits.")
+	if !tutorialPause(reader) {
+		return nil
+	}
+
+	fmt.Println("=== Step 3 of 3: Your config ===")
+	if config.Path != "" {
+		fmt.Printf("Your config is %s. These are the options most setups change:\n\n", config.Path)
+	}
+	for _, option := range tutorialOptions(config) {
+		value := option.value
+		if value == "" {
+			value = "default"
+		}
+		fmt.Printf("%s (now: %s)\n       %s\n", option.key, value, option.explanation)
+	}
+	fmt.Println()
+	fmt.Println("Every option is described in the Configuration section of the README. Run gs in a repository")
+	fmt.Println("with staged changes to write your first commit message.")
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ToolchainConfig controls the upgrade section added when a branch changes language or runtime versions
+type ToolchainConfig struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ToolchainUpgrade is a change of a language, runtime or base image version
+type ToolchainUpgrade struct {
+	Kind string
+	File string
+	Old  string
+	New  string
+}
+
+// versionFiles are single-value files that pin a runtime version
+var versionFiles = map[string]string{
+	".nvmrc":          "Node.js",
+	".node-version":   "Node.js",
+	".python-version": "Python",
+	".ruby-version":   "Ruby",
+	".go-version":     "Go",
+	".java-version":   "Java",
+}
+
+// toolchainLine recognizes a diff line that pins a toolchain version in the given file and
+// returns the kind of toolchain and the version
+func toolchainLine(file string, line string) (string, string, bool) {
+	base := path.Base(file)
+	fields := strings.Fields(line)
+
+	switch {
+	case base == "go.mod" && len(fields) == 2 && (fields[0] == "go" || fields[0] == "toolchain"):
+		if fields[0] == "go" {
+			return "Go", fields[1], true
+		}
+		return "Go toolchain", fields[1], true
+	case strings.HasPrefix(base, "Dockerfile") && len(fields) >= 2 && strings.EqualFold(fields[0], "FROM"):
+		return "Docker base image", fields[1], true
+	case base == "package.json" && strings.Contains(line, "\"node\""):
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			return "Node.js", strings.Trim(strings.TrimSpace(parts[1]), "\","), true
+		}
+	case base == ".tool-versions" && len(fields) >= 2:
+		return fields[0], fields[1], true
+	case versionFiles[base] != "" && len(fields) == 1:
+		return versionFiles[base], fields[0], true
+	}
+	return "", "", false
+}
+
+// detectToolchainUpgrades finds toolchain version changes in a diff by pairing removed and added
+// version lines of the same kind in the same file
+func detectToolchainUpgrades(diff string) []ToolchainUpgrade {
+	var upgrades []ToolchainUpgrade
+	for _, file := range splitDiffByFile(diff) {
+		removed := make(map[string]string)
+		var addedKinds []string
+		added := make(map[string]string)
+		for _, line := range strings.Split(file.Content, "\n") {
+			if len(line) < 2 || strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++") {
+				continue
+			}
+			if line[0] != '-' && line[0] != '+' {
+				continue
+			}
+			kind, version, ok := toolchainLine(file.Path, line[1:])
+			if !ok {
+				continue
+			}
+			if line[0] == '-' {
+				removed[kind] = version
+			} else {
+				if _, seen := added[kind]; !seen {
+					addedKinds = append(addedKinds, kind)
+				}
+				added[kind] = version
+			}
+		}
+		for _, kind := range addedKinds {
+			if old, ok := removed[kind]; ok && old != added[kind] {
+				upgrades = append(upgrades, ToolchainUpgrade{Kind: kind, File: file.Path, Old: old, New: added[kind]})
+			}
+		}
+	}
+	return upgrades
+}
+
+// buildToolchainUpgradeSection explains the toolchain upgrades made on the branch, if any
+func buildToolchainUpgradeSection(ctx context.Context, targetBranch string, commits string, vendorPaths []string, llmConfig LLMConfig) (string, error) {
+	diff, err := getDiffInRange(targetBranch, headRev)
+	if err != nil {
+		return "", err
+	}
+	upgrades := detectToolchainUpgrades(diff)
+	if len(upgrades) == 0 {
+		Log(DEBUG, "No toolchain upgrades detected")
+		return "", nil
+	}
+	Log(INFO, "Detected %d toolchain upgrades", len(upgrades))
+
+	var sb strings.Builder
+	for _, upgrade := range upgrades {
+		sb.WriteString(fmt.Sprintf("- %s in %s: %s -> %s\n", upgrade.Kind, upgrade.File, upgrade.Old, upgrade.New))
+	}
+
+	explanation, err := GenerateUpgradeNotes(ctx, sb.String(), commits, promptDiff(stripVendoredDiff(diff, vendorPaths), llmConfig), llmConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate upgrade notes: %w", err)
+	}
+	return "## Toolchain upgrade\n\n" + sb.String() + "\n" + explanation, nil
+}
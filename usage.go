@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UsageConfig controls the record of the tokens each run uses and what they cost
+type UsageConfig struct {
+	Mode   string                `json:"mode"`   // "local" (default) records runs, "off" doesn't
+	Path   string                `json:"path"`   // default ~/.gitscribe/usage.jsonl
+	Prices map[string]ModelPrice `json:"prices"` // by model name prefix, overriding the built-in prices
+}
+
+// ModelPrice is what a model costs in dollars per million tokens
+type ModelPrice struct {
+	Input       float64 `json:"input"`
+	CachedInput float64 `json:"cached_input"` // default the input price
+	Output      float64 `json:"output"`
+}
+
+// modelPrices are the list prices of OpenAI model families, matched by the longest prefix of the
+// model name. Local models through Ollama cost nothing.
+var modelPrices = map[string]ModelPrice{
+	"gpt-5": {1.25, 0.125, 10}, "gpt-5-mini": {0.25, 0.025, 2}, "gpt-5-nano": {0.05, 0.005, 0.40},
+	"gpt-4.1": {2, 0.50, 8}, "gpt-4.1-mini": {0.40, 0.10, 1.60}, "gpt-4.1-nano": {0.10, 0.025, 0.40},
+	"gpt-4o": {2.50, 1.25, 10}, "gpt-4o-mini": {0.15, 0.075, 0.60}, "gpt-4-turbo": {10, 10, 30},
+	"gpt-4": {30, 30, 60}, "gpt-3.5-turbo": {0.50, 0.50, 1.50},
+	"o1": {15, 7.50, 60}, "o1-mini": {1.10, 0.55, 4.40}, "o3": {2, 0.50, 8}, "o3-mini": {1.10, 0.55, 4.40},
+	"o4-mini": {1.10, 0.275, 4.40},
+}
+
+// ModelUsage is the tokens one model used
+type ModelUsage struct {
+	Provider         string `json:"provider"`
+	Requests         int    `json:"requests"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CachedTokens     int    `json:"cached_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+}
+
+// UsageRecord is one line of the usage file: what a model used in one run
+type UsageRecord struct {
+	Time    string `json:"time"`
+	Repo    string `json:"repo,omitempty"`
+	Command string `json:"command"`
+	Model   string `json:"model"`
+	ModelUsage
+	Cost   float64 `json:"cost"`
+	Priced bool    `json:"priced"` // false when the model's price isn't known
+}
+
+// usageSettings is set when the config is loaded
+var usageSettings UsageConfig
+
+// showCost prints the tokens and cost of the run when it ends, set by -show-cost
+var showCost bool
+
+// runUsage is the tokens used in this run so far, by model
+var runUsage = struct {
+	sync.Mutex
+	models map[string]*ModelUsage
+}{models: map[string]*ModelUsage{}}
+
+// addRunUsage adds the tokens a response used to the run's totals
+func addRunUsage(llmConfig LLMConfig, response ChatResponse) {
+	runUsage.Lock()
+	defer runUsage.Unlock()
+	usage, ok := runUsage.models[llmConfig.Model]
+	if !ok {
+		usage = &ModelUsage{Provider: llmConfig.Provider}
+		runUsage.models[llmConfig.Model] = usage
+	}
+	usage.Requests++
+	usage.PromptTokens += response.Usage.PromptTokens
+	usage.CachedTokens += response.Usage.PromptTokensDetails.CachedTokens
+	usage.CompletionTokens += response.Usage.CompletionTokens
+}
+
+// modelPrice returns the price of a model from usage.prices or the built-in prices
+func modelPrice(model string, provider string) (ModelPrice, bool) {
+	if provider == "ollama" || provider == "mock" {
+		return ModelPrice{}, true
+	}
+	model = strings.ToLower(model)
+	for _, prices := range []map[string]ModelPrice{usageSettings.Prices, modelPrices} {
+		price, longest := ModelPrice{}, 0
+		for prefix, candidate := range prices {
+			if strings.HasPrefix(model, strings.ToLower(prefix)) && len(prefix) > longest {
+				price, longest = candidate, len(prefix)
+			}
+		}
+		if longest > 0 {
+			return price, true
+		}
+	}
+	return ModelPrice{}, false
+}
+
+// usageCost estimates what a model's usage cost in dollars
+func usageCost(model string, usage ModelUsage) (float64, bool) {
+	price, ok := modelPrice(model, usage.Provider)
+	if !ok {
+		return 0, false
+	}
+	cachedPrice := price.CachedInput
+	if cachedPrice == 0 {
+		cachedPrice = price.Input
+	}
+	cost := float64(usage.PromptTokens-usage.CachedTokens)*price.Input + float64(usage.CachedTokens)*cachedPrice + float64(usage.CompletionTokens)*price.Output
+	return cost / 1e6, true
+}
+
+// usagePath returns where the usage records are kept
+func usagePath() (string, error) {
+	if usageSettings.Path != "" {
+		return expandPath(usageSettings.Path), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".gitscribe", "usage.jsonl"), nil
+}
+
+// runUsageRecords returns a record for each model this run used, sorted by model
+func runUsageRecords() []UsageRecord {
+	runUsage.Lock()
+	defer runUsage.Unlock()
+	if len(runUsage.models) == 0 {
+		return nil
+	}
+	repo, _ := repoRoot()
+	now := time.Now().UTC().Format(time.RFC3339)
+	var records []UsageRecord
+	for model, usage := range runUsage.models {
+		record := UsageRecord{Time: now, Repo: repo, Command: runCommand, Model: model, ModelUsage: *usage}
+		record.Cost, record.Priced = usageCost(model, *usage)
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Model < records[j].Model })
+	return records
+}
+
+// formatCost shows a cost in dollars, or that it's unknown
+func formatCost(cost float64, priced bool) string {
+	if !priced {
+		return "unknown"
+	}
+	return fmt.Sprintf("$%.4f", cost)
+}
+
+// saveRunUsage appends the tokens this run used to the usage file, and prints them with
+// -show-cost. Failures are only logged so recording usage can never break a run.
+func saveRunUsage() {
+	records := runUsageRecords()
+	if showCost {
+		if len(records) == 0 {
+			fmt.Fprintln(os.Stderr, "No LLM requests were made.")
+		}
+		for _, record := range records {
+			fmt.Fprintf(os.Stderr, "%s: %d requests, %d prompt tokens (%d cached), %d completion tokens, %s\n", record.Model,
+				record.Requests, record.PromptTokens, record.CachedTokens, record.CompletionTokens, formatCost(record.Cost, record.Priced))
+		}
+	}
+	if len(records) == 0 || strings.ToLower(usageSettings.Mode) == "off" {
+		return
+	}
+
+	path, err := usagePath()
+	if err != nil {
+		Log(DEBUG, "Not recording usage, no home directory: %v", err)
+		return
+	}
+	os.MkdirAll(filepath.Dir(path), 0700)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		Log(WARN, "Failed to record token usage: %v", err)
+		return
+	}
+	defer file.Close()
+	for _, record := range records {
+		data, _ := json.Marshal(record)
+		if _, err := file.Write(append(data, '\n')); err != nil {
+			Log(WARN, "Failed to record token usage: %v", err)
+			return
+		}
+	}
+}
+
+// readUsageRecords reads every record in the usage file
+func readUsageRecords(path string) ([]UsageRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []UsageRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			Log(DEBUG, "Skipping unreadable usage record: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// usageGroup returns the row of the report a record is counted in
+func usageGroup(record UsageRecord, by string) string {
+	switch by {
+	case "repo":
+		if record.Repo == "" {
+			return "(no repo)"
+		}
+		return record.Repo
+	case "model":
+		return record.Model
+	}
+	t, err := time.Parse(time.RFC3339, record.Time)
+	if err != nil {
+		return "(unknown)"
+	}
+	t = t.Local()
+	switch by {
+	case "week":
+		t = t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+		return "week of " + t.Format("2006-01-02")
+	case "month":
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// runUsageCommand reports the tokens used and their estimated cost over time
+func runUsageCommand(args []string) error {
+	if len(args) > 0 && args[0] == "reset" {
+		if _, err := parseCommandFlags(flag.NewFlagSet("usage reset", flag.ExitOnError), args[1:]); err != nil {
+			return err
+		}
+		path, err := usagePath()
+		if err != nil {
+			return fmt.Errorf("failed to find home directory: %v", err)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to reset usage: %v", err)
+		}
+		fmt.Println("Usage records deleted.")
+		return nil
+	}
+
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	days := fs.Int("days", 30, "Report the last n days, 0 for everything recorded")
+	by := fs.String("by", "day", "Group by day, week, month, repo or model")
+	allRepos := fs.Bool("all", false, "Report every repository instead of the current one")
+	if _, err := parseCommandFlags(fs, args); err != nil {
+		return err
+	}
+	switch *by {
+	case "day", "week", "month", "repo", "model":
+	default:
+		return fmt.Errorf("unknown -by %q: use day, week, month, repo or model", *by)
+	}
+
+	path, err := usagePath()
+	if err != nil {
+		return fmt.Errorf("failed to find home directory: %v", err)
+	}
+	records, err := readUsageRecords(path)
+	if os.IsNotExist(err) {
+		fmt.Println("No usage recorded yet.")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read usage: %v", err)
+	}
+	repo := ""
+	if !*allRepos && *by != "repo" {
+		if repo, err = repoRoot(); err != nil {
+			return fmt.Errorf("not in a repository, use -all to report every repository: %v", err)
+		}
+	}
+	since := time.Time{}
+	if *days > 0 {
+		since = time.Now().AddDate(0, 0, -*days)
+	}
+
+	type row struct {
+		usage    ModelUsage
+		cost     float64
+		unpriced int
+	}
+	rows := make(map[string]*row)
+	var total row
+	for _, record := range records {
+		if t, err := time.Parse(time.RFC3339, record.Time); err == nil && t.Before(since) {
+			continue
+		}
+		if repo != "" && record.Repo != repo {
+			continue
+		}
+		group := usageGroup(record, *by)
+		if rows[group] == nil {
+			rows[group] = &row{}
+		}
+		for _, r := range []*row{rows[group], &total} {
+			r.usage.Requests += record.Requests
+			r.usage.PromptTokens += record.PromptTokens
+			r.usage.CachedTokens += record.CachedTokens
+			r.usage.CompletionTokens += record.CompletionTokens
+			r.cost += record.Cost
+			if !record.Priced {
+				r.unpriced++
+			}
+		}
+	}
+	if len(rows) == 0 {
+		fmt.Println("No usage recorded in that period.")
+		return nil
+	}
+
+	groups := make([]string, 0, len(rows))
+	for group := range rows {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	fmt.Printf("%-24s %9s %14s %12s %14s %12s\n", strings.ToUpper(*by), "REQUESTS", "PROMPT", "CACHED", "COMPLETION", "COST")
+	printRow := func(name string, r *row) {
+		cost := formatCost(r.cost, true)
+		if r.unpriced > 0 {
+			cost += "*"
+		}
+		fmt.Printf("%-24s %9d %14d %12d %14d %12s\n", name, r.usage.Requests, r.usage.PromptTokens, r.usage.CachedTokens, r.usage.CompletionTokens, cost)
+	}
+	for _, group := range groups {
+		printRow(group, rows[group])
+	}
+	printRow("total", &total)
+	if total.unpriced > 0 {
+		fmt.Println("\n* leaves out models without a known price; set usage.prices for them")
+	}
+	return nil
+}
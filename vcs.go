@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VCS is where commit messages and PR descriptions get their changes from and where commit
+// messages are recorded: git, Jujutsu (jj), Sapling (sl) or Mercurial (hg)
+type VCS interface {
+	Name() string
+	// WorkingDiff returns the change to generate a commit message for, in git diff format
+	WorkingDiff() (string, error)
+	// BranchCommits returns the subjects of the commits on the branch that aren't in target, one per line
+	BranchCommits(target string) (string, error)
+	// BranchDiff returns the diff of the branch since it forked from target
+	BranchDiff(target string) (string, error)
+	// Describe records the message in the file as the message of the working change
+	Describe(messageFile string) error
+}
+
+// isValidVCSSetting reports whether the config's vcs setting is one detectVCS knows
+func isValidVCSSetting(setting string) bool {
+	switch setting {
+	case "", "auto", "git", "jj", "sl", "hg":
+		return true
+	}
+	return false
+}
+
+// vcsMarkers are the directories that mark a repository's root, checked in order at each level
+// so a jj repository colocated with git counts as jj
+var vcsMarkers = []struct {
+	dir string
+	vcs string
+}{
+	{".jj", "jj"},
+	{".sl", "sl"},
+	{".hg", "hg"},
+	{".git", "git"},
+}
+
+// detectVCS picks the VCS from the config's vcs setting, or for "auto" (the default) from the
+// nearest repository root above the current directory
+func detectVCS(setting string) VCS {
+	if setting == "" || setting == "auto" {
+		setting = "git"
+		if dir, found, ok := findVCSRoot(); ok {
+			Log(DEBUG, "Found %s repository at %s", found, dir)
+			setting = found
+		}
+	}
+	switch setting {
+	case "jj":
+		return jjVCS{}
+	case "sl", "hg":
+		return hgVCS{program: setting}
+	}
+	return gitVCS{}
+}
+
+// currentVCS returns the VCS of the working copy in the current directory, always git when
+// reading from a ref without one
+func currentVCS() VCS {
+	if worktreeless() {
+		return gitVCS{}
+	}
+	if loadedConfig == nil {
+		return detectVCS("")
+	}
+	return detectVCS(loadedConfig.VCS)
+}
+
+// findVCSRoot looks for a repository root in the current directory and its parents, returning
+// it and its VCS
+func findVCSRoot() (string, string, bool) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", "", false
+	}
+	for {
+		for _, marker := range vcsMarkers {
+			// A .git file rather than directory marks a git worktree or submodule
+			if _, err := os.Stat(filepath.Join(dir, marker.dir)); err == nil {
+				return dir, marker.vcs, true
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", "", false
+		}
+		dir = parent
+	}
+}
+
+// gitVCS uses the staged changes and commits with git
+type gitVCS struct{}
+
+func (gitVCS) Name() string {
+	return "git"
+}
+
+func (gitVCS) WorkingDiff() (string, error) {
+	return getStagedDiff()
+}
+
+func (gitVCS) BranchCommits(target string) (string, error) {
+	return getCommitMessages(target)
+}
+
+func (gitVCS) BranchDiff(target string) (string, error) {
+	return getDiffInRange(target, headRev)
+}
+
+func (gitVCS) Describe(messageFile string) error {
+	return commitChanges(messageFile)
+}
+
+// jjVCS uses the working-copy change with jj, which has no staging area. The branch is the
+// changes between the target bookmark and the working copy.
+type jjVCS struct{}
+
+func (jjVCS) Name() string {
+	return "jj"
+}
+
+func (jjVCS) WorkingDiff() (string, error) {
+	Log(INFO, "Getting diff of the working-copy change from jj")
+	output, err := newCommand("jj", "diff", "--git", "-r", "@").Output()
+	if err != nil {
+		Log(ERROR, "Failed to get working-copy diff: %v", err)
+		return "", newError(ErrGitState, "failed to get working-copy diff from jj: %v", err)
+	}
+	return string(output), nil
+}
+
+func (jjVCS) BranchCommits(target string) (string, error) {
+	Log(INFO, "Getting changes on the branch from jj")
+	revset := fmt.Sprintf("(%s..@) ~ empty()", target)
+	output, err := newCommand("jj", "log", "--no-graph", "--reversed", "-r", revset, "-T", `description.first_line() ++ "\n"`).Output()
+	if err != nil {
+		Log(ERROR, "Failed to get changes on the branch: %v", err)
+		return "", newError(ErrGitState, "failed to get changes in %s from jj: %v", revset, err)
+	}
+	var subjects []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			subjects = append(subjects, line)
+		}
+	}
+	Log(INFO, "Retrieved %d change descriptions", len(subjects))
+	return strings.Join(subjects, "\n"), nil
+}
+
+func (jjVCS) BranchDiff(target string) (string, error) {
+	forkPoint := fmt.Sprintf("heads(::%s & ::@)", target)
+	output, err := newCommand("jj", "diff", "--git", "--from", forkPoint, "--to", "@").Output()
+	if err != nil {
+		Log(ERROR, "Failed to get branch diff: %v", err)
+		return "", fmt.Errorf("failed to get diff from %s to @ from jj: %v", forkPoint, err)
+	}
+	return string(output), nil
+}
+
+func (jjVCS) Describe(messageFile string) error {
+	message, err := ioutil.ReadFile(messageFile)
+	if err != nil {
+		return fmt.Errorf("failed to read message file: %v", err)
+	}
+	Log(INFO, "Describing the working-copy change with jj")
+	cmd := &Command{Program: "jj", Args: []string{"describe", "-r", "@", "--stdin"}, Stdin: strings.NewReader(string(message)), ShowStderr: true}
+	if err := cmd.Run(); err != nil {
+		Log(ERROR, "Failed to describe change: %v", err)
+		return fmt.Errorf("failed to describe the working-copy change: %v", err)
+	}
+	return nil
+}
+
+// hgVCS uses Mercurial or Sapling, whose commands are compatible for what gs needs. Like jj they
+// have no staging area, so commit messages describe all uncommitted changes. The branch is the
+// stack of commits from the target bookmark to the working copy's parent.
+type hgVCS struct {
+	program string // "sl" or "hg"
+}
+
+func (v hgVCS) Name() string {
+	return v.program
+}
+
+func (v hgVCS) WorkingDiff() (string, error) {
+	Log(INFO, "Getting uncommitted changes from %s", v.program)
+	status, err := newCommand(v.program, "status", "--unknown", "--no-status").Output()
+	if untracked := strings.Split(strings.TrimSpace(string(status)), "\n"); err == nil && untracked[0] != "" {
+		Log(WARN, "%d untracked files aren't part of the commit, add them with %s add first", len(untracked), v.program)
+		fmt.Printf("Note: %d untracked files aren't included. Run %s add to include them.\n", len(untracked), v.program)
+	}
+	output, err := newCommand(v.program, "diff", "--git").Output()
+	if err != nil {
+		Log(ERROR, "Failed to get uncommitted changes: %v", err)
+		return "", newError(ErrGitState, "failed to get uncommitted changes from %s: %v", v.program, err)
+	}
+	return string(output), nil
+}
+
+func (v hgVCS) BranchCommits(target string) (string, error) {
+	Log(INFO, "Getting commits on the stack from %s", v.program)
+	revset := fmt.Sprintf("only(., %s)", target)
+	output, err := newCommand(v.program, "log", "-r", revset, "-T", "{desc|firstline}\n").Output()
+	if err != nil {
+		Log(ERROR, "Failed to get commits on the stack: %v", err)
+		return "", newError(ErrGitState, "failed to get commits in %s from %s: %v", revset, v.program, err)
+	}
+	subjects := strings.TrimSpace(string(output))
+	Log(DEBUG, "Commits on the stack:\n%s", subjects)
+	return subjects, nil
+}
+
+func (v hgVCS) BranchDiff(target string) (string, error) {
+	forkPoint := fmt.Sprintf("ancestor(., %s)", target)
+	output, err := newCommand(v.program, "diff", "--git", "-r", forkPoint, "-r", ".").Output()
+	if err != nil {
+		Log(ERROR, "Failed to get stack diff: %v", err)
+		return "", fmt.Errorf("failed to get diff from %s to . from %s: %v", forkPoint, v.program, err)
+	}
+	return string(output), nil
+}
+
+func (v hgVCS) Describe(messageFile string) error {
+	Log(INFO, "Committing with %s", v.program)
+	cmd := &Command{Program: v.program, Args: []string{"commit", "-l", messageFile}, ShowStderr: true}
+	if err := cmd.Run(); err != nil {
+		Log(ERROR, "Failed to commit changes: %v", err)
+		return fmt.Errorf("failed to commit with %s: %v", v.program, err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VendorConfig controls how vendored dependency updates are described
+type VendorConfig struct {
+	Paths             []string `json:"paths"`              // directories holding vendored code
+	SummarizeUpstream bool     `json:"summarize_upstream"` // add an upstream changes section for bumped modules
+}
+
+// ModuleUpdate is a dependency whose version changed on the branch
+type ModuleUpdate struct {
+	Module     string
+	OldVersion string
+	NewVersion string
+}
+
+// GitHubRelease is a release of a GitHub repository
+type GitHubRelease struct {
+	TagName string `json:"tag_name"`
+	Name    string `json:"name"`
+	Body    string `json:"body"`
+}
+
+// isVendoredPath reports whether the path is inside one of the vendor directories
+func isVendoredPath(p string, vendorPaths []string) bool {
+	for _, vendorPath := range vendorPaths {
+		if matchesPathPattern(p, vendorPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripVendoredDiff removes vendored files from the diff, replacing them with a short note so
+// the prompt isn't flooded with third-party code
+func stripVendoredDiff(diff string, vendorPaths []string) string {
+	var sb strings.Builder
+	var vendored []string
+	for _, file := range splitDiffByFile(diff) {
+		if isVendoredPath(file.Path, vendorPaths) {
+			vendored = append(vendored, file.Path)
+			continue
+		}
+		sb.WriteString(file.Content)
+	}
+	if len(vendored) == 0 {
+		return diff
+	}
+
+	Log(INFO, "Left %d vendored files out of the diff", len(vendored))
+	sb.WriteString(fmt.Sprintf("\n(%d vendored files under %s also changed; their diff is omitted. Describe them as a dependency update.)\n",
+		len(vendored), strings.Join(vendorPaths, ", ")))
+	return sb.String()
+}
+
+// getModuleUpdates compares go.mod at the merge base and HEAD and returns changed module versions
+func getModuleUpdates(base string) []ModuleUpdate {
+	before := goModRequirements(base)
+	after := goModRequirements(headRev)
+
+	var updates []ModuleUpdate
+	for module, newVersion := range after {
+		if oldVersion, ok := before[module]; ok && oldVersion != newVersion {
+			updates = append(updates, ModuleUpdate{Module: module, OldVersion: oldVersion, NewVersion: newVersion})
+		}
+	}
+	sort.Slice(updates, func(i, j int) bool { return updates[i].Module < updates[j].Module })
+	return updates
+}
+
+// compareVersions compares two semantic versions like v1.2.3, returning -1, 0 or 1.
+// Pre-release and build suffixes are ignored.
+func compareVersions(a string, b string) int {
+	parse := func(v string) [3]int {
+		var parts [3]int
+		v = strings.TrimPrefix(v, "v")
+		v = strings.SplitN(strings.SplitN(v, "-", 2)[0], "+", 2)[0]
+		for i, field := range strings.SplitN(v, ".", 3) {
+			parts[i], _ = strconv.Atoi(field)
+		}
+		return parts
+	}
+	pa, pb := parse(a), parse(b)
+	for i := 0; i < 3; i++ {
+		if pa[i] != pb[i] {
+			if pa[i] < pb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// githubRepoForModule returns "owner/repo" for modules hosted on GitHub
+func githubRepoForModule(module string) (string, bool) {
+	parts := strings.Split(module, "/")
+	if len(parts) < 3 || parts[0] != "github.com" {
+		return "", false
+	}
+	return parts[1] + "/" + parts[2], true
+}
+
+// upstreamNotes fetches the release notes for the versions in (old, new] of a module,
+// falling back to the commit log between the two tags when there are no releases
+func upstreamNotes(update ModuleUpdate) string {
+	repo, ok := githubRepoForModule(update.Module)
+	if !ok {
+		return "(release notes unavailable: module is not hosted on GitHub)"
+	}
+
+	var releases []GitHubRelease
+	if err := ghAPI("GET", fmt.Sprintf("repos/%s/releases?per_page=100", repo), nil, &releases); err != nil {
+		Log(WARN, "Could not fetch releases for %s: %v", repo, err)
+	}
+
+	var sb strings.Builder
+	for i := len(releases) - 1; i >= 0; i-- {
+		release := releases[i]
+		if compareVersions(release.TagName, update.OldVersion) > 0 && compareVersions(release.TagName, update.NewVersion) <= 0 {
+			sb.WriteString(fmt.Sprintf("Release %s:\n%s\n\n", release.TagName, release.Body))
+		}
+	}
+	if sb.Len() > 0 {
+		return sb.String()
+	}
+
+	commits, _, err := compareCommits(repo, update.OldVersion, update.NewVersion)
+	if err != nil {
+		Log(WARN, "Could not compare %s...%s in %s: %v", update.OldVersion, update.NewVersion, repo, err)
+		return "(release notes unavailable)"
+	}
+	return "Upstream commits:\n" + commits
+}
+
+// moduleUsage lists the files outside the vendor directories that import the module
+func moduleUsage(module string, vendorPaths []string) []string {
+	output, err := newCommand("git", "grep", "-l", "--fixed-strings", "\""+module).Output()
+	if err != nil {
+		return nil
+	}
+	var files []string
+	for _, file := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if file != "" && !isVendoredPath(file, vendorPaths) && file != "go.mod" && file != "go.sum" {
+			files = append(files, file)
+		}
+	}
+	return files
+}
+
+// buildUpstreamChangesSection summarizes the upstream changes of the modules bumped on the branch
+// and how they affect this repo
+func buildUpstreamChangesSection(ctx context.Context, targetBranch string, vendorConfig VendorConfig, llmConfig LLMConfig) (string, error) {
+	base, err := getMergeBase(targetBranch)
+	if err != nil {
+		return "", err
+	}
+	updates := getModuleUpdates(base)
+	if len(updates) == 0 {
+		Log(DEBUG, "No module version changes on the branch")
+		return "", nil
+	}
+	// The release notes are what the section summarizes
+	if github := githubAvailable(); !github.Active {
+		noteOmitted("the Upstream changes section", github)
+		return "", nil
+	}
+
+	fmt.Printf("Fetching upstream release notes for %d updated dependencies...\n", len(updates))
+	var sb strings.Builder
+	for _, update := range updates {
+		sb.WriteString(fmt.Sprintf("### %s %s -> %s\n", update.Module, update.OldVersion, update.NewVersion))
+		if usage := moduleUsage(update.Module, vendorConfig.Paths); len(usage) > 0 {
+			sb.WriteString(fmt.Sprintf("Used by: %s\n", strings.Join(usage, ", ")))
+		}
+		sb.WriteString(upstreamNotes(update) + "\n\n")
+	}
+
+	summary, err := GenerateUpstreamSummary(ctx, sb.String(), llmConfig)
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize upstream changes: %w", err)
+	}
+	return "## Upstream changes\n\n" + summary, nil
+}
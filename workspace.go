@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WorkspaceConfig lists the repos whose related changes are described together
+type WorkspaceConfig struct {
+	Repos []string `json:"repos"`
+}
+
+// inRepo runs fn with the working directory set to the given repo, restoring it afterwards,
+// so the git helpers operate on that repo
+func inRepo(dir string, fn func() error) error {
+	previous, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %v", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return fmt.Errorf("failed to enter repo %s: %v", dir, err)
+	}
+	defer os.Chdir(previous)
+	return fn()
+}
+
+// repoName is the short name used to refer to a repo in prompts and output
+func repoName(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return filepath.Base(dir)
+	}
+	return filepath.Base(abs)
+}
+
+// splitWorkspaceMessages parses the "=== <repo> ===" blocks of a workspace response
+func splitWorkspaceMessages(response string) map[string]string {
+	messages := make(map[string]string)
+	current := ""
+	var sb strings.Builder
+	for _, line := range strings.Split(response, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "===") && strings.HasSuffix(trimmed, "===") && len(trimmed) > 6 {
+			if current != "" {
+				messages[current] = strings.TrimSpace(sb.String())
+			}
+			current = strings.TrimSpace(strings.Trim(trimmed, "="))
+			sb.Reset()
+			continue
+		}
+		sb.WriteString(line + "\n")
+	}
+	if current != "" {
+		messages[current] = strings.TrimSpace(sb.String())
+	}
+	return messages
+}
+
+// runWorkspaceCommand dispatches the workspace subcommands
+func runWorkspaceCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: gs workspace <commit|pr> [-repo <path>]...")
+	}
+	switch args[0] {
+	case "commit":
+		return runWorkspaceCommitCommand(args[1:])
+	case "pr":
+		return runWorkspacePRCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown workspace command %q, expected commit or pr", args[0])
+	}
+}
+
+// workspaceRepos returns the repos from the -repo flags, falling back to the config
+func workspaceRepos(flagRepos []string, config Config) ([]string, error) {
+	repos := flagRepos
+	if len(repos) == 0 {
+		repos = config.Workspace.Repos
+	}
+	if len(repos) < 2 {
+		return nil, fmt.Errorf("workspace mode needs at least two repos, set with -repo or workspace.repos in the config")
+	}
+	for i := range repos {
+		repos[i] = expandPath(repos[i])
+	}
+	return repos, nil
+}
+
+// runWorkspaceCommitCommand writes coordinated commit messages for changes staged across repos
+// and commits each repo
+func runWorkspaceCommitCommand(args []string) error {
+	fs := flag.NewFlagSet("workspace commit", flag.ExitOnError)
+	var repoFlags stringListFlag
+	fs.Var(&repoFlags, "repo", "Path to a repo in the workspace (can be repeated)")
+	dryRun := fs.Bool("dry-run", false, "Print the generated messages without committing")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	repos, err := workspaceRepos(repoFlags, config)
+	if err != nil {
+		return err
+	}
+
+	diffs := make(map[string]string)
+	var names []string
+	dirs := make(map[string]string)
+	for _, repo := range repos {
+		name := repoName(repo)
+		err := inRepo(repo, func() error {
+			diff, err := getStagedDiff()
+			if err != nil {
+				return err
+			}
+			if diff != "" {
+				diffs[name] = promptDiff(diff, config.LLM)
+				names = append(names, name)
+				dirs[name] = repo
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(names) == 0 {
+		return newError(ErrGitState, "no changes staged in any workspace repo")
+	}
+
+	template, err := readTemplate(config.CommitTemplate, "commit")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Generating coordinated commit messages for %s...\n", strings.Join(names, ", "))
+	ctx, stop := interruptContext()
+	defer stop()
+	response, err := GenerateWorkspaceCommitMessages(ctx, diffs, names, config.LLM, template)
+	if err != nil {
+		return fmt.Errorf("LLM generation failed: %w", err)
+	}
+	messages := splitWorkspaceMessages(response)
+
+	for _, name := range names {
+		message, ok := messages[name]
+		if !ok {
+			return fmt.Errorf("the model did not return a commit message for %s", name)
+		}
+		// Scopes are per repo, so infer them from each repo's own diff
+		input := postProcessInput{Prefix: inferScope(changedPathsFromDiff(diffs[name]), *config.CommitFormat), Budget: config.CommitBudget, Template: template}
+		message, err = postProcess(postProcessSettings.commit, message, input)
+		if err != nil {
+			return err
+		}
+
+		if *dryRun {
+			fmt.Printf("=== %s (Dry Run) ===\n%s\n\n", name, message)
+			continue
+		}
+
+		err := inRepo(dirs[name], func() error {
+			edited, err := editMessage(message)
+			if err != nil {
+				return err
+			}
+			if edited == "" {
+				fmt.Printf("Empty message, skipping commit in %s.\n", name)
+				return nil
+			}
+			tempFile := filepath.Join(os.TempDir(), fmt.Sprintf("git_message_%s.txt", name))
+			if err := ioutil.WriteFile(tempFile, []byte(edited), 0600); err != nil {
+				return fmt.Errorf("failed to write temp file: %v", err)
+			}
+			defer os.Remove(tempFile)
+			return commitChanges(tempFile)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to commit in %s: %v", name, err)
+		}
+		fmt.Printf("Committed in %s.\n", name)
+	}
+	return nil
+}
+
+// runWorkspacePRCommand creates a PR in each repo and cross-links them
+func runWorkspacePRCommand(args []string) error {
+	fs := flag.NewFlagSet("workspace pr", flag.ExitOnError)
+	var repoFlags stringListFlag
+	fs.Var(&repoFlags, "repo", "Path to a repo in the workspace (can be repeated)")
+	targetBranch := fs.String("target", "master", "Target branch for the PRs")
+	dryRun := fs.Bool("dry-run", false, "Print the generated descriptions without creating PRs")
+	config, err := parseCommandFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	repos, err := workspaceRepos(repoFlags, config)
+	if err != nil {
+		return err
+	}
+
+	type workspacePR struct {
+		name string
+		dir  string
+		body string
+		url  string
+	}
+	var prs []workspacePR
+
+	for _, repo := range repos {
+		pr := workspacePR{name: repoName(repo), dir: repo}
+		err := inRepo(repo, func() error {
+			commits, err := currentVCS().BranchCommits(*targetBranch)
+			if err != nil {
+				return err
+			}
+			if commits == "" {
+				Log(INFO, "No commits on branch in %s, skipping", pr.name)
+				return nil
+			}
+			fmt.Printf("Generating PR description for %s...\n", pr.name)
+			pr.body, err = createPRMessage(ctx, commits, *targetBranch, config.PRTemplate, config.AreaTemplates, config.HumanSections, config.LLM)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to generate PR description for %s: %w", pr.name, err)
+		}
+		if pr.body != "" {
+			prs = append(prs, pr)
+		}
+	}
+	if len(prs) == 0 {
+		return fmt.Errorf("no workspace repo has commits ahead of %s", *targetBranch)
+	}
+
+	if *dryRun {
+		for _, pr := range prs {
+			fmt.Printf("=== %s (Dry Run) ===\n%s\n\n", pr.name, pr.body)
+		}
+		return nil
+	}
+
+	for i := range prs {
+		err := inRepo(prs[i].dir, func() error {
+			edited, err := editMessage(prs[i].body)
+			if err != nil {
+				return err
+			}
+			prs[i].body = edited
+			tempFile := filepath.Join(os.TempDir(), fmt.Sprintf("git_message_%s.txt", prs[i].name))
+			if err := ioutil.WriteFile(tempFile, []byte(edited), 0600); err != nil {
+				return fmt.Errorf("failed to write temp file: %v", err)
+			}
+			defer os.Remove(tempFile)
+			prs[i].url, err = createPullRequest(tempFile, *targetBranch, PRExtras{})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create PR for %s: %v", prs[i].name, err)
+		}
+		fmt.Printf("Created PR for %s: %s\n", prs[i].name, prs[i].url)
+	}
+
+	// Now that every PR has a URL, link each one to the others
+	for i, pr := range prs {
+		var sb strings.Builder
+		sb.WriteString("## Related pull requests\n\n")
+		for j, other := range prs {
+			if i != j {
+				sb.WriteString(fmt.Sprintf("- %s: %s\n", other.name, other.url))
+			}
+		}
+		body := appendSections(pr.body, []string{strings.TrimRight(sb.String(), "\n")})
+		if err := updatePullRequestBody(pr.url, body); err != nil {
+			return fmt.Errorf("failed to cross-link PR for %s: %v", pr.name, err)
+		}
+	}
+	fmt.Println("Cross-linked all workspace PRs.")
+	return nil
+}